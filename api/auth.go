@@ -0,0 +1,216 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	dbSql "database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+)
+
+const (
+	SCOPE_ALL          = "*"
+	SCOPE_BILLS_CREATE = "bills:create"
+	SCOPE_BILLS_READ   = "bills:read"
+	SCOPE_BILLS_UPDATE = "bills:update"
+	SCOPE_BILLS_SEND   = "bills:send"
+	SCOPE_KEYS_ADMIN   = "keys:admin"
+	SCOPE_HOOKS_ADMIN  = "webhooks:admin"
+
+	SCOPE_ISSUERS_ADMIN      = "issuers:admin"
+	SCOPE_TRANSLATIONS_ADMIN = "translations:admin"
+	SCOPE_REFERENCES_ADMIN   = "references:admin"
+
+	TOKEN_LENGTH = 48
+)
+
+var SCOPES = []string{SCOPE_ALL, SCOPE_BILLS_CREATE, SCOPE_BILLS_READ, SCOPE_BILLS_UPDATE, SCOPE_BILLS_SEND,
+	SCOPE_KEYS_ADMIN, SCOPE_HOOKS_ADMIN, SCOPE_ISSUERS_ADMIN, SCOPE_TRANSLATIONS_ADMIN, SCOPE_REFERENCES_ADMIN}
+
+type ApiKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	RateLimit int        `json:"rate_limit"`
+}
+
+type ApiKeyResponse struct {
+	*specs.ApiKey
+	Token string `json:"token"` // only returned once, on creation
+}
+
+// authorize checks the api key of the request for the given scope. If the
+// request isn't authorized, an error is written and nil is returned.
+func (api *Api) authorize(w http.ResponseWriter, r *http.Request, scope string) *specs.ApiKey {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, TOKEN_KEY+" ") {
+		api.log.WarnContext(r.Context(), "unauthorized client", "path", r.URL.Path, "remote", r.RemoteAddr)
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return nil
+	}
+	token := strings.TrimPrefix(auth, TOKEN_KEY+" ")
+
+	key, err := api.db.GetApiKeyByHash(utils.GetSha256([]byte(token)))
+	if errors.Is(err, dbSql.ErrNoRows) || (err == nil && !utils.ValidateToken(token, key.TokenHash)) {
+		api.log.WarnContext(r.Context(), "unknown api key used", "path", r.URL.Path, "remote", r.RemoteAddr)
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return nil
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "unable to validate token", logging.Err(err))
+		http.Error(w, "unable to validate token", http.StatusInternalServerError)
+		return nil
+	}
+
+	if !key.Active(time.Now()) {
+		api.log.WarnContext(r.Context(), "inactive api key used", "api_key", key.Name)
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return nil
+	}
+	if !key.HasScope(scope) {
+		api.log.WarnContext(r.Context(), "api key without scope used", "scope", scope, "api_key", key.Name)
+		http.Error(w, "missing scope "+scope, http.StatusForbidden)
+		return nil
+	}
+
+	limit := key.RateLimit
+	if limit <= 0 {
+		limit = api.limits.PerKey
+	}
+	if limit > 0 && !api.allow(w, r, time.Now(), LIMIT_SCOPE_KEY, strconv.Itoa(key.Id), limit, RATE_WINDOW, 1) {
+		return nil
+	}
+
+	err = api.db.TouchApiKey(key.Id)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot update last usage of api key", logging.Err(err))
+	}
+
+	return key
+}
+
+// ApiKeys lists (GET) or creates (POST) api keys.
+func (api *Api) ApiKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if api.authorize(w, r, SCOPE_KEYS_ADMIN) == nil {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		keys, err := api.db.GetApiKeys()
+		if err != nil {
+			api.log.ErrorContext(r.Context(), "cannot get api keys", logging.Err(err))
+			http.Error(w, "cannot get api keys", http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, http.StatusOK, keys)
+		return
+	}
+
+	req := ApiKeyRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "cannot unmarshal json", http.StatusNotAcceptable)
+		return
+	}
+	if req.Name == "" || len(req.Scopes) == 0 {
+		http.Error(w, "name and scopes are required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !ValidScope(scope) {
+			http.Error(w, "unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, token, err := api.CreateApiKey(req.Name, req.Scopes, req.ExpiresAt, req.RateLimit)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot create api key", logging.Err(err))
+		http.Error(w, "cannot create api key", http.StatusConflict)
+		return
+	}
+	api.log.InfoContext(r.Context(), "created api key", "api_key", key.Name)
+	writeJson(w, http.StatusCreated, ApiKeyResponse{ApiKey: key, Token: token})
+}
+
+// RevokeApiKey revokes the key of DELETE {apiPath}/keys/{id}.
+func (api *Api) RevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, api.apiPath+"/keys/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if api.authorize(w, r, SCOPE_KEYS_ADMIN) == nil {
+		return
+	}
+
+	err = api.db.RevokeApiKey(id)
+	if errors.Is(err, dbSql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot revoke api key", logging.Err(err))
+		http.Error(w, "cannot revoke api key", http.StatusInternalServerError)
+		return
+	}
+	api.log.InfoContext(r.Context(), "revoked api key", "api_key_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateApiKey generates and stores a new key. The plain token is returned
+// and cannot be recovered later.
+func (api *Api) CreateApiKey(name string, scopes []string, expiresAt *time.Time,
+	rateLimit int) (*specs.ApiKey, string, error) {
+
+	token := utils.CreateNewToken(TOKEN_LENGTH)
+	key := &specs.ApiKey{
+		Name:      name,
+		TokenHash: token.Sha256,
+		Scopes:    scopes,
+		Enable:    true,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+		RateLimit: rateLimit,
+	}
+	err := api.db.InsertApiKey(key)
+	return key, token.Plain, err
+}
+
+func ValidScope(scope string) bool {
+	for _, s := range SCOPES {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
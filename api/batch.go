@@ -0,0 +1,352 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/bill"
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/sql"
+)
+
+const (
+	MIME_TYPE_CSV = "text/csv"
+	MIME_TYPE_ZIP = "application/zip"
+
+	BATCH_FORMAT_ZIP = "zip"
+	BATCH_FORMAT_PDF = "pdf"
+
+	BATCH_MAX_ROWS   = 10000 // of a job
+	BATCH_SYNC_ROWS  = 500   // of a batch generated within the request
+	BATCH_MAX_BODY   = 32 << 20
+	BATCH_REPORT     = "report.json"
+	BATCH_MERGED_PDF = "bills.pdf"
+
+	BATCH_FAILED_TITLE = "Failed rows"
+)
+
+var BATCH_WORKERS = runtime.NumCPU()
+
+// BatchRow is the outcome of one row of a batch, along with the bill if it
+// was generated.
+type BatchRow struct {
+	specs.BatchRow
+
+	bill *specs.Bill
+}
+
+// CreateBatch generates many bills at once. The body is a json array of
+// BillInformation or a csv file with the json keys as header. The result
+// is a zip with one pdf per bill and report.json holding the outcome per
+// row (format=zip) or one merged pdf (format=pdf), which lists the failed
+// rows on its last page. Batches of more than BATCH_SYNC_ROWS rows are
+// queued as a job, see CreateJob.
+func (api *Api) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if api.authorize(w, r, SCOPE_BILLS_CREATE) == nil {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = BATCH_FORMAT_ZIP
+	}
+	if format != BATCH_FORMAT_ZIP && format != BATCH_FORMAT_PDF {
+		http.Error(w, "unknown format "+format, http.StatusBadRequest)
+		return
+	}
+
+	infos, err := parseBatch(r)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot parse batch", logging.Err(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(infos) > BATCH_SYNC_ROWS {
+		http.Error(w, fmt.Sprintf("batch exceeds %d rows, queue it with POST %s/jobs", BATCH_SYNC_ROWS,
+			api.apiPath), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !api.allowBatch(w, r, infos) {
+		return
+	}
+
+	api.log.InfoContext(r.Context(), "generate batch", "bills", len(infos))
+	rows, _ := api.runBatch(r.Context(), infos, nil, 0)
+
+	err = writeBatch(w, format, rows)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot write batch", logging.Err(err))
+	}
+}
+
+// allowBatch counts the rows of a batch against the issuers quotas. If the
+// quota of an issuer is exceeded, the rows counted for the others are taken
+// back, so a rejected batch doesn't use up any quota.
+func (api *Api) allowBatch(w http.ResponseWriter, r *http.Request, infos []BillInformation) bool {
+	var (
+		now       time.Time   = time.Now()
+		perIssuer map[int]int = map[int]int{}
+		counted   map[int]int = map[int]int{}
+	)
+
+	for _, info := range infos {
+		perIssuer[info.IssuerId]++
+	}
+	for issuerId, n := range perIssuer {
+		quota := api.issuerQuota(issuerId)
+		if quota <= 0 {
+			continue
+		}
+		if !api.allow(w, r, now, LIMIT_SCOPE_ISSUER, strconv.Itoa(issuerId), quota, QUOTA_WINDOW, n) {
+			for id, m := range counted {
+				api.uncount(LIMIT_SCOPE_ISSUER, strconv.Itoa(id), now.Truncate(QUOTA_WINDOW), m)
+			}
+			return false
+		}
+		counted[issuerId] = n
+	}
+	return true
+}
+
+// runBatch generates the bills with a bounded pool of workers. Only the
+// rows listed in pending are generated, all if pending is nil. The rows of
+// a job (jobId > 0) are stored along with their bills, the first error
+// storing a row is returned. Rows not started before ctx is done are
+// reported as canceled and not stored.
+func (api *Api) runBatch(ctx context.Context, infos []BillInformation, pending []int,
+	jobId int) ([]BatchRow, error) {
+
+	var (
+		rows     []BatchRow = make([]BatchRow, len(infos))
+		jobs     chan int   = make(chan int)
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		storeErr error
+	)
+
+	if pending == nil {
+		pending = make([]int, len(infos))
+		for i := range infos {
+			pending[i] = i
+		}
+	}
+
+	for i := 0; i < BATCH_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				var err error
+				rows[i], err = api.batchRow(ctx, i, &infos[i], jobId)
+				if err != nil {
+					mutex.Lock()
+					if storeErr == nil {
+						storeErr = err
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, i := range pending {
+		if ctx.Err() != nil {
+			rows[i].Row = i + 1
+			rows[i].Error = "canceled"
+			continue
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return rows, storeErr
+}
+
+// batchRow generates the bill of a row. The bill of a job row is stored
+// along with the row in one transaction, failed rows of a job are stored
+// as well. The error is set, if the row of a job can't be stored.
+func (api *Api) batchRow(ctx context.Context, i int, info *BillInformation, jobId int) (BatchRow, error) {
+	row := BatchRow{}
+	row.Row = i + 1
+
+	b, err := api.newBill(info)
+	if err == nil {
+		err = bill.DrawReference(api.db, info, b)
+	}
+	if err != nil {
+		row.Error = err.Error()
+		return row, api.storeJobRow(jobId, row)
+	}
+
+	store := api.db.InsertBill
+	if jobId > 0 {
+		store = func(b *specs.Bill) error {
+			return api.db.InsertJobBill(jobId, row.Row, b)
+		}
+	}
+	err = api.generateBill(ctx, b, store)
+	if errors.Is(err, sql.ErrDuplicateReference) {
+		row.Error = err.Error()
+		return row, api.storeJobRow(jobId, row)
+	} else if err != nil {
+		api.log.WarnContext(ctx, "cannot generate bill of batch row", "row", row.Row, logging.Err(err))
+		row.Error = "cannot generate bill"
+		return row, api.storeJobRow(jobId, row)
+	}
+
+	row.BillId = b.Id
+	row.Reference = b.Details.Referece
+	row.bill = b
+	return row, nil
+}
+
+// storeJobRow stores a failed row of a job, rows of batches aren't stored.
+func (api *Api) storeJobRow(jobId int, row BatchRow) error {
+	if jobId <= 0 {
+		return nil
+	}
+	return api.db.InsertJobRow(jobId, row.BatchRow)
+}
+
+func writeBatch(w http.ResponseWriter, format string, rows []BatchRow) error {
+	failed := 0
+	for _, row := range rows {
+		if row.bill == nil {
+			failed++
+		}
+	}
+	if failed == len(rows) {
+		writeJson(w, http.StatusUnprocessableEntity, rows)
+		return nil
+	}
+	w.Header().Set("X-Batch-Failed", strconv.Itoa(failed))
+
+	if format == BATCH_FORMAT_PDF {
+		w.Header().Set("Content-Type", MIME_TYPE_PDF)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+BATCH_MERGED_PDF+`"`)
+		return WriteBatchPdf(w, rows)
+	}
+	w.Header().Set("Content-Type", MIME_TYPE_ZIP)
+	w.Header().Set("Content-Disposition", `attachment; filename="bills.zip"`)
+	return WriteBatchZip(w, rows)
+}
+
+// WriteBatchPdf merges the pdfs of a batch into one, the failed rows are
+// listed on the last page.
+func WriteBatchPdf(w io.Writer, rows []BatchRow) error {
+	pdfFiles := []string{}
+	failedRows := []string{}
+	for _, row := range rows {
+		if row.bill != nil {
+			pdfFiles = append(pdfFiles, row.bill.PdfFile)
+		} else {
+			failedRows = append(failedRows, fmt.Sprintf("row %d: %s", row.Row, row.Error))
+		}
+	}
+	return bill.MergePDFsWithReport(pdfFiles, BATCH_FAILED_TITLE, failedRows, w)
+}
+
+// WriteBatchZip writes the pdfs of a batch and the report into a zip.
+func WriteBatchZip(w io.Writer, rows []BatchRow) error {
+	archive := zip.NewWriter(w)
+
+	for _, row := range rows {
+		if row.bill == nil {
+			continue
+		}
+		err := addZipFile(archive, fmt.Sprintf("bill-%05d-%d.pdf", row.Row, row.BillId), row.bill.PdfFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := archive.Create(BATCH_REPORT)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(rows)
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func addZipFile(archive *zip.Writer, name string, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	return err
+}
+
+func parseBatch(r *http.Request) ([]BillInformation, error) {
+	var infos []BillInformation
+
+	body := http.MaxBytesReader(nil, r.Body, BATCH_MAX_BODY)
+	defer body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == MIME_TYPE_CSV {
+		var err error
+		infos, err = bill.ParseCsv(body)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := json.NewDecoder(body).Decode(&infos)
+		if err != nil {
+			return nil, errors.New("cannot unmarshal json")
+		}
+	}
+
+	if len(infos) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	if len(infos) > BATCH_MAX_ROWS {
+		return nil, fmt.Errorf("batch exceeds %d rows", BATCH_MAX_ROWS)
+	}
+	return infos, nil
+}
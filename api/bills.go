@@ -0,0 +1,265 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"bytes"
+	dbSql "database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+	"github.com/ChrIgiSta/swiss-qr-bill/webhook"
+)
+
+const (
+	DEFAULT_LIMIT = 50
+	MAX_LIMIT     = 500
+)
+
+type BillList struct {
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+	Bills  []*specs.Bill `json:"bills"`
+}
+
+// ListBills returns the bill history. Supported query parameters are
+// issuer_id, customer, reference, channel, from, to (RFC 3339 or
+// YYYY-MM-DD), limit and offset. Api keys aren't bound to an issuer, a key
+// with bills:read sees the bills of all issuers.
+func (api *Api) ListBills(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if api.authorize(w, r, SCOPE_BILLS_READ) == nil {
+		return
+	}
+
+	filter, err := parseBillFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bills, total, err := api.db.GetBills(filter)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get bills", logging.Err(err))
+		http.Error(w, "cannot get bills", http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, http.StatusOK, BillList{
+		Total:  total,
+		Limit:  filter.Limit,
+		Offset: filter.Offset,
+		Bills:  bills,
+	})
+}
+
+// BillResource serves
+//   - GET {apiPath}/bills/{id}/pdf with the stored pdf
+//   - POST {apiPath}/bills/{id}/paid to mark a bill as paid
+//   - POST {apiPath}/bills/{id}/send to mail the pdf to the debtor
+//   - GET {apiPath}/bills/{id}/deliveries with the mail deliveries of a bill
+func (api *Api) BillResource(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, api.apiPath+"/bills/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case parts[1] == "pdf" && r.Method == http.MethodGet:
+		api.getBillPdf(w, r, id)
+	case parts[1] == "paid" && r.Method == http.MethodPost:
+		api.markBillPaid(w, r, id)
+	case parts[1] == "send" && r.Method == http.MethodPost:
+		api.sendBill(w, r, id)
+	case parts[1] == "deliveries" && r.Method == http.MethodGet:
+		api.getBillDeliveries(w, r, id)
+	case parts[1] == "pdf" || parts[1] == "paid" || parts[1] == "send" || parts[1] == "deliveries":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (api *Api) getBillPdf(w http.ResponseWriter, r *http.Request, id int) {
+	if api.authorize(w, r, SCOPE_BILLS_READ) == nil {
+		return
+	}
+
+	b, err := api.db.GetBill(id)
+	if errors.Is(err, dbSql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get bill", logging.Err(err))
+		http.Error(w, "cannot get bill", http.StatusInternalServerError)
+		return
+	}
+
+	api.servePdf(w, r, b, http.StatusOK)
+}
+
+func (api *Api) markBillPaid(w http.ResponseWriter, r *http.Request, id int) {
+	if api.authorize(w, r, SCOPE_BILLS_UPDATE) == nil {
+		return
+	}
+
+	err := api.db.MarkBillPaid(id, time.Now())
+	if errors.Is(err, dbSql.ErrNoRows) {
+		http.Error(w, "no unpaid bill with this id", http.StatusConflict)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot mark bill as paid", logging.Err(err))
+		http.Error(w, "cannot mark bill as paid", http.StatusInternalServerError)
+		return
+	}
+
+	b, err := api.db.GetBill(id)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get bill", logging.Err(err))
+		http.Error(w, "cannot get bill", http.StatusInternalServerError)
+		return
+	}
+	err = webhook.Emit(api.db, webhook.EVENT_BILL_PAID, b)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot emit webhook", logging.Err(err))
+	}
+
+	writeJson(w, http.StatusOK, b)
+}
+
+func parseBillFilter(r *http.Request) (specs.BillFilter, error) {
+	var err error
+
+	q := r.URL.Query()
+	filter := specs.BillFilter{
+		Customer:  q.Get("customer"),
+		Reference: q.Get("reference"),
+		Channel:   strings.ToUpper(q.Get("channel")),
+	}
+
+	if q.Get("issuer_id") != "" {
+		filter.IssuerId, err = strconv.Atoi(q.Get("issuer_id"))
+		if err != nil {
+			return filter, fmt.Errorf("invalid issuer_id")
+		}
+	}
+	filter.Limit, filter.Offset, err = parsePaging(r)
+	if err != nil {
+		return filter, err
+	}
+
+	times := map[string]*time.Time{
+		"from": &filter.From,
+		"to":   &filter.To,
+	}
+	for key, val := range times {
+		if q.Get(key) == "" {
+			continue
+		}
+		*val, err = time.Parse(time.RFC3339, q.Get(key))
+		if err != nil {
+			*val, err = time.ParseInLocation("2006-01-02", q.Get(key), time.Local)
+		}
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s, use RFC 3339 or YYYY-MM-DD", key)
+		}
+	}
+
+	return filter, nil
+}
+
+// parsePaging reads the query parameters limit and offset. The limit
+// defaults to DEFAULT_LIMIT and is capped at MAX_LIMIT.
+func parsePaging(r *http.Request) (int, int, error) {
+	var (
+		err           error
+		limit, offset int = DEFAULT_LIMIT, 0
+	)
+
+	q := r.URL.Query()
+	if q.Get("limit") != "" {
+		limit, err = strconv.Atoi(q.Get("limit"))
+		if err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit")
+		}
+		if limit > MAX_LIMIT {
+			limit = MAX_LIMIT
+		}
+	}
+	if q.Get("offset") != "" {
+		offset, err = strconv.Atoi(q.Get("offset"))
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
+
+// servePdf writes the stored pdf of a bill, if it is still identical to
+// the generated one.
+func (api *Api) servePdf(w http.ResponseWriter, r *http.Request, b *specs.Bill, status int) {
+	pdf, err := os.ReadFile(b.PdfFile)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "pdf of bill not available", "bill_id", b.Id, logging.Err(err))
+		http.Error(w, "pdf of bill not available", http.StatusGone)
+		return
+	}
+	if b.PdfHash != "" && utils.GetSha256(pdf) != b.PdfHash {
+		api.log.ErrorContext(r.Context(), "pdf of bill was modified", "bill_id", b.Id)
+		http.Error(w, "pdf of bill not available", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", MIME_TYPE_PDF)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="bill-%d.pdf"`, b.Id))
+	w.Header().Set("Content-Length", strconv.Itoa(len(pdf)))
+	w.WriteHeader(status)
+	_, err = bytes.NewReader(pdf).WriteTo(w)
+	if err != nil {
+		api.log.WarnContext(r.Context(), "cannot write pdf", logging.Err(err))
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", MIME_TYPE_JSON)
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("cannot encode json", logging.Err(err))
+	}
+}
@@ -0,0 +1,100 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	dbSql "database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	netMail "net/mail"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/mail"
+)
+
+type SendRequest struct {
+	Email    string `json:"email"`
+	Language string `json:"language"` // DE, FR, IT or EN, the language of the bill if empty
+}
+
+// sendBill queues the pdf of a bill to be mailed to the debtor by the mail
+// configuration of the issuer. The delivery is returned with state
+// PENDING, its outcome is available at the deliveries of the bill.
+func (api *Api) sendBill(w http.ResponseWriter, r *http.Request, id int) {
+	if api.authorize(w, r, SCOPE_BILLS_SEND) == nil {
+		return
+	}
+
+	req := SendRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "cannot unmarshal json", http.StatusNotAcceptable)
+		return
+	}
+	address, err := netMail.ParseAddress(req.Email)
+	if err != nil {
+		http.Error(w, "invalid email", http.StatusBadRequest)
+		return
+	}
+	req.Language = strings.ToUpper(req.Language)
+	if _, ok := mail.REPLY_TEXTS[req.Language]; req.Language != "" && !ok {
+		http.Error(w, "unsupported language", http.StatusBadRequest)
+		return
+	}
+
+	b, err := api.db.GetBill(id)
+	if errors.Is(err, dbSql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get bill", logging.Err(err))
+		http.Error(w, "cannot get bill", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Language == "" {
+		req.Language = b.LanguageCode
+	}
+	delivery, err := mail.QueueBill(api.db, b, address.Address, req.Language)
+	if errors.Is(err, mail.ErrNoMailConfig) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot queue bill delivery", logging.Err(err))
+		http.Error(w, "cannot queue bill delivery", http.StatusInternalServerError)
+		return
+	}
+	api.log.InfoContext(r.Context(), "queued bill delivery", "delivery_id", delivery.Id, "bill_id", b.Id)
+	writeJson(w, http.StatusAccepted, delivery)
+}
+
+func (api *Api) getBillDeliveries(w http.ResponseWriter, r *http.Request, id int) {
+	if api.authorize(w, r, SCOPE_BILLS_READ) == nil {
+		return
+	}
+
+	deliveries, err := api.db.GetBillDeliveries(id)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get bill deliveries", logging.Err(err))
+		http.Error(w, "cannot get bill deliveries", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, http.StatusOK, deliveries)
+}
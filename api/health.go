@@ -0,0 +1,125 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/mail"
+	"github.com/ChrIgiSta/swiss-qr-bill/metrics"
+)
+
+const (
+	HEALTH_TIMEOUT = 3 * time.Second
+
+	HEALTH_OK    = "ok"
+	HEALTH_ERROR = "error"
+)
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Health struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// Healthz reports the state of the database and of all mailboxes. If one
+// of them fails, 503 is returned.
+func (api *Api) Healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	health := Health{
+		Status: HEALTH_OK,
+		Checks: map[string]HealthCheck{},
+	}
+	health.add("database", api.pingDb(r.Context()))
+	for mailbox, err := range mail.PollStatus() {
+		health.add("mail:"+mailbox, err)
+	}
+
+	status := http.StatusOK
+	if health.Status != HEALTH_OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, health)
+}
+
+// Readyz reports whether the api accepts requests. It fails while the
+// server shuts down or the database is not reachable.
+func (api *Api) Readyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if atomic.LoadInt32(&api.ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	err := api.pingDb(r.Context())
+	if err != nil {
+		http.Error(w, "database not reachable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte(HEALTH_OK))
+}
+
+// Metrics exposes the metrics in the prometheus text format.
+func (api *Api) Metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", metrics.CONTENT_TYPE)
+	err := metrics.Write(w)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot write metrics", logging.Err(err))
+	}
+}
+
+func (api *Api) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&api.ready, v)
+}
+
+func (api *Api) pingDb(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_TIMEOUT)
+	defer cancel()
+	return api.db.Ping(ctx)
+}
+
+func (h *Health) add(name string, err error) {
+	if err != nil {
+		h.Status = HEALTH_ERROR
+		h.Checks[name] = HealthCheck{Status: HEALTH_ERROR, Error: err.Error()}
+		return
+	}
+	h.Checks[name] = HealthCheck{Status: HEALTH_OK}
+}
@@ -0,0 +1,107 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+)
+
+const (
+	IDEMPOTENCY_HEADER   = "Idempotency-Key"
+	IDEMPOTENCY_REPLAYED = "Idempotent-Replayed"
+	IDEMPOTENCY_MAX_LEN  = 255
+	IDEMPOTENCY_TTL      = 24 * time.Hour
+)
+
+// reserveIdempotencyKey registers the key for this request. If the key was
+// used before, the bill of the first request is served again, or a
+// conflict is reported if the requests differ. false is returned, if the
+// response is written.
+func (api *Api) reserveIdempotencyKey(w http.ResponseWriter, r *http.Request, apiKey *specs.ApiKey, key string,
+	billInfo *BillInformation) bool {
+
+	if len(key) > IDEMPOTENCY_MAX_LEN {
+		http.Error(w, IDEMPOTENCY_HEADER+" too long", http.StatusBadRequest)
+		return false
+	}
+
+	// hash the normalized request, so formatting doesn't matter
+	normalized, err := json.Marshal(billInfo)
+	if err != nil {
+		http.Error(w, "cannot marshal json", http.StatusInternalServerError)
+		return false
+	}
+
+	reserved, stored, err := api.db.ReserveIdempotencyKey(&specs.IdempotencyKey{
+		ApiKeyId:    apiKey.Id,
+		Key:         key,
+		RequestHash: utils.GetSha256(normalized),
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		api.log.Error("cannot reserve idempotency key", logging.Err(err))
+		http.Error(w, "cannot reserve idempotency key", http.StatusInternalServerError)
+		return false
+	}
+	if reserved {
+		return true
+	}
+
+	if stored.RequestHash != utils.GetSha256(normalized) {
+		api.log.WarnContext(r.Context(), "idempotency key reused with a different request", "api_key", apiKey.Name)
+		http.Error(w, IDEMPOTENCY_HEADER+" was used for a different request", http.StatusUnprocessableEntity)
+		return false
+	}
+	if stored.BillId <= 0 {
+		http.Error(w, "request with this "+IDEMPOTENCY_HEADER+" is in progress", http.StatusConflict)
+		return false
+	}
+
+	b, err := api.db.GetBill(stored.BillId)
+	if err != nil {
+		api.log.Error("cannot get bill of idempotency key", logging.Err(err))
+		http.Error(w, "cannot get bill", http.StatusInternalServerError)
+		return false
+	}
+	api.log.InfoContext(r.Context(), "replay bill for idempotency key", "bill_id", b.Id)
+	w.Header().Set(IDEMPOTENCY_REPLAYED, "true")
+	api.writeBill(w, r, b, http.StatusCreated)
+	return false
+}
+
+// finishIdempotencyKey links the generated bill to the key, or releases
+// the key if no bill was generated.
+func (api *Api) finishIdempotencyKey(ctx context.Context, apiKey *specs.ApiKey, key string, b *specs.Bill) {
+	var err error
+
+	if b != nil {
+		err = api.db.CompleteIdempotencyKey(apiKey.Id, key, b.Id)
+	} else {
+		err = api.db.DeleteIdempotencyKey(apiKey.Id, key)
+	}
+	if err != nil {
+		api.log.Error("cannot update idempotency key", logging.Err(err))
+	}
+}
@@ -0,0 +1,133 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	dbSql "database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+)
+
+// IssuerRequest creates an issuer, the creditor of its bills.
+type IssuerRequest struct {
+	IBAN string `json:"iban"`
+	specs.AccountDetails
+}
+
+type IssuerResponse struct {
+	Id   int    `json:"id"`
+	IBAN string `json:"iban"`
+	specs.AccountDetails
+}
+
+// Issuers creates (POST) an issuer.
+func (api *Api) Issuers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if api.authorize(w, r, SCOPE_ISSUERS_ADMIN) == nil {
+		return
+	}
+
+	req := IssuerRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "cannot unmarshal json", http.StatusNotAcceptable)
+		return
+	}
+	if req.AddressType == "" {
+		req.AddressType = qr.ADDRESS_TYPE_STRUCTURED
+	}
+	if req.Country == "" {
+		req.Country = qr.COUNTRY_SWITZERLAND
+	}
+	err = validateIssuer(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, id, err := api.db.InsertIssuer(req.IBAN, req.AccountDetails)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot insert issuer", logging.Err(err))
+		http.Error(w, "cannot insert issuer", http.StatusInternalServerError)
+		return
+	}
+	api.log.InfoContext(r.Context(), "issuer created", "issuer_id", id)
+
+	w.Header().Set("Location", api.apiPath+"/issuers/"+strconv.Itoa(id))
+	writeJson(w, http.StatusCreated, IssuerResponse{Id: id, IBAN: req.IBAN, AccountDetails: req.AccountDetails})
+}
+
+// IssuerResource returns (GET) the iban and the address of an issuer.
+func (api *Api) IssuerResource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, api.apiPath+"/issuers/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if api.authorize(w, r, SCOPE_ISSUERS_ADMIN) == nil {
+		return
+	}
+
+	iban, details, err := api.db.GetIssuer(id)
+	if errors.Is(err, dbSql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get issuer", logging.Err(err))
+		http.Error(w, "cannot get issuer", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, http.StatusOK, IssuerResponse{Id: id, IBAN: iban, AccountDetails: details})
+}
+
+// validateIssuer checks the iban and the address, which are printed on
+// the bills of the issuer.
+func validateIssuer(req *IssuerRequest) error {
+	err := utils.ValidateIban(req.IBAN)
+	if err != nil {
+		return err
+	}
+	switch req.AddressType {
+	case qr.ADDRESS_TYPE_STRUCTURED:
+		if req.Name == "" || req.Zip == "" || req.Location == "" {
+			return errors.New("name, zip and location of the issuer are required")
+		}
+	case qr.ADDRESS_TYPE_COMBINED:
+		if req.Name == "" || req.Address2 == "" {
+			return errors.New("name and address2 of the issuer are required")
+		}
+	default:
+		return errors.New("unknown address type " + req.AddressType)
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"context"
+	dbSql "database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/sql"
+)
+
+const JOB_MAX_ATTEMPTS = 5 // failed attempts, before a job fails
+
+// JOB_POLL_INTERVAL is the wait for queued jobs, failed jobs are retried
+// after it.
+var JOB_POLL_INTERVAL = 5 * time.Second
+
+// CreateJob queues a batch (see CreateBatch) to be generated in the
+// background and returns the job with status 202.
+func (api *Api) CreateJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := api.authorize(w, r, SCOPE_BILLS_CREATE)
+	if key == nil {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = BATCH_FORMAT_ZIP
+	}
+	if format != BATCH_FORMAT_ZIP && format != BATCH_FORMAT_PDF {
+		http.Error(w, "unknown format "+format, http.StatusBadRequest)
+		return
+	}
+
+	infos, err := parseBatch(r)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot parse job", logging.Err(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !api.allowBatch(w, r, infos) {
+		return
+	}
+
+	request, err := json.Marshal(infos)
+	if err != nil {
+		http.Error(w, "cannot marshal job", http.StatusInternalServerError)
+		return
+	}
+
+	job := &specs.Job{
+		ApiKeyId:  key.Id,
+		Format:    format,
+		Total:     len(infos),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	err = api.db.InsertJob(job, string(request))
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot queue job", logging.Err(err))
+		http.Error(w, "cannot queue job", http.StatusInternalServerError)
+		return
+	}
+	api.log.InfoContext(r.Context(), "queued job", "job_id", job.Id, "bills", job.Total)
+	api.notifyJobs()
+
+	w.Header().Set("Location", api.apiPath+"/jobs/"+strconv.Itoa(job.Id))
+	writeJson(w, http.StatusAccepted, job)
+}
+
+// GetJob serves {apiPath}/jobs/{id} with the state and progress of a job,
+// {apiPath}/jobs/{id}/result with the zip or pdf of a finished job and
+// {apiPath}/jobs/{id}/report with its outcome per row.
+func (api *Api) GetJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, api.apiPath+"/jobs/"), "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "result" && parts[1] != "report") {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := api.authorize(w, r, SCOPE_BILLS_READ)
+	if key == nil {
+		return
+	}
+
+	job, err := api.db.GetJob(id)
+	if errors.Is(err, dbSql.ErrNoRows) || (err == nil && job.ApiKeyId != key.Id && !key.HasScope(SCOPE_ALL)) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get job", logging.Err(err))
+		http.Error(w, "cannot get job", http.StatusInternalServerError)
+		return
+	}
+
+	if len(parts) == 1 {
+		writeJson(w, http.StatusOK, job)
+		return
+	}
+
+	if job.State != sql.JOB_STATE_DONE {
+		http.Error(w, "job not done", http.StatusConflict)
+		return
+	}
+
+	rows, err := api.jobResult(job.Id)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get result of job", logging.Err(err))
+		http.Error(w, "cannot get result of job", http.StatusInternalServerError)
+		return
+	}
+	if parts[1] == "report" {
+		writeJson(w, http.StatusOK, rows)
+		return
+	}
+	err = writeBatch(w, job.Format, rows)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot write result of job", logging.Err(err))
+	}
+}
+
+// RunJobs processes queued jobs one after each other until ctx is done.
+// Jobs interrupted by a previous stop are resumed with their pending rows.
+func (api *Api) RunJobs(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	n, err := api.db.RequeueRunningJobs()
+	if err != nil {
+		api.log.ErrorContext(ctx, "cannot requeue interrupted jobs", logging.Err(err))
+	} else if n > 0 {
+		api.log.Info("resume interrupted jobs", "jobs", n)
+	}
+
+	api.log.Info("job runner started")
+	for ctx.Err() == nil {
+		// requeued jobs are retried after the poll interval
+		job, err := api.db.ClaimNextJob()
+		if err == nil && api.runJob(ctx, job) {
+			continue
+		}
+		if err != nil && !errors.Is(err, dbSql.ErrNoRows) {
+			api.log.ErrorContext(ctx, "cannot get next job", logging.Err(err))
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-api.jobNotify:
+		case <-time.After(JOB_POLL_INTERVAL):
+		}
+	}
+	api.log.Info("job runner stopped")
+}
+
+// runJob generates the pending rows of a job. Jobs, which can't be read or
+// stored, are retried up to JOB_MAX_ATTEMPTS times, interrupted ones are
+// queued again. false is returned then.
+func (api *Api) runJob(ctx context.Context, job *specs.Job) bool {
+	api.log.InfoContext(ctx, "run job", "job_id", job.Id)
+
+	request, err := api.db.GetJobRequest(job.Id)
+	if err != nil {
+		api.log.ErrorContext(ctx, "cannot get request of job", "job_id", job.Id, logging.Err(err))
+		api.retryJob(job, "cannot get request of job: "+err.Error())
+		return false
+	}
+	infos := []BillInformation{}
+	err = json.Unmarshal([]byte(request), &infos)
+	if err != nil {
+		api.finishJob(job.Id, sql.JOB_STATE_FAILED, "invalid request")
+		return true
+	}
+
+	processed, err := api.db.GetJobRows(job.Id)
+	if err != nil {
+		api.log.ErrorContext(ctx, "cannot get processed rows of job", "job_id", job.Id, logging.Err(err))
+		api.retryJob(job, "cannot get processed rows of job: "+err.Error())
+		return false
+	}
+	done := map[int]bool{}
+	for _, row := range processed {
+		done[row.Row] = true
+	}
+	pending := []int{}
+	for i := range infos {
+		if !done[i+1] {
+			pending = append(pending, i)
+		}
+	}
+
+	_, err = api.runBatch(ctx, infos, pending, job.Id)
+	if err != nil {
+		api.log.ErrorContext(ctx, "cannot store row of job", "job_id", job.Id, logging.Err(err))
+		api.retryJob(job, "cannot store row of job: "+err.Error())
+		return false
+	}
+	if ctx.Err() != nil {
+		api.log.InfoContext(ctx, "job interrupted, resume on next start", "job_id", job.Id)
+		api.requeueJob(job.Id)
+		return false
+	}
+	api.finishJob(job.Id, sql.JOB_STATE_DONE, "")
+	return true
+}
+
+// requeueJob queues an interrupted job again to resume its pending rows.
+// Jobs, which can't be queued, are resumed on the next start.
+func (api *Api) requeueJob(id int) {
+	err := api.db.RequeueJob(id)
+	if err != nil {
+		api.log.Error("cannot requeue job", "job_id", id, logging.Err(err))
+	}
+}
+
+// retryJob queues a job again after a failed attempt. The job fails with
+// errMsg, once it failed JOB_MAX_ATTEMPTS times.
+func (api *Api) retryJob(job *specs.Job, errMsg string) {
+	if job.Attempts+1 >= JOB_MAX_ATTEMPTS {
+		api.finishJob(job.Id, sql.JOB_STATE_FAILED, errMsg)
+		return
+	}
+	err := api.db.RetryJob(job.Id, errMsg)
+	if err != nil {
+		api.log.Error("cannot requeue job", "job_id", job.Id, logging.Err(err))
+	}
+}
+
+func (api *Api) finishJob(id int, state string, errMsg string) {
+	api.log.Info("job finished", "job_id", id, "state", state)
+	err := api.db.FinishJob(id, state, errMsg)
+	if err != nil {
+		api.log.Error("cannot finish job", logging.Err(err))
+	}
+}
+
+// jobResult loads the rows of a job along with their bills.
+func (api *Api) jobResult(jobId int) ([]BatchRow, error) {
+	jobRows, err := api.db.GetJobRows(jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]BatchRow, len(jobRows))
+	for i, jobRow := range jobRows {
+		rows[i].BatchRow = jobRow
+		if jobRow.BillId <= 0 {
+			continue
+		}
+		rows[i].bill, err = api.db.GetBill(jobRow.BillId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+func (api *Api) notifyJobs() {
+	select {
+	case api.jobNotify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,188 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+)
+
+const (
+	LIMIT_SCOPE_KEY    = "key"
+	LIMIT_SCOPE_IP     = "ip"
+	LIMIT_SCOPE_ISSUER = "issuer"
+
+	RATE_WINDOW  = time.Minute
+	QUOTA_WINDOW = 24 * time.Hour
+
+	COUNTER_RETENTION = 2 * QUOTA_WINDOW
+)
+
+// RateLimits configures the limits of the api. A limit of 0 disables it.
+type RateLimits struct {
+	PerKey      int  // requests per minute and api key, if not set on the key
+	PerIp       int  // requests per minute and client ip
+	IssuerQuota int  // bills per day and issuer, if not set on the issuer
+	TrustProxy  bool // take the client ip from X-Forwarded-For
+}
+
+type limiter struct {
+	mutex       sync.Mutex
+	lastCleanup time.Time
+}
+
+// RateLimitsFromEnv reads API_RATE_LIMIT_KEY, API_RATE_LIMIT_IP,
+// API_DAILY_QUOTA_ISSUER and API_TRUST_PROXY.
+func RateLimitsFromEnv() RateLimits {
+	limits := RateLimits{}
+	envs := map[string]*int{
+		"API_RATE_LIMIT_KEY":     &limits.PerKey,
+		"API_RATE_LIMIT_IP":      &limits.PerIp,
+		"API_DAILY_QUOTA_ISSUER": &limits.IssuerQuota,
+	}
+	for env, val := range envs {
+		if os.Getenv(env) == "" {
+			continue
+		}
+		limit, err := strconv.Atoi(os.Getenv(env))
+		if err != nil || limit < 0 {
+			slog.Warn("ignore invalid limit", "env", env)
+			continue
+		}
+		*val = limit
+	}
+	limits.TrustProxy = os.Getenv("API_TRUST_PROXY") == "true"
+	return limits
+}
+
+func (api *Api) SetRateLimits(limits RateLimits) {
+	api.limits = limits
+}
+
+// limitIp wraps a handler with the rate limit per client ip.
+func (api *Api) limitIp(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.limits.PerIp > 0 &&
+			!api.allow(w, r, time.Now(), LIMIT_SCOPE_IP, api.clientIp(r), api.limits.PerIp, RATE_WINDOW, 1) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allow counts n requests of a subject in the window of now. If the limit
+// is exceeded, 429 is written and false returned, the rejected requests
+// aren't counted. Counters are persisted, so the limits survive a restart.
+// If the counter isn't available, the request is allowed.
+func (api *Api) allow(w http.ResponseWriter, r *http.Request, now time.Time, scope string, subject string,
+	limit int, window time.Duration, n int) bool {
+
+	windowStart := now.Truncate(window)
+	api.cleanup(now)
+
+	count, err := api.db.IncrementCounter(scope, subject, windowStart, n)
+	if err != nil {
+		api.log.Error("cannot count request for rate limit", logging.Err(err))
+		return true
+	}
+	if count <= limit {
+		return true
+	}
+	api.uncount(scope, subject, windowStart, n)
+
+	retryAfter := int(windowStart.Add(window).Sub(now).Seconds()) + 1
+	api.log.InfoContext(r.Context(), "rate limit exceeded", "scope", scope, "subject", subject)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, fmt.Sprintf("%s limit of %d per %s exceeded", scope, limit, window), http.StatusTooManyRequests)
+	return false
+}
+
+// uncount takes back n requests counted in the window starting at
+// windowStart.
+func (api *Api) uncount(scope string, subject string, windowStart time.Time, n int) {
+	_, err := api.db.IncrementCounter(scope, subject, windowStart, -n)
+	if err != nil {
+		api.log.Error("cannot uncount rejected requests", "scope", scope, "subject", subject, logging.Err(err))
+	}
+}
+
+// allowIssuer counts n bills against the daily quota of an issuer.
+func (api *Api) allowIssuer(w http.ResponseWriter, r *http.Request, now time.Time, issuerId int, n int) bool {
+	quota := api.issuerQuota(issuerId)
+	if quota <= 0 {
+		return true
+	}
+	return api.allow(w, r, now, LIMIT_SCOPE_ISSUER, strconv.Itoa(issuerId), quota, QUOTA_WINDOW, n)
+}
+
+// issuerQuota returns the bills per day an issuer may generate, 0 if
+// unlimited.
+func (api *Api) issuerQuota(issuerId int) int {
+	quota, err := api.db.GetIssuerDailyQuota(issuerId)
+	if err != nil {
+		api.log.Error("cannot get quota of issuer", logging.Err(err))
+	}
+	if quota <= 0 {
+		quota = api.limits.IssuerQuota
+	}
+	return quota
+}
+
+// cleanup removes expired rate counters and idempotency keys once an hour.
+func (api *Api) cleanup(now time.Time) {
+	api.limiter.mutex.Lock()
+	defer api.limiter.mutex.Unlock()
+
+	if now.Sub(api.limiter.lastCleanup) < time.Hour {
+		return
+	}
+	api.limiter.lastCleanup = now
+	go func() {
+		err := api.db.DeleteCountersBefore(now.Add(-COUNTER_RETENTION))
+		if err != nil {
+			api.log.Error("cannot cleanup rate counters", logging.Err(err))
+		}
+		err = api.db.DeleteIdempotencyKeysBefore(now.Add(-IDEMPOTENCY_TTL))
+		if err != nil {
+			api.log.Error("cannot cleanup idempotency keys", logging.Err(err))
+		}
+	}()
+}
+
+func (api *Api) clientIp(r *http.Request) string {
+	if api.limits.TrustProxy {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0]
+		if ip := strings.TrimSpace(forwarded); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,105 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	dbSql "database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/bill"
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+// ReferenceResource serves
+//   - GET {apiPath}/references/{issuer_id} with the reference format and
+//     the last invoice number of an issuer
+//   - PUT {apiPath}/references/{issuer_id} to set the BESR-ID and the
+//     customer digits of the generated QRR references
+func (api *Api) ReferenceResource(w http.ResponseWriter, r *http.Request) {
+	issuerId, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, api.apiPath+"/references/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if api.authorize(w, r, SCOPE_BILLS_READ) == nil {
+			return
+		}
+		f, err := api.db.GetReferenceFormat(issuerId)
+		if errors.Is(err, dbSql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			api.log.ErrorContext(r.Context(), "cannot get reference format", logging.Err(err))
+			http.Error(w, "cannot get reference format", http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, http.StatusOK, f)
+	case http.MethodPut:
+		api.setReferenceFormat(w, r, issuerId)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (api *Api) setReferenceFormat(w http.ResponseWriter, r *http.Request, issuerId int) {
+	if api.authorize(w, r, SCOPE_REFERENCES_ADMIN) == nil {
+		return
+	}
+
+	f := specs.ReferenceFormat{}
+	err := json.NewDecoder(r.Body).Decode(&f)
+	if err != nil {
+		http.Error(w, "cannot unmarshal json", http.StatusNotAcceptable)
+		return
+	}
+	f.IssuerId = issuerId
+	err = bill.ValidateReferenceFormat(&f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, _, err = api.db.GetIssuer(issuerId)
+	if err != nil {
+		http.Error(w, "unknown issuer", http.StatusBadRequest)
+		return
+	}
+
+	err = api.db.SetReferenceFormat(&f)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot set reference format", logging.Err(err))
+		http.Error(w, "cannot set reference format", http.StatusInternalServerError)
+		return
+	}
+	api.log.InfoContext(r.Context(), "set reference format", "issuer_id", issuerId)
+
+	saved, err := api.db.GetReferenceFormat(issuerId)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get reference format", logging.Err(err))
+		http.Error(w, "cannot get reference format", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, http.StatusOK, saved)
+}
@@ -18,77 +18,167 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/ChrIgiSta/swiss-qr-bill/bill"
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
 	"github.com/ChrIgiSta/swiss-qr-bill/sql"
+	"github.com/ChrIgiSta/swiss-qr-bill/webhook"
 )
 
 const (
 	TOKEN_KEY = "X-API-Key"
+
+	MIME_TYPE_PDF  = "application/pdf"
+	MIME_TYPE_JSON = "application/json"
+
+	READ_HEADER_TIMEOUT = 10 * time.Second
+	READ_TIMEOUT        = time.Minute
+	WRITE_TIMEOUT       = 5 * time.Minute // rendering of pdfs can take a while
+	IDLE_TIMEOUT        = 2 * time.Minute
+	SHUTDOWN_TIMEOUT    = 30 * time.Second
 )
 
-type BillInformation struct {
-	IssuerId     int     `json:"issuer_id"`
-	Name         string  `json:"name"`
-	FirstName    string  `json:"firstname"`
-	Street       string  `json:"street"`
-	StreetNumber string  `json:"streetNumber"`
-	Postal       string  `json:"postal"`
-	City         string  `json:"city"`
-	Amount       float32 `json:"amount"`
-	Message      string  `json:"message"`
-}
+// BillInformation is the request schema of a bill, see bill.Information.
+type BillInformation = bill.Information
 
 type Api struct {
 	apiPath string
 	port    int
-	db      sql.Db
+	db      sql.Repository
+	limits  RateLimits
+	limiter limiter
+	log     *slog.Logger
+	ready   int32
+	tlsCert string
+	tlsKey  string
+
+	jobNotify chan struct{}
 }
 
-func NewApi(apiPath string, port int, db *sql.Db) *Api {
+func NewApi(apiPath string, port int, db sql.Repository) *Api {
 	return &Api{
-		apiPath: apiPath,
-		port:    port,
-		db:      *db,
+		apiPath:   "/" + strings.Trim(apiPath, "/"),
+		port:      port,
+		db:        db,
+		log:       slog.Default(),
+		jobNotify: make(chan struct{}, 1),
 	}
 }
 
-func (api *Api) Run(wg *sync.WaitGroup) {
+// Handler routes the requests of the api.
+func (api *Api) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(api.apiPath+"/bill", api.limitIp(api.GetBill))
+	mux.HandleFunc(api.apiPath+"/bills", api.limitIp(api.ListBills))
+	mux.HandleFunc(api.apiPath+"/bills/", api.limitIp(api.BillResource))
+	mux.HandleFunc(api.apiPath+"/bills/batch", api.limitIp(api.CreateBatch))
+	mux.HandleFunc(api.apiPath+"/jobs", api.limitIp(api.CreateJob))
+	mux.HandleFunc(api.apiPath+"/jobs/", api.limitIp(api.GetJob))
+	mux.HandleFunc(api.apiPath+"/webhooks", api.limitIp(api.Webhooks))
+	mux.HandleFunc(api.apiPath+"/webhooks/", api.limitIp(api.WebhookResource))
+	mux.HandleFunc(api.apiPath+"/translations", api.limitIp(api.Translations))
+	mux.HandleFunc(api.apiPath+"/translations/", api.limitIp(api.TranslationResource))
+	mux.HandleFunc(api.apiPath+"/references/", api.limitIp(api.ReferenceResource))
+	mux.HandleFunc(api.apiPath+"/issuers", api.limitIp(api.Issuers))
+	mux.HandleFunc(api.apiPath+"/issuers/", api.limitIp(api.IssuerResource))
+	mux.HandleFunc(api.apiPath+"/keys", api.limitIp(api.ApiKeys))
+	mux.HandleFunc(api.apiPath+"/keys/", api.limitIp(api.RevokeApiKey))
+	mux.HandleFunc("/healthz", api.Healthz)
+	mux.HandleFunc("/readyz", api.Readyz)
+	mux.HandleFunc("/metrics", api.Metrics)
+	return api.withRequestId(mux)
+}
+
+// Run serves the api until ctx is done. In-flight requests are drained
+// for up to SHUTDOWN_TIMEOUT before the server is closed.
+func (api *Api) Run(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	http.HandleFunc(api.apiPath+"/bill", api.GetBill)
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", api.port),
+		Handler:           api.Handler(),
+		ReadHeaderTimeout: READ_HEADER_TIMEOUT,
+		ReadTimeout:       READ_TIMEOUT,
+		WriteTimeout:      WRITE_TIMEOUT,
+		IdleTimeout:       IDLE_TIMEOUT,
+		// requests keep the values of ctx, but are drained on shutdown
+		// instead of being canceled
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithoutCancel(ctx)
+		},
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		api.setReady(false)
 
-	log.Println("start server on port", api.port)
-	listen := fmt.Sprintf(":%d", api.port)
-	err := http.ListenAndServe(listen, nil)
-	if err != nil {
-		log.Println("http server shutdown todue an error. ", err)
+		api.log.Info("shutdown http server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			api.log.ErrorContext(ctx, "http server not shutdown gracefully", logging.Err(err))
+			srv.Close()
+		}
+	}()
+
+	api.setReady(true)
+
+	var err error
+	if api.tlsCert != "" && api.tlsKey != "" {
+		api.log.Info("start tls server", "port", api.port)
+		err = srv.ListenAndServeTLS(api.tlsCert, api.tlsKey)
+	} else {
+		api.log.Info("start server", "port", api.port)
+		err = srv.ListenAndServe()
 	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		api.log.ErrorContext(ctx, "http server shutdown todue an error", logging.Err(err))
+		return
+	}
+
+	<-stopped
+	api.log.Info("http server stopped")
 }
 
-func (api *Api) GetBill(w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
+// SetLogger replaces the default logger.
+func (api *Api) SetLogger(logger *slog.Logger) {
+	api.log = logger
+}
 
-	token, err := api.db.GetApiToken()
-	if err != nil {
-		log.Println("unable to validate token", err.Error())
-		http.Error(w, "unable to validate token", http.StatusInternalServerError)
+// SetTLS serves the api with tls, using the given pem encoded files.
+func (api *Api) SetTLS(certFile string, keyFile string) {
+	api.tlsCert = certFile
+	api.tlsKey = keyFile
+}
+
+func (api *Api) GetBill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if auth != TOKEN_KEY+" "+token {
-		log.Println("unauthorized client wanted to gen bill. ", r.Host)
-		http.Error(w, "not authorized", http.StatusUnauthorized)
+	key := api.authorize(w, r, SCOPE_BILLS_CREATE)
+	if key == nil {
 		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println("error while reading body. ", err)
+		api.log.ErrorContext(r.Context(), "error while reading body", logging.Err(err))
 		http.Error(w, "cannot read body", http.StatusNoContent)
 		return
 	}
@@ -97,12 +187,99 @@ func (api *Api) GetBill(w http.ResponseWriter, r *http.Request) {
 	billInfo := BillInformation{}
 	err = json.Unmarshal(body, &billInfo)
 	if err != nil {
-		log.Println("error while encoding json", err)
+		api.log.ErrorContext(r.Context(), "error while encoding json", logging.Err(err))
 		http.Error(w, "cannot unmarshal json", http.StatusNotAcceptable)
 		return
 	}
 
-	log.Println("generate new bill")
+	idempotencyKey := r.Header.Get(IDEMPOTENCY_HEADER)
+	if idempotencyKey != "" && !api.reserveIdempotencyKey(w, r, key, idempotencyKey, &billInfo) {
+		return
+	}
+
+	var b *specs.Bill
+	if idempotencyKey != "" {
+		// release the key on failure, so the request can be retried
+		defer func() {
+			api.finishIdempotencyKey(r.Context(), key, idempotencyKey, b)
+		}()
+	}
+
+	api.log.DebugContext(r.Context(), "generate new bill", "issuer_id", billInfo.IssuerId)
+
+	newBill, err := api.newBill(&billInfo)
+	if err != nil {
+		api.log.InfoContext(r.Context(), "invalid bill information", logging.Err(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !api.allowIssuer(w, r, time.Now(), newBill.IssuerId, 1) {
+		return
+	}
+	// the number of the sequence is drawn once the bill is accepted
+	err = bill.DrawReference(api.db, &billInfo, newBill)
+	var validationErr *bill.ValidationError
+	if errors.As(err, &validationErr) {
+		api.log.InfoContext(r.Context(), "invalid reference", logging.Err(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot generate reference", logging.Err(err))
+		http.Error(w, "cannot generate reference", http.StatusInternalServerError)
+		return
+	}
+
+	err = api.generateBill(r.Context(), newBill, api.db.InsertBill)
+	if errors.Is(err, sql.ErrDuplicateReference) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot generate bill", logging.Err(err))
+		http.Error(w, "cannot generate bill", http.StatusInternalServerError)
+		return
+	}
+	b = newBill
+
+	api.writeBill(w, r, b, http.StatusCreated)
+}
+
+func (api *Api) writeBill(w http.ResponseWriter, r *http.Request, b *specs.Bill, status int) {
+	w.Header().Set("Location", fmt.Sprintf("%s/bills/%d/pdf", api.apiPath, b.Id))
+	w.Header().Set("X-Bill-Id", fmt.Sprint(b.Id))
+	w.Header().Set("X-Bill-Reference", b.Details.Referece)
+	api.servePdf(w, r, b, status)
+}
+
+// generateBill renders a bill and stores it with store.
+func (api *Api) generateBill(ctx context.Context, b *specs.Bill, store func(b *specs.Bill) error) error {
+	err := bill.Generate(ctx, b, bill.Translation(api.db, b.IssuerId, b.LanguageCode), nil)
+	if err != nil {
+		return err
+	}
+	err = store(b)
+	if err != nil {
+		return err
+	}
+
+	err = webhook.Emit(api.db, webhook.EVENT_BILL_GENERATED, b)
+	if err != nil {
+		api.log.ErrorContext(ctx, "cannot emit webhook", logging.Err(err))
+	}
+	return nil
+}
+
+// newBill maps the api request onto a bill of the requested issuer and
+// validates it. A generated reference is only previewed, see
+// bill.DrawReference.
+func (api *Api) newBill(billInfo *BillInformation) (*specs.Bill, error) {
+	iban, issuer, err := api.db.GetIssuer(billInfo.IssuerId)
+	if err != nil {
+		return nil, bill.Invalid(bill.RULE_ISSUER, "unknown issuer %d", billInfo.IssuerId)
+	}
 
-	log.Fatal("not implemented: -> ToDo: get issuer, generate qr and send it back")
+	preview, err := bill.PreviewReference(api.db, billInfo)
+	if err != nil {
+		return nil, err
+	}
+	return bill.NewBill(preview, bill.CHANNEL_API, iban, issuer)
 }
@@ -0,0 +1,140 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	dbSql "database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/bill"
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+)
+
+// Translations lists (GET) the texts of the bill in all languages, as used
+// for the issuer of the query issuer_id.
+func (api *Api) Translations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if api.authorize(w, r, SCOPE_BILLS_READ) == nil {
+		return
+	}
+
+	issuerId, _ := strconv.Atoi(r.URL.Query().Get("issuer_id"))
+	translations := []*specs.Translation{}
+	for _, language := range utils.LANGUAGES {
+		translations = append(translations, api.translation(issuerId, language))
+	}
+	writeJson(w, http.StatusOK, translations)
+}
+
+// TranslationResource serves
+//   - GET {apiPath}/translations/{language} with the texts used for the
+//     issuer of the query issuer_id
+//   - PUT {apiPath}/translations/{language} to set the texts of an issuer,
+//     empty texts fall back to the built-in ones
+//   - DELETE {apiPath}/translations/{language}?issuer_id= to reset the texts
+//     of an issuer
+func (api *Api) TranslationResource(w http.ResponseWriter, r *http.Request) {
+	language := strings.ToUpper(strings.TrimPrefix(r.URL.Path, api.apiPath+"/translations/"))
+	if utils.ParseLanguage(language) != language {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if api.authorize(w, r, SCOPE_BILLS_READ) == nil {
+			return
+		}
+		issuerId, _ := strconv.Atoi(r.URL.Query().Get("issuer_id"))
+		writeJson(w, http.StatusOK, api.translation(issuerId, language))
+	case http.MethodPut:
+		api.setTranslation(w, r, language)
+	case http.MethodDelete:
+		api.deleteTranslation(w, r, language)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (api *Api) setTranslation(w http.ResponseWriter, r *http.Request, language string) {
+	if api.authorize(w, r, SCOPE_TRANSLATIONS_ADMIN) == nil {
+		return
+	}
+
+	tr := specs.Translation{}
+	err := json.NewDecoder(r.Body).Decode(&tr)
+	if err != nil {
+		http.Error(w, "cannot unmarshal json", http.StatusNotAcceptable)
+		return
+	}
+	_, _, err = api.db.GetIssuer(tr.IssuerId)
+	if err != nil {
+		http.Error(w, "unknown issuer", http.StatusBadRequest)
+		return
+	}
+	tr.LanguageCode = language
+
+	err = api.db.SetIssuerTranslation(&tr)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot set translation", logging.Err(err))
+		http.Error(w, "cannot set translation", http.StatusInternalServerError)
+		return
+	}
+	api.log.InfoContext(r.Context(), "set translation", "issuer_id", tr.IssuerId, "language", language)
+	writeJson(w, http.StatusOK, api.translation(tr.IssuerId, language))
+}
+
+func (api *Api) deleteTranslation(w http.ResponseWriter, r *http.Request, language string) {
+	if api.authorize(w, r, SCOPE_TRANSLATIONS_ADMIN) == nil {
+		return
+	}
+
+	issuerId, err := strconv.Atoi(r.URL.Query().Get("issuer_id"))
+	if err != nil {
+		http.Error(w, "issuer_id is required", http.StatusBadRequest)
+		return
+	}
+	err = api.db.DeleteIssuerTranslation(issuerId, language)
+	if errors.Is(err, dbSql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot delete translation", logging.Err(err))
+		http.Error(w, "cannot delete translation", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// translation returns the texts of the bill of an issuer in a language.
+func (api *Api) translation(issuerId int, language string) *specs.Translation {
+	return &specs.Translation{
+		IssuerId:         issuerId,
+		LanguageCode:     language,
+		TranslationTable: *bill.Translation(api.db, issuerId, language),
+	}
+}
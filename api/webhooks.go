@@ -0,0 +1,215 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	dbSql "database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+	"github.com/ChrIgiSta/swiss-qr-bill/webhook"
+)
+
+const WEBHOOK_SECRET_LENGTH = 32
+
+type WebhookRequest struct {
+	IssuerId int      `json:"issuer_id"`
+	Url      string   `json:"url"`
+	Events   []string `json:"events"`
+	Secret   string   `json:"secret"` // generated, if empty
+}
+
+type WebhookResponse struct {
+	*specs.Webhook
+	Secret string `json:"secret"` // only returned once, on creation
+}
+
+// Webhooks lists (GET, optional query issuer_id) or creates (POST)
+// webhook subscriptions.
+func (api *Api) Webhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if api.authorize(w, r, SCOPE_HOOKS_ADMIN) == nil {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		issuerId, _ := strconv.Atoi(r.URL.Query().Get("issuer_id"))
+		hooks, err := api.db.GetWebhooks(issuerId)
+		if err != nil {
+			api.log.ErrorContext(r.Context(), "cannot get webhooks", logging.Err(err))
+			http.Error(w, "cannot get webhooks", http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, http.StatusOK, hooks)
+		return
+	}
+
+	req := WebhookRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "cannot unmarshal json", http.StatusNotAcceptable)
+		return
+	}
+	u, err := url.Parse(req.Url)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		http.Error(w, "events are required", http.StatusBadRequest)
+		return
+	}
+	for _, event := range req.Events {
+		if !webhook.ValidEvent(event) {
+			http.Error(w, "unknown event "+event, http.StatusBadRequest)
+			return
+		}
+	}
+	_, _, err = api.db.GetIssuer(req.IssuerId)
+	if err != nil {
+		http.Error(w, "unknown issuer", http.StatusBadRequest)
+		return
+	}
+	if req.Secret == "" {
+		req.Secret = utils.CreateNewToken(WEBHOOK_SECRET_LENGTH).Plain
+	}
+
+	hook := &specs.Webhook{
+		IssuerId:  req.IssuerId,
+		Url:       req.Url,
+		Secret:    req.Secret,
+		Events:    req.Events,
+		Enable:    true,
+		CreatedAt: time.Now(),
+	}
+	err = api.db.InsertWebhook(hook)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot create webhook", logging.Err(err))
+		http.Error(w, "cannot create webhook", http.StatusInternalServerError)
+		return
+	}
+	api.log.InfoContext(r.Context(), "created webhook", "webhook_id", hook.Id, "issuer_id", hook.IssuerId)
+	writeJson(w, http.StatusCreated, WebhookResponse{Webhook: hook, Secret: hook.Secret})
+}
+
+// WebhookResource serves
+//   - DELETE {apiPath}/webhooks/{id} to remove a subscription
+//   - GET {apiPath}/webhooks/{id}/deliveries with the delivery log (limit, offset)
+//   - POST {apiPath}/webhooks/deliveries/{id}/replay to send a delivery again
+func (api *Api) WebhookResource(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, api.apiPath+"/webhooks/"), "/")
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		api.deleteWebhook(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "deliveries" && r.Method == http.MethodGet:
+		api.webhookDeliveries(w, r, parts[0])
+	case len(parts) == 3 && parts[0] == "deliveries" && parts[2] == "replay" && r.Method == http.MethodPost:
+		api.replayDelivery(w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (api *Api) deleteWebhook(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if api.authorize(w, r, SCOPE_HOOKS_ADMIN) == nil {
+		return
+	}
+
+	err = api.db.DeleteWebhook(id)
+	if errors.Is(err, dbSql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot delete webhook", logging.Err(err))
+		http.Error(w, "cannot delete webhook", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *Api) webhookDeliveries(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if api.authorize(w, r, SCOPE_HOOKS_ADMIN) == nil {
+		return
+	}
+
+	limit, offset, err := parsePaging(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deliveries, err := api.db.GetWebhookDeliveries(id, limit, offset)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get webhook deliveries", logging.Err(err))
+		http.Error(w, "cannot get webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, http.StatusOK, deliveries)
+}
+
+func (api *Api) replayDelivery(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if api.authorize(w, r, SCOPE_HOOKS_ADMIN) == nil {
+		return
+	}
+
+	err = api.db.ReplayWebhookDelivery(id)
+	if errors.Is(err, dbSql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot replay webhook delivery", logging.Err(err))
+		http.Error(w, "cannot replay webhook delivery", http.StatusInternalServerError)
+		return
+	}
+
+	delivery, err := api.db.GetWebhookDelivery(id)
+	if err != nil {
+		api.log.ErrorContext(r.Context(), "cannot get webhook delivery", logging.Err(err))
+		http.Error(w, "cannot get webhook delivery", http.StatusInternalServerError)
+		return
+	}
+	api.log.InfoContext(r.Context(), "replay webhook delivery", "delivery_id", id)
+	writeJson(w, http.StatusAccepted, delivery)
+}
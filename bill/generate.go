@@ -0,0 +1,90 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bill
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/metrics"
+	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+)
+
+const (
+	CHANNEL_API  = "API"
+	CHANNEL_MAIL = "MAIL"
+	CHANNEL_CLI  = "CLI"
+
+	OUT_DIR = "out/bills"
+)
+
+var logger = slog.Default()
+
+// SetLogger replaces the default logger of the package.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Generate renders the qr code and the pdf of a bill. The output files are
+// created in OUT_DIR, unless the bill already defines them. Payload and pdf
+// hashes are set on the bill, so it can be persisted afterwards.
+func Generate(ctx context.Context, b *specs.Bill, dictionary *specs.TranslationTable, existingPdf interface{}) error {
+	sQr := qr.NewSwissBillQr(&b.Issuer)
+	b.PayloadHash = utils.GetSha256([]byte(sQr.GetSwissPaymentText(&b.Customer, &b.Details)))
+
+	if b.QrFile == "" || b.PdfFile == "" {
+		err := os.MkdirAll(OUT_DIR, 0755)
+		if err != nil {
+			return err
+		}
+		base := filepath.Join(OUT_DIR, fmt.Sprintf("%d-%s", time.Now().UnixNano(), b.PayloadHash[:12]))
+		b.QrFile = base + ".png"
+		b.PdfFile = base + ".pdf"
+	}
+
+	start := time.Now()
+	err := sQr.GetSwissPaymentQR(&b.Customer, &b.Details, b.QrFile)
+	if err != nil {
+		logger.ErrorContext(ctx, "cannot render qr code", "file", b.QrFile, logging.Err(err))
+		return err
+	}
+
+	err = CreatePDF(&b.Issuer, &b.Customer, &b.Details, b.QrFile, b.PdfFile, dictionary, existingPdf)
+	if err != nil {
+		logger.ErrorContext(ctx, "cannot render pdf", "file", b.PdfFile, logging.Err(err))
+		return err
+	}
+	metrics.RenderDuration.Since(start)
+
+	pdf, err := os.ReadFile(b.PdfFile)
+	if err != nil {
+		return err
+	}
+	b.PdfHash = utils.GetSha256(pdf)
+	metrics.BillsGenerated.Inc(b.Channel)
+	logger.DebugContext(ctx, "bill rendered", "channel", b.Channel, "file", b.PdfFile, "duration", time.Since(start))
+
+	return nil
+}
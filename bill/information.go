@@ -0,0 +1,177 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bill
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+)
+
+// Information is the request schema of a bill, shared by the api and the
+// mail channel.
+type Information struct {
+	IssuerId      int     `json:"issuer_id"`
+	Name          string  `json:"name"`
+	FirstName     string  `json:"firstname"`
+	Street        string  `json:"street"`
+	StreetNumber  string  `json:"streetNumber"`
+	Postal        string  `json:"postal"`
+	City          string  `json:"city"`
+	Country       string  `json:"country"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	ReferenceType string  `json:"reference_type"`
+	Reference     string  `json:"reference"`
+	Message       string  `json:"message"`
+	Language      string  `json:"language"` // of the pdf, the preferred language of the customer
+
+	// parts of a generated reference, see NewReference
+	CustomerNumber string `json:"customer_number"`
+	InvoiceNumber  string `json:"invoice_number"`
+}
+
+// NewBill maps the requested information to a validated bill of the
+// issuer.
+func NewBill(info *Information, channel string, iban string, issuer specs.AccountDetails) (*specs.Bill, error) {
+	// language tags like de-CH are accepted, others are reported by Validate
+	language := utils.ParseLanguage(info.Language)
+	if language == "" {
+		language = strings.ToUpper(info.Language)
+	}
+	b := &specs.Bill{
+		IssuerId:     info.IssuerId,
+		Channel:      channel,
+		LanguageCode: language,
+		Issuer:       issuer,
+		Customer: specs.AccountDetails{
+			AddressType: qr.ADDRESS_TYPE_STRUCTURED,
+			Name:        strings.TrimSpace(info.Name + " " + info.FirstName),
+			Address1:    strings.TrimSpace(info.Street + " " + info.StreetNumber),
+			Zip:         info.Postal,
+			Location:    info.City,
+			Country:     info.Country,
+		},
+		Details: specs.BillingDetails{
+			IBAN:           iban,
+			RefenreceType:  info.ReferenceType,
+			Referece:       info.Reference,
+			AdditionalInfo: info.Message,
+			Currency:       info.Currency,
+			Amount:         info.Amount,
+		},
+	}
+
+	SetDefaults(b)
+	err := Validate(b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ParseCsv reads bill informations from a csv with a header row of the
+// json keys of Information. Comma and semicolon separated files are
+// supported.
+func ParseCsv(in io.Reader) ([]Information, error) {
+	content, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(strings.NewReader(string(content)))
+	firstLine := strings.SplitN(string(content), "\n", 2)[0]
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		reader.Comma = ';'
+	}
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 1 {
+		return nil, errors.New("csv without header")
+	}
+
+	header := records[0]
+	infos := make([]Information, 0, len(records)-1)
+	for i, record := range records[1:] {
+		info := Information{}
+		for col, key := range header {
+			err = info.set(strings.TrimSpace(strings.TrimPrefix(key, "\ufeff")), strings.TrimSpace(record[col]))
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %s", i+1, err.Error())
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (info *Information) set(key string, value string) error {
+	var err error
+
+	switch key {
+	case "issuer_id":
+		info.IssuerId, err = strconv.Atoi(value)
+	case "name":
+		info.Name = value
+	case "firstname":
+		info.FirstName = value
+	case "street":
+		info.Street = value
+	case "streetNumber":
+		info.StreetNumber = value
+	case "postal":
+		info.Postal = value
+	case "city":
+		info.City = value
+	case "country":
+		info.Country = value
+	case "amount":
+		info.Amount, err = strconv.ParseFloat(value, 64)
+	case "currency":
+		info.Currency = value
+	case "reference_type":
+		info.ReferenceType = value
+	case "reference":
+		info.Reference = value
+	case "message":
+		info.Message = value
+	case "language":
+		info.Language = value
+	case "customer_number":
+		info.CustomerNumber = value
+	case "invoice_number":
+		info.InvoiceNumber = value
+	default:
+		return fmt.Errorf("unknown column %s", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s", key)
+	}
+	return nil
+}
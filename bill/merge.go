@@ -0,0 +1,117 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bill
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/phpdave11/gofpdi"
+	"github.com/signintech/gopdf"
+)
+
+const (
+	REPORT_FONT_SIZE   = 10
+	REPORT_LINE_HEIGHT = 6
+	REPORT_MARGIN      = 20
+)
+
+// MergePDFs writes all pages of the bill pdfs into one document.
+func MergePDFs(pdfFiles []string, w io.Writer) error {
+	return MergePDFsWithReport(pdfFiles, "", nil, w)
+}
+
+// MergePDFsWithReport writes all pages of the bill pdfs into one document,
+// followed by pages with the title and the lines of a report, if there are
+// any lines.
+func MergePDFsWithReport(pdfFiles []string, title string, report []string, w io.Writer) error {
+	if len(pdfFiles) == 0 {
+		return errors.New("no pdf to merge")
+	}
+
+	pdf := gopdf.GoPdf{}
+	pdf.Start(gopdf.Config{
+		PageSize: gopdf.Rect{W: A4_WIDE, H: A4_HEIGHT},
+		Unit:     gopdf.UnitMM,
+	})
+
+	for _, pdfFile := range pdfFiles {
+		pages, err := countPages(pdfFile)
+		if err != nil {
+			return err
+		}
+		for page := 1; page <= pages; page++ {
+			pdf.AddPage()
+			addPdfPage(&pdf, pdfFile, page)
+		}
+	}
+
+	if len(report) > 0 {
+		err := addReport(&pdf, title, report)
+		if err != nil {
+			return err
+		}
+	}
+
+	return pdf.Write(w)
+}
+
+// addReport adds the lines of a report on as many pages as needed.
+func addReport(pdf *gopdf.GoPdf, title string, report []string) error {
+	err := loadFonts(pdf)
+	if err != nil {
+		return err
+	}
+
+	y := float64(A4_HEIGHT)
+	for i, line := range append([]string{title}, report...) {
+		if y+REPORT_LINE_HEIGHT > A4_HEIGHT-REPORT_MARGIN {
+			pdf.AddPage()
+			y = REPORT_MARGIN
+		}
+		font := FONT_REG
+		if i == 0 {
+			font = FONT_BOLD
+		}
+		err = pdf.SetFont(font, "", REPORT_FONT_SIZE)
+		if err != nil {
+			return err
+		}
+		pdf.SetXY(REPORT_MARGIN, y)
+		err = pdf.Text(line)
+		if err != nil {
+			return err
+		}
+		y += REPORT_LINE_HEIGHT
+	}
+	return nil
+}
+
+// countPages returns the number of pages of a pdf file.
+func countPages(pdfFile string) (pages int, err error) {
+	// gofpdi panics on unreadable files
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot read %s: %v", pdfFile, r)
+		}
+	}()
+	importer := gofpdi.NewImporter()
+	importer.SetSourceFile(pdfFile)
+	return len(importer.GetPageSizes()), nil
+}
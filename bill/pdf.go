@@ -19,8 +19,8 @@ package bill
 
 import (
 	"fmt"
-	"log"
 
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
 	"github.com/ChrIgiSta/swiss-qr-bill/qr"
 	"github.com/ChrIgiSta/swiss-qr-bill/specs"
 
@@ -53,12 +53,12 @@ func loadFonts(pdf *gopdf.GoPdf) error {
 	// maybe downoad into container..?
 	err := pdf.AddTTFFont(FONT_REG, "ttf/LiberationSans-Regular.ttf")
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return err
 	}
 	err = pdf.AddTTFFont(FONT_BOLD, "ttf/LiberationSans-Bold.ttf")
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return err
 	}
 	return nil
@@ -91,9 +91,14 @@ func drawScissors(pdf *gopdf.GoPdf) {
 }
 
 func addExistingBillPdf(pdf *gopdf.GoPdf, pdfPath string) {
+	addPdfPage(pdf, pdfPath, 1)
+}
+
+// addPdfPage draws a page of a pdf file onto the current page.
+func addPdfPage(pdf *gopdf.GoPdf, pdfPath string, page int) {
 	pdf.SetXY(0, 0)
-	tpl1 := pdf.ImportPage(pdfPath, 1, "/MediaBox")
-	pdf.UseImportedTemplate(tpl1, 0, 0, A4_WIDE, A4_HEIGHT)
+	tpl := pdf.ImportPage(pdfPath, page, "/MediaBox")
+	pdf.UseImportedTemplate(tpl, 0, 0, A4_WIDE, A4_HEIGHT)
 }
 
 func drawTitle(pdf *gopdf.GoPdf, dictionary *specs.TranslationTable) error {
@@ -101,7 +106,7 @@ func drawTitle(pdf *gopdf.GoPdf, dictionary *specs.TranslationTable) error {
 	fontSize := 11
 	err := pdf.SetFont(FONT_BOLD, "", fontSize)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return err
 	}
 
@@ -119,7 +124,7 @@ func drawIssuer(pdf *gopdf.GoPdf, dictionary *specs.TranslationTable,
 
 	err := pdf.SetFont(FONT_BOLD, "", fontSizeTitle)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return -1, err
 	}
 	y := Y_SHIFT + 5 + 7 + SIX_PT_MM
@@ -128,7 +133,7 @@ func drawIssuer(pdf *gopdf.GoPdf, dictionary *specs.TranslationTable,
 
 	err = pdf.SetFont(FONT_REG, "", fontSizeContent)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return y, err
 	}
 	y += spacing
@@ -158,7 +163,7 @@ func drawReference(pdf *gopdf.GoPdf, dictionary *specs.TranslationTable,
 
 	err := pdf.SetFont(FONT_BOLD, "", fontSizeTitle)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return yStart, err
 	}
 	yStart += 2 * spacing
@@ -167,7 +172,7 @@ func drawReference(pdf *gopdf.GoPdf, dictionary *specs.TranslationTable,
 
 	err = pdf.SetFont(FONT_REG, "", fontSizeContent)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return yStart, err
 	}
 	yStart += spacing
@@ -183,7 +188,7 @@ func drawPayableByReceipt(pdf *gopdf.GoPdf, dictionary *specs.TranslationTable,
 
 	err := pdf.SetFont(FONT_BOLD, "", fontSizeTitle)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return yStart, err
 	}
 	yStart += 2 * spacing
@@ -192,7 +197,7 @@ func drawPayableByReceipt(pdf *gopdf.GoPdf, dictionary *specs.TranslationTable,
 
 	err = pdf.SetFont(FONT_REG, "", fontSizeContent)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return yStart, err
 	}
 	yStart += spacing
@@ -271,7 +276,7 @@ func CreatePDF(issuer *specs.AccountDetails, receipt *specs.AccountDetails,
 	fontSize = 6
 	err = pdf.SetFont(FONT_BOLD, "", fontSize)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return err
 	}
 	y = Y_SHIFT + 5 + 7 + 56 + SIX_PT_MM
@@ -282,7 +287,7 @@ func CreatePDF(issuer *specs.AccountDetails, receipt *specs.AccountDetails,
 	fontSize = 8
 	err = pdf.SetFont(FONT_REG, "", fontSize)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return err
 	}
 	y += ELEVEN_PT_MM
@@ -294,7 +299,7 @@ func CreatePDF(issuer *specs.AccountDetails, receipt *specs.AccountDetails,
 	fontSize = 6
 	err = pdf.SetFont(FONT_BOLD, "", fontSize)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return err
 	}
 
@@ -318,7 +323,7 @@ func CreatePDF(issuer *specs.AccountDetails, receipt *specs.AccountDetails,
 		fontSize = 8
 		err = pdf.SetFont(FONT_BOLD, "", fontSize)
 		if err != nil {
-			log.Print(err.Error())
+			logger.Debug("cannot render pdf", logging.Err(err))
 			return err
 		}
 		y += 2 * ELEVEN_PT_MM
@@ -327,7 +332,7 @@ func CreatePDF(issuer *specs.AccountDetails, receipt *specs.AccountDetails,
 		fontSize = 10
 		err = pdf.SetFont(FONT_REG, "", fontSize)
 		if err != nil {
-			log.Print(err.Error())
+			logger.Debug("cannot render pdf", logging.Err(err))
 			return err
 		}
 		y += ELEVEN_PT_MM
@@ -343,7 +348,7 @@ func CreatePDF(issuer *specs.AccountDetails, receipt *specs.AccountDetails,
 	fontSize = 8
 	err = pdf.SetFont(FONT_BOLD, "", fontSize)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return err
 	}
 	y = Y_SHIFT + 5 + 7 + 56 + ELEVEN_PT_MM
@@ -354,7 +359,7 @@ func CreatePDF(issuer *specs.AccountDetails, receipt *specs.AccountDetails,
 	fontSize = 10
 	err = pdf.SetFont(FONT_REG, "", fontSize)
 	if err != nil {
-		log.Print(err.Error())
+		logger.Debug("cannot render pdf", logging.Err(err))
 		return err
 	}
 	y += ELEVEN_PT_MM
@@ -363,7 +368,5 @@ func CreatePDF(issuer *specs.AccountDetails, receipt *specs.AccountDetails,
 	pdf.SetXY(62+5+15, y)
 	pdf.Text(fmt.Sprintf("%.2f", billingDetails.Amount))
 
-	pdf.WritePdf(output)
-
-	return err
+	return pdf.WritePdf(output)
 }
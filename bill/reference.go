@@ -0,0 +1,193 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bill
+
+import (
+	dbSql "database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+)
+
+const (
+	// digits of the BESR-ID and the customer number of a QRR reference, the
+	// remaining 6 of the 26 digits are the invoice number
+	REFERENCE_MAX_PREFIX = 20
+	// digits of the BESR-ID, the size of reference_sequence.besr_id
+	REFERENCE_MAX_BESR_ID = 12
+)
+
+// ReferenceStore provides the reference formats and the invoice number
+// sequences of the issuers.
+type ReferenceStore interface {
+	GetReferenceFormat(issuerId int) (*specs.ReferenceFormat, error)
+	NextInvoiceNumber(issuerId int) (int, error)
+	ReserveInvoiceNumber(issuerId int, number int) (bool, error)
+}
+
+// ValidateReferenceFormat checks the BESR-ID and the customer digits of a
+// reference format, the BESR-ID has up to 12 digits and at least 6 digits
+// are left for the invoice number.
+func ValidateReferenceFormat(f *specs.ReferenceFormat) error {
+	if strings.Trim(f.BesrId, "0123456789") != "" {
+		return Invalid(RULE_REFERENCE, "besr_id contains characters")
+	}
+	if len(f.BesrId) > REFERENCE_MAX_BESR_ID {
+		return Invalid(RULE_REFERENCE, "besr_id exceeds %d digits", REFERENCE_MAX_BESR_ID)
+	}
+	if f.CustomerDigits < 0 || len(f.BesrId)+f.CustomerDigits > REFERENCE_MAX_PREFIX {
+		return Invalid(RULE_REFERENCE, "besr_id and customer_digits exceed %d digits", REFERENCE_MAX_PREFIX)
+	}
+	return nil
+}
+
+// NeedsReference reports whether a reference is generated for a bill, it
+// is of the type QRR or SCOR and requested without a reference.
+func NeedsReference(info *Information) bool {
+	referenceType := strings.ToUpper(info.ReferenceType)
+	return info.Reference == "" &&
+		(referenceType == qr.REFERENCE_TYPE_QR || referenceType == qr.REFERENCE_TYPE_CREDITOR)
+}
+
+// PreviewReference returns a copy of the information with the reference a
+// bill requested without one would get now, so the bill is validated
+// before a number of the sequence is drawn. The sequence isn't changed,
+// the information is returned as is, if no reference is generated. See
+// DrawReference.
+func PreviewReference(store ReferenceStore, info *Information) (*Information, error) {
+	if !NeedsReference(info) {
+		return info, nil
+	}
+	reference, err := buildReference(store, info.IssuerId, info.ReferenceType, info.CustomerNumber,
+		info.InvoiceNumber, false)
+	if err != nil {
+		return nil, err
+	}
+	preview := *info
+	preview.Reference = reference
+	return &preview, nil
+}
+
+// DrawReference generates the reference of a bill requested without one
+// and sets it on the bill, see NewReference. Call it once the bill is
+// validated with PreviewReference and accepted, the drawn number is used
+// up.
+func DrawReference(store ReferenceStore, info *Information, b *specs.Bill) error {
+	if !NeedsReference(info) {
+		return nil
+	}
+	reference, err := NewReference(store, info.IssuerId, info.ReferenceType, info.CustomerNumber,
+		info.InvoiceNumber)
+	if err != nil {
+		return err
+	}
+	b.Details.Referece = reference
+	return nil
+}
+
+// NewReference builds a QRR or SCOR reference of an issuer. Without an
+// invoice number, the next number of the issuer's sequence is used, which
+// is unique over all channels. A numeric invoice number advances the
+// sequence past it, a reference issued already is rejected when the bill
+// is stored (sql.ErrDuplicateReference). QRR references start with the
+// BESR-ID and the customer number of the issuer's reference format, the
+// customer number is ignored for SCOR references.
+func NewReference(store ReferenceStore, issuerId int, referenceType string, customerNumber string,
+	invoiceNumber string) (string, error) {
+
+	return buildReference(store, issuerId, referenceType, customerNumber, invoiceNumber, true)
+}
+
+// buildReference builds a reference of the next or the given invoice
+// number. Without draw, the sequence is only read.
+func buildReference(store ReferenceStore, issuerId int, referenceType string, customerNumber string,
+	invoiceNumber string, draw bool) (string, error) {
+
+	referenceType = strings.ToUpper(referenceType)
+	if referenceType != qr.REFERENCE_TYPE_QR && referenceType != qr.REFERENCE_TYPE_CREDITOR {
+		return "", Invalid(RULE_REFERENCE, "references are generated for QRR and SCOR only")
+	}
+	format, err := store.GetReferenceFormat(issuerId)
+	if errors.Is(err, dbSql.ErrNoRows) {
+		format = &specs.ReferenceFormat{IssuerId: issuerId}
+	} else if err != nil {
+		return "", err
+	}
+
+	switch {
+	case !draw && invoiceNumber == "":
+		invoiceNumber = strconv.Itoa(format.LastNumber + 1)
+	case !draw:
+		// the invoice number of the request is used as it is
+	case invoiceNumber == "":
+		number, err := store.NextInvoiceNumber(issuerId)
+		if errors.Is(err, dbSql.ErrNoRows) {
+			return "", Invalid(RULE_ISSUER, "unknown issuer %d", issuerId)
+		} else if err != nil {
+			return "", err
+		}
+		invoiceNumber = strconv.Itoa(number)
+	default:
+		err = reserveInvoiceNumber(store, issuerId, invoiceNumber)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var reference string
+	if referenceType == qr.REFERENCE_TYPE_QR {
+		reference, err = utils.CreateQrReference(format.BesrId, customerNumber, format.CustomerDigits, invoiceNumber)
+	} else {
+		reference, err = utils.CreateCreditorReference(invoiceNumber)
+	}
+	if err != nil {
+		return "", Invalid(RULE_REFERENCE, "%s", err.Error())
+	}
+	return reference, nil
+}
+
+// reserveInvoiceNumber keeps the sequence of an issuer from handing out an
+// invoice number of a request. Numbers below the sequence, e.g. of imported
+// invoices, leave it as it is.
+func reserveInvoiceNumber(store ReferenceStore, issuerId int, invoiceNumber string) error {
+	number, ok := sequenceNumber(invoiceNumber)
+	if !ok {
+		return nil
+	}
+	_, err := store.ReserveInvoiceNumber(issuerId, number)
+	if errors.Is(err, dbSql.ErrNoRows) {
+		return Invalid(RULE_ISSUER, "unknown issuer %d", issuerId)
+	}
+	return err
+}
+
+// sequenceNumber parses an invoice number, which the sequence may hand out.
+// Invoice numbers with other characters than digits and spaces or out of
+// the range of an int never collide with the sequence.
+func sequenceNumber(invoiceNumber string) (int, bool) {
+	digits := strings.ReplaceAll(invoiceNumber, " ", "")
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return 0, false
+	}
+	number, err := strconv.Atoi(digits)
+	return number, err == nil
+}
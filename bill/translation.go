@@ -0,0 +1,66 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bill
+
+import (
+	dbSql "database/sql"
+	"errors"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+)
+
+// TranslationStore provides the texts of the bill stored in the database.
+type TranslationStore interface {
+	GetTranslationTable(languageCode string) (specs.TranslationTable, error)
+	GetIssuerTranslation(issuerId int, languageCode string) (*specs.Translation, error)
+}
+
+// Translation returns the texts of the bill of an issuer in a language. The
+// built-in texts are replaced by the ones of the translation table and of
+// the issuer. Unsupported languages are english.
+func Translation(store TranslationStore, issuerId int, languageCode string) *specs.TranslationTable {
+	languageCode = utils.ParseLanguage(languageCode)
+	if languageCode == "" {
+		languageCode = utils.LANGUAGE_DEFAULT
+	}
+	tr := utils.GetTranslationTable(languageCode)
+	if store == nil {
+		return tr
+	}
+
+	global, err := store.GetTranslationTable(languageCode)
+	if err == nil {
+		utils.MergeTranslationTable(tr, &global)
+	} else if !errors.Is(err, dbSql.ErrNoRows) {
+		logger.Warn("cannot get translation", "language", languageCode, logging.Err(err))
+	}
+
+	if issuerId <= 0 {
+		return tr
+	}
+	issuer, err := store.GetIssuerTranslation(issuerId, languageCode)
+	if err == nil {
+		utils.MergeTranslationTable(tr, &issuer.TranslationTable)
+	} else if !errors.Is(err, dbSql.ErrNoRows) {
+		logger.Warn("cannot get translation of issuer", "issuer_id", issuerId, "language", languageCode,
+			logging.Err(err))
+	}
+	return tr
+}
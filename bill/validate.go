@@ -0,0 +1,101 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bill
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/metrics"
+	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+)
+
+const (
+	// validation rules, reported in the metrics
+	RULE_ISSUER    = "issuer"
+	RULE_CURRENCY  = "currency"
+	RULE_AMOUNT    = "amount"
+	RULE_CUSTOMER  = "customer"
+	RULE_REFERENCE = "reference"
+	RULE_LANGUAGE  = "language"
+
+	MAX_AMOUNT = 999999999.99
+)
+
+// ValidationError reports a bill, which violates a rule.
+type ValidationError struct {
+	Rule string
+	Err  error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Invalid counts the violated rule and returns it as ValidationError.
+func Invalid(rule string, format string, a ...interface{}) error {
+	metrics.ValidationFailures.Inc(rule)
+	return &ValidationError{Rule: rule, Err: fmt.Errorf(format, a...)}
+}
+
+// SetDefaults completes the country of the customer (CH), the currency
+// (CHF), the reference type (NON) and the language (EN), if they are
+// missing.
+func SetDefaults(b *specs.Bill) {
+	if b.LanguageCode == "" {
+		b.LanguageCode = utils.LANGUAGE_DEFAULT
+	}
+	if b.Customer.Country == "" {
+		b.Customer.Country = qr.COUNTRY_SWITZERLAND
+	}
+	if b.Details.Currency == "" {
+		b.Details.Currency = qr.CURRENCY_SWISS_FRANCS
+	}
+	if b.Details.RefenreceType == "" {
+		b.Details.RefenreceType = qr.REFERENCE_TYPE_NO_REF
+	}
+}
+
+// Validate checks the bill against the rules of the qr bill. A violation
+// is returned as ValidationError.
+func Validate(b *specs.Bill) error {
+	if b.Details.Currency != qr.CURRENCY_SWISS_FRANCS && b.Details.Currency != qr.CURRENCY_EURO {
+		return Invalid(RULE_CURRENCY, "unsupported currency %s", b.Details.Currency)
+	}
+	if b.Details.Amount < 0 || b.Details.Amount > MAX_AMOUNT {
+		return Invalid(RULE_AMOUNT, "amount must be between 0 and %.2f", MAX_AMOUNT)
+	}
+	if b.Customer.Name == "" || b.Customer.Zip == "" || b.Customer.Location == "" {
+		return Invalid(RULE_CUSTOMER, "name, postal and city of the customer are required")
+	}
+	if utils.ParseLanguage(b.LanguageCode) != b.LanguageCode {
+		return Invalid(RULE_LANGUAGE, "unsupported language %s, use %s", b.LanguageCode,
+			strings.Join(utils.LANGUAGES, ", "))
+	}
+	err := utils.ValidateReference(b.Details.RefenreceType, b.Details.Referece)
+	if err != nil {
+		return Invalid(RULE_REFERENCE, "%s", err.Error())
+	}
+	return nil
+}
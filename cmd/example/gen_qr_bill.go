@@ -18,11 +18,15 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"strconv"
 
 	"github.com/ChrIgiSta/swiss-qr-bill/bill"
 	"github.com/ChrIgiSta/swiss-qr-bill/qr"
 	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/sql"
 	"github.com/ChrIgiSta/swiss-qr-bill/utils"
 )
 
@@ -37,7 +41,12 @@ const (
 
 func main() {
 
-	tr := utils.GetEnglishTranslationTable()
+	// DE, FR, IT or EN (default)
+	language := utils.ParseLanguage(os.Getenv("BILL_LANGUAGE"))
+	if language == "" {
+		language = utils.LANGUAGE_DEFAULT
+	}
+	tr := utils.GetTranslationTable(language)
 
 	issuer := specs.AccountDetails{
 		AddressType: qr.ADDRESS_TYPE_STRUCTURED,
@@ -67,7 +76,22 @@ func main() {
 		Amount:         660.80,
 	}
 
-	err := utils.ValidateReference(billingDetails.RefenreceType, billingDetails.Referece)
+	var (
+		db  *sql.Db
+		err error
+	)
+	if os.Getenv("SQL_HOST") != "" || os.Getenv("SQL_DRIVER") != "" {
+		db, err = sql.NewFromEnv()
+		if err != nil {
+			log.Fatal("cannot open db: ", err)
+		}
+		err = db.Connect()
+		if err != nil {
+			log.Fatal("cannot connect to db: ", err)
+		}
+	}
+
+	err = utils.ValidateReference(billingDetails.RefenreceType, billingDetails.Referece)
 	if err != nil {
 		log.Fatal("invalide reference: ", err)
 	}
@@ -77,10 +101,40 @@ func main() {
 		log.Fatal("invalide iban: ", err)
 	}
 
-	sQr := qr.NewSwissBillQr(&issuer)
+	issuerId, _ := strconv.Atoi(os.Getenv("BILL_ISSUER_ID"))
+	bills := []*specs.Bill{
+		{IssuerId: issuerId, Channel: bill.CHANNEL_CLI, QrFile: OUT_QR, PdfFile: OUT_PDF},
+		{IssuerId: issuerId, Channel: bill.CHANNEL_CLI, QrFile: OUT_QR, PdfFile: OUT_PDF_FROM_BILL_PDF},
+	}
+	existingPdfs := []interface{}{nil, "graphics/pdf-bill-example.pdf"}
 
-	sQr.GetSwissPaymentQR(&receipt, &billingDetails, OUT_QR)
+	for i, b := range bills {
+		b.LanguageCode = language
+		b.Issuer = issuer
+		b.Customer = receipt
+		b.Details = billingDetails
+		// take the references from the sequence of the issuer BILL_ISSUER_ID,
+		// the references of an issuer are unique
+		if db != nil && issuerId > 0 {
+			b.Details.Referece, err = bill.NewReference(db, issuerId, qr.REFERENCE_TYPE_QR, "", "")
+			if err != nil {
+				log.Fatal("cannot generate reference: ", err)
+			}
+		}
+		err = bill.Generate(context.Background(), b, tr, existingPdfs[i])
+		if err != nil {
+			log.Fatal("cannot generate bill: ", err)
+		}
+	}
 
-	bill.CreatePDF(&issuer, &receipt, &billingDetails, OUT_QR, OUT_PDF, tr, nil)
-	bill.CreatePDF(&issuer, &receipt, &billingDetails, OUT_QR, OUT_PDF_FROM_BILL_PDF, tr, "graphics/pdf-bill-example.pdf")
+	// keep a history of the generated bills, if a database is configured
+	if db != nil {
+		for _, b := range bills {
+			err = db.InsertBill(b)
+			if err != nil {
+				log.Fatal("cannot store bill: ", err)
+			}
+			log.Println("stored bill with id ", b.Id)
+		}
+	}
 }
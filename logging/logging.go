@@ -0,0 +1,196 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	KEY_REQUEST_ID = "request_id"
+	KEY_MAIL_ID    = "mail_id"
+	KEY_ERROR      = "err"
+
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+
+	REDACTED = "[REDACTED]"
+)
+
+type ctxKey int
+
+const (
+	ctxRequestId ctxKey = iota
+	ctxMailId
+)
+
+var (
+	// attributes with these keys (or suffixes) are never logged
+	SENSITIVE_KEYS = []string{"password", "secret", "token", "authorization", "x-api-key", "key_file", "dsn"}
+
+	ibanPattern = regexp.MustCompile(`\b[A-Z]{2}[0-9]{2}(?: ?[A-Z0-9]){11,30}\b`)
+	dsnPattern  = regexp.MustCompile(`([^\s:/@]+):([^\s@]*)@(tcp|unix)\(`)
+)
+
+// New creates a logger writing to w. format is FORMAT_TEXT or FORMAT_JSON.
+// Secrets and ibans are redacted and correlation ids of the context are
+// added to every record.
+func New(w io.Writer, level slog.Leveler, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+
+	var handler slog.Handler
+	if format == FORMAT_JSON {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(&contextHandler{handler})
+}
+
+// FromEnv creates a logger to stderr configured by LOG_LEVEL (debug, info,
+// warn, error) and LOG_FORMAT (text, json).
+func FromEnv() *slog.Logger {
+	return New(os.Stderr, ParseLevel(os.Getenv("LOG_LEVEL")), strings.ToLower(os.Getenv("LOG_FORMAT")))
+}
+
+// ParseLevel returns the level by name, info is the default.
+func ParseLevel(level string) slog.Level {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// Err is the attribute for errors.
+func Err(err error) slog.Attr {
+	return slog.Any(KEY_ERROR, err)
+}
+
+// NewId returns a random id for correlating log records.
+func NewId() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxRequestId, id)
+}
+
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(ctxRequestId).(string)
+	return id
+}
+
+func WithMailId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxMailId, id)
+}
+
+func MailId(ctx context.Context) string {
+	id, _ := ctx.Value(ctxMailId).(string)
+	return id
+}
+
+// RedactString masks ibans and passwords of connection strings in s.
+func RedactString(s string) string {
+	s = dsnPattern.ReplaceAllString(s, "$1:"+REDACTED+"@$3(")
+	return ibanPattern.ReplaceAllStringFunc(s, func(iban string) string {
+		// keep country, check digits and the last 4 characters
+		iban = strings.ReplaceAll(iban, " ", "")
+		return iban[:4] + strings.Repeat("*", len(iban)-8) + iban[len(iban)-4:]
+	})
+}
+
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range SENSITIVE_KEYS {
+		if key == s || strings.HasSuffix(key, "_"+s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if sensitive(a.Key) {
+		return slog.String(a.Key, REDACTED)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, RedactString(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			return slog.Any(a.Key, redactedError{v})
+		case []byte:
+			return slog.String(a.Key, RedactString(string(v)))
+		}
+	}
+	return a
+}
+
+type redactedError struct {
+	err error
+}
+
+func (e redactedError) Error() string {
+	return RedactString(e.err.Error())
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
+
+// contextHandler adds the correlation ids of the context to the records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestId(ctx); id != "" {
+		r.AddAttrs(slog.String(KEY_REQUEST_ID, id))
+	}
+	if id := MailId(ctx); id != "" {
+		r.AddAttrs(slog.String(KEY_MAIL_ID, id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
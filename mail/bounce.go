@@ -0,0 +1,114 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+const (
+	MIME_TYPE_REPORT          = "multipart/report"
+	MIME_TYPE_DELIVERY_STATUS = "message/delivery-status"
+	MIME_TYPE_RFC822          = "message/rfc822"
+	MIME_TYPE_RFC822_HEADERS  = "text/rfc822-headers"
+
+	REPORT_TYPE_DELIVERY_STATUS = "delivery-status"
+
+	BOUNCE_ACTION_FAILED = "failed"
+
+	MAX_REPORT_SIZE = 1000000
+)
+
+// Bounce is a delivery status notification (RFC 3464) of a sent mail.
+type Bounce struct {
+	MessageId  string // of the sent mail
+	Recipient  string
+	Action     string // failed, delayed, delivered, relayed or expanded
+	Status     string // e.g. 5.1.1
+	Diagnostic string // reason given by the remote server
+}
+
+// IsReport reports whether a mail is a delivery status notification.
+func IsReport(header message.Header) bool {
+	mediaType, params, _ := header.ContentType()
+	return mediaType == MIME_TYPE_REPORT && strings.EqualFold(params["report-type"], REPORT_TYPE_DELIVERY_STATUS)
+}
+
+// Failed reports whether the mail could not be delivered, other actions
+// like delayed are informational.
+func (b *Bounce) Failed() bool {
+	return strings.EqualFold(b.Action, BOUNCE_ACTION_FAILED)
+}
+
+// parseReportPart fills in the bounce from a part of a notification, the
+// delivery status or the returned mail or its header.
+func (b *Bounce) parseReportPart(mediaType string, body io.Reader) error {
+	switch mediaType {
+	case MIME_TYPE_DELIVERY_STATUS:
+		return b.parseDeliveryStatus(body)
+	case MIME_TYPE_RFC822, MIME_TYPE_RFC822_HEADERS:
+		header, err := readHeader(body)
+		if err != nil {
+			return err
+		}
+		b.MessageId = strings.Trim(strings.TrimSpace(header.Get("Message-Id")), "<>")
+	}
+	return nil
+}
+
+// parseDeliveryStatus reads the per-message fields and the fields of the
+// first recipient.
+func (b *Bounce) parseDeliveryStatus(body io.Reader) error {
+	r := textproto.NewReader(bufio.NewReader(io.LimitReader(body, MAX_REPORT_SIZE)))
+	for b.Action == "" {
+		fields, err := r.ReadMIMEHeader()
+		if len(fields) == 0 {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		b.Recipient = typedValue(fields.Get("Final-Recipient"))
+		b.Action = strings.ToLower(strings.TrimSpace(fields.Get("Action")))
+		b.Status = strings.TrimSpace(fields.Get("Status"))
+		b.Diagnostic = typedValue(fields.Get("Diagnostic-Code"))
+		if err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+func readHeader(body io.Reader) (textproto.MIMEHeader, error) {
+	// the header ends at the first empty line, which text/rfc822-headers lacks
+	r := io.MultiReader(io.LimitReader(body, MAX_REPORT_SIZE), strings.NewReader("\r\n\r\n"))
+	return textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+}
+
+// typedValue strips the type of a field like "rfc822; user@example.com".
+func typedValue(field string) string {
+	if i := strings.Index(field, ";"); i >= 0 {
+		field = field[i+1:]
+	}
+	return strings.TrimSpace(field)
+}
@@ -18,19 +18,15 @@
 package mail
 
 import (
-	"bufio"
-	"encoding/base64"
-	"errors"
+	"context"
 	"fmt"
-	"io"
-	"log"
-	"os"
+	"log/slog"
 	"strconv"
 	"strings"
 
+	"github.com/ChrIgiSta/swiss-qr-bill/bill"
 	"github.com/ChrIgiSta/swiss-qr-bill/qr"
 	"github.com/ChrIgiSta/swiss-qr-bill/specs"
-	"github.com/knadh/go-pop3"
 	gomail "gopkg.in/mail.v2"
 )
 
@@ -39,58 +35,123 @@ const (
 	MIME_TYPE_HTML = "text/html"
 	MIME_TYPE_JSON = "application/json"
 	MIME_TYPE_PDF  = "application/pdf"
+	MIME_TYPE_CSV  = "text/csv"
+
+	MIME_TYPE_OCTET_STREAM = "application/octet-stream"
 
 	MAX_DOWNLOAD_SIZE = 100000000
+
+	SECURITY_TLS      = "TLS"      // implicit tls
+	SECURITY_STARTTLS = "STARTTLS" // plaintext connection upgraded to tls
+	SECURITY_NONE     = "NONE"     // plaintext, e.g. for local test servers
+
+	SMTP_PORT          = 587
+	SMTP_PORT_TLS      = 465
+	POP3_PORT          = 995
+	IMAP_PORT          = 993
+	IMAP_PORT_STARTTLS = 143
 )
 
 type Client struct {
-	Username   string
-	Password   string
-	From       string
-	SmtpSecure bool
-	ImapSecure bool
-	SmtpServer string
-	SmtpPort   uint16
-	Pop3Server string
-	Pop3Port   uint16
-	Token      string
+	Username     string
+	Password     string
+	From         string
+	SenderName   string // display name in the From header
+	SmtpSecurity string
+	SmtpServer   string
+	SmtpPort     int
+	Token        string
+	IssuerId     int                 // replies use the templates of this issuer
+	Language     string              // of the replies, if the request has no Content-Language
+	Templates    TemplateStore       // optional, the built-in templates are used otherwise
+	References   bill.ReferenceStore // optional, requests without a QRR or SCOR reference are rejected otherwise
+
+	// pdf attachments of received mails are stored here
+	AttachmentDir string
+	Mailbox       Mailbox
+
+	log *slog.Logger
 }
 
 type Attachments struct {
-	FileName string
+	FileName string // path of the file
+	Name     string // original file name
 	MimeTyoe string
 }
 type Message struct {
+	Id           string // Message-Id or a generated id, to correlate logs
+	InReplyTo    string // Message-Id of the answered mail
 	To           []string
 	CC           []string
 	BCC          []string
 	Subject      string
 	Body         string
 	BodyMimeType string
+	HtmlBody     string // optional alternative to a text body
+	Language     string // Content-Language of a received mail
 	Attachments  []Attachments
+	From         string         // sender address of a received mail
+	Auth         Authentication // sender authentication of a received mail
+	Bounce       *Bounce        // set, if a received mail is a delivery status notification
 }
 
+// NewMailClient creates a client with STARTTLS on port 587 for SMTP and TLS
+// on port 995 for POP3, see NewMailClientFromConfig.
 func NewMailClient(username string, password string, from string,
-	smtpHost string, imapHost string, token string) *Client {
-	return &Client{
+	smtpHost string, pop3Host string, token string) *Client {
+	return NewMailClientFromConfig(specs.MailConfig{
 		Username:   username,
 		Password:   password,
-		From:       from,
+		Email:      from,
 		SmtpSecure: true,
-		ImapSecure: true,
-		SmtpServer: smtpHost,
-		SmtpPort:   587, // 465 SSL/TLS | 587 STARTTLS
-		Pop3Server: imapHost,
-		Pop3Port:   995, // 993 Imap | 995 pop3
+		SmtpHost:   smtpHost,
+		Pop3Secure: true,
+		Pop3Host:   pop3Host,
 		Token:      token,
+	})
+}
+
+// NewMailClientFromConfig creates a client and its mailbox from a mail
+// configuration. Secure SMTP uses implicit TLS on port 465 and STARTTLS on
+// other ports, otherwise plaintext is used. Unset ports get the defaults.
+func NewMailClientFromConfig(cnf specs.MailConfig) *Client {
+	c := &Client{
+		Username:      cnf.Username,
+		Password:      cnf.Password,
+		From:          cnf.Email,
+		SenderName:    cnf.SenderName,
+		SmtpSecurity:  SECURITY_NONE,
+		SmtpServer:    cnf.SmtpHost,
+		SmtpPort:      orDefaultPort(cnf.SmtpPort, SMTP_PORT),
+		Token:         cnf.Token,
+		IssuerId:      cnf.IssuerId,
+		Language:      cnf.LanguageCode,
+		AttachmentDir: ATTACHMENT_DIR,
+		log:           slog.Default(),
+	}
+	if cnf.SmtpSecure && c.SmtpPort == SMTP_PORT_TLS {
+		c.SmtpSecurity = SECURITY_TLS
+	} else if cnf.SmtpSecure {
+		c.SmtpSecurity = SECURITY_STARTTLS
 	}
+	c.Mailbox = NewMailbox(cnf, c.AttachmentDir, c.log)
+	return c
+}
+
+// SetLogger replaces the default logger.
+func (c *Client) SetLogger(logger *slog.Logger) {
+	c.log = logger
 }
 
 func (c *Client) SendEmail(msg Message) error {
 
 	m := gomail.NewMessage()
 
-	m.SetHeader("From", c.From)
+	if c.SenderName != "" {
+		m.SetAddressHeader("From", c.From, c.SenderName)
+	} else {
+		m.SetHeader("From", c.From)
+	}
 	m.SetHeader("To", msg.To...)
 
 	if len(msg.CC) > 0 {
@@ -101,196 +162,88 @@ func (c *Client) SendEmail(msg Message) error {
 	}
 
 	m.SetHeader("Subject", msg.Subject)
-
-	m.SetBody(msg.BodyMimeType, msg.Body)
-
-	d := gomail.NewDialer(c.SmtpServer, int(c.SmtpPort), c.Username, c.Password)
-
-	if msg.Attachments != nil && len(msg.Attachments) > 0 {
-		for _, a := range msg.Attachments {
-			m.Attach(a.FileName)
-		}
-	}
-
-	// d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-	// d.SSL = c.SmtpSecure
-	// d.StartTLSPolicy = gomail.MandatoryStartTLS
-
-	return d.DialAndSend(m)
-}
-
-func (c *Client) GetMails() ([]Message, error) {
-	var messages []Message = []Message{}
-	var idsToDelete []int = []int{}
-
-	opt := pop3.Opt{
-		Host:       c.Pop3Server,
-		Port:       int(c.Pop3Port),
-		TLSEnabled: true,
+	if msg.Id != "" {
+		m.SetHeader("Message-Id", "<"+msg.Id+">")
 	}
-
-	pop := pop3.New(opt)
-
-	conn, err := pop.NewConn()
-	if err != nil {
-		return nil, err
+	if msg.InReplyTo != "" {
+		m.SetHeader("In-Reply-To", "<"+msg.InReplyTo+">")
+		m.SetHeader("References", "<"+msg.InReplyTo+">")
 	}
-	defer conn.Quit()
 
-	if err := conn.Auth(c.Username, c.Password); err != nil {
-		return nil, err
+	m.SetBody(msg.BodyMimeType, msg.Body)
+	if msg.HtmlBody != "" {
+		m.AddAlternative(MIME_TYPE_HTML, msg.HtmlBody)
 	}
 
-	count, size, _ := conn.Stat()
-	if size > MAX_DOWNLOAD_SIZE {
-		return nil, errors.New("max download size.")
+	d := gomail.NewDialer(c.SmtpServer, c.SmtpPort, c.Username, c.Password)
+	switch c.SmtpSecurity {
+	case SECURITY_TLS:
+		d.SSL = true
+	case SECURITY_STARTTLS:
+		d.SSL = false
+		d.StartTLSPolicy = gomail.MandatoryStartTLS
+	default:
+		d.SSL = false
+		d.StartTLSPolicy = gomail.NoStartTLS
 	}
 
-	for id := 1; id <= count; id++ {
-		m, _ := conn.Retr(id)
-
-		if m.Header.Get("subject") == c.Token {
-			log.Println("qr mail found")
-			idsToDelete = append(idsToDelete, id)
-
-			to := []string{m.Header.Get("from")}
-			body, err := io.ReadAll(m.Body)
-
-			if err != nil {
-				return nil, err
-			}
-			msg := Message{
-				To:      to,
-				Subject: m.Header.Get("subject"),
-			}
-
-			newL := strings.Index(string(body), "\n")
-			hash := string(body)[0:newL]
-			fmt.Println(hash)
-			splitedMimes := strings.Split(string(body), hash)
-
-			for _, mime := range splitedMimes {
-				cT := getKey(mime, "Content-Type")
-				log.Println("Content Type of MIME: ", cT)
-				if strings.Contains(cT, MIME_TYPE_PDF) {
-					log.Printf("pdf found")
-					enc := getKey(mime, "Content-Transfer-Encoding")
-					content, _ := extractContentFromHeader(mime)
-					if strings.Contains(enc, "base64") {
-						log.Println("base64 encoded")
-						dec, err := base64.StdEncoding.DecodeString(content)
-						if err != nil {
-							return nil, err
-						}
-						content = string(dec)
-					}
-					start := strings.Index(cT, `name=`)
-					end := strings.Index(cT, `.pdf`)
-					fileName := cT[start+6 : end+4]
-					os.WriteFile(fileName, []byte(content), 0644)
-					msg.Attachments = []Attachments{}
-					msg.Attachments = append(msg.Attachments, Attachments{
-						FileName: fileName,
-						MimeTyoe: MIME_TYPE_PDF,
-					})
-				} else if strings.Contains(cT, MIME_TYPE_TEXT) {
-					content, _ := extractContentFromHeader(mime)
-					msg.BodyMimeType = MIME_TYPE_TEXT
-					msg.Body = content
-					log.Println(content)
-
-				} else if strings.Contains(cT, MIME_TYPE_JSON) {
-					content, _ := extractContentFromHeader(mime)
-					msg.BodyMimeType = MIME_TYPE_JSON
-					msg.Body = content
-					log.Println(content)
-				}
+	if msg.Attachments != nil && len(msg.Attachments) > 0 {
+		for _, a := range msg.Attachments {
+			if a.Name != "" {
+				m.Attach(a.FileName, gomail.Rename(a.Name))
+			} else {
+				m.Attach(a.FileName)
 			}
-
-			messages = append(messages, msg)
 		}
 	}
 
-	for _, idToDel := range idsToDelete {
-		conn.Dele(idToDel)
-	}
+	return d.DialAndSend(m)
+}
 
-	return messages, nil
+// Receive passes the mails with the token as subject to handle, see
+// Mailbox.
+func (c *Client) Receive(ctx context.Context, handle Handler) error {
+	return c.Mailbox.Receive(ctx, c.Token, handle)
 }
 
+// getKey returns the value of the line "key: value" of a body, without the
+// surrounding spaces. Missing keys and empty values are "".
 func getKey(msg string, key string) string {
 	start := strings.Index(msg, key+":")
 	if start == -1 {
 		return ""
 	}
 
-	stop := strings.Index(msg[start:], "\n")
-	if stop == -1 {
-		return ""
+	value := msg[start+len(key)+1:]
+	if stop := strings.IndexAny(value, "\r\n"); stop != -1 {
+		value = value[:stop]
 	}
-
-	stop += start
-	start += len(key + ": ")
-
-	return msg[start:stop]
-}
-
-func extractContentFromHeader(part string) (string, string) {
-	var (
-		err             error
-		line            string
-		contentSel      bool = false
-		header, content string
-		lineNum         int = 0
-	)
-
-	reader := strings.NewReader(part)
-
-	in := bufio.NewReader(reader)
-
-	for err == nil {
-		line, err = in.ReadString('\n')
-		if (line == "\n" || line == "\r\n" || line == "\n\r") && lineNum > 0 {
-			contentSel = true
-		} else if !strings.Contains(line, "--") {
-			if contentSel {
-				content += line
-			} else {
-				header += line
-			}
-		}
-		lineNum++
-	}
-	fmt.Println(err)
-	return strings.Replace(content, line, "", 1), header
+	return strings.TrimSpace(value)
 }
 
 func (c *Client) GetBillingInformationsFromBody(body string) (specs.AccountDetails, specs.BillingDetails, error) {
 	account := specs.AccountDetails{
-		Name:        removeNewlines(getKey(body, "Name")),
+		Name:        getKey(body, "Name"),
 		AddressType: qr.ADDRESS_TYPE_STRUCTURED,
-		Address1:    removeNewlines(getKey(body, "Address1")),
-		Address2:    removeNewlines(getKey(body, "Address2")),
-		Zip:         removeNewlines(getKey(body, "Zip")),
-		Location:    removeNewlines(getKey(body, "Location")),
-		Country:     removeNewlines(getKey(body, "Country")),
+		Address1:    getKey(body, "Address1"),
+		Address2:    getKey(body, "Address2"),
+		Zip:         getKey(body, "Zip"),
+		Location:    getKey(body, "Location"),
+		Country:     getKey(body, "Country"),
 	}
 
 	amount, err := strconv.ParseFloat(getKey(body, "Amount"), 64)
+	if err != nil {
+		err = fmt.Errorf("invalid amount %q", getKey(body, "Amount"))
+	}
 
 	billingDetails := specs.BillingDetails{
-		RefenreceType:  removeNewlines(getKey(body, "ReferenceType")),
-		Referece:       removeNewlines(getKey(body, "Reference")),
-		AdditionalInfo: removeNewlines(getKey(body, "AdditionalInformations")),
-		Currency:       removeNewlines(getKey(body, "Currency")),
+		RefenreceType:  getKey(body, "ReferenceType"),
+		Referece:       getKey(body, "Reference"),
+		AdditionalInfo: getKey(body, "AdditionalInformations"),
+		Currency:       getKey(body, "Currency"),
 		Amount:         amount,
 	}
 
 	return account, billingDetails, err
 }
-
-func removeNewlines(in string) string {
-	out := strings.ReplaceAll(in, "\r", "")
-	out = strings.ReplaceAll(out, "\n", "")
-	return out
-}
@@ -0,0 +1,257 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
+	gomessage "github.com/emersion/go-message/mail"
+)
+
+// ImapMailbox receives mails of a folder by IMAP. Handled mails are moved to
+// the processed or failed folder. Wait uses IDLE, so new mails are handled
+// right away.
+type ImapMailbox struct {
+	Host            string
+	Port            int
+	Secure          bool
+	Username        string
+	Password        string
+	Folder          string
+	ProcessedFolder string
+	FailedFolder    string
+	AttachmentDir   string
+
+	log    *slog.Logger
+	c      *client.Client
+	notify chan struct{}
+}
+
+func (m *ImapMailbox) Receive(ctx context.Context, subject string, handle Handler) error {
+	err := m.connect()
+	if err != nil {
+		return err
+	}
+	// updates until now are covered by the search
+	select {
+	case <-m.notify:
+	default:
+	}
+
+	requests := imap.NewSearchCriteria()
+	requests.Header.Add("Subject", subject)
+	reports := imap.NewSearchCriteria()
+	reports.Header.Add("Content-Type", MIME_TYPE_REPORT)
+	criteria := imap.NewSearchCriteria()
+	criteria.Or = [][2]*imap.SearchCriteria{{requests, reports}}
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	uids, err := m.c.UidSearch(criteria)
+	if err != nil {
+		m.reset()
+		return err
+	}
+
+	for _, uid := range uids {
+		if ctx.Err() != nil {
+			break
+		}
+		err = m.receive(uid, subject, handle)
+		if err != nil {
+			m.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ImapMailbox) receive(uid uint32, subject string, handle Handler) error {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	section := &imap.BodySectionName{Peek: true}
+
+	messages := make(chan *imap.Message, 1)
+	err := m.c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages)
+	if err != nil {
+		return err
+	}
+	fetched := <-messages
+	if fetched == nil || fetched.GetBody(section) == nil {
+		return fmt.Errorf("mail %d not found", uid)
+	}
+
+	raw, err := io.ReadAll(fetched.GetBody(section))
+	if err != nil {
+		return err
+	}
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		m.log.Warn("cannot read mail", "uid", uid, logging.Err(err))
+		return m.c.UidMove(seqset, m.FailedFolder)
+	}
+	// the search matches substrings
+	header := gomessage.Header{Header: entity.Header}
+	s, _ := header.Subject()
+	if strings.TrimSpace(s) != subject && !IsReport(entity.Header) {
+		return nil
+	}
+
+	msg, err := ParseEntity(entity, m.AttachmentDir)
+	msg.Auth = Authenticate(raw)
+	defer msg.RemoveAttachments()
+	if err != nil {
+		m.log.Warn("cannot parse mail", logging.KEY_MAIL_ID, msg.Id, logging.Err(err))
+		return m.c.UidMove(seqset, m.FailedFolder)
+	}
+
+	folder := m.FailedFolder
+	if handle(&msg) {
+		folder = m.ProcessedFolder
+	}
+	return m.c.UidMove(seqset, folder)
+}
+
+// Wait idles until the server reports a change of the folder.
+func (m *ImapMailbox) Wait(ctx context.Context, timeout time.Duration) error {
+	err := m.connect()
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- m.c.Idle(stop, nil)
+	}()
+
+	select {
+	case <-m.notify:
+	case <-ctx.Done():
+	case <-time.After(timeout):
+	case err = <-done:
+		m.reset()
+		return err
+	}
+
+	close(stop)
+	err = <-done
+	if err != nil {
+		m.reset()
+	}
+	return err
+}
+
+func (m *ImapMailbox) Close() error {
+	if m.c == nil {
+		return nil
+	}
+	err := m.c.Logout()
+	m.c = nil
+	return err
+}
+
+func (m *ImapMailbox) connect() error {
+	if m.c != nil {
+		return nil
+	}
+
+	var (
+		c    *client.Client
+		err  error
+		addr = net.JoinHostPort(m.Host, fmt.Sprint(m.Port))
+	)
+	dialer := &net.Dialer{Timeout: DIAL_TIMEOUT}
+	if m.Secure && m.Port != IMAP_PORT_STARTTLS {
+		c, err = client.DialWithDialerTLS(dialer, addr, &tls.Config{ServerName: m.Host})
+	} else {
+		c, err = client.DialWithDialer(dialer, addr)
+	}
+	if err != nil {
+		return err
+	}
+	if m.Secure && m.Port == IMAP_PORT_STARTTLS {
+		err = c.StartTLS(&tls.Config{ServerName: m.Host})
+		if err != nil {
+			c.Logout()
+			return err
+		}
+	}
+	c.ErrorLog = slog.NewLogLogger(m.log.Handler(), slog.LevelWarn)
+
+	err = c.Login(m.Username, m.Password)
+	if err != nil {
+		c.Logout()
+		return err
+	}
+
+	// the folders may exist already
+	for _, folder := range []string{m.ProcessedFolder, m.FailedFolder} {
+		if err := c.Create(folder); err != nil {
+			m.log.Debug("cannot create folder", "folder", folder, logging.Err(err))
+		}
+	}
+
+	_, err = c.Select(m.Folder, false)
+	if err != nil {
+		c.Logout()
+		return err
+	}
+
+	// updates must be consumed, otherwise the client blocks
+	updates := make(chan client.Update, 16)
+	m.notify = make(chan struct{}, 1)
+	go func(notify chan struct{}) {
+		for {
+			select {
+			case update := <-updates:
+				if _, ok := update.(*client.MailboxUpdate); !ok {
+					continue
+				}
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			case <-c.LoggedOut():
+				return
+			}
+		}
+	}(m.notify)
+	c.Updates = updates
+
+	m.c = c
+	return nil
+}
+
+// reset drops a broken connection, it is reopened on the next call.
+func (m *ImapMailbox) reset() {
+	if m.c != nil {
+		m.c.Terminate()
+		m.c = nil
+	}
+}
@@ -0,0 +1,107 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+const (
+	PROTOCOL_POP3 = "POP3"
+	PROTOCOL_IMAP = "IMAP"
+
+	FOLDER_INBOX     = "INBOX"
+	FOLDER_PROCESSED = "Processed"
+	FOLDER_FAILED    = "Failed"
+
+	DIAL_TIMEOUT = 30 * time.Second
+)
+
+// Handler processes a received mail and reports whether it succeeded.
+type Handler func(msg *Message) bool
+
+// Mailbox is the source of the mail requests.
+type Mailbox interface {
+	// Receive passes each mail with the given subject and each delivery
+	// status notification to handle. Handled
+	// mails are removed from the inbox. If supported, they are kept in the
+	// processed or failed folder, depending on the result of handle.
+	Receive(ctx context.Context, subject string, handle Handler) error
+	// Wait blocks until new mails might have arrived, the timeout elapsed
+	// or ctx is done.
+	Wait(ctx context.Context, timeout time.Duration) error
+	Close() error
+}
+
+// NewMailbox creates the mailbox of the configured protocol (POP3 is the
+// default). Secure IMAP uses STARTTLS on port 143 and implicit TLS on other
+// ports, secure POP3 implicit TLS. Pdf attachments are stored in
+// attachmentDir.
+func NewMailbox(cnf specs.MailConfig, attachmentDir string, logger *slog.Logger) Mailbox {
+	if cnf.Protocol == PROTOCOL_IMAP {
+		return &ImapMailbox{
+			Host:            cnf.ImapHost,
+			Port:            orDefaultPort(cnf.ImapPort, IMAP_PORT),
+			Secure:          cnf.ImapSecure,
+			Username:        cnf.Username,
+			Password:        cnf.Password,
+			Folder:          orDefault(cnf.ImapFolder, FOLDER_INBOX),
+			ProcessedFolder: orDefault(cnf.ProcessedFolder, FOLDER_PROCESSED),
+			FailedFolder:    orDefault(cnf.FailedFolder, FOLDER_FAILED),
+			AttachmentDir:   attachmentDir,
+			log:             logger,
+		}
+	}
+	return &Pop3Mailbox{
+		Host:          cnf.Pop3Host,
+		Port:          orDefaultPort(cnf.Pop3Port, POP3_PORT),
+		Secure:        cnf.Pop3Secure,
+		Username:      cnf.Username,
+		Password:      cnf.Password,
+		AttachmentDir: attachmentDir,
+		log:           logger,
+	}
+}
+
+// waitTimeout blocks until the timeout elapsed or ctx is done.
+func waitTimeout(ctx context.Context, timeout time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+func orDefaultPort(port int, def int) int {
+	if port <= 0 {
+		return def
+	}
+	return port
+}
@@ -0,0 +1,337 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mailtest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+const IMAP_DELIMITER = "/"
+
+// imapBackend serves the folders of the server by IMAP. Appended mails are
+// announced to idling clients.
+type imapBackend struct {
+	s *Server
+}
+
+type imapUser struct {
+	s *Server
+}
+
+type imapMailbox struct {
+	s    *Server
+	name string
+}
+
+func (b *imapBackend) Login(_ *imap.ConnInfo, username string, password string) (backend.User, error) {
+	if b.s.login(username, password) != nil {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return &imapUser{s: b.s}, nil
+}
+
+func (b *imapBackend) Updates() <-chan backend.Update {
+	return b.s.updates
+}
+
+func (u *imapUser) Username() string {
+	return u.s.Username
+}
+
+func (u *imapUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	u.s.mutex.Lock()
+	defer u.s.mutex.Unlock()
+
+	mailboxes := []backend.Mailbox{}
+	for name := range u.s.folders {
+		mailboxes = append(mailboxes, &imapMailbox{s: u.s, name: name})
+	}
+	return mailboxes, nil
+}
+
+func (u *imapUser) GetMailbox(name string) (backend.Mailbox, error) {
+	u.s.mutex.Lock()
+	defer u.s.mutex.Unlock()
+
+	if _, ok := u.s.folders[name]; !ok {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return &imapMailbox{s: u.s, name: name}, nil
+}
+
+func (u *imapUser) CreateMailbox(name string) error {
+	u.s.mutex.Lock()
+	defer u.s.mutex.Unlock()
+
+	if _, ok := u.s.folders[name]; ok {
+		return backend.ErrMailboxAlreadyExists
+	}
+	u.s.folders[name] = &folder{uidNext: 1}
+	return nil
+}
+
+func (u *imapUser) DeleteMailbox(name string) error {
+	return errors.New("not supported")
+}
+
+func (u *imapUser) RenameMailbox(existingName string, newName string) error {
+	return errors.New("not supported")
+}
+
+func (u *imapUser) Logout() error {
+	return nil
+}
+
+func (m *imapMailbox) Name() string {
+	return m.name
+}
+
+func (m *imapMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: IMAP_DELIMITER, Name: m.name}, nil
+}
+
+func (m *imapMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	f, err := m.folder()
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mutex.Unlock()
+
+	status := imap.NewMailboxStatus(m.name, items)
+	status.Flags = []string{imap.SeenFlag, imap.DeletedFlag}
+	status.PermanentFlags = []string{"\\*"}
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(f.mails))
+		case imap.StatusUidNext:
+			status.UidNext = f.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = 1
+		}
+	}
+	return status, nil
+}
+
+func (m *imapMailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+func (m *imapMailbox) Check() error {
+	return nil
+}
+
+func (m *imapMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem,
+	ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	f, err := m.folder()
+	if err != nil {
+		return err
+	}
+	messages := []*imap.Message{}
+	for i, mail := range f.mails {
+		if !seqSet.Contains(id(uid, i, mail)) {
+			continue
+		}
+		msg, err := fetch(uint32(i+1), mail, items)
+		if err != nil {
+			m.s.mutex.Unlock()
+			return err
+		}
+		messages = append(messages, msg)
+	}
+	m.s.mutex.Unlock()
+
+	for _, msg := range messages {
+		ch <- msg
+	}
+	return nil
+}
+
+func (m *imapMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	f, err := m.folder()
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mutex.Unlock()
+
+	ids := []uint32{}
+	for i, mail := range f.mails {
+		entity, err := message.Read(bytes.NewReader(mail.raw))
+		if err != nil && !message.IsUnknownCharset(err) {
+			continue
+		}
+		ok, err := backendutil.Match(entity, uint32(i+1), mail.uid, mail.date, mail.flags, criteria)
+		if err == nil && ok {
+			ids = append(ids, id(uid, i, mail))
+		}
+	}
+	return ids, nil
+}
+
+func (m *imapMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return m.s.append(m.name, raw, flags, date)
+}
+
+func (m *imapMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, operation imap.FlagsOp,
+	flags []string) error {
+	f, err := m.folder()
+	if err != nil {
+		return err
+	}
+	defer m.s.mutex.Unlock()
+
+	for i, mail := range f.mails {
+		if seqSet.Contains(id(uid, i, mail)) {
+			mail.flags = backendutil.UpdateFlags(mail.flags, operation, flags)
+		}
+	}
+	return nil
+}
+
+func (m *imapMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	_, err := m.copy(uid, seqSet, dest)
+	return err
+}
+
+// MoveMessages implements backend.MoveMailbox.
+func (m *imapMailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	moved, err := m.copy(uid, seqSet, dest)
+	if err != nil {
+		return err
+	}
+	m.s.remove(m.name, func(mail *storedMail) bool {
+		return moved[mail]
+	})
+	return nil
+}
+
+func (m *imapMailbox) Expunge() error {
+	m.s.remove(m.name, func(mail *storedMail) bool {
+		for _, flag := range mail.flags {
+			if flag == imap.DeletedFlag {
+				return true
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// copy appends the selected mails to dest and returns them.
+func (m *imapMailbox) copy(uid bool, seqSet *imap.SeqSet, dest string) (map[*storedMail]bool, error) {
+	f, err := m.folder()
+	if err != nil {
+		return nil, err
+	}
+	selected := map[*storedMail]bool{}
+	for i, mail := range f.mails {
+		if seqSet.Contains(id(uid, i, mail)) {
+			selected[mail] = true
+		}
+	}
+	m.s.mutex.Unlock()
+
+	for mail := range selected {
+		err = m.s.append(dest, mail.raw, mail.flags, mail.date)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return selected, nil
+}
+
+// folder locks the server and returns the folder of the mailbox. The
+// server is unlocked on errors only.
+func (m *imapMailbox) folder() (*folder, error) {
+	m.s.mutex.Lock()
+	f, ok := m.s.folders[m.name]
+	if !ok {
+		m.s.mutex.Unlock()
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return f, nil
+}
+
+// id returns the uid or the sequence number of the i-th mail.
+func id(uid bool, i int, mail *storedMail) uint32 {
+	if uid {
+		return mail.uid
+	}
+	return uint32(i + 1)
+}
+
+func fetch(seqNum uint32, mail *storedMail, items []imap.FetchItem) (*imap.Message, error) {
+	msg := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			header, _, err := readMail(mail)
+			if err != nil {
+				return nil, err
+			}
+			msg.Envelope, _ = backendutil.FetchEnvelope(header)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			header, body, err := readMail(mail)
+			if err != nil {
+				return nil, err
+			}
+			msg.BodyStructure, _ = backendutil.FetchBodyStructure(header, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			msg.Flags = mail.flags
+		case imap.FetchInternalDate:
+			msg.InternalDate = mail.date
+		case imap.FetchRFC822Size:
+			msg.Size = uint32(len(mail.raw))
+		case imap.FetchUid:
+			msg.Uid = mail.uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				return nil, err
+			}
+			header, body, err := readMail(mail)
+			if err != nil {
+				return nil, err
+			}
+			msg.Body[section], _ = backendutil.FetchBodySection(header, body, section)
+		}
+	}
+	return msg, nil
+}
+
+func readMail(mail *storedMail) (textproto.Header, io.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(mail.raw))
+	header, err := textproto.ReadHeader(body)
+	return header, body, err
+}
@@ -0,0 +1,140 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mailtest
+
+import (
+	"net"
+	"net/textproto"
+	"strconv"
+)
+
+// servePop3 handles a POP3 session on the INBOX. Deleted mails are removed
+// on QUIT.
+func (s *Server) servePop3(conn net.Conn) {
+	tp := textproto.NewConn(conn)
+
+	var (
+		username string
+		mails    []*storedMail
+		deleted  = map[*storedMail]bool{}
+	)
+	// message returns the mail of a message number, nil if unknown or deleted
+	message := func(arg string) *storedMail {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(mails) || deleted[mails[n-1]] {
+			return nil
+		}
+		return mails[n-1]
+	}
+
+	tp.PrintfLine("+OK mailtest POP3 ready")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := command(line)
+
+		if mails == nil && verb != "USER" && verb != "PASS" && verb != "CAPA" && verb != "QUIT" {
+			tp.PrintfLine("-ERR authentication required")
+			continue
+		}
+
+		switch verb {
+		case "CAPA":
+			tp.PrintfLine("+OK")
+			tp.PrintfLine("USER")
+			tp.PrintfLine("UIDL")
+			tp.PrintfLine(".")
+		case "USER":
+			username = arg
+			tp.PrintfLine("+OK")
+		case "PASS":
+			if s.login(username, arg) != nil {
+				tp.PrintfLine("-ERR invalid credentials")
+				continue
+			}
+			s.mutex.Lock()
+			mails = append([]*storedMail{}, s.folders[FOLDER_INBOX].mails...)
+			s.mutex.Unlock()
+			tp.PrintfLine("+OK logged in")
+		case "STAT":
+			count, size := 0, 0
+			for _, m := range mails {
+				if !deleted[m] {
+					count++
+					size += len(m.raw)
+				}
+			}
+			tp.PrintfLine("+OK %d %d", count, size)
+		case "LIST", "UIDL":
+			value := func(m *storedMail) string {
+				if verb == "UIDL" {
+					return strconv.Itoa(int(m.uid))
+				}
+				return strconv.Itoa(len(m.raw))
+			}
+			if arg != "" {
+				if m := message(arg); m != nil {
+					tp.PrintfLine("+OK %s %s", arg, value(m))
+				} else {
+					tp.PrintfLine("-ERR no such message")
+				}
+				continue
+			}
+			tp.PrintfLine("+OK")
+			for i, m := range mails {
+				if !deleted[m] {
+					tp.PrintfLine("%d %s", i+1, value(m))
+				}
+			}
+			tp.PrintfLine(".")
+		case "RETR":
+			m := message(arg)
+			if m == nil {
+				tp.PrintfLine("-ERR no such message")
+				continue
+			}
+			tp.PrintfLine("+OK %d octets", len(m.raw))
+			w := tp.DotWriter()
+			w.Write(m.raw)
+			w.Close()
+		case "DELE":
+			m := message(arg)
+			if m == nil {
+				tp.PrintfLine("-ERR no such message")
+				continue
+			}
+			deleted[m] = true
+			tp.PrintfLine("+OK deleted")
+		case "RSET":
+			deleted = map[*storedMail]bool{}
+			tp.PrintfLine("+OK")
+		case "NOOP":
+			tp.PrintfLine("+OK")
+		case "QUIT":
+			s.remove(FOLDER_INBOX, func(m *storedMail) bool {
+				return deleted[m]
+			})
+			tp.PrintfLine("+OK bye")
+			return
+		default:
+			tp.PrintfLine("-ERR command not implemented")
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package mailtest provides an in-process mail server, so the mail channel
+// can be tested end to end without network access.
+package mailtest
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapServer "github.com/emersion/go-imap/server"
+)
+
+const (
+	HOST = "127.0.0.1"
+
+	FOLDER_INBOX = "INBOX"
+
+	UPDATE_QUEUE_SIZE = 64
+)
+
+// Mail is a mail received by SMTP.
+type Mail struct {
+	From string
+	To   []string
+	Raw  []byte
+}
+
+// Server is a mail server with SMTP, POP3 and IMAP on local ports and one
+// account. All protocols need the credentials of the account, plaintext
+// is used. Mails sent by SMTP are recorded and put into the INBOX, whatever
+// the recipient, so a client can receive its own mails.
+type Server struct {
+	Username string
+	Password string
+	SmtpPort int
+	Pop3Port int
+	ImapPort int
+
+	mutex     sync.Mutex
+	folders   map[string]*folder
+	sent      []Mail
+	rejected  map[string]bool
+	updates   chan backend.Update
+	listeners []net.Listener
+	imap      *imapServer.Server
+	wg        sync.WaitGroup
+}
+
+type storedMail struct {
+	uid   uint32
+	raw   []byte
+	flags []string
+	date  time.Time
+}
+
+type folder struct {
+	mails   []*storedMail
+	uidNext uint32
+}
+
+// NewServer starts a server on random ports, see Close.
+func NewServer(username string, password string) (*Server, error) {
+	s := &Server{
+		Username: username,
+		Password: password,
+		folders:  map[string]*folder{FOLDER_INBOX: {uidNext: 1}},
+		rejected: map[string]bool{},
+		updates:  make(chan backend.Update, UPDATE_QUEUE_SIZE),
+	}
+
+	s.imap = imapServer.New(&imapBackend{s: s})
+	s.imap.AllowInsecureAuth = true
+	s.imap.ErrorLog = log.New(io.Discard, "", 0)
+
+	var err error
+	s.SmtpPort, err = s.listen(s.serveSmtp)
+	if err == nil {
+		s.Pop3Port, err = s.listen(s.servePop3)
+	}
+	if err == nil {
+		s.ImapPort, err = s.listen(nil)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// listen accepts connections, which are handled by serve or by the IMAP
+// server, if serve is nil.
+func (s *Server) listen(serve func(conn net.Conn)) (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(HOST, "0"))
+	if err != nil {
+		return 0, err
+	}
+	s.listeners = append(s.listeners, l)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if serve == nil {
+			s.imap.Serve(l)
+			return
+		}
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Close stops listening and closes all connections.
+func (s *Server) Close() error {
+	err := s.imap.Close()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+// MailConfig returns a configuration of the account, the protocol and the
+// token have to be set.
+func (s *Server) MailConfig() specs.MailConfig {
+	return specs.MailConfig{
+		Enable:   true,
+		Username: s.Username,
+		Password: s.Password,
+		Email:    s.Username,
+		SmtpHost: HOST,
+		SmtpPort: s.SmtpPort,
+		Pop3Host: HOST,
+		Pop3Port: s.Pop3Port,
+		ImapHost: HOST,
+		ImapPort: s.ImapPort,
+	}
+}
+
+// Reject makes SMTP answer RCPT of the addresses with 550, like unknown
+// mailboxes.
+func (s *Server) Reject(addresses ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, address := range addresses {
+		s.rejected[strings.ToLower(address)] = true
+	}
+}
+
+// Deliver puts a raw mail into the INBOX.
+func (s *Server) Deliver(raw []byte) {
+	s.append(FOLDER_INBOX, raw, nil, time.Now())
+}
+
+// Sent returns the mails received by SMTP.
+func (s *Server) Sent() []Mail {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Mail{}, s.sent...)
+}
+
+// Folder returns the raw mails of a folder.
+func (s *Server) Folder(name string) [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mails := [][]byte{}
+	if f, ok := s.folders[name]; ok {
+		for _, m := range f.mails {
+			mails = append(mails, m.raw)
+		}
+	}
+	return mails
+}
+
+// append stores a mail and notifies idling IMAP clients.
+func (s *Server) append(name string, raw []byte, flags []string, date time.Time) error {
+	s.mutex.Lock()
+	f, ok := s.folders[name]
+	if !ok {
+		s.mutex.Unlock()
+		return backend.ErrNoSuchMailbox
+	}
+	f.mails = append(f.mails, &storedMail{uid: f.uidNext, raw: raw, flags: flags, date: date})
+	f.uidNext++
+	status := imap.NewMailboxStatus(name, []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(len(f.mails))
+	s.mutex.Unlock()
+
+	select {
+	case s.updates <- &backend.MailboxUpdate{Update: backend.NewUpdate(s.Username, name), MailboxStatus: status}:
+	default:
+	}
+	return nil
+}
+
+// remove deletes mails of a folder.
+func (s *Server) remove(name string, remove func(m *storedMail) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, ok := s.folders[name]
+	if !ok {
+		return
+	}
+	mails := f.mails[:0]
+	for _, m := range f.mails {
+		if !remove(m) {
+			mails = append(mails, m)
+		}
+	}
+	f.mails = mails
+}
+
+func (s *Server) login(username string, password string) error {
+	if username != s.Username || password != s.Password {
+		return errors.New("invalid credentials")
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mailtest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// serveSmtp handles an SMTP session. AUTH PLAIN or LOGIN is required
+// before MAIL.
+func (s *Server) serveSmtp(conn net.Conn) {
+	tp := textproto.NewConn(conn)
+
+	var (
+		authenticated bool
+		from          string
+		to            []string
+	)
+	tp.PrintfLine("220 %s ESMTP mailtest", HOST)
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := command(line)
+
+		switch verb {
+		case "EHLO":
+			tp.PrintfLine("250-%s", HOST)
+			tp.PrintfLine("250 AUTH PLAIN LOGIN")
+		case "HELO":
+			tp.PrintfLine("250 %s", HOST)
+		case "AUTH":
+			authenticated = s.smtpAuth(tp, arg)
+			if authenticated {
+				tp.PrintfLine("235 2.7.0 authenticated")
+			} else {
+				tp.PrintfLine("535 5.7.8 invalid credentials")
+			}
+		case "MAIL":
+			if !authenticated {
+				tp.PrintfLine("530 5.7.0 authentication required")
+				continue
+			}
+			from, to = address(arg, "FROM:"), nil
+			tp.PrintfLine("250 2.1.0 ok")
+		case "RCPT":
+			rcpt := address(arg, "TO:")
+			if from == "" || rcpt == "" {
+				tp.PrintfLine("503 5.5.1 bad sequence of commands")
+			} else if s.isRejected(rcpt) {
+				tp.PrintfLine("550 5.1.1 mailbox unavailable")
+			} else {
+				to = append(to, rcpt)
+				tp.PrintfLine("250 2.1.5 ok")
+			}
+		case "DATA":
+			if len(to) == 0 {
+				tp.PrintfLine("503 5.5.1 no valid recipients")
+				continue
+			}
+			tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			raw, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			raw = bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+			s.mutex.Lock()
+			s.sent = append(s.sent, Mail{From: from, To: to, Raw: raw})
+			s.mutex.Unlock()
+			s.Deliver(raw)
+			from, to = "", nil
+			tp.PrintfLine("250 2.0.0 queued")
+		case "RSET":
+			from, to = "", nil
+			tp.PrintfLine("250 2.0.0 ok")
+		case "NOOP":
+			tp.PrintfLine("250 2.0.0 ok")
+		case "QUIT":
+			tp.PrintfLine("221 2.0.0 bye")
+			return
+		default:
+			tp.PrintfLine("502 5.5.2 command not implemented")
+		}
+	}
+}
+
+// smtpAuth checks the credentials of AUTH PLAIN or LOGIN, the initial
+// response is optional.
+func (s *Server) smtpAuth(tp *textproto.Conn, arg string) bool {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	read := func(challenge string) string {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+		line, _ := tp.ReadLine()
+		return line
+	}
+	decode := func(in string) string {
+		out, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(in))
+		return string(out)
+	}
+
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			initial = read("")
+		}
+		// authorization identity, username and password
+		parts := strings.Split(decode(initial), "\x00")
+		return len(parts) == 3 && s.login(parts[1], parts[2]) == nil
+	case "LOGIN":
+		username := initial
+		if username == "" {
+			username = read("Username:")
+		}
+		password := read("Password:")
+		return s.login(decode(username), decode(password)) == nil
+	}
+	return false
+}
+
+func (s *Server) isRejected(address string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rejected[strings.ToLower(address)]
+}
+
+// command splits a line into the upper case verb and its argument.
+func command(line string) (string, string) {
+	verb, arg, _ := strings.Cut(line, " ")
+	return strings.ToUpper(verb), strings.TrimSpace(arg)
+}
+
+// address returns the address of "FROM:<address> PARAM=..." or "TO:<...>".
+func address(arg string, prefix string) string {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return ""
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if start, end := strings.Index(arg, "<"), strings.Index(arg, ">"); start == 0 && end > 0 {
+		return arg[1:end]
+	}
+	return strings.Fields(arg + " ")[0]
+}
@@ -0,0 +1,127 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryMailbox is a Mailbox held in memory, e.g. for tests.
+type MemoryMailbox struct {
+	mutex     sync.Mutex
+	inbox     []Message
+	processed []Message
+	failed    []Message
+	notify    chan struct{}
+}
+
+func NewMemoryMailbox() *MemoryMailbox {
+	return &MemoryMailbox{
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Deliver puts a mail into the inbox and wakes up a waiting receiver.
+func (m *MemoryMailbox) Deliver(msg Message) {
+	m.mutex.Lock()
+	m.inbox = append(m.inbox, msg)
+	m.mutex.Unlock()
+
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (m *MemoryMailbox) Receive(ctx context.Context, subject string, handle Handler) error {
+	m.mutex.Lock()
+	var matching []Message
+	remaining := m.inbox[:0]
+	for _, msg := range m.inbox {
+		if strings.TrimSpace(msg.Subject) == subject || msg.Bounce != nil {
+			matching = append(matching, msg)
+		} else {
+			remaining = append(remaining, msg)
+		}
+	}
+	m.inbox = remaining
+	m.mutex.Unlock()
+
+	for i := range matching {
+		if ctx.Err() != nil {
+			m.mutex.Lock()
+			m.inbox = append(m.inbox, matching[i:]...)
+			m.mutex.Unlock()
+			break
+		}
+
+		ok := handle(&matching[i])
+		m.mutex.Lock()
+		if ok {
+			m.processed = append(m.processed, matching[i])
+		} else {
+			m.failed = append(m.failed, matching[i])
+		}
+		m.mutex.Unlock()
+	}
+	return nil
+}
+
+func (m *MemoryMailbox) Wait(ctx context.Context, timeout time.Duration) error {
+	select {
+	case <-m.notify:
+		return nil
+	default:
+	}
+	select {
+	case <-m.notify:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func (m *MemoryMailbox) Close() error {
+	return nil
+}
+
+// Inbox returns the mails, which are not handled yet.
+func (m *MemoryMailbox) Inbox() []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Message{}, m.inbox...)
+}
+
+// Processed returns the successfully handled mails.
+func (m *MemoryMailbox) Processed() []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Message{}, m.processed...)
+}
+
+// Failed returns the mails, which could not be handled.
+func (m *MemoryMailbox) Failed() []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Message{}, m.failed...)
+}
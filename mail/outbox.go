@@ -0,0 +1,258 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"context"
+	dbSql "database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/metrics"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/sql"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+	"github.com/ChrIgiSta/swiss-qr-bill/webhook"
+	gomail "gopkg.in/mail.v2"
+)
+
+const (
+	OUTBOX_MAX_ATTEMPTS  = 10
+	OUTBOX_POLL_INTERVAL = 10 * time.Second
+	OUTBOX_BATCH_SIZE    = 20
+
+	DELIVERY_FILE_NAME = "qr-bill-%d.pdf"
+
+	DELIVERY_RESULT_SENT    = "sent"
+	DELIVERY_RESULT_RETRY   = "retry"
+	DELIVERY_RESULT_FAILED  = "failed"
+	DELIVERY_RESULT_BOUNCED = "bounced"
+)
+
+var (
+	ErrNoMailConfig   = errors.New("issuer has no mail configuration")
+	ErrPdfUnavailable = errors.New("pdf of bill not available")
+)
+
+// Outbox sends the queued bill deliveries, see QueueBill. Failed attempts
+// are retried with an exponential backoff, so an unavailable SMTP server
+// doesn't lose mails.
+type Outbox struct {
+	db  sql.Repository
+	log *slog.Logger
+}
+
+func NewOutbox(db sql.Repository) *Outbox {
+	return &Outbox{db: db, log: slog.Default()}
+}
+
+// SetLogger replaces the default logger.
+func (o *Outbox) SetLogger(logger *slog.Logger) {
+	o.log = logger
+}
+
+// QueueBill queues the bill to be sent to recipient by the first enabled
+// mail configuration of its issuer. The language of the mail falls back to
+// the one of the mail configuration. ErrNoMailConfig is returned, if the
+// issuer can't send mails.
+func QueueBill(db sql.Repository, b *specs.Bill, recipient string, languageCode string) (*specs.BillDelivery, error) {
+	cnf, err := db.GetMailConfigByIssuer(b.IssuerId)
+	if errors.Is(err, dbSql.ErrNoRows) {
+		return nil, ErrNoMailConfig
+	} else if err != nil {
+		return nil, err
+	}
+
+	delivery := &specs.BillDelivery{
+		BillId:        b.Id,
+		MailId:        cnf.Id,
+		Recipient:     recipient,
+		LanguageCode:  strings.ToUpper(languageCode),
+		MessageId:     fmt.Sprintf("%s.%d@%s", logging.NewId(), b.Id, domainOf(cnf.Email)),
+		NextAttemptAt: time.Now(),
+	}
+	err = db.InsertBillDelivery(delivery)
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// SendBill mails the pdf of a bill to the recipient of a delivery. The
+// Message-Id of the delivery is set, to match bounces.
+func (c *Client) SendBill(delivery *specs.BillDelivery, b *specs.Bill) error {
+	pdf, err := os.ReadFile(b.PdfFile)
+	if err != nil || (b.PdfHash != "" && utils.GetSha256(pdf) != b.PdfHash) {
+		return ErrPdfUnavailable
+	}
+
+	msg, err := c.render(c.language(delivery.LanguageCode), TEMPLATE_DELIVERY, TemplateData{
+		Name:      b.Customer.Name,
+		Amount:    fmt.Sprintf("%.2f", b.Details.Amount),
+		Currency:  b.Details.Currency,
+		Reference: b.Details.Referece,
+	}, createdAt(b))
+	if err != nil {
+		return err
+	}
+	msg.Id = delivery.MessageId
+	msg.To = []string{delivery.Recipient}
+	msg.Attachments = []Attachments{{
+		FileName: b.PdfFile,
+		Name:     fmt.Sprintf(DELIVERY_FILE_NAME, b.Id),
+		MimeTyoe: MIME_TYPE_PDF,
+	}}
+	return c.SendEmail(msg)
+}
+
+// Run sends due deliveries until ctx is done.
+func (o *Outbox) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	o.log.Info("mail outbox started")
+	for ctx.Err() == nil {
+		deliveries, err := o.db.GetDueBillDeliveries(time.Now(), OUTBOX_BATCH_SIZE)
+		if err != nil {
+			o.log.ErrorContext(ctx, "cannot get due bill deliveries", logging.Err(err))
+		}
+		for _, delivery := range deliveries {
+			if ctx.Err() != nil {
+				break
+			}
+			o.deliver(ctx, delivery)
+		}
+
+		if len(deliveries) < OUTBOX_BATCH_SIZE {
+			select {
+			case <-ctx.Done():
+			case <-time.After(OUTBOX_POLL_INTERVAL):
+			}
+		}
+	}
+	o.log.Info("mail outbox stopped")
+}
+
+func (o *Outbox) deliver(ctx context.Context, delivery *specs.BillDelivery) {
+	logger := o.log.With("delivery_id", delivery.Id, "bill_id", delivery.BillId)
+
+	delivery.Attempts++
+	err := o.send(logger, delivery)
+	delivery.LastError = ""
+
+	if err == nil {
+		now := time.Now()
+		delivery.State = sql.BILL_DELIVERY_SENT
+		delivery.SentAt = &now
+		logger.InfoContext(ctx, "bill sent")
+		metrics.MailDeliveries.Inc(DELIVERY_RESULT_SENT)
+	} else {
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= OUTBOX_MAX_ATTEMPTS || permanent(err) {
+			logger.WarnContext(ctx, "bill delivery failed finally", logging.Err(err))
+			delivery.State = sql.BILL_DELIVERY_FAILED
+			metrics.MailDeliveries.Inc(DELIVERY_RESULT_FAILED)
+		} else {
+			logger.InfoContext(ctx, "bill delivery failed, retry later", "attempts", delivery.Attempts,
+				logging.Err(err))
+			delivery.NextAttemptAt = time.Now().Add(webhook.Backoff(delivery.Attempts))
+			metrics.MailDeliveries.Inc(DELIVERY_RESULT_RETRY)
+		}
+	}
+
+	err = o.db.UpdateBillDelivery(delivery)
+	if err != nil {
+		logger.ErrorContext(ctx, "cannot update bill delivery", logging.Err(err))
+	}
+}
+
+func (o *Outbox) send(logger *slog.Logger, delivery *specs.BillDelivery) error {
+	b, err := o.db.GetBill(delivery.BillId)
+	if err != nil {
+		return err
+	}
+	cnf, err := o.db.GetMailConfig(delivery.MailId)
+	if err != nil {
+		return err
+	}
+	if !cnf.Enable {
+		return fmt.Errorf("mail configuration %d disabled", cnf.Id)
+	}
+
+	client := NewMailClientFromConfig(*cnf)
+	client.SetLogger(logger)
+	client.Templates = o.db
+	return client.SendBill(delivery, b)
+}
+
+// permanent reports whether a failed attempt is not worth a retry: the
+// bill, its pdf or the mail configuration is gone or the server rejected
+// the recipient (reply codes 550 - 554). Other errors, e.g. failed logins, may be
+// resolved later.
+func permanent(err error) bool {
+	if errors.Is(err, dbSql.ErrNoRows) || errors.Is(err, ErrPdfUnavailable) {
+		return true
+	}
+	var sendErr *gomail.SendError
+	if errors.As(err, &sendErr) {
+		err = sendErr.Cause
+	}
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 550 && smtpErr.Code <= 554
+}
+
+// processBounce marks the delivery of a bounced bill. Notifications are
+// matched by the Message-Id of deliveries of this mailbox only, so they
+// can't affect other mails. It returns true, if the delivery was found.
+func processBounce(ctx context.Context, logger *slog.Logger, mailConfig specs.MailConfig, db sql.Repository,
+	mail *Message) bool {
+	bounce := mail.Bounce
+	delivery, err := db.GetBillDeliveryByMessageId(bounce.MessageId)
+	if errors.Is(err, dbSql.ErrNoRows) || (err == nil && delivery.MailId != mailConfig.Id) {
+		logger.InfoContext(ctx, "delivery status of unknown mail", "message_id", bounce.MessageId,
+			"action", bounce.Action)
+		return false
+	} else if err != nil {
+		logger.ErrorContext(ctx, "cannot get bill delivery", logging.Err(err))
+		return false
+	}
+
+	logger = logger.With("delivery_id", delivery.Id, "bill_id", delivery.BillId, "recipient", bounce.Recipient,
+		"action", bounce.Action, "status", bounce.Status)
+	if !bounce.Failed() {
+		logger.InfoContext(ctx, "delivery status of bill", "diagnostic", bounce.Diagnostic)
+		return true
+	}
+
+	delivery.State = sql.BILL_DELIVERY_BOUNCED
+	delivery.LastError = strings.TrimSpace(bounce.Status + " " + bounce.Diagnostic)
+	err = db.UpdateBillDelivery(delivery)
+	if err != nil {
+		logger.ErrorContext(ctx, "cannot update bill delivery", logging.Err(err))
+		return false
+	}
+	logger.WarnContext(ctx, "bill delivery bounced", "diagnostic", bounce.Diagnostic)
+	metrics.MailDeliveries.Inc(DELIVERY_RESULT_BOUNCED)
+	return true
+}
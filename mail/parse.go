@@ -0,0 +1,219 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	gomessage "github.com/emersion/go-message/mail"
+)
+
+const (
+	ATTACHMENT_DIR = "out/mails"
+
+	DISPOSITION_ATTACHMENT = "attachment"
+)
+
+var (
+	// preferred content types of the body, the highest rank wins
+	BODY_RANKS = map[string]int{
+		MIME_TYPE_JSON: 3,
+		MIME_TYPE_TEXT: 2,
+		MIME_TYPE_HTML: 1,
+	}
+
+	unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	htmlBreaks      = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</tr>|</li>`)
+	htmlTags        = regexp.MustCompile(`<[^>]*>`)
+)
+
+// ParseMessage reads a raw mail, see ParseEntity. The sender is
+// authenticated as well, see Authenticate.
+func ParseMessage(r io.Reader, dir string) (Message, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, MAX_DOWNLOAD_SIZE))
+	if err != nil {
+		return Message{}, err
+	}
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return Message{}, err
+	}
+	msg, err := ParseEntity(entity, dir)
+	msg.Auth = Authenticate(raw)
+	return msg, err
+}
+
+// ParseEntity walks through all (nested) parts of a mail. The body is taken
+// from the json, text or html part, in this order. Transfer encodings and
+// charsets are decoded. Pdf and csv attachments are stored in dir. Delivery
+// status notifications are parsed into Bounce.
+func ParseEntity(entity *message.Entity, dir string) (Message, error) {
+	header := gomessage.Header{Header: entity.Header}
+
+	msg := Message{}
+	msg.Id, _ = header.MessageID()
+	if msg.Id == "" {
+		msg.Id = logging.NewId()
+	}
+	msg.Subject, _ = header.Subject()
+	msg.Language = strings.TrimSpace(strings.Split(header.Get("Content-Language"), ",")[0])
+	from, err := header.AddressList("From")
+	if err == nil && len(from) > 0 {
+		msg.From = from[0].Address
+	} else {
+		msg.From = header.Get("From")
+	}
+	if msg.From != "" {
+		msg.To = []string{msg.From}
+	}
+
+	if IsReport(entity.Header) {
+		msg.Bounce = &Bounce{}
+	}
+
+	prefix := logging.NewId()
+	bodyRank := 0
+
+	err = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return err
+		}
+
+		mediaType, _, _ := part.Header.ContentType()
+		if strings.HasPrefix(mediaType, "multipart/") {
+			return nil
+		}
+		if msg.Bounce != nil && (mediaType == MIME_TYPE_DELIVERY_STATUS || mediaType == MIME_TYPE_RFC822 ||
+			mediaType == MIME_TYPE_RFC822_HEADERS) {
+			return msg.Bounce.parseReportPart(mediaType, part.Body)
+		}
+		disposition, _, _ := part.Header.ContentDisposition()
+		attachment := gomessage.AttachmentHeader{Header: part.Header}
+		name, _ := attachment.Filename()
+
+		attachmentType := ""
+		if isPdf(mediaType, name) {
+			attachmentType = MIME_TYPE_PDF
+		} else if isCsv(mediaType, name) {
+			attachmentType = MIME_TYPE_CSV
+			if name == "" {
+				name = "attachment.csv"
+			}
+		}
+		if attachmentType != "" {
+			file, err := saveAttachment(dir, prefix+"-"+strconv.Itoa(len(msg.Attachments)), name, part.Body)
+			if err != nil {
+				return err
+			}
+			msg.Attachments = append(msg.Attachments, Attachments{
+				FileName: file,
+				Name:     name,
+				MimeTyoe: attachmentType,
+			})
+			return nil
+		}
+
+		rank := BODY_RANKS[mediaType]
+		if rank <= bodyRank || (disposition == DISPOSITION_ATTACHMENT && mediaType != MIME_TYPE_JSON) {
+			return nil
+		}
+		content, err := io.ReadAll(io.LimitReader(part.Body, MAX_DOWNLOAD_SIZE))
+		if err != nil {
+			return err
+		}
+		msg.Body = string(content)
+		msg.BodyMimeType = mediaType
+		if mediaType == MIME_TYPE_HTML {
+			msg.Body = htmlToText(msg.Body)
+		}
+		bodyRank = rank
+		return nil
+	})
+
+	return msg, err
+}
+
+// AttachmentsOf returns the attachments of a mime type.
+func (msg *Message) AttachmentsOf(mimeType string) []Attachments {
+	attachments := []Attachments{}
+	for _, a := range msg.Attachments {
+		if a.MimeTyoe == mimeType {
+			attachments = append(attachments, a)
+		}
+	}
+	return attachments
+}
+
+// RemoveAttachments deletes the stored attachments of a message.
+func (msg *Message) RemoveAttachments() {
+	for _, a := range msg.Attachments {
+		os.Remove(a.FileName)
+	}
+}
+
+func isPdf(mediaType string, name string) bool {
+	return mediaType == MIME_TYPE_PDF ||
+		(mediaType == MIME_TYPE_OCTET_STREAM && strings.HasSuffix(strings.ToLower(name), ".pdf"))
+}
+
+func isCsv(mediaType string, name string) bool {
+	return mediaType == MIME_TYPE_CSV ||
+		(mediaType == MIME_TYPE_OCTET_STREAM && strings.HasSuffix(strings.ToLower(name), ".csv"))
+}
+
+func saveAttachment(dir string, prefix string, name string, body io.Reader) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	name = unsafeFileChars.ReplaceAllString(filepath.Base(name), "_")
+	if name == "" || name == "." || name == "_" {
+		name = "attachment.pdf"
+	}
+	path := filepath.Join(dir, prefix+"-"+name)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, io.LimitReader(body, MAX_DOWNLOAD_SIZE))
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+func htmlToText(in string) string {
+	out := htmlBreaks.ReplaceAllString(in, "\n")
+	out = htmlTags.ReplaceAllString(out, "")
+	return html.UnescapeString(out)
+}
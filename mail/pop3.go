@@ -0,0 +1,119 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/emersion/go-message"
+	gomessage "github.com/emersion/go-message/mail"
+	"github.com/knadh/go-pop3"
+)
+
+// Pop3Mailbox receives mails by POP3. Handled mails are deleted, as POP3
+// has no folders.
+type Pop3Mailbox struct {
+	Host          string
+	Port          int
+	Secure        bool
+	Username      string
+	Password      string
+	AttachmentDir string
+
+	log *slog.Logger
+}
+
+func (m *Pop3Mailbox) Receive(ctx context.Context, subject string, handle Handler) error {
+	pop := pop3.New(pop3.Opt{
+		Host:        m.Host,
+		Port:        m.Port,
+		TLSEnabled:  m.Secure,
+		DialTimeout: DIAL_TIMEOUT,
+	})
+
+	conn, err := pop.NewConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Quit()
+
+	err = conn.Auth(m.Username, m.Password)
+	if err != nil {
+		return err
+	}
+
+	count, size, err := conn.Stat()
+	if err != nil {
+		return err
+	}
+	if size > MAX_DOWNLOAD_SIZE {
+		return errors.New("max download size.")
+	}
+
+	for id := 1; id <= count && ctx.Err() == nil; id++ {
+		raw, err := conn.RetrRaw(id)
+		if err != nil {
+			return err
+		}
+		entity, err := message.Read(bytes.NewReader(raw.Bytes()))
+		if err != nil && !message.IsUnknownCharset(err) {
+			// unreadable mails are deleted, they would fail forever
+			m.log.Warn("cannot read mail", "id", id, logging.Err(err))
+			err = conn.Dele(id)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		header := gomessage.Header{Header: entity.Header}
+		s, _ := header.Subject()
+		if strings.TrimSpace(s) != subject && !IsReport(entity.Header) {
+			continue
+		}
+
+		msg, err := ParseEntity(entity, m.AttachmentDir)
+		msg.Auth = Authenticate(raw.Bytes())
+		if err != nil {
+			// unparsable mails are deleted as well, they would fail forever
+			m.log.Warn("cannot parse mail", logging.KEY_MAIL_ID, msg.Id, logging.Err(err))
+		} else {
+			handle(&msg)
+		}
+		msg.RemoveAttachments()
+
+		err = conn.Dele(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Pop3Mailbox) Wait(ctx context.Context, timeout time.Duration) error {
+	return waitTimeout(ctx, timeout)
+}
+
+func (m *Pop3Mailbox) Close() error {
+	return nil
+}
@@ -0,0 +1,185 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/bill"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+const (
+	REPLY_FILE_NAME       = "qr-bill.pdf"
+	REPLY_FILE_NAME_ROW   = "qr-bill-%05d.pdf"
+	REPLY_FILE_NAME_BILLS = "qr-bills.pdf"
+
+	REPLY_INTERNAL_ERROR = "internal error, please try again later"
+
+	// explains the expected format of a request
+	REQUEST_HELP = `Please send the billing information in the body of the mail, one per line:
+
+Name: Muster Hans
+Address1: Bahnhofstrasse 1
+Address2:
+Zip: 8000
+Location: Zuerich
+Country: CH
+Amount: 120.50
+Currency: CHF
+ReferenceType: NON
+Reference:
+AdditionalInformations: Invoice 2023-01
+
+Currency (CHF or EUR), Country (CH) and ReferenceType (NON, QRR or SCOR) are optional.
+A QRR or SCOR reference is generated, if the Reference is empty. It is built of the optional
+InvoiceNumber (the next one of the issuer otherwise) and, for QRR, the CustomerNumber.
+Attach your invoice as pdf to get the QR bill appended to it.
+
+Alternatively send a json body like the api request, a single bill or an array of bills:
+
+{"name": "Muster", "firstname": "Hans", "street": "Bahnhofstrasse", "streetNumber": "1",
+ "postal": "8000", "city": "Zuerich", "country": "CH", "amount": 120.50, "currency": "CHF",
+ "reference_type": "NON", "reference": "", "message": "Invoice 2023-01"}
+
+or attach csv files with these keys as header row, one bill per row. Many bills are answered
+with one pdf per bill, add "Format: pdf" to the body to get one merged pdf.
+`
+)
+
+// NewReply creates a reply to the sender of a request.
+func NewReply(request *Message, subject string, body string) Message {
+	return Message{
+		To:           request.To,
+		InReplyTo:    request.Id,
+		Subject:      subject,
+		Body:         body,
+		BodyMimeType: MIME_TYPE_TEXT,
+	}
+}
+
+// ReplyBill sends the pdf of the generated bill to the sender of the request.
+func (c *Client) ReplyBill(request *Message, b *specs.Bill) error {
+	reply, err := c.renderReply(request, TEMPLATE_BILL, TemplateData{
+		Name:      b.Customer.Name,
+		Amount:    fmt.Sprintf("%.2f", b.Details.Amount),
+		Currency:  b.Details.Currency,
+		Reference: b.Details.Referece,
+	}, createdAt(b))
+	if err != nil {
+		return err
+	}
+	reply.Attachments = []Attachments{{
+		FileName: b.PdfFile,
+		Name:     REPLY_FILE_NAME,
+		MimeTyoe: MIME_TYPE_PDF,
+	}}
+	return c.SendEmail(reply)
+}
+
+// ReplyBills sends the pdfs of a batch to the sender of the request, one
+// per generated row or merged into one. The rows, which failed, are listed
+// in the body.
+func (c *Client) ReplyBills(request *Message, rows []RequestRow, merged bool) error {
+	var (
+		pdfFiles   []string
+		failedRows []string
+	)
+	for _, row := range rows {
+		if row.Bill != nil {
+			pdfFiles = append(pdfFiles, row.Bill.PdfFile)
+		} else {
+			failedRows = append(failedRows, fmt.Sprintf("row %d: %s", row.Row, row.Err))
+		}
+	}
+
+	reply, err := c.renderReply(request, TEMPLATE_BILLS, TemplateData{
+		Count:      len(pdfFiles),
+		FailedRows: failedRows,
+	}, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if merged {
+		file, err := mergeToFile(c.AttachmentDir, pdfFiles)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file)
+		reply.Attachments = []Attachments{{
+			FileName: file,
+			Name:     REPLY_FILE_NAME_BILLS,
+			MimeTyoe: MIME_TYPE_PDF,
+		}}
+	} else {
+		for _, row := range rows {
+			if row.Bill == nil {
+				continue
+			}
+			reply.Attachments = append(reply.Attachments, Attachments{
+				FileName: row.Bill.PdfFile,
+				Name:     fmt.Sprintf(REPLY_FILE_NAME_ROW, row.Row),
+				MimeTyoe: MIME_TYPE_PDF,
+			})
+		}
+	}
+	return c.SendEmail(reply)
+}
+
+func mergeToFile(dir string, pdfFiles []string) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "merged-*.pdf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	err = bill.MergePDFs(pdfFiles, f)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// ReplyError tells the sender of the request, why no bill was generated.
+// The expected format is added, if the request was invalid.
+func (c *Client) ReplyError(request *Message, reason string, help bool) error {
+	data := TemplateData{Reason: reason}
+	if help {
+		data.Help = REQUEST_HELP
+	}
+	reply, err := c.renderReply(request, TEMPLATE_ERROR, data, time.Now())
+	if err != nil {
+		return err
+	}
+	return c.SendEmail(reply)
+}
+
+func createdAt(b *specs.Bill) time.Time {
+	if b.CreatedAt.IsZero() {
+		return time.Now()
+	}
+	return b.CreatedAt
+}
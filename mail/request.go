@@ -0,0 +1,182 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/bill"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+const (
+	REQUEST_MAX_ROWS        = 1000
+	REQUEST_MAX_ATTACHMENTS = 20 // larger batches are answered with a merged pdf
+
+	REQUEST_FORMAT_MERGED = "pdf"
+)
+
+// RequestRow is one bill requested by a mail, either the validated bill or
+// the reason, why it is invalid.
+type RequestRow struct {
+	Row  int
+	Bill *specs.Bill
+	Err  error
+}
+
+// Request holds the bills requested by a mail.
+type Request struct {
+	Rows   []RequestRow
+	Batch  bool // json array or csv, answered with one pdf per bill
+	Merged bool // answer the batch with one merged pdf instead
+}
+
+// ParseRequest reads the bills requested by a mail. Csv attachments hold a
+// bill per row (see bill.ParseCsv), a json body one bill.Information or an
+// array of them. Otherwise the body holds one bill as "Key: value" lines.
+// The issuer of the mail configuration is used for all bills. A batch is
+// merged into one pdf, if the body contains "Format: pdf" or the batch
+// exceeds REQUEST_MAX_ATTACHMENTS.
+func (c *Client) ParseRequest(msg *Message, issuerId int, iban string, issuer specs.AccountDetails) (Request, error) {
+	var (
+		err   error
+		infos []bill.Information
+		req   Request
+	)
+
+	body := strings.TrimSpace(msg.Body)
+	csvs := msg.AttachmentsOf(MIME_TYPE_CSV)
+	switch {
+	case len(csvs) > 0:
+		for _, a := range csvs {
+			rows, err := parseCsvFile(a.FileName)
+			if err != nil {
+				return req, fmt.Errorf("%s: %s", a.Name, err.Error())
+			}
+			infos = append(infos, rows...)
+		}
+		req.Batch = true
+		req.Merged = strings.EqualFold(getKey(msg.Body, "Format"), REQUEST_FORMAT_MERGED)
+	case msg.BodyMimeType == MIME_TYPE_JSON || strings.HasPrefix(body, "{") || strings.HasPrefix(body, "["):
+		req.Batch = strings.HasPrefix(body, "[")
+		infos, err = parseJson(body)
+		if err != nil {
+			return req, err
+		}
+	default:
+		receipt, details, err := c.GetBillingInformationsFromBody(msg.Body)
+		if err != nil {
+			return req, err
+		}
+		details.IBAN = iban
+		info := &bill.Information{IssuerId: issuerId, ReferenceType: details.RefenreceType,
+			Reference: details.Referece, CustomerNumber: getKey(msg.Body, "CustomerNumber"),
+			InvoiceNumber: getKey(msg.Body, "InvoiceNumber")}
+		if c.References != nil {
+			preview, err := bill.PreviewReference(c.References, info)
+			if err != nil {
+				req.Rows = []RequestRow{{Row: 1, Err: err}}
+				return req, nil
+			}
+			details.Referece = preview.Reference
+		}
+		b := &specs.Bill{
+			IssuerId:     issuerId,
+			Channel:      bill.CHANNEL_MAIL,
+			LanguageCode: c.language(msg.Language),
+			Issuer:       issuer,
+			Customer:     receipt,
+			Details:      details,
+		}
+		bill.SetDefaults(b)
+		err = bill.Validate(b)
+		if err == nil && c.References != nil {
+			err = bill.DrawReference(c.References, info, b)
+		}
+		if err != nil {
+			b = nil
+		}
+		req.Rows = []RequestRow{{Row: 1, Bill: b, Err: err}}
+		return req, nil
+	}
+
+	if len(infos) == 0 {
+		return req, errors.New("no bill requested")
+	}
+	if len(infos) > REQUEST_MAX_ROWS {
+		return req, fmt.Errorf("request exceeds %d bills", REQUEST_MAX_ROWS)
+	}
+	req.Merged = req.Batch && (req.Merged || len(infos) > REQUEST_MAX_ATTACHMENTS)
+
+	for i := range infos {
+		infos[i].IssuerId = issuerId
+		if infos[i].Language == "" {
+			infos[i].Language = c.language(msg.Language)
+		}
+		// the number of the sequence is drawn once the bill is valid
+		info := &infos[i]
+		if c.References != nil {
+			info, err = bill.PreviewReference(c.References, &infos[i])
+			if err != nil {
+				req.Rows = append(req.Rows, RequestRow{Row: i + 1, Err: err})
+				continue
+			}
+		}
+		b, err := bill.NewBill(info, bill.CHANNEL_MAIL, iban, issuer)
+		if err == nil && c.References != nil {
+			err = bill.DrawReference(c.References, &infos[i], b)
+			if err != nil {
+				b = nil
+			}
+		}
+		req.Rows = append(req.Rows, RequestRow{Row: i + 1, Bill: b, Err: err})
+	}
+	return req, nil
+}
+
+func parseJson(body string) ([]bill.Information, error) {
+	var infos []bill.Information
+
+	if strings.HasPrefix(body, "[") {
+		err := json.Unmarshal([]byte(body), &infos)
+		if err != nil {
+			return nil, errors.New("cannot unmarshal json")
+		}
+		return infos, nil
+	}
+
+	info := bill.Information{}
+	err := json.Unmarshal([]byte(body), &info)
+	if err != nil {
+		return nil, errors.New("cannot unmarshal json")
+	}
+	return append(infos, info), nil
+}
+
+func parseCsvFile(path string) ([]bill.Information, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return bill.ParseCsv(f)
+}
@@ -0,0 +1,46 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"sync"
+)
+
+var (
+	pollMutex  sync.Mutex
+	pollStatus = map[string]error{}
+)
+
+// PollStatus returns the result of the last poll per mailbox. A nil error
+// means the mailbox was reachable.
+func PollStatus() map[string]error {
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+
+	status := make(map[string]error, len(pollStatus))
+	for mailbox, err := range pollStatus {
+		status[mailbox] = err
+	}
+	return status
+}
+
+func setPollStatus(mailbox string, err error) {
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+	pollStatus[mailbox] = err
+}
@@ -0,0 +1,299 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"bytes"
+	dbSql "database/sql"
+	"errors"
+	"fmt"
+	htmlTemplate "html/template"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+const (
+	TEMPLATE_BILL  = "BILL"  // reply with one bill
+	TEMPLATE_BILLS = "BILLS" // reply with the bills of a batch
+	TEMPLATE_ERROR = "ERROR" // reply, if no bill was generated
+
+	TEMPLATE_DELIVERY = "DELIVERY" // bill sent to the debtor, see Client.SendBill
+
+	LANGUAGE_DEFAULT = "EN"
+	DUE_DAYS         = 30
+	DUE_DATE_FORMAT  = "02.01.2006"
+)
+
+// TemplateStore provides the reply templates configured per issuer.
+type TemplateStore interface {
+	GetMailTemplate(issuerId int, languageCode string, kind string) (*specs.MailTemplate, error)
+}
+
+// TemplateData holds the placeholders of the reply templates, e.g.
+// {{.Name}} or {{range .FailedRows}}.
+type TemplateData struct {
+	Name       string // debtor
+	Amount     string
+	Currency   string
+	Reference  string
+	DueDate    string // creation date plus the due days of the template
+	Count      int    // generated bills of a batch
+	FailedRows []string
+	Reason     string // why no bill was generated
+	Help       string // expected format of a request
+}
+
+// replyTexts are the phrases of the built-in templates in one language.
+type replyTexts struct {
+	Greeting      string
+	BillSubject   string
+	BillIntro     string
+	DeliveryIntro string
+	BillsSubject  string
+	BillsIntro    string
+	FailedRows    string
+	ErrorSubject  string
+	ErrorIntro    string
+	Amount        string
+	Reference     string
+	DueDate       string
+}
+
+var REPLY_TEXTS = map[string]replyTexts{
+	"EN": {
+		Greeting:      "Hello",
+		BillSubject:   "Your QR bill",
+		BillIntro:     "Please find the requested QR bill attached.",
+		DeliveryIntro: "Please find attached our QR bill.",
+		BillsSubject:  "Your QR bills",
+		BillsIntro:    "Please find the {{.Count}} requested QR bills attached.",
+		FailedRows:    "The following rows could not be generated:",
+		ErrorSubject:  "Your QR bill could not be generated",
+		ErrorIntro:    "Your QR bill could not be generated:",
+		Amount:        "Amount",
+		Reference:     "Reference",
+		DueDate:       "Payable by",
+	},
+	"DE": {
+		Greeting:      "Guten Tag",
+		BillSubject:   "Ihre QR-Rechnung",
+		BillIntro:     "Im Anhang finden Sie die gewünschte QR-Rechnung.",
+		DeliveryIntro: "Im Anhang erhalten Sie unsere QR-Rechnung.",
+		BillsSubject:  "Ihre QR-Rechnungen",
+		BillsIntro:    "Im Anhang finden Sie die {{.Count}} gewünschten QR-Rechnungen.",
+		FailedRows:    "Die folgenden Zeilen konnten nicht erstellt werden:",
+		ErrorSubject:  "Ihre QR-Rechnung konnte nicht erstellt werden",
+		ErrorIntro:    "Ihre QR-Rechnung konnte nicht erstellt werden:",
+		Amount:        "Betrag",
+		Reference:     "Referenz",
+		DueDate:       "Zahlbar bis",
+	},
+	"FR": {
+		Greeting:      "Bonjour",
+		BillSubject:   "Votre QR-facture",
+		BillIntro:     "Veuillez trouver ci-joint la QR-facture demandée.",
+		DeliveryIntro: "Veuillez trouver ci-joint notre QR-facture.",
+		BillsSubject:  "Vos QR-factures",
+		BillsIntro:    "Veuillez trouver ci-joint les {{.Count}} QR-factures demandées.",
+		FailedRows:    "Les lignes suivantes n'ont pas pu être générées :",
+		ErrorSubject:  "Votre QR-facture n'a pas pu être générée",
+		ErrorIntro:    "Votre QR-facture n'a pas pu être générée :",
+		Amount:        "Montant",
+		Reference:     "Référence",
+		DueDate:       "Payable jusqu'au",
+	},
+	"IT": {
+		Greeting:      "Buongiorno",
+		BillSubject:   "La sua QR-fattura",
+		BillIntro:     "In allegato trova la QR-fattura richiesta.",
+		DeliveryIntro: "In allegato trova la nostra QR-fattura.",
+		BillsSubject:  "Le sue QR-fatture",
+		BillsIntro:    "In allegato trova le {{.Count}} QR-fatture richieste.",
+		FailedRows:    "Le seguenti righe non hanno potuto essere generate:",
+		ErrorSubject:  "La sua QR-fattura non ha potuto essere generata",
+		ErrorIntro:    "La sua QR-fattura non ha potuto essere generata:",
+		Amount:        "Importo",
+		Reference:     "Riferimento",
+		DueDate:       "Pagabile entro",
+	},
+}
+
+// DefaultTemplate returns the built-in template of a kind in a language,
+// english for unknown languages.
+func DefaultTemplate(languageCode string, kind string) *specs.MailTemplate {
+	texts, ok := REPLY_TEXTS[languageCode]
+	if !ok {
+		languageCode = LANGUAGE_DEFAULT
+		texts = REPLY_TEXTS[languageCode]
+	}
+	t := &specs.MailTemplate{
+		LanguageCode: languageCode,
+		Kind:         kind,
+		DueDays:      DUE_DAYS,
+	}
+	greeting := texts.Greeting + "{{with .Name}} {{.}}{{end}}"
+
+	switch kind {
+	case TEMPLATE_BILL, TEMPLATE_DELIVERY:
+		intro := texts.BillIntro
+		if kind == TEMPLATE_DELIVERY {
+			intro = texts.DeliveryIntro
+		}
+		t.Subject = texts.BillSubject
+		t.TextBody = greeting + "\n\n" + intro + "\n\n" +
+			texts.Amount + ": {{.Currency}} {{.Amount}}\n" +
+			texts.Reference + ": {{or .Reference \"-\"}}\n" +
+			"{{with .DueDate}}" + texts.DueDate + ": {{.}}\n{{end}}"
+		t.HtmlBody = "<p>" + greeting + "</p>\n<p>" + intro + "</p>\n<table>\n" +
+			"<tr><td>" + texts.Amount + "</td><td>{{.Currency}} {{.Amount}}</td></tr>\n" +
+			"<tr><td>" + texts.Reference + "</td><td>{{or .Reference \"-\"}}</td></tr>\n" +
+			"{{with .DueDate}}<tr><td>" + texts.DueDate + "</td><td>{{.}}</td></tr>\n{{end}}</table>\n"
+	case TEMPLATE_BILLS:
+		t.Subject = texts.BillsSubject
+		t.TextBody = greeting + "\n\n" + texts.BillsIntro + "\n" +
+			"{{with .DueDate}}" + texts.DueDate + ": {{.}}\n{{end}}" +
+			"{{if .FailedRows}}\n" + texts.FailedRows + "\n\n{{range .FailedRows}}    {{.}}\n{{end}}{{end}}"
+		t.HtmlBody = "<p>" + greeting + "</p>\n<p>" + texts.BillsIntro + "</p>\n" +
+			"{{with .DueDate}}<p>" + texts.DueDate + ": {{.}}</p>\n{{end}}" +
+			"{{if .FailedRows}}<p>" + texts.FailedRows + "</p>\n<ul>\n{{range .FailedRows}}<li>{{.}}</li>\n{{end}}</ul>\n{{end}}"
+	default:
+		t.Kind = TEMPLATE_ERROR
+		t.Subject = texts.ErrorSubject
+		t.TextBody = greeting + "\n\n" + texts.ErrorIntro + "\n\n    {{.Reason}}\n{{with .Help}}\n{{.}}{{end}}"
+		t.HtmlBody = "<p>" + greeting + "</p>\n<p>" + texts.ErrorIntro + "</p>\n<p><b>{{.Reason}}</b></p>\n" +
+			"{{with .Help}}<pre>{{.}}</pre>\n{{end}}"
+	}
+	return t
+}
+
+// Render fills in a template. The html body is optional and its
+// placeholders are escaped.
+func Render(t *specs.MailTemplate, data TemplateData) (string, string, string, error) {
+	subject, err := renderText(t.Subject, data)
+	if err != nil {
+		return "", "", "", fmt.Errorf("subject: %w", err)
+	}
+	subject = strings.TrimSpace(subject)
+	text, err := renderText(t.TextBody, data)
+	if err != nil {
+		return "", "", "", fmt.Errorf("text body: %w", err)
+	}
+	if t.HtmlBody == "" {
+		return subject, text, "", nil
+	}
+
+	tpl, err := htmlTemplate.New(t.Kind).Parse(t.HtmlBody)
+	if err != nil {
+		return "", "", "", fmt.Errorf("html body: %w", err)
+	}
+	html := bytes.Buffer{}
+	err = tpl.Execute(&html, data)
+	if err != nil {
+		return "", "", "", fmt.Errorf("html body: %w", err)
+	}
+	return subject, text, html.String(), nil
+}
+
+func renderText(text string, data TemplateData) (string, error) {
+	tpl, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	out := bytes.Buffer{}
+	err = tpl.Execute(&out, data)
+	return out.String(), err
+}
+
+// language picks the language of a mail, the requested one, if supported,
+// or the language of the mail configuration. Requests pass their
+// Content-Language.
+func (c *Client) language(requested string) string {
+	language := strings.ToUpper(requested)
+	if len(language) > 2 {
+		language = language[:2]
+	}
+	if _, ok := REPLY_TEXTS[language]; ok {
+		return language
+	}
+	if _, ok := REPLY_TEXTS[c.Language]; ok {
+		return c.Language
+	}
+	return LANGUAGE_DEFAULT
+}
+
+// template returns the template of the issuer or the built-in one.
+func (c *Client) template(languageCode string, kind string) *specs.MailTemplate {
+	if c.Templates != nil && c.IssuerId > 0 {
+		t, err := c.Templates.GetMailTemplate(c.IssuerId, languageCode, kind)
+		if err == nil {
+			return t
+		}
+		if !errors.Is(err, dbSql.ErrNoRows) {
+			c.log.Warn("cannot get mail template", "issuer_id", c.IssuerId, "language", languageCode,
+				"kind", kind, logging.Err(err))
+		}
+	}
+	return DefaultTemplate(languageCode, kind)
+}
+
+// renderReply creates a reply to a request from the template of a kind.
+func (c *Client) renderReply(request *Message, kind string, data TemplateData, created time.Time) (Message, error) {
+	msg, err := c.render(c.language(request.Language), kind, data, created)
+	if err != nil {
+		return msg, err
+	}
+	reply := NewReply(request, msg.Subject, msg.Body)
+	reply.HtmlBody = msg.HtmlBody
+	return reply, nil
+}
+
+// render creates a mail without recipients from the template of a kind.
+// The due date is calculated from created. Broken templates of the issuer
+// are logged and replaced by the built-in ones.
+func (c *Client) render(language string, kind string, data TemplateData, created time.Time) (Message, error) {
+	t := c.template(language, kind)
+
+	render := func(t *specs.MailTemplate) (Message, error) {
+		data.DueDate = ""
+		if t.DueDays > 0 {
+			data.DueDate = created.AddDate(0, 0, t.DueDays).Format(DUE_DATE_FORMAT)
+		}
+		subject, text, html, err := Render(t, data)
+		if err != nil {
+			return Message{}, err
+		}
+		return Message{
+			Subject:      subject,
+			Body:         text,
+			BodyMimeType: MIME_TYPE_TEXT,
+			HtmlBody:     html,
+		}, nil
+	}
+
+	msg, err := render(t)
+	if err != nil && t.IssuerId != 0 {
+		c.log.Warn("invalid mail template", "issuer_id", c.IssuerId, "language", language, "kind", kind,
+			logging.Err(err))
+		msg, err = render(DefaultTemplate(language, kind))
+	}
+	return msg, err
+}
@@ -0,0 +1,183 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const (
+	MAX_DKIM_SIGNATURES = 5
+
+	RULE_MAIL_SENDER = "mail_sender"
+)
+
+// LookupTXT resolves the public DKIM keys, tests replace it to avoid dns
+// queries.
+var LookupTXT = net.LookupTXT
+
+// Authentication holds the results of the sender authentication of a
+// received mail.
+type Authentication struct {
+	DkimDomains  []string    // domains of the valid DKIM signatures
+	DkimFailures []string    // domains and reasons of the invalid signatures
+	Spf          []SpfResult // passed SPF checks
+}
+
+// SpfResult is a passed SPF check, as noted by a receiving server in the
+// Authentication-Results header.
+type SpfResult struct {
+	ServId string // authserv-id of the server, which checked SPF
+	Domain string // domain of the envelope sender
+}
+
+// Authenticate verifies the DKIM signatures of a raw mail and collects the
+// passed SPF checks of its Authentication-Results headers. Of each server,
+// only the topmost headers are read.
+func Authenticate(raw []byte) Authentication {
+	auth := Authentication{}
+
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT:        LookupTXT,
+		MaxVerifications: MAX_DKIM_SIGNATURES,
+	})
+	if err != nil && err != dkim.ErrTooManySignatures {
+		auth.DkimFailures = append(auth.DkimFailures, err.Error())
+	}
+	for _, v := range verifications {
+		if v.Err != nil {
+			auth.DkimFailures = append(auth.DkimFailures, v.Domain+": "+v.Err.Error())
+			continue
+		}
+		auth.DkimDomains = append(auth.DkimDomains, strings.ToLower(v.Domain))
+	}
+
+	entity, err := message.Read(bytes.NewReader(raw))
+	if entity == nil {
+		return auth
+	}
+	// a server adds its headers on top of the received ones (RFC 8601 section
+	// 5), so only the topmost run of adjacent headers of a server is its own,
+	// lower ones with its authserv-id may be forged by the sender
+	var (
+		run    string          // authserv-id of the current run
+		closed map[string]bool = map[string]bool{}
+	)
+	fields := entity.Header.Fields()
+	for fields.Next() {
+		if !strings.EqualFold(fields.Key(), "Authentication-Results") {
+			closed[run] = true
+			run = ""
+			continue
+		}
+		servId, results, err := authres.Parse(fields.Value())
+		servId = strings.ToLower(servId)
+		if servId != run {
+			closed[run] = true
+			run = servId
+		}
+		if err != nil || closed[servId] {
+			continue
+		}
+		for _, r := range results {
+			spf, ok := r.(*authres.SPFResult)
+			if !ok || spf.Value != authres.ResultPass {
+				continue
+			}
+			auth.Spf = append(auth.Spf, SpfResult{
+				ServId: servId,
+				Domain: domainOf(spf.From),
+			})
+		}
+	}
+	return auth
+}
+
+// CheckSender verifies that the sender of a mail is whitelisted and
+// authenticated. As the From header alone can be forged, its domain must
+// match a valid DKIM signature or an SPF check passed on the server
+// authServId (empty to ignore SPF). The server must add its
+// Authentication-Results header to every received mail, otherwise a header
+// of the sender would be taken as its one.
+func CheckSender(msg *Message, whitelist []string, authServId string) error {
+	from := strings.ToLower(strings.TrimSpace(msg.From))
+	if from == "" {
+		return fmt.Errorf("sender unknown")
+	}
+
+	allowed := false
+	for _, pattern := range whitelist {
+		if matchWhitelist(from, pattern) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("sender %s not whitelisted", from)
+	}
+
+	domain := domainOf(from)
+	for _, d := range msg.Auth.DkimDomains {
+		if alignedDomain(domain, d) {
+			return nil
+		}
+	}
+	if authServId != "" {
+		for _, spf := range msg.Auth.Spf {
+			if spf.ServId == strings.ToLower(authServId) && alignedDomain(domain, spf.Domain) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("sender %s not authenticated by dkim or spf", from)
+}
+
+// matchWhitelist compares an address with a whitelist entry, which is an
+// address, *@domain or *@*.domain for all subdomains.
+func matchWhitelist(address string, pattern string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	switch {
+	case strings.HasPrefix(pattern, "*@*."):
+		return strings.HasSuffix(domainOf(address), pattern[3:])
+	case strings.HasPrefix(pattern, "*@"):
+		return domainOf(address) == pattern[2:]
+	default:
+		return address == pattern
+	}
+}
+
+// alignedDomain reports whether the authenticated domain is the domain of
+// the sender or one of its parents (relaxed alignment).
+func alignedDomain(domain string, authenticated string) bool {
+	authenticated = strings.ToLower(strings.TrimSuffix(authenticated, "."))
+	if authenticated == "" {
+		return false
+	}
+	return domain == authenticated || strings.HasSuffix(domain, "."+authenticated)
+}
+
+func domainOf(address string) string {
+	return strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+}
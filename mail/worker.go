@@ -18,48 +18,240 @@
 package mail
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/bill"
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/metrics"
 	"github.com/ChrIgiSta/swiss-qr-bill/specs"
 	"github.com/ChrIgiSta/swiss-qr-bill/sql"
+	"github.com/ChrIgiSta/swiss-qr-bill/webhook"
 )
 
-func ServeMails(mailConfig specs.MailConfig, db *sql.Db, wg *sync.WaitGroup, interval int) {
-	log.Println("ToDo: not all configurations from email config set")
-	client := NewMailClient(mailConfig.Username, mailConfig.Password, mailConfig.Email, mailConfig.SmtpHost, mailConfig.Pop3Host, mailConfig.Token)
+const (
+	POLL_RESULT_SUCCESS = "success"
+	POLL_RESULT_ERROR   = "error"
 
-	log.Println("mailer started")
+	MESSAGE_RESULT_GENERATED = "generated"
+	MESSAGE_RESULT_REJECTED  = "rejected"
+	MESSAGE_RESULT_FAILED    = "failed"
 
-	for true {
-		mails, err := client.GetMails()
+	RULE_MAIL_BODY = "mail_body"
+)
+
+// ServeMails polls the mailbox every interval seconds until ctx is done. A
+// mail in progress is completed before stopping.
+func ServeMails(ctx context.Context, mailConfig specs.MailConfig, db sql.Repository, logger *slog.Logger,
+	wg *sync.WaitGroup, interval int) {
+	defer wg.Done()
+
+	logger = logger.With("mailbox", mailConfig.Email)
+	client := NewMailClientFromConfig(mailConfig)
+	client.SetLogger(logger)
+	client.Templates = db
+	client.References = db
+	client.Mailbox = NewMailbox(mailConfig, client.AttachmentDir, logger)
+	defer client.Mailbox.Close()
+
+	logger.Info("mailer started", "protocol", orDefault(mailConfig.Protocol, PROTOCOL_POP3))
+
+	timeout := time.Duration(interval) * time.Second
+	for ctx.Err() == nil {
+		err := client.Receive(ctx, func(mail *Message) bool {
+			if mail.Bounce != nil {
+				return processBounce(logging.WithMailId(ctx, mail.Id), logger, mailConfig, db, mail)
+			}
+			return processMail(logging.WithMailId(ctx, mail.Id), logger, client, mailConfig, db, mail)
+		})
+		setPollStatus(mailConfig.Email, err)
 		if err != nil {
-			log.Println("error while reciving email", err)
-			goto pass
+			logger.Warn("error while reciving email", logging.Err(err))
+			metrics.MailPolls.Inc(mailConfig.Email, POLL_RESULT_ERROR)
+		} else {
+			metrics.MailPolls.Inc(mailConfig.Email, POLL_RESULT_SUCCESS)
 		}
-		for _, mail := range mails {
-			// gen qr and bill
-			iban, issuer, err := db.GetIssuer(mailConfig.IssuerId)
-			if err != nil {
-				log.Println("error bet issuer from db", err)
-			}
-			receipt, billingDetails, err := client.GetBillingInformationsFromBody(mail.Body)
-			q := qr.NewSwissBillQr(&issuer)
-			billingDetails.IBAN = iban
-			q.GetSwissPaymentQR(&receipt, &billingDetails, "mail_generated_qr.png")
-			if len(mail.Attachments) > 0 {
-				// get pdf name
-			}
-			// send back
-			// delete pdf
-			log.Println(mail)
+
+		err = client.Mailbox.Wait(ctx, timeout)
+		if err != nil && ctx.Err() == nil {
+			logger.Warn("error while waiting for new mails", logging.Err(err))
+			waitTimeout(ctx, timeout)
+		}
+	}
+
+	logger.Info("mailer exited")
+}
+
+// processMail generates the bill requested by a mail and replies with the
+// pdf or the reason, why it failed. Mails of untrusted senders are dropped
+// without a reply, as their sender address might be forged. It returns
+// true, if the bill was generated. A panic fails the mail only, the mailer
+// and the api keep running.
+func processMail(ctx context.Context, logger *slog.Logger, client *Client, mailConfig specs.MailConfig,
+	db sql.Repository, mail *Message) (generated bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.ErrorContext(ctx, "panic while processing mail", "panic", r, "stack", string(debug.Stack()))
+			metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_FAILED)
+			generated = false
+		}
+	}()
+
+	if mailConfig.UseWhitelist {
+		whitelist, err := db.GetMailWhitelist(mailConfig.Id)
+		if err != nil {
+			logger.ErrorContext(ctx, "cannot get mail whitelist", logging.Err(err))
+			metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_FAILED)
+			return false
+		}
+		err = CheckSender(mail, whitelist, mailConfig.AuthServId)
+		if err != nil {
+			logger.WarnContext(ctx, "mail rejected", "from", mail.From, "dkim", mail.Auth.DkimDomains,
+				"dkim_failures", mail.Auth.DkimFailures, "spf", mail.Auth.Spf, logging.Err(err))
+			metrics.ValidationFailures.Inc(RULE_MAIL_SENDER)
+			metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_REJECTED)
+			return false
+		}
+	}
+
+	reply := func(b *specs.Bill, reason string, help bool) {
+		var err error
+		if b != nil {
+			err = client.ReplyBill(mail, b)
+		} else {
+			err = client.ReplyError(mail, reason, help)
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "cannot send reply", logging.Err(err))
+		}
+	}
+
+	// gen qr and bill
+	iban, issuer, err := db.GetIssuer(mailConfig.IssuerId)
+	if err != nil {
+		logger.ErrorContext(ctx, "error get issuer from db", logging.Err(err))
+		metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_FAILED)
+		reply(nil, REPLY_INTERNAL_ERROR, false)
+		return false
+	}
+	req, err := client.ParseRequest(mail, mailConfig.IssuerId, iban, issuer)
+	if err != nil {
+		logger.InfoContext(ctx, "error while reading billing informations", logging.Err(err))
+		metrics.ValidationFailures.Inc(RULE_MAIL_BODY)
+		metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_REJECTED)
+		reply(nil, err.Error(), true)
+		return false
+	}
+	if req.Batch {
+		return processBatch(ctx, logger, client, db, mailConfig, mail, req)
+	}
+
+	b := req.Rows[0].Bill
+	if b == nil {
+		logger.InfoContext(ctx, "invalid bill information", logging.Err(req.Rows[0].Err))
+		metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_REJECTED)
+		reply(nil, req.Rows[0].Err.Error(), true)
+		return false
+	}
+
+	// the first pdf is the invoice, the bill is appended to it
+	var existingPdf interface{}
+	pdfs := mail.AttachmentsOf(MIME_TYPE_PDF)
+	if len(pdfs) > 0 {
+		existingPdf = pdfs[0].FileName
+	}
+	if len(pdfs) > 1 {
+		logger.DebugContext(ctx, "ignore further pdf attachments", "attachments", len(pdfs))
+	}
+	err = generateBill(ctx, logger, db, b, existingPdf)
+	if errors.Is(err, sql.ErrDuplicateReference) {
+		metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_REJECTED)
+		reply(nil, err.Error(), false)
+		return false
+	} else if err != nil {
+		metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_FAILED)
+		reply(nil, REPLY_INTERNAL_ERROR, false)
+		return false
+	}
+	metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_GENERATED)
+
+	reply(b, "", false)
+	logger.InfoContext(ctx, "bill generated from mail", "bill_id", b.Id, "to", mail.To)
+	return true
+}
+
+// processBatch generates the valid rows of a batch and replies with their
+// pdfs, along with the rows, which failed. It returns true, if at least one
+// bill was generated.
+func processBatch(ctx context.Context, logger *slog.Logger, client *Client, db sql.Repository,
+	mailConfig specs.MailConfig, mail *Message, req Request) bool {
+	generated := 0
+	for i, row := range req.Rows {
+		if row.Bill == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			req.Rows[i].Bill, req.Rows[i].Err = nil, errors.New("canceled")
+			continue
+		}
+		err := generateBill(ctx, logger, db, row.Bill, nil)
+		if errors.Is(err, sql.ErrDuplicateReference) {
+			req.Rows[i].Bill, req.Rows[i].Err = nil, err
+			continue
+		} else if err != nil {
+			req.Rows[i].Bill, req.Rows[i].Err = nil, errors.New(REPLY_INTERNAL_ERROR)
+			continue
+		}
+		generated++
+	}
+
+	if generated == 0 {
+		logger.InfoContext(ctx, "no valid row in batch", "rows", len(req.Rows))
+		metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_REJECTED)
+		failures := []string{}
+		for _, row := range req.Rows {
+			failures = append(failures, fmt.Sprintf("row %d: %s", row.Row, row.Err))
 		}
+		err := client.ReplyError(mail, strings.Join(failures, "\n    "), true)
+		if err != nil {
+			logger.ErrorContext(ctx, "cannot send reply", logging.Err(err))
+		}
+		return false
+	}
+	metrics.MailMessages.Inc(mailConfig.Email, MESSAGE_RESULT_GENERATED)
 
-	pass:
-		time.Sleep(time.Duration(interval) * time.Second)
+	err := client.ReplyBills(mail, req.Rows, req.Merged)
+	if err != nil {
+		logger.ErrorContext(ctx, "cannot send reply", logging.Err(err))
 	}
+	logger.InfoContext(ctx, "bills generated from mail", "bills", generated, "rows", len(req.Rows),
+		"merged", req.Merged, "to", mail.To)
+	return true
+}
 
-	log.Println("mailer exited")
+// generateBill renders the pdf of a bill, stores it and emits the webhook.
+// Bills, which can't be stored, are sent anyway, unless the issuer has a
+// bill with the reference already.
+func generateBill(ctx context.Context, logger *slog.Logger, db sql.Repository, b *specs.Bill, existingPdf interface{}) error {
+	err := bill.Generate(ctx, b, bill.Translation(db, b.IssuerId, b.LanguageCode), existingPdf)
+	if err != nil {
+		logger.ErrorContext(ctx, "error while generating bill", logging.Err(err))
+		return err
+	}
+	err = db.InsertBill(b)
+	if errors.Is(err, sql.ErrDuplicateReference) {
+		logger.InfoContext(ctx, "duplicate reference", "reference", b.Details.Referece)
+		return err
+	} else if err != nil {
+		logger.ErrorContext(ctx, "error while storing bill", logging.Err(err))
+	} else if err = webhook.Emit(db, webhook.EVENT_BILL_GENERATED, b); err != nil {
+		logger.ErrorContext(ctx, "error while emitting webhook", logging.Err(err))
+	}
+	return nil
 }
@@ -18,18 +18,29 @@
 package main
 
 import (
+	"context"
+	dbSql "database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/ChrIgiSta/swiss-qr-bill/api"
+	"github.com/ChrIgiSta/swiss-qr-bill/bill"
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
 	"github.com/ChrIgiSta/swiss-qr-bill/mail"
 	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/secret"
 	"github.com/ChrIgiSta/swiss-qr-bill/specs"
 	"github.com/ChrIgiSta/swiss-qr-bill/sql"
 	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+	"github.com/ChrIgiSta/swiss-qr-bill/webhook"
 )
 
 const (
@@ -38,25 +49,66 @@ const (
 
 func main() {
 	var wg sync.WaitGroup = sync.WaitGroup{}
-	defer wg.Wait()
-	defer log.Println("qr app stopped")
 
-	fmt.Println("start qr app")
+	logger := logging.FromEnv()
+	slog.SetDefault(logger)
+	bill.SetLogger(logger)
 
-	connectionString := os.Getenv("SQL_USER") + ":" + os.Getenv("SQL_PASSWORD") + "@" +
-		"tcp(" + os.Getenv("SQL_HOST") + ":" + os.Getenv("SQL_PORT") + ")/" + os.Getenv("SQL_DATABASE")
-	log.Println("use db: " + connectionString)
+	logger.Info("start qr app")
 
-	db := sql.NewMariaDb(connectionString)
-	err := db.Connect()
+	// stop gracefully on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(os.Args) > 2 && os.Args[1] == "secrets" && os.Args[2] == "generate" {
+		key, err := secret.GenerateKey()
+		if err != nil {
+			fatal("cannot generate key", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	keyring, err := secret.FromEnv()
+	if err != nil {
+		fatal("invalid secret key", err)
+	}
+	if keyring == nil {
+		logger.Warn("no SECRET_KEY set, secrets are stored in plaintext")
+	}
+
+	db, err := sql.NewFromEnv()
+	if err != nil {
+		fatal("invalid database", err)
+	}
+	db.SetLogger(logger)
+	db.SetKeyring(keyring)
+	err = db.Connect()
 
 	if err != nil {
-		log.Fatal("cannot connect to db. ", err)
+		fatal("cannot connect to db", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err = migrateCommand(ctx, db, os.Args[2:])
+		db.Close()
+		if err != nil {
+			fatal("migration failed", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "secrets" {
+		err = secretsCommand(ctx, db, os.Args[2:])
+		db.Close()
+		if err != nil {
+			fatal("rotating secrets failed", err)
+		}
+		return
 	}
 
-	ver, err := db.CheckVersion()
-	if err != nil && !strings.ContainsAny(err.Error(), "Error 1146:") {
-		log.Fatal("cannot get version. ", err)
+	ver, err := migrate(ctx, db, os.Getenv("SQL_MIGRATE") != "false")
+	if err != nil {
+		fatal("cannot migrate database", err)
 	}
 
 	// init from env
@@ -65,44 +117,153 @@ func main() {
 	if primAcc != nil {
 		_, issuerId, err = db.InsertIssuer(iban, *primAcc)
 		if err != nil {
-			log.Println("couldn't add primary issuer from env. ", err.Error())
+			logger.Error("couldn't add primary issuer from env", logging.Err(err))
 		} else {
-			log.Println("added primary issuer with id ", issuerId)
+			logger.Info("added primary issuer", "issuer_id", issuerId)
+		}
+	}
+	refFormat := getPrimaryReferenceFormat(issuerId)
+	if refFormat != nil {
+		err = bill.ValidateReferenceFormat(refFormat)
+		if err == nil {
+			err = db.SetReferenceFormat(refFormat)
+		}
+		if err != nil {
+			logger.Error("couldn't set primary reference format from env", logging.Err(err))
 		}
 	}
 	mailCnf := getPrimaryMailSettings(issuerId)
 	if mailCnf != nil {
-		log.Println("insert primary mail config")
+		logger.Info("insert primary mail config")
 		err = db.InsertMailConfig(mailCnf)
 		if err != nil {
-			log.Println("couldn't add primary email config from env.", err.Error())
+			logger.Error("couldn't add primary email config from env", logging.Err(err))
+		} else {
+			for _, email := range mailWhitelist() {
+				err = db.InsertMailWhitelist(mailCnf.Id, email)
+				if err != nil {
+					logger.Error("couldn't add mail whitelist from env", "email", email, logging.Err(err))
+				}
+			}
 		}
 	}
 
-	log.Println("starting @ version ", ver)
+	err = addPrimaryApiKey(db, os.Getenv("API_TOKEN"))
+	if err != nil {
+		logger.Error("couldn't add primary api key from env", logging.Err(err))
+	}
+
+	logger.Info("starting", "schema_version", ver)
 
 	// run api server
 
-	log.Println("start api server")
-	qrApi := api.NewApi("v1", 3000, db)
-	wg.Add(1)
-	go qrApi.Run(&wg)
+	logger.Info("start api server")
+	qrApi := api.NewApi("v1", API_LISTEN_PORT, db)
+	qrApi.SetLogger(logger)
+	qrApi.SetRateLimits(api.RateLimitsFromEnv())
+	qrApi.SetTLS(os.Getenv("API_TLS_CERT"), os.Getenv("API_TLS_KEY"))
+	wg.Add(4)
+	go qrApi.Run(ctx, &wg)
+	go qrApi.RunJobs(ctx, &wg)
+	dispatcher := webhook.NewDispatcher(db)
+	dispatcher.SetLogger(logger)
+	go dispatcher.Run(ctx, &wg)
+	outbox := mail.NewOutbox(db)
+	outbox.SetLogger(logger)
+	go outbox.Run(ctx, &wg)
 
 	// run mail cient
 
 	mailCnfs, err := db.GetMailConfigurations()
 	if err != nil {
-		log.Fatal("cannot get mail configs")
+		fatal("cannot get mail configs", err)
 	}
 
 	for _, mailCnf := range mailCnfs {
 		if mailCnf != nil {
 			if mailCnf.Enable {
 				wg.Add(1)
-				go mail.ServeMails(*mailCnf, db, &wg, 10)
+				go mail.ServeMails(ctx, *mailCnf, db, logger, &wg, 10)
+			}
+		}
+	}
+
+	<-ctx.Done()
+	logger.Info("stopping qr app")
+	wg.Wait()
+	db.Close()
+	logger.Info("qr app stopped")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, logging.Err(err))
+	os.Exit(1)
+}
+
+// migrate applies pending migrations, or with apply false fails if there
+// are any. It returns the schema version.
+func migrate(ctx context.Context, db *sql.Db, apply bool) (int, error) {
+	if apply {
+		count, err := db.Migrate(ctx)
+		if err != nil {
+			return 0, err
+		}
+		slog.Info("database migrated", "applied", count)
+	} else {
+		migrations, err := db.MigrationStatus(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, m := range migrations {
+			if m.AppliedAt == nil {
+				return 0, fmt.Errorf("migration %d_%s is pending, run migrate", m.Version, m.Name)
 			}
 		}
 	}
+	return db.SchemaVersion(ctx)
+}
+
+// migrateCommand runs "migrate" to apply the pending migrations or
+// "migrate status" to list them.
+func migrateCommand(ctx context.Context, db *sql.Db, args []string) error {
+	if len(args) == 0 {
+		_, err := migrate(ctx, db, true)
+		return err
+	}
+	if args[0] != "status" {
+		return fmt.Errorf("unknown command %q, use migrate [status]", args[0])
+	}
+
+	migrations, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if m.AppliedAt != nil {
+			state = "applied " + m.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%04d %-30s %s\n", m.Version, m.Name, state)
+	}
+	return nil
+}
+
+// secretsCommand runs "secrets rotate" to encrypt the stored secrets with
+// the primary key. "secrets generate" is handled before connecting.
+func secretsCommand(ctx context.Context, db *sql.Db, args []string) error {
+	if len(args) != 1 || args[0] != "rotate" {
+		return errors.New("unknown command, use secrets rotate|generate")
+	}
+	_, err := migrate(ctx, db, false)
+	if err != nil {
+		return err
+	}
+	count, err := db.RotateSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("secrets rotated", "count", count)
+	return nil
 }
 
 func getPrimaryIssuerFromEnv() (*specs.AccountDetails, string) {
@@ -124,33 +285,105 @@ func getPrimaryIssuerFromEnv() (*specs.AccountDetails, string) {
 			if err := utils.ValidateIban(iban); err == nil {
 				return &primatyAccount, iban
 			} else {
-				log.Println("no valid iban in initial issuer", err.Error())
+				slog.Warn("no valid iban in initial issuer", logging.Err(err))
 			}
 		}
-		log.Println("no valid country set")
+		slog.Warn("no valid country set")
 	}
-	log.Println("no primary account set")
+	slog.Info("no primary account set")
 	return nil, ""
 }
 
+// addPrimaryApiKey registers the token from the env as api key with all
+// scopes, if it isn't known yet.
+func addPrimaryApiKey(db sql.ApiKeyRepository, token string) error {
+	if token == "" {
+		return nil
+	}
+	hash := utils.GetSha256([]byte(token))
+	_, err := db.GetApiKeyByHash(hash)
+	if !errors.Is(err, dbSql.ErrNoRows) {
+		return err
+	}
+
+	slog.Info("add primary api key")
+	return db.InsertApiKey(&specs.ApiKey{
+		Name:      "primary",
+		TokenHash: hash,
+		Scopes:    []string{api.SCOPE_ALL},
+		Enable:    true,
+	})
+}
+
+// getPrimaryReferenceFormat reads the format of the QRR references of the
+// primary issuer, if REFERENCE_BESR_ID or REFERENCE_CUSTOMER_DIGITS is set.
+func getPrimaryReferenceFormat(issuerId int) *specs.ReferenceFormat {
+	besrId := os.Getenv("REFERENCE_BESR_ID")
+	customerDigits := os.Getenv("REFERENCE_CUSTOMER_DIGITS")
+	if issuerId < 0 || (besrId == "" && customerDigits == "") {
+		return nil
+	}
+
+	f := &specs.ReferenceFormat{IssuerId: issuerId, BesrId: besrId}
+	if customerDigits != "" {
+		digits, err := strconv.Atoi(customerDigits)
+		if err != nil {
+			slog.Error("invalid REFERENCE_CUSTOMER_DIGITS", logging.Err(err))
+			return nil
+		}
+		f.CustomerDigits = digits
+	}
+	return f
+}
+
 func getPrimaryMailSettings(issuerId int) *specs.MailConfig {
 	mailCnf := specs.MailConfig{}
 
 	mailCnf.Enable = true
 	mailCnf.Email = os.Getenv("MAIL_SENDER_ADDRESS")
+	mailCnf.SenderName = os.Getenv("MAIL_SENDER_NAME")
+	mailCnf.LanguageCode = strings.ToUpper(os.Getenv("MAIL_LANGUAGE"))
 	mailCnf.IssuerId = issuerId
+	mailCnf.Username = os.Getenv("MAIL_USER")
 	mailCnf.Password = os.Getenv("MAIL_PASSWORD")
 	mailCnf.Pop3Host = os.Getenv("MAIL_POP3_HOST")
-	mailCnf.Pop3Port = 995
-	mailCnf.Pop3Secure = true
+	mailCnf.Pop3Port = mail.POP3_PORT
+	mailCnf.Pop3Secure = os.Getenv("MAIL_POP3_SECURE") != "false"
 	mailCnf.SmtpHost = os.Getenv("MAIL_SMTP_HOST")
-	mailCnf.SmtpPort = 587
-	mailCnf.SmtpSecure = true
+	mailCnf.SmtpPort = mail.SMTP_PORT
+	mailCnf.SmtpSecure = os.Getenv("MAIL_SMTP_SECURE") != "false"
+	ports := map[string]*int{
+		"MAIL_POP3_PORT": &mailCnf.Pop3Port,
+		"MAIL_SMTP_PORT": &mailCnf.SmtpPort,
+	}
+	for env, val := range ports {
+		if os.Getenv(env) == "" {
+			continue
+		}
+		port, err := strconv.Atoi(os.Getenv(env))
+		if err != nil || port <= 0 || port > 65535 {
+			slog.Warn("ignore invalid port", "env", env)
+			continue
+		}
+		*val = port
+	}
 	mailCnf.Token = os.Getenv("MAIL_TOKEN")
-	mailCnf.UseWhitelist = false
+	mailCnf.UseWhitelist = len(mailWhitelist()) > 0
+	mailCnf.AuthServId = os.Getenv("MAIL_AUTHSERV_ID")
 
 	if mailCnf.Email != "" && mailCnf.Pop3Host != "" && mailCnf.SmtpHost != "" {
 		return &mailCnf
 	}
 	return nil
 }
+
+// mailWhitelist reads the comma separated senders of MAIL_WHITELIST.
+func mailWhitelist() []string {
+	whitelist := []string{}
+	for _, email := range strings.Split(os.Getenv("MAIL_WHITELIST"), ",") {
+		if strings.TrimSpace(email) != "" {
+			whitelist = append(whitelist, strings.TrimSpace(email))
+		}
+	}
+	return whitelist
+}
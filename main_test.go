@@ -18,17 +18,45 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	dbSql "database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ChrIgiSta/swiss-qr-bill/api"
 	"github.com/ChrIgiSta/swiss-qr-bill/bill"
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
 	"github.com/ChrIgiSta/swiss-qr-bill/mail"
+	"github.com/ChrIgiSta/swiss-qr-bill/mail/mailtest"
+	"github.com/ChrIgiSta/swiss-qr-bill/metrics"
 	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/secret"
 	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/sql"
+	"github.com/ChrIgiSta/swiss-qr-bill/sql/sqltest"
 	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+	"github.com/ChrIgiSta/swiss-qr-bill/webhook"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/phpdave11/gofpdi"
 )
 
 const (
@@ -38,6 +66,9 @@ const (
 
 	PDF_TEST_SUBMISSION = `graphics/pdf-bill-example.pdf`
 
+	// sha256 of the init.sql of v1.0.0
+	INIT_SQL_CHECKSUM = "aef4fe450eeae195b85519b4c05aeb43c9334520e80b73bd69d1ead423af3267"
+
 	QR_SHOULD = `SPC
 0200
 1
@@ -92,6 +123,12 @@ func TestToken(t *testing.T) {
 	if randToken.Plain == randToken2.Plain {
 		t.Error("token not random (seed)")
 	}
+	if !utils.ValidateToken(randToken.Plain, randToken.Sha256) {
+		t.Error("token validation of own hash")
+	}
+	if utils.ValidateToken(randToken2.Plain, randToken.Sha256) {
+		t.Error("token validated with foreign hash")
+	}
 }
 
 func TestUtils(t *testing.T) {
@@ -130,6 +167,389 @@ func TestUtils(t *testing.T) {
 	}
 }
 
+func TestWebhook(t *testing.T) {
+	// echo -n '1700000000.{"event":"bill.paid"}' | openssl dgst -sha256 -hmac secret
+	sig := webhook.Sign("secret", "1700000000", []byte(`{"event":"bill.paid"}`))
+	if sig != "5a00a12589ea803f39acd964a8137fb1b607b30695c946081ad8a2eb67d6f2e3" {
+		t.Error("signature: ", sig)
+	}
+	if webhook.Sign("other", "1700000000", []byte(`{"event":"bill.paid"}`)) == sig {
+		t.Error("signature independent of secret")
+	}
+
+	if webhook.Backoff(1) != webhook.BACKOFF_BASE || webhook.Backoff(3) != 4*webhook.BACKOFF_BASE {
+		t.Error("backoff not exponential")
+	}
+	if webhook.Backoff(100) != webhook.BACKOFF_MAX {
+		t.Error("backoff not capped")
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	db := sqltest.Sqlite(t)
+	issuerId := newTestIssuer(t, db)
+	key, _ := secret.GenerateKey()
+	raw, _ := secret.ParseKey(key)
+	keyring, err := secret.NewKeyring(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetKeyring(keyring)
+	hook := &specs.Webhook{IssuerId: issuerId, Url: "http://127.0.0.1:1/hook", Secret: "secret",
+		Events: webhook.EVENTS, Enable: true}
+	err = db.InsertWebhook(hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := &specs.WebhookDelivery{WebhookId: hook.Id, Event: webhook.EVENT_BILL_PAID,
+		Payload: `{"event":"bill.paid"}`, NextAttemptAt: time.Now().Add(-time.Second)}
+	err = db.InsertWebhookDelivery(delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dispatch runs a dispatcher, until the delivery was attempted
+	dispatch := func(attempts int) *specs.WebhookDelivery {
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go webhook.NewDispatcher(db).Run(ctx, &wg)
+		defer func() {
+			cancel()
+			wg.Wait()
+		}()
+		for i := 0; i < 100; i++ {
+			stored, err := db.GetWebhookDelivery(delivery.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Attempts >= attempts {
+				return stored
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("delivery not attempted: ", attempts)
+		return nil
+	}
+
+	// the secret doesn't decrypt after a key change, the delivery is retried
+	// later instead of blocking the dispatcher
+	other, _ := secret.GenerateKey()
+	raw, _ = secret.ParseKey(other)
+	keyring, _ = secret.NewKeyring(raw)
+	db.SetKeyring(keyring)
+	stored := dispatch(1)
+	if stored.State != sql.DELIVERY_STATE_PENDING ||
+		!strings.Contains(stored.LastError, secret.ErrUnknownKey.Error()) ||
+		!stored.NextAttemptAt.After(time.Now().Add(webhook.BACKOFF_BASE/2)) {
+		t.Errorf("undecryptable webhook: %+v", stored)
+	}
+	due, err := db.GetDueWebhookDeliveries(time.Now(), webhook.BATCH_SIZE)
+	if err != nil || len(due) != 0 {
+		t.Error("delivery due again: ", len(due), err)
+	}
+
+	stored.Attempts, stored.NextAttemptAt = webhook.MAX_ATTEMPTS-1, time.Now().Add(-time.Second)
+	err = db.UpdateWebhookDelivery(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored = dispatch(webhook.MAX_ATTEMPTS)
+	if stored.State != sql.DELIVERY_STATE_FAILED || stored.LastError == "" {
+		t.Errorf("undecryptable webhook after max attempts: %+v", stored)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	versions := 0
+	for _, dialect := range []string{sql.DIALECT_MARIADB, sql.DIALECT_POSTGRES, sql.DIALECT_SQLITE} {
+		migrations, err := sql.Migrations(dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if versions == 0 {
+			versions = len(migrations)
+		}
+		if len(migrations) < 3 || len(migrations) != versions {
+			t.Errorf("%s: versions of the dialects differ", dialect)
+		}
+		for i, m := range migrations {
+			if m.Version != i+1 || m.Name == "" || len(m.Checksum) != 64 {
+				t.Errorf("%s migration %d: %d_%s", dialect, i, m.Version, m.Name)
+			}
+			if len(m.Statements()) == 0 {
+				t.Errorf("%s migration %d_%s has no statements", dialect, m.Version, m.Name)
+			}
+		}
+	}
+
+	m := sql.Migration{Sql: `-- header; with semicolon
+CREATE TABLE a (id INT); # trailing
+/* block; comment */ INSERT INTO a VALUES ('x;''y', "it\'s;", 1--1);
+
+`}
+	statements := m.Statements()
+	if len(statements) != 2 || statements[0] != "CREATE TABLE a (id INT)" ||
+		!strings.HasSuffix(statements[1], `INSERT INTO a VALUES ('x;''y', "it\'s;", 1--1)`) {
+		t.Errorf("statements: %q", statements)
+	}
+}
+
+// TestMigrateBaseline upgrades a database created from the init.sql of
+// v1.0.0, if TEST_MARIADB_BASELINE is the connection string of an empty
+// mariadb database.
+func TestMigrateBaseline(t *testing.T) {
+	migrations, err := sql.Migrations(sql.DIALECT_MARIADB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrations[0].Checksum != INIT_SQL_CHECKSUM {
+		t.Fatal("mariadb migration 1 is not the init.sql of v1.0.0")
+	}
+	dsn := os.Getenv("TEST_MARIADB_BASELINE")
+	if dsn == "" {
+		t.Skip("TEST_MARIADB_BASELINE not set")
+	}
+
+	v1, err := dbSql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v1.Close()
+	tables := 0
+	err = v1.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE()").Scan(&tables)
+	if err != nil || tables > 0 {
+		t.Fatal("TEST_MARIADB_BASELINE is not empty: ", tables, err)
+	}
+	statements := migrations[0].Statements()
+	statements = append(statements,
+		"INSERT INTO issuer (fistname, lastname, address1, zip, location, country, iban) "+
+			"VALUES ('Hans', 'Muster', 'Bahnhofstrasse 1', '8000', 'Vaduz', 'FL', '"+sqltest.IBAN+"')",
+		"INSERT INTO customer (fistname, lastname, address1, zip, location, country) "+
+			"VALUES ('Peter', 'Meier', 'Dorfstrasse 2', '9490', 'Vaduz', 'FL')",
+		"INSERT INTO bill (cust_id, ts, ref_type, reference, currency, amount) "+
+			"VALUES (1, CURRENT_TIMESTAMP, 'NON', '', 'CHF', 10)",
+		"INSERT INTO api (token, enable) VALUES ('v1-token', true)",
+		"INSERT INTO mail (token, enable, issuer_id, username, email, password) "+
+			"VALUES ('bill', true, 1, 'bills', 'bills@example.org', 'secret')",
+		"INSERT INTO mail_whitelist (email) VALUES ('hans@example.org')")
+	for _, statement := range statements {
+		_, err = v1.Exec(statement)
+		if err != nil {
+			t.Fatal(statement, ": ", err)
+		}
+	}
+
+	db := sqltest.Open(t, sql.DIALECT_MARIADB, dsn)
+	status, err := db.MigrationStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range status {
+		if m.AppliedAt == nil {
+			t.Errorf("migration %d_%s not applied", m.Version, m.Name)
+		}
+	}
+
+	_, issuer, err := db.GetIssuer(1)
+	if err != nil || issuer.Country != "LI" || issuer.Name != "Muster Hans" {
+		t.Errorf("issuer of v1.0.0: %+v %v", issuer, err)
+	}
+	customer, err := db.GetCustomer(1)
+	if err != nil || customer.Country != "LI" {
+		t.Errorf("customer of v1.0.0: %+v %v", customer, err)
+	}
+	key, err := db.GetApiKeyByHash(utils.GetSha256([]byte("v1-token")))
+	if err != nil || !key.HasScope(api.SCOPE_ALL) {
+		t.Errorf("api token of v1.0.0: %+v %v", key, err)
+	}
+	configs, err := db.GetMailConfigurations()
+	if err != nil || len(configs) != 1 || configs[0].Id <= 0 || configs[0].Pop3Port != 993 {
+		t.Fatal("mail config of v1.0.0: ", len(configs), err)
+	}
+	whitelist, err := db.GetMailWhitelist(configs[0].Id)
+	if err != nil || len(whitelist) != 1 || whitelist[0] != "hans@example.org" {
+		t.Errorf("mail whitelist of v1.0.0: %v %v", whitelist, err)
+	}
+
+	sqltest.Run(t, db)
+}
+
+// TestRepository runs the conformance tests on sqlite and, if their
+// connection strings are set, on mariadb (TEST_MARIADB) and postgres
+// (TEST_POSTGRES).
+func TestRepository(t *testing.T) {
+	t.Run(sql.DIALECT_SQLITE, func(t *testing.T) {
+		sqltest.Run(t, sqltest.Sqlite(t))
+	})
+	t.Run(sql.DIALECT_MARIADB, func(t *testing.T) {
+		if os.Getenv("TEST_MARIADB") == "" {
+			t.Skip("TEST_MARIADB not set")
+		}
+		sqltest.Run(t, sqltest.Open(t, sql.DIALECT_MARIADB, os.Getenv("TEST_MARIADB")))
+	})
+	t.Run(sql.DIALECT_POSTGRES, func(t *testing.T) {
+		if os.Getenv("TEST_POSTGRES") == "" {
+			t.Skip("TEST_POSTGRES not set")
+		}
+		sqltest.Run(t, sqltest.Open(t, sql.DIALECT_POSTGRES, os.Getenv("TEST_POSTGRES")))
+	})
+}
+
+func TestSecrets(t *testing.T) {
+	oldKey, _ := secret.GenerateKey()
+	newKey, _ := secret.GenerateKey()
+	rawOld, err := secret.ParseKey(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNew, _ := secret.ParseKey(newKey)
+	old, err := secret.NewKeyring(rawOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := secret.NewKeyring(rawNew, rawOld)
+	current, _ := secret.NewKeyring(rawNew)
+
+	enc, err := old.Encrypt("myMailPassword", sql.SECRET_MAIL_PASSWORD)
+	if err != nil || !secret.IsEncrypted(enc) || strings.Contains(enc, "myMailPassword") {
+		t.Fatal("encrypt: ", enc, err)
+	}
+	plain, err := old.Decrypt(enc, sql.SECRET_MAIL_PASSWORD)
+	if err != nil || plain != "myMailPassword" {
+		t.Error("decrypt: ", plain, err)
+	}
+	if _, err = old.Decrypt(enc, sql.SECRET_WEBHOOK_SECRET); err == nil {
+		t.Error("decrypted with another context")
+	}
+	if _, err = current.Decrypt(enc, sql.SECRET_MAIL_PASSWORD); !errors.Is(err, secret.ErrUnknownKey) {
+		t.Error("decrypted with an unknown key: ", err)
+	}
+	var none *secret.Keyring
+	if _, err = none.Decrypt(enc, sql.SECRET_MAIL_PASSWORD); !errors.Is(err, secret.ErrNoKey) {
+		t.Error("decrypted without key: ", err)
+	}
+	if plain, _ = current.Decrypt("legacy", sql.SECRET_MAIL_PASSWORD); plain != "legacy" {
+		t.Error("plaintext: ", plain)
+	}
+	if !rotated.NeedsRotation(enc) || !rotated.NeedsRotation("legacy") || old.NeedsRotation(enc) {
+		t.Error("needs rotation")
+	}
+	if _, err = secret.ParseKey("c2hvcnQ="); err == nil {
+		t.Error("short key accepted")
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(keyFile, []byte("# primary\n"+newKey+"\n"+oldKey+"\n"), 0600)
+	t.Setenv("SECRET_KEY_FILE", keyFile)
+	fromFile, err := secret.FromEnv()
+	if err != nil || fromFile.PrimaryId() != rotated.PrimaryId() {
+		t.Fatal("key file: ", err)
+	}
+	if plain, err = fromFile.Decrypt(enc, sql.SECRET_MAIL_PASSWORD); err != nil || plain != "myMailPassword" {
+		t.Error("old key of the key file: ", plain, err)
+	}
+
+	// stored encrypted, plaintext rows of an older release are rotated
+	db := sqltest.Sqlite(t)
+	legacy := specs.MailConfig{Email: "legacy@test.ch", Password: "legacyPassword", Token: "qr"}
+	if err = db.InsertMailConfig(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	_, issuerId, err := db.InsertIssuer(sqltest.IBAN, specs.AccountDetails{AddressType: qr.ADDRESS_TYPE_STRUCTURED,
+		Name: "Muster Hans", Address1: "Bahnhofstrasse 1", Zip: "8000", Location: "Zürich", Country: "CH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetKeyring(old)
+	mailCnf := specs.MailConfig{Enable: true, Email: "qr@test.ch", Password: "myMailPassword", Token: "qr"}
+	hook := specs.Webhook{IssuerId: issuerId, Url: "https://example.com/hook", Secret: "hookSecret", Enable: true}
+	if err = db.InsertMailConfig(&mailCnf); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.InsertWebhook(&hook); err != nil {
+		t.Fatal(err)
+	}
+	mailCnfs, err := db.GetMailConfigurations()
+	if err != nil || len(mailCnfs) != 1 || mailCnfs[0].Password != "myMailPassword" {
+		t.Fatal("transparent decrypt: ", mailCnfs, err)
+	}
+	db.SetKeyring(nil)
+	if _, err = db.GetMailConfig(mailCnf.Id); !errors.Is(err, secret.ErrNoKey) {
+		t.Error("stored in plaintext: ", err)
+	}
+
+	db.SetKeyring(rotated)
+	count, err := db.RotateSecrets(context.Background())
+	if err != nil || count != 3 {
+		t.Fatal("rotate: ", count, err)
+	}
+	if count, _ = db.RotateSecrets(context.Background()); count != 0 {
+		t.Error("rotated twice: ", count)
+	}
+	db.SetKeyring(current)
+	for _, c := range []specs.MailConfig{mailCnf, legacy} {
+		got, err := db.GetMailConfig(c.Id)
+		if err != nil || got.Password != c.Password {
+			t.Error("rotated mail password: ", got, err)
+		}
+	}
+	gotHook, err := db.GetWebhook(hook.Id)
+	if err != nil || gotHook.Secret != "hookSecret" {
+		t.Error("rotated webhook secret: ", gotHook, err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	counter := metrics.NewCounterVec("test_total", "Test counter.", "channel")
+	counter.Inc("API")
+	counter.Add(2, "API")
+	if counter.Value("API") != 3 || counter.Value("MAIL") != 0 {
+		t.Error("counter: ", counter.Value("API"))
+	}
+
+	histogram := metrics.NewHistogram("test_seconds", "Test histogram.", []float64{1, 5})
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+	if histogram.Count() != 2 {
+		t.Error("histogram count: ", histogram.Count())
+	}
+
+	metrics.ValidationFailures.Inc("reference")
+	var out bytes.Buffer
+	err := metrics.Write(&out)
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(out.String(), `qrbill_validation_failures_total{rule="reference"} 1`) ||
+		!strings.Contains(out.String(), `qrbill_pdf_render_seconds_bucket{le="+Inf"}`) {
+		t.Error("unexpected exposition: ", out.String())
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var out bytes.Buffer
+	logger := logging.New(&out, slog.LevelInfo, logging.FORMAT_TEXT)
+
+	ctx := logging.WithRequestId(context.Background(), "req-1")
+	logger.InfoContext(ctx, "test", "password", "geheim", "iban", "CH93 0076 2011 6238 5295 7",
+		"url", "user:geheim@tcp(db:3306)/qr", logging.Err(errors.New("invalid iban CH9300762011623852957")))
+	logger.Debug("hidden")
+
+	line := out.String()
+	if strings.Contains(line, "geheim") || strings.Contains(line, "6238") || strings.Contains(line, "hidden") {
+		t.Error("not redacted: ", line)
+	}
+	if !strings.Contains(line, "request_id=req-1") || !strings.Contains(line, "CH93") ||
+		!strings.Contains(line, "2957") {
+		t.Error("unexpected log: ", line)
+	}
+
+	if logging.ParseLevel("debug") != slog.LevelDebug || logging.ParseLevel("nonsense") != slog.LevelInfo {
+		t.Error("parse level")
+	}
+}
+
 func TestQr(t *testing.T) {
 	issuer := specs.AccountDetails{
 		AddressType: qr.ADDRESS_TYPE_STRUCTURED,
@@ -190,6 +610,254 @@ func TestPDF(t *testing.T) {
 	if err != nil {
 		t.Error("cannot create billing pdf")
 	}
+
+	// all pages of the merged pdfs are kept
+	merge := func(name string, pdfFiles ...string) string {
+		path := filepath.Join(t.TempDir(), name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err = bill.MergePDFs(pdfFiles, f); err != nil {
+			t.Fatal("cannot merge pdfs: ", err)
+		}
+		return path
+	}
+	twoPages := merge("two.pdf", PDF_OUT_NO_SUBMISSION, PDF_OUT_SUBMISSION)
+	threePages := merge("three.pdf", twoPages, PDF_OUT_NO_SUBMISSION)
+	importer := gofpdi.NewImporter()
+	importer.SetSourceFile(threePages)
+	if pages := len(importer.GetPageSizes()); pages != 3 {
+		t.Error("pages of the merged pdf: ", pages)
+	}
+
+	// a long report continues on further pages
+	report := []string{}
+	for i := 1; i <= 60; i++ {
+		report = append(report, fmt.Sprintf("row %d: invalid amount", i))
+	}
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bill.MergePDFsWithReport([]string{PDF_OUT_NO_SUBMISSION}, "Failed rows", report, f)
+	f.Close()
+	if err != nil {
+		t.Fatal("cannot merge pdfs with report: ", err)
+	}
+	importer = gofpdi.NewImporter()
+	importer.SetSourceFile(path)
+	if pages := len(importer.GetPageSizes()); pages != 3 {
+		t.Error("pages of the merged pdf with report: ", pages)
+	}
+}
+
+func TestTranslations(t *testing.T) {
+	for _, language := range utils.LANGUAGES {
+		tr := utils.GetTranslationTable(language)
+		if tr.PaymentPart == "" || tr.InFavour == "" || tr.PayableByNameAddr == "" {
+			t.Errorf("built-in %s: %+v", language, tr)
+		}
+	}
+	if utils.GetTranslationTable("XX").PaymentPart != "Payment part" || utils.ParseLanguage("de-CH") != "DE" ||
+		utils.ParseLanguage("es") != "" {
+		t.Error("unsupported language")
+	}
+	// the built-in tables are copied
+	utils.GetTranslationTable("DE").PaymentPart = "changed"
+	if utils.GetTranslationTable("DE").PaymentPart != "Zahlteil" {
+		t.Error("built-in table changed")
+	}
+
+	db := sqltest.Sqlite(t)
+	_, issuerId, err := db.InsertIssuer(sqltest.IBAN, specs.AccountDetails{Name: "Muster Hans",
+		Address1: "Bahnhofstrasse 1", Zip: "8000", Location: "Zürich", Country: "CH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetIssuerTranslation(&specs.Translation{IssuerId: issuerId, LanguageCode: "FR",
+		TranslationTable: specs.TranslationTable{Receipt: "Quittance"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := bill.Translation(db, issuerId, "fr")
+	if tr.Receipt != "Quittance" || tr.PaymentPart != "Section paiement" {
+		t.Errorf("issuer translation: %+v", tr)
+	}
+	if tr = bill.Translation(db, 0, "FR"); tr.Receipt != "Récépissé" {
+		t.Errorf("translation without issuer: %+v", tr)
+	}
+	if tr = bill.Translation(nil, issuerId, ""); tr.PaymentPart != "Payment part" {
+		t.Errorf("default translation: %+v", tr)
+	}
+
+	info := &bill.Information{Name: "Muster", FirstName: "Hans", Postal: "8000", City: "Zürich", Amount: 10,
+		Language: "it-CH"}
+	b, err := bill.NewBill(info, bill.CHANNEL_API, sqltest.IBAN, specs.AccountDetails{})
+	if err != nil || b.LanguageCode != "IT" {
+		t.Error("language of the request: ", err)
+	}
+	info.Language = ""
+	if b, _ = bill.NewBill(info, bill.CHANNEL_API, sqltest.IBAN, specs.AccountDetails{}); b.LanguageCode != "EN" {
+		t.Error("default language: ", b.LanguageCode)
+	}
+	info.Language = "ES"
+	var validationErr *bill.ValidationError
+	if _, err = bill.NewBill(info, bill.CHANNEL_API, sqltest.IBAN, specs.AccountDetails{}); !errors.As(err, &validationErr) ||
+		validationErr.Rule != bill.RULE_LANGUAGE {
+		t.Error("unsupported language: ", err)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	ref, err := utils.CreateQrReference("21", "", 0, "313947143000901")
+	if err != nil || ref != "210000000003139471430009017" {
+		t.Error("qr reference: ", ref, err)
+	}
+	ref, err = utils.CreateQrReference("123456", "42", 6, "7")
+	if err != nil || len(ref) != 27 || !strings.HasPrefix(ref, "123456000042") ||
+		utils.ValidateReference(qr.REFERENCE_TYPE_QR, ref) != nil {
+		t.Error("qr reference of parts: ", ref, err)
+	}
+	if _, err = utils.CreateQrReference("", "1234567", 6, "1"); err == nil {
+		t.Error("customer number exceeds its digits")
+	}
+	if _, err = utils.CreateQrReference("", "", 0, "12a"); err == nil {
+		t.Error("invoice number with characters")
+	}
+	ref, err = utils.CreateCreditorReference("539007547034")
+	if err != nil || ref != "RF18539007547034" {
+		t.Error("creditor reference: ", ref, err)
+	}
+	if utils.ValidateReference(qr.REFERENCE_TYPE_CREDITOR, "RF18539007547034") != nil ||
+		utils.ValidateReference(qr.REFERENCE_TYPE_CREDITOR, "RF19539007547034") == nil {
+		t.Error("creditor reference check digits")
+	}
+	if bill.ValidateReferenceFormat(&specs.ReferenceFormat{BesrId: "123456", CustomerDigits: 15}) == nil {
+		t.Error("reference format without invoice digits")
+	}
+	if bill.ValidateReferenceFormat(&specs.ReferenceFormat{BesrId: "1234567890123", CustomerDigits: 0}) == nil {
+		t.Error("besr id exceeds its column")
+	}
+
+	db := sqltest.Sqlite(t)
+	_, issuerId, err := db.InsertIssuer(sqltest.IBAN, specs.AccountDetails{Name: "Muster Hans",
+		Address1: "Bahnhofstrasse 1", Zip: "8000", Location: "Zürich", Country: "CH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetReferenceFormat(&specs.ReferenceFormat{IssuerId: issuerId, BesrId: "210000", CustomerDigits: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	draw := func(info *bill.Information) (string, error) {
+		b := &specs.Bill{}
+		err := bill.DrawReference(db, info, b)
+		return b.Details.Referece, err
+	}
+
+	// the api, the mail client and the cli draw from the same sequence
+	const count = 20
+	refs := make(chan string, count)
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			ref, err := draw(&bill.Information{IssuerId: issuerId, ReferenceType: "qrr", CustomerNumber: "42"})
+			refs <- ref
+			errs <- err
+		}()
+	}
+	seen := map[string]bool{}
+	for i := 0; i < count; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal("generate reference: ", err)
+		}
+		ref = <-refs
+		if seen[ref] || !strings.HasPrefix(ref, "210000000042") {
+			t.Error("reference not unique: ", ref)
+		}
+		seen[ref] = true
+	}
+	f, err := db.GetReferenceFormat(issuerId)
+	if err != nil || f.LastNumber != count {
+		t.Error("last invoice number: ", f, err)
+	}
+
+	// bills are validated with a preview, which doesn't draw a number
+	var validationErr *bill.ValidationError
+	info := &bill.Information{IssuerId: issuerId, ReferenceType: "QRR", CustomerNumber: "42"}
+	preview, err := bill.PreviewReference(db, info)
+	if err != nil || info.Reference != "" || !strings.HasPrefix(preview.Reference, "21000000004200000000000021") {
+		t.Error("preview reference: ", preview, err)
+	}
+	info = &bill.Information{IssuerId: issuerId, ReferenceType: "QRR", CustomerNumber: "1234567"}
+	if _, err = bill.PreviewReference(db, info); !errors.As(err, &validationErr) ||
+		validationErr.Rule != bill.RULE_REFERENCE {
+		t.Error("preview reference of a too long customer number: ", err)
+	}
+	info = &bill.Information{IssuerId: issuerId, ReferenceType: "NON"}
+	if preview, err = bill.PreviewReference(db, info); err != nil || preview != info {
+		t.Error("preview without reference: ", preview, err)
+	}
+	f, err = db.GetReferenceFormat(issuerId)
+	if err != nil || f.LastNumber != count {
+		t.Error("last invoice number after previews: ", f, err)
+	}
+
+	// explicit invoice numbers are reserved in the sequence
+	info = &bill.Information{IssuerId: issuerId, ReferenceType: "QRR", CustomerNumber: "42", InvoiceNumber: "30"}
+	if ref, err = draw(info); err != nil || ref != "210000000042000000000000306" {
+		t.Error("qr reference of the invoice number: ", ref, err)
+	}
+	// numbers below the sequence, e.g. of imported invoices, leave it as it
+	// is, the unique references of the bills reject the issued ones
+	info = &bill.Information{IssuerId: issuerId, ReferenceType: "QRR", InvoiceNumber: "5"}
+	if preview, err = bill.PreviewReference(db, info); err != nil || preview.Reference != "210000000000000000000000056" {
+		t.Error("preview of an invoice number below the sequence: ", preview, err)
+	}
+	if ref, err = draw(info); err != nil || ref != "210000000000000000000000056" {
+		t.Error("invoice number below the sequence: ", ref, err)
+	}
+	ref, err = bill.NewReference(db, issuerId, "QRR", "42", "")
+	if err != nil || !strings.HasPrefix(ref, "21000000004200000000000031") {
+		t.Error("sequence after the invoice number: ", ref, err)
+	}
+	info = &bill.Information{IssuerId: issuerId, ReferenceType: "SCOR", InvoiceNumber: "539007547034"}
+	if ref, err = draw(info); err != nil || ref != "RF18539007547034" {
+		t.Error("creditor reference of the invoice number: ", ref, err)
+	}
+	info = &bill.Information{IssuerId: issuerId, ReferenceType: "NON"}
+	if ref, err = draw(info); err != nil || ref != "" {
+		t.Error("reference without type: ", ref, err)
+	}
+	info = &bill.Information{IssuerId: issuerId + 1, ReferenceType: "QRR"}
+	if _, err = draw(info); !errors.As(err, &validationErr) || validationErr.Rule != bill.RULE_ISSUER {
+		t.Error("reference of unknown issuer: ", err)
+	}
+
+	// invalid rows of a mail don't use up numbers
+	f, err = db.GetReferenceFormat(issuerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := mail.NewMailClient("", "", "", "", "", "makeMeQrBill")
+	client.References = db
+	msg := mail.Message{Body: `[{"name": "Muster", "postal": "8000", "city": "Zuerich", "amount": 10, ` +
+		`"reference_type": "QRR"}, {"name": "Muster", "postal": "8000", "city": "Zuerich", "amount": -1, ` +
+		`"reference_type": "QRR"}]`, BodyMimeType: mail.MIME_TYPE_JSON}
+	req, err := client.ParseRequest(&msg, issuerId, sqltest.IBAN, specs.AccountDetails{Name: "Muster Hans",
+		Address1: "Bahnhofstrasse 1", Zip: "8000", Location: "Zürich", Country: "CH"})
+	if err != nil || len(req.Rows) != 2 || req.Rows[0].Bill == nil || req.Rows[1].Bill != nil {
+		t.Fatal("mail with an invalid row: ", req, err)
+	}
+	next, err := db.GetReferenceFormat(issuerId)
+	if err != nil || next.LastNumber != f.LastNumber+1 ||
+		!strings.HasSuffix(req.Rows[0].Bill.Details.Referece[:26], strconv.Itoa(next.LastNumber)) {
+		t.Error("numbers drawn for a mail with an invalid row: ", next, req.Rows[0].Bill.Details.Referece, err)
+	}
 }
 
 func TestClean(t *testing.T) {
@@ -207,59 +875,1281 @@ func TestClean(t *testing.T) {
 	}
 }
 
-func TestMail(t *testing.T) {
-	token := "makeMeQrBill"
+func TestValidate(t *testing.T) {
+	b := &specs.Bill{
+		Customer: specs.AccountDetails{Name: "Muster Hans", Zip: "8000", Location: "Zuerich"},
+		Details:  specs.BillingDetails{Amount: 12.5},
+	}
+	bill.SetDefaults(b)
+	if b.Customer.Country != qr.COUNTRY_SWITZERLAND || b.Details.Currency != qr.CURRENCY_SWISS_FRANCS ||
+		b.Details.RefenreceType != qr.REFERENCE_TYPE_NO_REF {
+		t.Error("defaults not set: ", b)
+	}
+	if err := bill.Validate(b); err != nil {
+		t.Error(err)
+	}
 
-	mailClient := mail.NewMailClient(os.Getenv("MAIL_USER"), os.Getenv("MAIL_PASSWORD"),
-		os.Getenv("MAIL_SENDER"), os.Getenv("SMTP_HOST"), os.Getenv("POP_HOST"), token)
+	b.Details.Currency = "USD"
+	var validationErr *bill.ValidationError
+	if err := bill.Validate(b); !errors.As(err, &validationErr) || validationErr.Rule != bill.RULE_CURRENCY {
+		t.Error("currency not validated: ", err)
+	}
 
-	msg := mail.Message{
-		Subject: token,
-		Body: `
-		Name: Mister Receipt
-		Address1: Hello World 4
-		Location: NoLoc
-		Zip: 4523
-		Country: Schweiz
-		Currency: CHF
-		Amount: 3445.34
-		ReferenceType: NON
-		AdditionalInformations: Please pay fast`,
-		Attachments:  []mail.Attachments{},
-		BodyMimeType: mail.MIME_TYPE_TEXT,
+	reply := mail.NewReply(&mail.Message{Id: "1@example.ch", To: []string{"a@example.ch"}}, "subject", "body")
+	if reply.InReplyTo != "1@example.ch" || reply.To[0] != "a@example.ch" {
+		t.Error("reply: ", reply)
 	}
-	msg.To = []string{os.Getenv("MAIL_USER")}
+}
 
-	msg.Attachments = append(msg.Attachments, mail.Attachments{
-		FileName: "graphics/pdf-bill-example.pdf",
-		MimeTyoe: mail.MIME_TYPE_PDF,
-	})
+func TestMailParse(t *testing.T) {
+	raw := "From: =?UTF-8?Q?J=C3=BCrg?= <juerg@example.ch>\r\n" +
+		"Subject: makeMeQrBill\r\n" +
+		"Message-Id: <1@example.ch>\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"Name: J=FCrg M=FCller\r\nLocation: Z=FCrich\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<p>Name: ignored</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"=?UTF-8?Q?Rechnung_M=C3=A4rz.pdf?=\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"JVBERi0xLjQK\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/octet-stream; name=\"second.pdf\"\r\n\r\n" +
+		"%PDF-1.4\r\n" +
+		"--outer--\r\n"
+
+	dir := t.TempDir()
+	msg, err := mail.ParseMessage(strings.NewReader(raw), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != "1@example.ch" || msg.Subject != "makeMeQrBill" || len(msg.To) != 1 || msg.To[0] != "juerg@example.ch" {
+		t.Error("header: ", msg.Id, msg.Subject, msg.To)
+	}
+	if msg.BodyMimeType != mail.MIME_TYPE_TEXT || !strings.Contains(msg.Body, "Name: Jürg Müller") {
+		t.Error("body: ", msg.BodyMimeType, msg.Body)
+	}
+	if len(msg.Attachments) != 2 || msg.Attachments[0].Name != "Rechnung März.pdf" ||
+		msg.Attachments[1].Name != "second.pdf" {
+		t.Fatal("attachments: ", msg.Attachments)
+	}
+	content, err := os.ReadFile(msg.Attachments[0].FileName)
+	if err != nil || string(content) != "%PDF-1.4\n" {
+		t.Error("attachment content: ", string(content), err)
+	}
+
+	msg.RemoveAttachments()
+	if _, err = os.Stat(msg.Attachments[1].FileName); !os.IsNotExist(err) {
+		t.Error("attachment not removed")
+	}
+}
+
+func TestMailClientConfig(t *testing.T) {
+	cnf := specs.MailConfig{
+		Email:      "qr@example.ch",
+		SenderName: "QR Bills",
+		SmtpSecure: true,
+		SmtpHost:   "smtp.example.ch",
+		SmtpPort:   465,
+		Pop3Host:   "pop3.example.ch",
+	}
+	client := mail.NewMailClientFromConfig(cnf)
+	if client.SmtpSecurity != mail.SECURITY_TLS || client.SenderName != "QR Bills" {
+		t.Error("implicit tls expected", client.SmtpSecurity)
+	}
+	pop, ok := client.Mailbox.(*mail.Pop3Mailbox)
+	if !ok || pop.Port != mail.POP3_PORT || pop.Secure {
+		t.Error("plaintext pop3 on default port expected", client.Mailbox)
+	}
 
-	err := mailClient.SendEmail(msg)
+	cnf.SmtpPort = 0
+	if client = mail.NewMailClientFromConfig(cnf); client.SmtpSecurity != mail.SECURITY_STARTTLS || client.SmtpPort != mail.SMTP_PORT {
+		t.Error("starttls on default port expected", client.SmtpSecurity, client.SmtpPort)
+	}
+	cnf.SmtpSecure = false
+	if client = mail.NewMailClientFromConfig(cnf); client.SmtpSecurity != mail.SECURITY_NONE {
+		t.Error("plaintext expected", client.SmtpSecurity)
+	}
+
+	cnf.Protocol = mail.PROTOCOL_IMAP
+	cnf.ImapSecure = true
+	imap, ok := mail.NewMailClientFromConfig(cnf).Mailbox.(*mail.ImapMailbox)
+	if !ok || imap.Port != mail.IMAP_PORT || imap.Folder != mail.FOLDER_INBOX {
+		t.Error("imap on default port expected", imap)
+	}
+}
+
+func TestMailSender(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
 	if err != nil {
-		t.Error("send mail", err)
+		t.Fatal(err)
 	}
+	mail.LookupTXT = func(domain string) ([]string, error) {
+		if domain != "test._domainkey.example.ch" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+	}
+	defer func() { mail.LookupTXT = net.LookupTXT }()
 
-	// critical
-	time.Sleep(5 * time.Second)
+	raw := "From: Juerg <juerg@billing.example.ch>\r\n" +
+		"Subject: makeMeQrBill\r\n" +
+		"Authentication-Results: mx.example.ch; spf=pass smtp.mailfrom=other.ch\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"Name: Juerg\r\n"
+	signed := bytes.Buffer{}
+	err = dkim.Sign(&signed, strings.NewReader(raw), &dkim.SignOptions{
+		Domain:   "example.ch",
+		Selector: "test",
+		Signer:   key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	mails, err := mailClient.GetMails()
+	msg, err := mail.ParseMessage(&signed, t.TempDir())
 	if err != nil {
-		t.Error("get mails", err)
+		t.Fatal(err)
 	}
-	for _, mail := range mails {
-		receipt, bDetails, err := mailClient.GetBillingInformationsFromBody(mail.Body)
-		// ToDo: Check
-		fmt.Println("RECEIPT: *************", receipt)
-		fmt.Println("Details", bDetails)
-		for _, att := range mail.Attachments {
-			if att.FileName != "pdf-bill-example.pdf" {
-				t.Error("pdf filename missmatch")
-			}
-			err = os.Remove(att.FileName)
-			if err != nil {
-				t.Error("removing pdf", err)
-			}
+	if len(msg.Auth.DkimDomains) != 1 || msg.Auth.DkimDomains[0] != "example.ch" {
+		t.Error("dkim not verified", msg.Auth)
+	}
+
+	for _, whitelist := range [][]string{{"juerg@billing.example.ch"}, {"*@billing.example.ch"}, {"*@*.example.ch"}} {
+		if err = mail.CheckSender(&msg, whitelist, ""); err != nil {
+			t.Error("whitelisted sender rejected", whitelist, err)
+		}
+	}
+	for _, whitelist := range [][]string{{}, {"other@billing.example.ch"}, {"*@example.ch"}, {"*@*.billing.example.ch"}} {
+		if mail.CheckSender(&msg, whitelist, "") == nil {
+			t.Error("sender not whitelisted", whitelist)
 		}
 	}
+
+	// a modified mail is not authenticated by its signature anymore
+	tampered, err := mail.ParseMessage(strings.NewReader(strings.Replace(signed.String(), "Name: Juerg", "Name: Mallory", 1)), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tampered.Auth.DkimFailures) != 1 || mail.CheckSender(&tampered, []string{"*@*.example.ch"}, "") == nil {
+		t.Error("tampered mail accepted", tampered.Auth)
+	}
+
+	// spf is only trusted from the given server and for the sender domain
+	spf := mail.Message{From: "juerg@other.ch", Auth: mail.Authenticate([]byte(raw))}
+	if err = mail.CheckSender(&spf, []string{"*@other.ch"}, "mx.example.ch"); err != nil {
+		t.Error("spf authenticated sender rejected", err)
+	}
+	if mail.CheckSender(&spf, []string{"*@other.ch"}, "mx.evil.ch") == nil {
+		t.Error("spf result of untrusted server accepted")
+	}
+	if mail.CheckSender(&mail.Message{From: "juerg@third.ch", Auth: spf.Auth}, []string{"*@third.ch"}, "mx.example.ch") == nil {
+		t.Error("spf result of other domain accepted")
+	}
+
+	// only the topmost headers of the server are its own, lower ones are
+	// added by the sender
+	forged := mail.Message{From: "juerg@other.ch", Auth: mail.Authenticate([]byte(
+		"Authentication-Results: mx.example.ch; spf=fail smtp.mailfrom=other.ch\r\n" +
+			"Received: from mail.other.ch by mx.example.ch\r\n" + raw))}
+	if mail.CheckSender(&forged, []string{"*@other.ch"}, "mx.example.ch") == nil {
+		t.Error("forged spf result below the header of the server accepted", forged.Auth)
+	}
+	split := mail.Message{From: "juerg@other.ch", Auth: mail.Authenticate([]byte(
+		"Authentication-Results: mx.example.ch; dkim=none\r\n" +
+			"Authentication-Results: mx.example.ch; spf=pass smtp.mailfrom=other.ch\r\n" +
+			"Received: from mail.other.ch by mx.example.ch\r\n" +
+			"Authentication-Results: mx.example.ch; spf=fail smtp.mailfrom=other.ch\r\n" + raw))}
+	if err = mail.CheckSender(&split, []string{"*@other.ch"}, "mx.example.ch"); err != nil || len(split.Auth.Spf) != 1 {
+		t.Error("spf result of the topmost headers rejected", split.Auth, err)
+	}
+}
+
+func TestMailRequest(t *testing.T) {
+	client := mail.NewMailClient("", "", "", "", "", "makeMeQrBill")
+	issuer := specs.AccountDetails{Name: "Issuer", Address1: "Street 1", Zip: "8000", Location: "Zuerich", Country: "CH"}
+	iban := "CH0011112222333344446"
+
+	raw := "From: juerg@example.ch\r\n" +
+		"Subject: makeMeQrBill\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"Format: pdf\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Disposition: attachment; filename=\"bills.csv\"\r\n\r\n" +
+		"name;firstname;street;streetNumber;postal;city;amount;issuer_id\r\n" +
+		"Muster;Hans;Bahnhofstrasse;1;8000;Zuerich;120.50;99\r\n" +
+		"Muster;Heidi;Bahnhofstrasse;1;8000;Zuerich;-1;99\r\n" +
+		"--outer--\r\n"
+	msg, err := mail.ParseMessage(strings.NewReader(raw), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := client.ParseRequest(&msg, 1, iban, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.Batch || !req.Merged || len(req.Rows) != 2 {
+		t.Fatal("csv batch expected", req)
+	}
+	if req.Rows[0].Bill == nil || req.Rows[0].Bill.IssuerId != 1 || req.Rows[0].Bill.Channel != bill.CHANNEL_MAIL {
+		t.Error("first row invalid", req.Rows[0])
+	}
+	if req.Rows[1].Bill != nil || req.Rows[1].Err == nil {
+		t.Error("negative amount accepted", req.Rows[1])
+	}
+
+	msg = mail.Message{
+		Body:         `{"name": "Muster", "firstname": "Hans", "postal": "8000", "city": "Zuerich", "amount": 10}`,
+		BodyMimeType: mail.MIME_TYPE_JSON,
+	}
+	req, err = client.ParseRequest(&msg, 1, iban, issuer)
+	if err != nil || req.Batch || len(req.Rows) != 1 || req.Rows[0].Bill == nil {
+		t.Error("single json bill expected", req, err)
+	} else if req.Rows[0].Bill.Customer.Name != "Muster Hans" || req.Rows[0].Bill.Details.IBAN != iban {
+		t.Error("json bill mapping", req.Rows[0].Bill)
+	}
+
+	msg.Body = "[" + strings.TrimSuffix(strings.Repeat(msg.Body+",", mail.REQUEST_MAX_ATTACHMENTS+1), ",") + "]"
+	req, err = client.ParseRequest(&msg, 1, iban, issuer)
+	if err != nil || !req.Batch || !req.Merged || len(req.Rows) != mail.REQUEST_MAX_ATTACHMENTS+1 {
+		t.Error("merged json batch expected", err)
+	}
+
+	msg.Body = "{no json"
+	if _, err = client.ParseRequest(&msg, 1, iban, issuer); err == nil {
+		t.Error("invalid json accepted")
+	}
+
+	msg = mail.Message{Body: "Name: Muster Hans\nZip: 8000\nLocation: Zuerich\nAmount: 12.5\n", BodyMimeType: mail.MIME_TYPE_TEXT}
+	req, err = client.ParseRequest(&msg, 1, iban, issuer)
+	if err != nil || req.Batch || len(req.Rows) != 1 || req.Rows[0].Bill == nil || req.Rows[0].Bill.Details.Amount != 12.5 {
+		t.Error("text bill expected", req, err)
+	}
+
+	// empty values as in the help, with lf line endings and without a
+	// newline at the end
+	customer, details, err := client.GetBillingInformationsFromBody("Name: Muster Hans\nAddress1:  Bahnhofstrasse 1 \n" +
+		"Address2:\nZip: 8000\nLocation: Zuerich\nAmount: 12.5\nReference:\nAdditionalInformations:")
+	if err != nil || customer.Address1 != "Bahnhofstrasse 1" || customer.Address2 != "" || customer.Location != "Zuerich" ||
+		details.Referece != "" || details.AdditionalInfo != "" || details.Amount != 12.5 {
+		t.Errorf("lf body: %+v %+v %v", customer, details, err)
+	}
+
+	raw = "From: juerg@example.ch\r\n" +
+		"Subject: makeMeQrBill\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<p>Name: Muster Hans</p><p>Address2:</p><p>Zip: 8000</p><p>Location: Z&uuml;rich</p>" +
+		"<p>Amount: 12.5</p><p>Reference:</p><p>Format:</p>"
+	msg, err = mail.ParseMessage(strings.NewReader(raw), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = client.ParseRequest(&msg, 1, iban, issuer)
+	if err != nil || len(req.Rows) != 1 || req.Rows[0].Bill == nil {
+		t.Fatal("html bill expected", req, err)
+	}
+	if b := req.Rows[0].Bill; b.Customer.Location != "Zürich" || b.Customer.Address2 != "" || b.Details.Referece != "" {
+		t.Errorf("html bill: %+v", b)
+	}
+}
+
+func TestMailTemplate(t *testing.T) {
+	data := mail.TemplateData{
+		Name:       "Hans <Muster>",
+		Amount:     "120.50",
+		Currency:   "CHF",
+		Reference:  "RF18539007547034",
+		DueDate:    "31.01.2023",
+		Count:      2,
+		FailedRows: []string{"row 3: invalid amount"},
+		Reason:     "invalid amount",
+	}
+	intros := map[string]string{
+		"EN": "Please find the requested QR bill attached.",
+		"DE": "Im Anhang finden Sie die gewünschte QR-Rechnung.",
+		"FR": "Veuillez trouver ci-joint la QR-facture demandée.",
+		"IT": "In allegato trova la QR-fattura richiesta.",
+	}
+	for language, intro := range intros {
+		for _, kind := range []string{mail.TEMPLATE_BILL, mail.TEMPLATE_BILLS, mail.TEMPLATE_ERROR,
+			mail.TEMPLATE_DELIVERY} {
+			subject, text, html, err := mail.Render(mail.DefaultTemplate(language, kind), data)
+			if err != nil || subject == "" || text == "" || html == "" {
+				t.Error("render", language, kind, err)
+			}
+			if strings.Contains(html, "<Muster>") || !strings.Contains(html, "&lt;Muster&gt;") {
+				t.Error("html not escaped", html)
+			}
+			if kind == mail.TEMPLATE_BILL && (!strings.Contains(text, intro) || !strings.Contains(text, "CHF 120.50") ||
+				!strings.Contains(text, "31.01.2023") || !strings.Contains(text, "RF18539007547034")) {
+				t.Error("bill placeholders", language, text)
+			}
+			if kind == mail.TEMPLATE_BILLS && !strings.Contains(text, "row 3: invalid amount") {
+				t.Error("failed rows missing", language, text)
+			}
+		}
+	}
+	if mail.DefaultTemplate("XX", mail.TEMPLATE_BILL).LanguageCode != "EN" {
+		t.Error("english expected for unknown languages")
+	}
+
+	_, _, _, err := mail.Render(&specs.MailTemplate{Subject: "{{.Unknown}}", TextBody: "x"}, data)
+	if err == nil {
+		t.Error("invalid placeholder accepted")
+	}
+	subject, text, html, err := mail.Render(&specs.MailTemplate{Subject: "Bill {{.Reference}}",
+		TextBody: "Dear {{.Name}}, pay {{.Amount}} by {{.DueDate}}"}, data)
+	if err != nil || subject != "Bill RF18539007547034" || text != "Dear Hans <Muster>, pay 120.50 by 31.01.2023" || html != "" {
+		t.Error("custom template", subject, text, html, err)
+	}
+}
+
+func TestMailBounce(t *testing.T) {
+	report := "From: MAILER-DAEMON@example.com\r\n" +
+		"To: bills@example.com\r\n" +
+		"Subject: Undelivered Mail Returned to Sender\r\n" +
+		"Message-Id: <dsn-1@example.com>\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Your mail could not be delivered.\r\n" +
+		"--b1\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"\r\n" +
+		"Reporting-MTA: dns; mx.example.com\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; hans@example.org\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"Diagnostic-Code: smtp; 550 5.1.1 user unknown\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/rfc822-headers\r\n" +
+		"\r\n" +
+		"From: bills@example.com\r\n" +
+		"To: hans@example.org\r\n" +
+		"Message-Id: <a1b2c3.42@example.com>\r\n" +
+		"--b1--\r\n"
+
+	msg, err := mail.ParseMessage(strings.NewReader(report), t.TempDir())
+	if err != nil || msg.Bounce == nil {
+		t.Fatal("parse report", err)
+	}
+	if msg.Bounce.MessageId != "a1b2c3.42@example.com" || msg.Bounce.Recipient != "hans@example.org" ||
+		msg.Bounce.Status != "5.1.1" || msg.Bounce.Diagnostic != "550 5.1.1 user unknown" || !msg.Bounce.Failed() {
+		t.Error("bounce", *msg.Bounce)
+	}
+
+	plain, err := mail.ParseMessage(strings.NewReader("Subject: makeMeQrBill\r\n\r\nName: Muster\r\n"), t.TempDir())
+	if err != nil || plain.Bounce != nil {
+		t.Error("request parsed as bounce", err)
+	}
+
+	// reports are passed to the handler regardless of the subject
+	mailbox := mail.NewMemoryMailbox()
+	mailbox.Deliver(msg)
+	mailbox.Deliver(plain)
+	mailbox.Deliver(mail.Message{Subject: "other"})
+	received := 0
+	mailbox.Receive(context.Background(), "makeMeQrBill", func(m *mail.Message) bool {
+		received++
+		return true
+	})
+	if received != 2 || len(mailbox.Inbox()) != 1 {
+		t.Error("received", received, len(mailbox.Inbox()))
+	}
+
+	client := mail.NewMailClientFromConfig(specs.MailConfig{Email: "bills@example.com"})
+	err = client.SendBill(&specs.BillDelivery{Recipient: "hans@example.org"},
+		&specs.Bill{PdfFile: filepath.Join(t.TempDir(), "missing.pdf")})
+	if !errors.Is(err, mail.ErrPdfUnavailable) {
+		t.Error("missing pdf", err)
+	}
+}
+
+func TestMail(t *testing.T) {
+	token := "makeMeQrBill"
+	issuer := specs.AccountDetails{Name: "Issuer", Address1: "Street 1", Zip: "8000", Location: "Zuerich", Country: "CH"}
+	iban := "CH9300762011623852957"
+
+	server, err := mailtest.NewServer("bills@example.com", "geheim")
+	if err != nil {
+		t.Fatal("start mail server", err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var generated *specs.Bill
+	for _, protocol := range []string{mail.PROTOCOL_POP3, mail.PROTOCOL_IMAP} {
+		cnf := server.MailConfig()
+		cnf.Protocol = protocol
+		cnf.Token = token
+		mailClient := mail.NewMailClientFromConfig(cnf)
+
+		msg := mail.Message{
+			Subject: token,
+			Body: `
+		Name: Mister Receipt
+		Address1: Hello World 4
+		Location: NoLoc
+		Zip: 4523
+		Country: Schweiz
+		Currency: CHF
+		Amount: 3445.34
+		ReferenceType: NON
+		AdditionalInformations: Please pay fast
+`,
+			To:           []string{cnf.Email},
+			BodyMimeType: mail.MIME_TYPE_TEXT,
+			Attachments: []mail.Attachments{{
+				FileName: "graphics/pdf-bill-example.pdf",
+				MimeTyoe: mail.MIME_TYPE_PDF,
+			}},
+		}
+		err = mailClient.SendEmail(msg)
+		if err != nil {
+			t.Fatal(protocol, "send request", err)
+		}
+
+		// receive, generate and reply like the mail worker
+		generated = nil
+		err = mailClient.Receive(ctx, func(m *mail.Message) bool {
+			pdfs := m.AttachmentsOf(mail.MIME_TYPE_PDF)
+			if len(pdfs) != 1 || pdfs[0].Name != "pdf-bill-example.pdf" {
+				t.Error(protocol, "pdf attachment", m.Attachments)
+				return false
+			}
+			req, err := mailClient.ParseRequest(m, 0, iban, issuer)
+			if err != nil || len(req.Rows) != 1 || req.Rows[0].Bill == nil {
+				t.Error(protocol, "parse request", err)
+				return false
+			}
+			b := req.Rows[0].Bill
+			if b.Customer.Name != "Mister Receipt" || b.Details.Amount != 3445.34 || b.Details.Currency != "CHF" {
+				t.Error(protocol, "billing information", b.Customer, b.Details)
+			}
+			err = bill.Generate(ctx, b, utils.GetEnglishTranslationTable(), pdfs[0].FileName)
+			if err == nil {
+				err = mailClient.ReplyBill(m, b)
+			}
+			if err != nil {
+				t.Error(protocol, "generate and reply", err)
+				return false
+			}
+			generated = b
+			return true
+		})
+		if err != nil || generated == nil {
+			t.Fatal(protocol, "receive request", err)
+		}
+
+		sent := server.Sent()
+		if len(sent) < 2 || len(sent[len(sent)-1].To) != 1 || sent[len(sent)-1].To[0] != cnf.Email {
+			t.Fatal(protocol, "reply not sent", sent)
+		}
+		reply, err := mail.ParseMessage(bytes.NewReader(sent[len(sent)-1].Raw), t.TempDir())
+		if err != nil || reply.Subject != "Your QR bill" || !strings.Contains(reply.Body, "CHF 3445.34") {
+			t.Error(protocol, "reply", reply.Subject, reply.Body, err)
+		}
+		if len(reply.Attachments) != 1 || reply.Attachments[0].Name != mail.REPLY_FILE_NAME {
+			t.Error(protocol, "reply attachment", reply.Attachments)
+		}
+	}
+
+	// pop3 deleted the request, imap moved it, the replies are left
+	if len(server.Folder(mail.FOLDER_PROCESSED)) != 1 || len(server.Folder(mailtest.FOLDER_INBOX)) != 2 {
+		t.Error("folders", len(server.Folder(mail.FOLDER_PROCESSED)), len(server.Folder(mailtest.FOLDER_INBOX)))
+	}
+
+	// imap wakes up on new mails
+	cnf := server.MailConfig()
+	cnf.Protocol = mail.PROTOCOL_IMAP
+	mailbox := mail.NewMailbox(cnf, t.TempDir(), slog.Default())
+	defer mailbox.Close()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		server.Deliver([]byte("Subject: " + token + "\r\n\r\nName: Muster Hans\r\n"))
+	}()
+	start := time.Now()
+	err = mailbox.Wait(ctx, 10*time.Second)
+	if err != nil || time.Since(start) > 5*time.Second {
+		t.Error("idle", time.Since(start), err)
+	}
+
+	// bills sent to the debtor carry the message id of the delivery
+	mailClient := mail.NewMailClientFromConfig(cnf)
+	err = mailClient.SendBill(&specs.BillDelivery{Recipient: "hans@example.org", MessageId: "a1b2.1@example.com"},
+		generated)
+	sent := server.Sent()
+	if err != nil || sent[len(sent)-1].To[0] != "hans@example.org" ||
+		!bytes.Contains(sent[len(sent)-1].Raw, []byte("Message-Id: <a1b2.1@example.com>")) {
+		t.Error("send bill", err)
+	}
+	server.Reject("unknown@example.org")
+	err = mailClient.SendBill(&specs.BillDelivery{Recipient: "unknown@example.org", MessageId: "a1b2.2@example.com"},
+		generated)
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Error("rejected recipient", err)
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	token := "makeMeQrBill"
+	mailbox := mail.NewMemoryMailbox()
+	mailbox.Deliver(mail.Message{Subject: token, Body: "good"})
+	mailbox.Deliver(mail.Message{Subject: token, Body: "bad"})
+	mailbox.Deliver(mail.Message{Subject: "other", Body: "other"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a delivered mail wakes up the waiting receiver
+	err := mailbox.Wait(ctx, time.Minute)
+	if err != nil {
+		t.Error("wait", err)
+	}
+
+	mailClient := mail.NewMailClient("", "", "", "", "", token)
+	mailClient.Mailbox = mailbox
+	err = mailClient.Receive(ctx, func(m *mail.Message) bool {
+		return m.Body == "good"
+	})
+	if err != nil {
+		t.Error("receive", err)
+	}
+
+	if len(mailbox.Processed()) != 1 || mailbox.Processed()[0].Body != "good" {
+		t.Error("processed mails", mailbox.Processed())
+	}
+	if len(mailbox.Failed()) != 1 || mailbox.Failed()[0].Body != "bad" {
+		t.Error("failed mails", mailbox.Failed())
+	}
+	if len(mailbox.Inbox()) != 1 || mailbox.Inbox()[0].Subject != "other" {
+		t.Error("mail with other subject touched", mailbox.Inbox())
+	}
+
+	// without new mails, wait returns after the timeout
+	start := time.Now()
+	err = mailbox.Wait(ctx, 50*time.Millisecond)
+	if err != nil || time.Since(start) < 50*time.Millisecond {
+		t.Error("wait timeout", err)
+	}
+}
+
+// newTestApi returns the api of an empty sqlite database and the token of
+// a key with the scopes.
+func newTestApi(t *testing.T, scopes ...string) (*api.Api, *sql.Db, string) {
+	t.Helper()
+
+	db := sqltest.Sqlite(t)
+	a := api.NewApi("/v1", 0, db)
+	token := "test-token-" + strings.Join(scopes, "-")
+	err := db.InsertApiKey(&specs.ApiKey{Name: "test", TokenHash: utils.GetSha256([]byte(token)), Scopes: scopes,
+		Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, db, token
+}
+
+// serveApi sends a request with the token to the handler of the api.
+func serveApi(handler http.Handler, method string, path string, token string, body string,
+	header map[string]string) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", api.TOKEN_KEY+" "+token)
+	}
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestApiIssuers(t *testing.T) {
+	a, db, token := newTestApi(t, api.SCOPE_ISSUERS_ADMIN)
+	handler := a.Handler()
+	issuer := `{"iban": "` + sqltest.IBAN + `", "name": "Muster Hans", "address1": "Bahnhofstrasse 1", ` +
+		`"zip": "8000", "location": "Zürich"}`
+
+	// issuers are administered with issuers:admin only
+	other := "test-token-bills"
+	err := db.InsertApiKey(&specs.ApiKey{Name: "bills", TokenHash: utils.GetSha256([]byte(other)),
+		Scopes: []string{api.SCOPE_BILLS_CREATE, api.SCOPE_BILLS_READ}, Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveApi(handler, http.MethodPost, "/v1/issuers", other, issuer, nil); w.Code != http.StatusForbidden {
+		t.Error("issuer created without scope: ", w.Code)
+	}
+
+	w := serveApi(handler, http.MethodPost, "/v1/issuers", token, issuer, nil)
+	created := api.IssuerResponse{}
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &created) != nil || created.Id <= 0 ||
+		created.Country != qr.COUNTRY_SWITZERLAND || created.AddressType != qr.ADDRESS_TYPE_STRUCTURED {
+		t.Fatal("create issuer: ", w.Code, w.Body.String())
+	}
+	w = serveApi(handler, http.MethodGet, w.Header().Get("Location"), token, "", nil)
+	stored := api.IssuerResponse{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &stored) != nil || stored != created {
+		t.Error("get issuer: ", w.Code, w.Body.String())
+	}
+	if w = serveApi(handler, http.MethodGet, "/v1/issuers/0", other, "", nil); w.Code != http.StatusForbidden {
+		t.Error("issuer read without scope: ", w.Code)
+	}
+	if w = serveApi(handler, http.MethodGet, "/v1/issuers/999", token, "", nil); w.Code != http.StatusNotFound {
+		t.Error("unknown issuer: ", w.Code)
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/issuers", token, `{"iban": "CH00", "name": "Muster Hans"}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Error("invalid issuer created: ", w.Code)
+	}
+}
+
+// newTestIssuer inserts an issuer, bills of the api are generated for.
+func newTestIssuer(t *testing.T, db *sql.Db) int {
+	t.Helper()
+
+	_, id, err := db.InsertIssuer(sqltest.IBAN, specs.AccountDetails{AddressType: qr.ADDRESS_TYPE_STRUCTURED,
+		Name: "Muster Hans", Address1: "Bahnhofstrasse 1", Zip: "8000", Location: "Zürich",
+		Country: qr.COUNTRY_SWITZERLAND})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// billJson is the api request of a bill to the customer.
+func billJson(issuerId int, name string) string {
+	return fmt.Sprintf(`{"issuer_id": %d, "name": %q, "firstname": "Peter", "street": "Seeweg", `+
+		`"streetNumber": "3", "postal": "6003", "city": "Luzern", "country": "CH", "amount": 49.5, `+
+		`"currency": "CHF", "reference_type": "NON", "language": "de"}`, issuerId, name)
+}
+
+func TestApiBillPdf(t *testing.T) {
+	a, db, token := newTestApi(t, api.SCOPE_BILLS_CREATE, api.SCOPE_BILLS_READ)
+	handler := a.Handler()
+	issuerId := newTestIssuer(t, db)
+
+	w := serveApi(handler, http.MethodPost, "/v1/bill", token, billJson(issuerId, "Beispiel"), nil)
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != api.MIME_TYPE_PDF {
+		t.Fatal("create bill: ", w.Code, w.Body.String())
+	}
+	generated := w.Body.Bytes()
+	id, err := strconv.Atoi(w.Header().Get("X-Bill-Id"))
+	if err != nil {
+		t.Fatal("bill id: ", err)
+	}
+	stored, err := db.GetBill(id)
+	if err != nil || stored.PdfHash != utils.GetSha256(generated) {
+		t.Fatal("stored bill: ", err)
+	}
+	defer os.Remove(stored.PdfFile)
+
+	// the stored pdf is downloaded again, as long as it is unchanged
+	w = serveApi(handler, http.MethodGet, w.Header().Get("Location"), token, "", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), generated) {
+		t.Error("download bill: ", w.Code, len(w.Body.Bytes()), len(generated))
+	}
+	if w = serveApi(handler, http.MethodGet, "/v1/bills/999/pdf", token, "", nil); w.Code != http.StatusNotFound {
+		t.Error("unknown bill: ", w.Code)
+	}
+
+	err = os.WriteFile(stored.PdfFile, append(generated, '\n'), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serveApi(handler, http.MethodGet, fmt.Sprintf("/v1/bills/%d/pdf", id), token, "", nil)
+	if w.Code != http.StatusGone {
+		t.Error("modified pdf downloaded: ", w.Code)
+	}
+	err = os.Remove(stored.PdfFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serveApi(handler, http.MethodGet, fmt.Sprintf("/v1/bills/%d/pdf", id), token, "", nil)
+	if w.Code != http.StatusGone {
+		t.Error("removed pdf downloaded: ", w.Code)
+	}
+}
+
+// quotaRepository overrides the daily quotas of the issuers.
+type quotaRepository struct {
+	sql.Repository
+	quotas map[int]int
+}
+
+func (repo quotaRepository) GetIssuerDailyQuota(issuerId int) (int, error) {
+	return repo.quotas[issuerId], nil
+}
+
+func TestApiRateLimits(t *testing.T) {
+	_, db, token := newTestApi(t, api.SCOPE_BILLS_CREATE, api.SCOPE_BILLS_READ)
+	limited, other, custom := newTestIssuer(t, db), newTestIssuer(t, db), newTestIssuer(t, db)
+	a := api.NewApi("/v1", 0, quotaRepository{Repository: db, quotas: map[int]int{custom: 1}})
+	a.SetRateLimits(api.RateLimits{IssuerQuota: 2})
+	handler := a.Handler()
+
+	retryAfter := func(w *httptest.ResponseRecorder, window time.Duration) bool {
+		seconds, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		return w.Code == http.StatusTooManyRequests && err == nil && seconds > 0 &&
+			seconds <= int(window.Seconds())+1
+	}
+
+	// the default quota counts the bills of each issuer
+	for i := 0; i < 2; i++ {
+		w := serveApi(handler, http.MethodPost, "/v1/bill", token, billJson(limited, "Quota"), nil)
+		if w.Code != http.StatusCreated {
+			t.Fatal("bill within quota: ", w.Code, w.Body.String())
+		}
+	}
+	w := serveApi(handler, http.MethodPost, "/v1/bill", token, billJson(limited, "Quota"), nil)
+	if !retryAfter(w, api.QUOTA_WINDOW) {
+		t.Error("quota exceeded: ", w.Code, w.Header().Get("Retry-After"))
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, billJson(other, "Quota"), nil)
+	if w.Code != http.StatusCreated {
+		t.Error("quota of other issuer: ", w.Code, w.Body.String())
+	}
+	// the quota of an issuer replaces the default
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, billJson(custom, "Quota"), nil)
+	if w.Code != http.StatusCreated {
+		t.Error("bill within quota of issuer: ", w.Code, w.Body.String())
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, billJson(custom, "Quota"), nil)
+	if !retryAfter(w, api.QUOTA_WINDOW) {
+		t.Error("quota of issuer exceeded: ", w.Code, w.Header().Get("Retry-After"))
+	}
+	bills, total, err := db.GetBills(specs.BillFilter{})
+	if err != nil || total != 4 {
+		t.Error("bills beyond the quota stored: ", total, err)
+	}
+	for _, b := range bills {
+		os.Remove(b.PdfFile)
+	}
+
+	// a rejected batch doesn't use up any quota, neither of the issuer
+	// exceeding its quota nor of the others
+	batchIssuer := newTestIssuer(t, db)
+	a = api.NewApi("/v1", 0, quotaRepository{Repository: db, quotas: map[int]int{batchIssuer: 2, custom: 1}})
+	handler = a.Handler()
+	rows := func(issuerId int, n int) string {
+		infos := []string{}
+		for i := 0; i < n; i++ {
+			infos = append(infos, billJson(issuerId, "Stapel"))
+		}
+		return "[" + strings.Join(infos, ", ") + "]"
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bills/batch", token, rows(batchIssuer, 3), nil)
+	if !retryAfter(w, api.QUOTA_WINDOW) {
+		t.Error("batch beyond quota: ", w.Code)
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/jobs", token,
+		strings.TrimSuffix(rows(batchIssuer, 1), "]")+", "+strings.TrimPrefix(rows(custom, 1), "["), nil)
+	if !retryAfter(w, api.QUOTA_WINDOW) {
+		t.Error("job beyond quota of one issuer: ", w.Code)
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bills/batch", token, rows(batchIssuer, 2), nil)
+	if w.Code != http.StatusOK || w.Header().Get("X-Batch-Failed") != "0" {
+		t.Error("batch within quota after rejected ones: ", w.Code, w.Body.String())
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, billJson(batchIssuer, "Quota"), nil)
+	if !retryAfter(w, api.QUOTA_WINDOW) {
+		t.Error("quota used up by batch: ", w.Code)
+	}
+	bills, total, err = db.GetBills(specs.BillFilter{IssuerId: batchIssuer})
+	if err != nil || total != 2 {
+		t.Error("bills of batches: ", total, err)
+	}
+	for _, b := range bills {
+		os.Remove(b.PdfFile)
+	}
+
+	// requests per api key
+	keyToken := "test-token-limited"
+	err = db.InsertApiKey(&specs.ApiKey{Name: "limited", TokenHash: utils.GetSha256([]byte(keyToken)),
+		Scopes: []string{api.SCOPE_BILLS_READ}, Enable: true, RateLimit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w = serveApi(handler, http.MethodGet, "/v1/bills", keyToken, "", nil); w.Code != http.StatusOK {
+		t.Error("request within rate limit: ", w.Code)
+	}
+	if w = serveApi(handler, http.MethodGet, "/v1/bills", keyToken, "", nil); !retryAfter(w, api.RATE_WINDOW) {
+		t.Error("rate limit of key exceeded: ", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w = serveApi(handler, http.MethodGet, "/v1/bills", token, "", nil); w.Code != http.StatusOK {
+		t.Error("rate limit of other key: ", w.Code)
+	}
+
+	// requests per client ip, the counters are shared through the database
+	a = api.NewApi("/v1", 0, db)
+	a.SetRateLimits(api.RateLimits{PerIp: 1})
+	handler = a.Handler()
+	if w = serveApi(handler, http.MethodGet, "/v1/bills", token, "", nil); w.Code != http.StatusOK {
+		t.Error("request within ip limit: ", w.Code)
+	}
+	if w = serveApi(handler, http.MethodGet, "/v1/bills", token, "", nil); !retryAfter(w, api.RATE_WINDOW) {
+		t.Error("ip limit exceeded: ", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w = serveApi(handler, http.MethodGet, "/healthz", "", "", nil); w.Code != http.StatusOK {
+		t.Error("health check limited: ", w.Code)
+	}
+}
+
+func TestApiShutdown(t *testing.T) {
+	_, db, token := newTestApi(t, api.SCOPE_BILLS_CREATE)
+	issuerId := newTestIssuer(t, db)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	a := api.NewApi("/v1", port, db)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go a.Run(ctx, &wg)
+
+	url := fmt.Sprintf("http://127.0.0.1:%d", port)
+	for i := 0; ; i++ {
+		resp, err := http.Get(url + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if i == 50 {
+			t.Fatal("server not ready: ", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the batch is in flight, while its body is still sent
+	body, bodyWriter := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/bills/batch", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", api.TOKEN_KEY+" "+token)
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error("batch request: ", err)
+		}
+		responses <- resp
+	}()
+	bodyWriter.Write([]byte("[" + billJson(issuerId, "Shutdown") + ","))
+	time.Sleep(100 * time.Millisecond)
+
+	cancel()
+	for i := 0; serveApi(a.Handler(), http.MethodGet, "/readyz", "", "", nil).Code != http.StatusServiceUnavailable; i++ {
+		if i == 50 {
+			t.Fatal("ready while shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err = http.Get(url + "/readyz"); err == nil {
+		t.Error("new connection accepted while shutting down")
+	}
+
+	bodyWriter.Write([]byte(billJson(issuerId, "Shutdown") + "]"))
+	bodyWriter.Close()
+	resp := <-responses
+	if resp == nil {
+		t.FailNow()
+	}
+	content, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil || resp.Header.Get("X-Batch-Failed") != "0" {
+		t.Error("batch drained: ", resp.StatusCode, resp.Header.Get("X-Batch-Failed"), string(content), err)
+	}
+	bills, total, err := db.GetBills(specs.BillFilter{})
+	if err != nil || total != 2 {
+		t.Error("bills of drained batch: ", total, err)
+	}
+	for _, b := range bills {
+		os.Remove(b.PdfFile)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(api.SHUTDOWN_TIMEOUT):
+		t.Error("server not stopped")
+	}
+}
+
+func TestApiBatch(t *testing.T) {
+	a, db, token := newTestApi(t, api.SCOPE_BILLS_CREATE)
+	handler := a.Handler()
+	issuerId := newTestIssuer(t, db)
+	defer func() {
+		bills, _, _ := db.GetBills(specs.BillFilter{})
+		for _, b := range bills {
+			os.Remove(b.PdfFile)
+		}
+	}()
+
+	// the third row has an unknown issuer
+	batch := "[" + billJson(issuerId, "Batch") + ", " + billJson(issuerId, "Stapel") + ", " +
+		billJson(-1, "Unbekannt") + "]"
+	w := serveApi(handler, http.MethodPost, "/v1/bills/batch", token, batch, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != api.MIME_TYPE_ZIP ||
+		w.Header().Get("X-Batch-Failed") != "1" {
+		t.Fatal("batch: ", w.Code, w.Body.String())
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal("zip: ", err)
+	}
+	pdfs := 0
+	report := []specs.BatchRow{}
+	for _, f := range archive.File {
+		if f.Name != api.BATCH_REPORT {
+			if strings.HasPrefix(f.Name, "bill-0000") && strings.HasSuffix(f.Name, ".pdf") {
+				pdfs++
+			}
+			continue
+		}
+		in, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(in).Decode(&report)
+		in.Close()
+		if err != nil {
+			t.Fatal("report: ", err)
+		}
+	}
+	if pdfs != 2 || len(report) != 3 || report[0].Row != 1 || report[0].BillId <= 0 ||
+		report[1].BillId <= 0 || report[2].Row != 3 || report[2].BillId != 0 || report[2].Error == "" {
+		t.Errorf("zip of batch: %d pdfs, report %+v", pdfs, report)
+	}
+
+	// a csv as one merged pdf, the failed rows are listed on the last page
+	csv := "issuer_id;name;firstname;street;streetNumber;postal;city;country;amount;currency;reference_type\n" +
+		fmt.Sprintf("%d;Muster;Hans;Seeweg;3;6003;Luzern;CH;10.5;CHF;NON\n", issuerId) +
+		fmt.Sprintf("%d;Muster;Eva;Seeweg;3;6003;Luzern;CH;-1;CHF;NON\n", issuerId) +
+		fmt.Sprintf("%d;Meier;Anna;Dorfstrasse;2;8000;Zürich;CH;20;CHF;NON\n", issuerId)
+	w = serveApi(handler, http.MethodPost, "/v1/bills/batch?format=pdf", token, csv,
+		map[string]string{"Content-Type": api.MIME_TYPE_CSV})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != api.MIME_TYPE_PDF ||
+		w.Header().Get("X-Batch-Failed") != "1" {
+		t.Fatal("merged batch: ", w.Code, w.Header(), w.Body.String())
+	}
+	merged := filepath.Join(t.TempDir(), api.BATCH_MERGED_PDF)
+	err = os.WriteFile(merged, w.Body.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importer := gofpdi.NewImporter()
+	importer.SetSourceFile(merged)
+	if pages := len(importer.GetPageSizes()); pages != 3 {
+		t.Error("pages of the merged batch: ", pages)
+	}
+
+	// without any bill, only the report is returned
+	w = serveApi(handler, http.MethodPost, "/v1/bills/batch?format=pdf", token, "["+billJson(-1, "Leer")+"]", nil)
+	if w.Code != http.StatusUnprocessableEntity || json.Unmarshal(w.Body.Bytes(), &report) != nil ||
+		len(report) != 1 || report[0].Error == "" {
+		t.Error("failed batch: ", w.Code, w.Body.String())
+	}
+	// large batches are queued as jobs
+	infos := make([]string, api.BATCH_SYNC_ROWS+1)
+	for i := range infos {
+		infos[i] = billJson(issuerId, "Gross")
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bills/batch", token, "["+strings.Join(infos, ", ")+"]", nil)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "/v1/jobs") {
+		t.Error("batch beyond the rows of a request: ", w.Code, w.Body.String())
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bills/batch?format=xls", token, batch, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Error("unknown format: ", w.Code)
+	}
+}
+
+func TestApiJobResume(t *testing.T) {
+	a, db, token := newTestApi(t, api.SCOPE_BILLS_CREATE, api.SCOPE_BILLS_READ)
+	handler := a.Handler()
+	issuerId := newTestIssuer(t, db)
+	defer func() {
+		bills, _, _ := db.GetBills(specs.BillFilter{})
+		for _, b := range bills {
+			os.Remove(b.PdfFile)
+		}
+	}()
+
+	batch := "[" + billJson(issuerId, "Job") + ", " + billJson(issuerId, "Auftrag") + ", " +
+		billJson(-1, "Unbekannt") + "]"
+	w := serveApi(handler, http.MethodPost, "/v1/jobs", token, batch, nil)
+	job := specs.Job{}
+	if w.Code != http.StatusAccepted || json.Unmarshal(w.Body.Bytes(), &job) != nil || job.Total != 3 {
+		t.Fatal("create job: ", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+	if w = serveApi(handler, http.MethodGet, location+"/result", token, "", nil); w.Code != http.StatusConflict {
+		t.Error("result of queued job: ", w.Code)
+	}
+
+	// the job was stopped after its first row
+	claimed, err := db.ClaimNextJob()
+	if err != nil || claimed.Id != job.Id {
+		t.Fatal("claim job: ", err)
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, billJson(issuerId, "Job"), nil)
+	first, err := strconv.Atoi(w.Header().Get("X-Bill-Id"))
+	if err != nil {
+		t.Fatal("first bill: ", w.Code, w.Body.String())
+	}
+	err = db.InsertJobRow(job.Id, specs.BatchRow{Row: 1, BillId: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// after the restart the pending rows are generated
+	restarted := api.NewApi("/v1", 0, db)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go restarted.RunJobs(ctx, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	handler = restarted.Handler()
+	for i := 0; job.State != sql.JOB_STATE_DONE; i++ {
+		if i == 100 {
+			t.Fatalf("job not resumed: %+v", job)
+		}
+		time.Sleep(50 * time.Millisecond)
+		w = serveApi(handler, http.MethodGet, location, token, "", nil)
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &job) != nil {
+			t.Fatal("get job: ", w.Code, w.Body.String())
+		}
+	}
+	if job.Done != 3 || job.Failed != 1 || job.FinishedAt == nil {
+		t.Errorf("resumed job: %+v", job)
+	}
+
+	report := []specs.BatchRow{}
+	w = serveApi(handler, http.MethodGet, location+"/report", token, "", nil)
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &report) != nil || len(report) != 3 ||
+		report[0].BillId != first || report[1].BillId <= 0 || report[1].BillId == first ||
+		report[2].BillId != 0 || report[2].Error == "" {
+		t.Errorf("report of resumed job: %d %s", w.Code, w.Body.String())
+	}
+	// the first row isn't generated twice
+	if _, total, err := db.GetBills(specs.BillFilter{}); err != nil || total != 2 {
+		t.Error("bills of resumed job: ", total, err)
+	}
+	w = serveApi(handler, http.MethodGet, location+"/result", token, "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != api.MIME_TYPE_ZIP ||
+		w.Header().Get("X-Batch-Failed") != "1" {
+		t.Error("result of resumed job: ", w.Code, w.Body.String())
+	}
+}
+
+func TestApiIdempotency(t *testing.T) {
+	a, db, token := newTestApi(t, api.SCOPE_BILLS_CREATE)
+	handler := a.Handler()
+	issuerId := newTestIssuer(t, db)
+	defer func() {
+		bills, _, _ := db.GetBills(specs.BillFilter{})
+		for _, b := range bills {
+			os.Remove(b.PdfFile)
+		}
+	}()
+	idempotent := func(key string) map[string]string {
+		return map[string]string{api.IDEMPOTENCY_HEADER: key}
+	}
+
+	body := billJson(issuerId, "Idempotent")
+	w := serveApi(handler, http.MethodPost, "/v1/bill", token, body, idempotent("order-1"))
+	if w.Code != http.StatusCreated || w.Header().Get(api.IDEMPOTENCY_REPLAYED) != "" {
+		t.Fatal("create bill: ", w.Code, w.Body.String())
+	}
+	id, pdf := w.Header().Get("X-Bill-Id"), w.Body.Bytes()
+
+	// the same request is answered with the stored bill, regardless of the
+	// formatting of the json
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, "\n "+body+"\n", idempotent("order-1"))
+	if w.Code != http.StatusCreated || w.Header().Get(api.IDEMPOTENCY_REPLAYED) != "true" ||
+		w.Header().Get("X-Bill-Id") != id || !bytes.Equal(w.Body.Bytes(), pdf) {
+		t.Error("replay bill: ", w.Code, w.Header(), w.Body.Len())
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, billJson(issuerId, "Anders"), idempotent("order-1"))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Error("key reused for another request: ", w.Code, w.Body.String())
+	}
+	if _, total, err := db.GetBills(specs.BillFilter{}); err != nil || total != 1 {
+		t.Error("bills of idempotent requests: ", total, err)
+	}
+
+	// a request in progress holds the key
+	apiKey, err := db.GetApiKeyByHash(utils.GetSha256([]byte(token)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := api.BillInformation{}
+	err = json.Unmarshal([]byte(body), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserved, _, err := db.ReserveIdempotencyKey(&specs.IdempotencyKey{ApiKeyId: apiKey.Id, Key: "order-2",
+		RequestHash: utils.GetSha256(normalized), CreatedAt: time.Now()})
+	if err != nil || !reserved {
+		t.Fatal("reserve key: ", err)
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, body, idempotent("order-2"))
+	if w.Code != http.StatusConflict {
+		t.Error("request in progress: ", w.Code, w.Body.String())
+	}
+
+	// a failed request releases the key
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, billJson(-1, "Unbekannt"), idempotent("order-3"))
+	if w.Code != http.StatusBadRequest {
+		t.Error("invalid bill: ", w.Code, w.Body.String())
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, body, idempotent("order-3"))
+	if w.Code != http.StatusCreated || w.Header().Get(api.IDEMPOTENCY_REPLAYED) != "" ||
+		w.Header().Get("X-Bill-Id") == id {
+		t.Error("retry of failed request: ", w.Code, w.Body.String())
+	}
+	w = serveApi(handler, http.MethodPost, "/v1/bill", token, body, idempotent(strings.Repeat("x", api.IDEMPOTENCY_MAX_LEN+1)))
+	if w.Code != http.StatusBadRequest {
+		t.Error("key too long: ", w.Code)
+	}
+}
+
+// failingJobRepository can't store the rows of jobs.
+type failingJobRepository struct {
+	sql.Repository
+}
+
+func (repo failingJobRepository) InsertJobBill(jobId int, rowNum int, b *specs.Bill) error {
+	return errors.New("constraint violated")
+}
+
+func (repo failingJobRepository) InsertJobRow(jobId int, row specs.BatchRow) error {
+	return errors.New("constraint violated")
+}
+
+func TestApiJobAttempts(t *testing.T) {
+	_, db, token := newTestApi(t, api.SCOPE_BILLS_CREATE, api.SCOPE_BILLS_READ)
+	issuerId := newTestIssuer(t, db)
+	interval := api.JOB_POLL_INTERVAL
+	api.JOB_POLL_INTERVAL = 10 * time.Millisecond
+	defer func() {
+		api.JOB_POLL_INTERVAL = interval
+	}()
+
+	a := api.NewApi("/v1", 0, failingJobRepository{Repository: db})
+	handler := a.Handler()
+	w := serveApi(handler, http.MethodPost, "/v1/jobs", token, "["+billJson(issuerId, "Fehler")+"]", nil)
+	job := specs.Job{}
+	if w.Code != http.StatusAccepted || json.Unmarshal(w.Body.Bytes(), &job) != nil {
+		t.Fatal("create job: ", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go a.RunJobs(ctx, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// a persistent error fails the job after the last attempt
+	for i := 0; job.State != sql.JOB_STATE_FAILED; i++ {
+		if i == 200 {
+			t.Fatalf("job not failed: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		w = serveApi(handler, http.MethodGet, location, token, "", nil)
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &job) != nil {
+			t.Fatal("get job: ", w.Code, w.Body.String())
+		}
+	}
+	if job.Attempts != api.JOB_MAX_ATTEMPTS-1 || !strings.Contains(job.Error, "constraint violated") ||
+		job.FinishedAt == nil || job.Done != 0 {
+		t.Errorf("failed job: %+v", job)
+	}
+	bills, total, err := db.GetBills(specs.BillFilter{})
+	if err != nil || total != 0 {
+		t.Error("bills of failed job: ", total, err)
+	}
+	for _, b := range bills {
+		os.Remove(b.PdfFile)
+	}
+}
+
+func TestApiReferences(t *testing.T) {
+	a, db, token := newTestApi(t, api.SCOPE_BILLS_CREATE)
+	handler := a.Handler()
+	issuerId := newTestIssuer(t, db)
+	defer func() {
+		bills, _, _ := db.GetBills(specs.BillFilter{})
+		for _, b := range bills {
+			os.Remove(b.PdfFile)
+		}
+	}()
+	qrBill := func(invoiceNumber string) *httptest.ResponseRecorder {
+		body := strings.Replace(billJson(issuerId, "Referenz"), `"reference_type": "NON"`,
+			`"reference_type": "QRR", "invoice_number": "`+invoiceNumber+`"`, 1)
+		return serveApi(handler, http.MethodPost, "/v1/bill", token, body, nil)
+	}
+
+	if w := qrBill("30"); w.Code != http.StatusCreated || !strings.HasPrefix(w.Header().Get("X-Bill-Reference"),
+		"00000000000000000000000030") {
+		t.Error("bill of an invoice number: ", w.Code, w.Header().Get("X-Bill-Reference"), w.Body.String())
+	}
+	// older invoice numbers are imported, as long as they weren't issued
+	if w := qrBill("5"); w.Code != http.StatusCreated {
+		t.Error("bill of an invoice number below the sequence: ", w.Code, w.Body.String())
+	}
+	if w := qrBill("5"); w.Code != http.StatusConflict {
+		t.Error("bill of an issued invoice number: ", w.Code, w.Body.String())
+	}
+	if w := qrBill(""); w.Code != http.StatusCreated || !strings.HasPrefix(w.Header().Get("X-Bill-Reference"),
+		"00000000000000000000000031") {
+		t.Error("bill of the sequence: ", w.Code, w.Header().Get("X-Bill-Reference"), w.Body.String())
+	}
 }
@@ -21,10 +21,12 @@ import (
 	"bufio"
 	"fmt"
 	"image"
-	"log"
+	_ "image/png"
+	"log/slog"
 	"os"
 	"strings"
 
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
 	"github.com/ChrIgiSta/swiss-qr-bill/specs"
 	"github.com/divan/qrlogo"
 )
@@ -74,13 +76,13 @@ func NewSwissBillQr(issuer *specs.AccountDetails) *SwissBillQr {
 }
 
 func (s *SwissBillQr) GetSwissPaymentQR(receipt *specs.AccountDetails,
-	billingDetails *specs.BillingDetails, outFile string) {
+	billingDetails *specs.BillingDetails, outFile string) error {
 
-	qrTxt := s.getSwissPaymentText(receipt, billingDetails)
-	s.qrWithLogo(qrTxt, outFile)
+	qrTxt := s.GetSwissPaymentText(receipt, billingDetails)
+	return s.qrWithLogo(qrTxt, outFile)
 }
 
-func (s *SwissBillQr) getSwissPaymentText(receipt *specs.AccountDetails,
+func (s *SwissBillQr) GetSwissPaymentText(receipt *specs.AccountDetails,
 	billingDetails *specs.BillingDetails) string {
 
 	swissPaymentTxt := fmt.Sprintf(`%s
@@ -138,34 +140,35 @@ func (s *SwissBillQr) getSwissPaymentText(receipt *specs.AccountDetails,
 	return swissPaymentTxt
 }
 
-func (s *SwissBillQr) qrWithLogo(txt string, outFile string) {
+func (s *SwissBillQr) qrWithLogo(txt string, outFile string) error {
 	inFile, err := os.Open(SWISS_CROSS_FILE)
 	if err != nil {
-		log.Println("cannot read logo file.", err)
-		return
+		slog.Debug("cannot read logo file", logging.Err(err))
+		return err
 	}
 	defer inFile.Close()
 	logo, _, err := image.Decode(inFile)
 	if err != nil {
-		log.Println("cannot decode in file (logo) as image.", err)
+		slog.Debug("cannot decode in file (logo) as image", logging.Err(err))
+		return err
 	}
 	buf, err := qrlogo.Encode(txt, logo, 1024)
 	if err != nil {
-		log.Println("cannot encode qr with logo.", err)
-		return
+		slog.Debug("cannot encode qr with logo", logging.Err(err))
+		return err
 	}
 
 	file, err := os.Create(outFile)
 	if err != nil {
-		log.Println("cannot create output file.", err)
-		return
+		slog.Debug("cannot create output file", logging.Err(err))
+		return err
 	}
 	defer file.Close()
 	writer := bufio.NewWriter(file)
 	_, err = writer.Write(buf.Bytes())
 	if err != nil {
-		log.Println("cannot write to file.", err)
-		return
+		slog.Debug("cannot write to file", logging.Err(err))
+		return err
 	}
-	writer.Flush()
+	return writer.Flush()
 }
@@ -0,0 +1,317 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package secret encrypts secrets at rest, like the passwords of the mail
+// configurations. Every value gets its own data key, which encrypts the value
+// with AES-256-GCM. The data key is sealed by a master key (envelope), so
+// rotating the master key only reseals the data keys.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	KEY_SIZE = 32 // AES-256
+
+	// PREFIX marks encrypted values: enc:v1:<key id>:<sealed data key>:<ciphertext>
+	PREFIX = "enc:v1:"
+)
+
+var (
+	ErrNoKey         = errors.New("secret is encrypted, but no key is set")
+	ErrUnknownKey    = errors.New("secret is encrypted with an unknown key")
+	ErrInvalidFormat = errors.New("invalid encrypted secret")
+
+	encoding = base64.RawStdEncoding
+)
+
+type key struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Keyring holds the primary key, which encrypts, and older keys, which only
+// decrypt until the secrets are rotated. The methods of a nil Keyring store
+// secrets in plaintext.
+type Keyring struct {
+	primary *key
+	keys    map[string]*key
+}
+
+// NewKeyring returns a keyring encrypting with primary. The old keys are
+// used to decrypt secrets, which aren't rotated yet.
+func NewKeyring(primary []byte, old ...[]byte) (*Keyring, error) {
+	k := &Keyring{keys: map[string]*key{}}
+	for i, raw := range append([][]byte{primary}, old...) {
+		if len(raw) != KEY_SIZE {
+			return nil, fmt.Errorf("key %d has %d bytes, want %d", i+1, len(raw), KEY_SIZE)
+		}
+		aead, err := newAead(raw)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(raw)
+		kk := &key{id: hex.EncodeToString(sum[:4]), aead: aead}
+		if i == 0 {
+			k.primary = kk
+		}
+		if _, ok := k.keys[kk.id]; !ok {
+			k.keys[kk.id] = kk
+		}
+	}
+	return k, nil
+}
+
+// FromEnv reads the primary key from SECRET_KEY or the first key of the file
+// SECRET_KEY_FILE. Further keys of the file and the comma separated keys of
+// SECRET_KEYS_OLD are used to decrypt only. Keys are base64 or hex encoded.
+// It returns nil, if no key is set.
+func FromEnv() (*Keyring, error) {
+	var keys []string
+	if os.Getenv("SECRET_KEY") != "" && os.Getenv("SECRET_KEY_FILE") != "" {
+		return nil, errors.New("set either SECRET_KEY or SECRET_KEY_FILE")
+	}
+	if os.Getenv("SECRET_KEY") != "" {
+		keys = append(keys, os.Getenv("SECRET_KEY"))
+	}
+	if file := os.Getenv("SECRET_KEY_FILE"); file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		if os.Getenv("SECRET_KEYS_OLD") != "" {
+			return nil, errors.New("SECRET_KEYS_OLD is set without a primary key")
+		}
+		return nil, nil
+	}
+	for _, old := range strings.Split(os.Getenv("SECRET_KEYS_OLD"), ",") {
+		if strings.TrimSpace(old) != "" {
+			keys = append(keys, strings.TrimSpace(old))
+		}
+	}
+
+	raw := make([][]byte, len(keys))
+	for i, k := range keys {
+		var err error
+		raw[i], err = ParseKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i+1, err)
+		}
+	}
+	return NewKeyring(raw[0], raw[1:]...)
+}
+
+// ParseKey decodes a base64 or hex encoded key.
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == hex.EncodedLen(KEY_SIZE) {
+		if raw, err := hex.DecodeString(s); err == nil {
+			return raw, nil
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		raw, err = encoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	if err != nil {
+		return nil, errors.New("key is neither base64 nor hex")
+	}
+	if len(raw) != KEY_SIZE {
+		return nil, fmt.Errorf("key has %d bytes, want %d", len(raw), KEY_SIZE)
+	}
+	return raw, nil
+}
+
+// GenerateKey returns a new random key, base64 encoded.
+func GenerateKey() (string, error) {
+	raw := make([]byte, KEY_SIZE)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// IsEncrypted reports whether value is an encrypted secret.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, PREFIX)
+}
+
+// PrimaryId returns the id of the key, which encrypts new secrets.
+func (k *Keyring) PrimaryId() string {
+	if k == nil {
+		return ""
+	}
+	return k.primary.id
+}
+
+// Encrypt encrypts plain with the primary key. The context, e.g. the table
+// and column, is authenticated: the value can't be decrypted elsewhere.
+// Empty values and values of a nil keyring are returned as is.
+func (k *Keyring) Encrypt(plain string, context string) (string, error) {
+	if k == nil || plain == "" {
+		return plain, nil
+	}
+
+	dataKey := make([]byte, KEY_SIZE)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(aead, []byte(plain), []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return k.wrap(dataKey, ciphertext, context)
+}
+
+// Decrypt returns the plaintext of an encrypted value. Values, which aren't
+// encrypted, are returned as is.
+func (k *Keyring) Decrypt(value string, context string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	dataKey, ciphertext, err := k.unwrap(value, context)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(aead, ciphertext, []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// NeedsRotation reports whether value is stored in plaintext or encrypted
+// with another key than the primary one.
+func (k *Keyring) NeedsRotation(value string) bool {
+	if k == nil || value == "" {
+		return false
+	}
+	if !IsEncrypted(value) {
+		return true
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(value, PREFIX), ":")
+	return id != k.primary.id
+}
+
+// Rotate encrypts a plaintext value or reseals the data key of an encrypted
+// value with the primary key. The ciphertext of the value is kept.
+func (k *Keyring) Rotate(value string, context string) (string, error) {
+	if k == nil {
+		return value, nil
+	}
+	if !IsEncrypted(value) {
+		return k.Encrypt(value, context)
+	}
+	dataKey, ciphertext, err := k.unwrap(value, context)
+	if err != nil {
+		return "", err
+	}
+	return k.wrap(dataKey, ciphertext, context)
+}
+
+func (k *Keyring) wrap(dataKey []byte, ciphertext []byte, context string) (string, error) {
+	sealed, err := seal(k.primary.aead, dataKey, []byte(k.primary.id+":"+context))
+	if err != nil {
+		return "", err
+	}
+	return PREFIX + k.primary.id + ":" + encoding.EncodeToString(sealed) + ":" +
+		encoding.EncodeToString(ciphertext), nil
+}
+
+func (k *Keyring) unwrap(value string, context string) ([]byte, []byte, error) {
+	if k == nil {
+		return nil, nil, ErrNoKey
+	}
+	parts := strings.Split(strings.TrimPrefix(value, PREFIX), ":")
+	if len(parts) != 3 {
+		return nil, nil, ErrInvalidFormat
+	}
+	kk, ok := k.keys[parts[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w %s", ErrUnknownKey, parts[0])
+	}
+	sealed, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, ErrInvalidFormat
+	}
+	ciphertext, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, ErrInvalidFormat
+	}
+	dataKey, err := open(kk.aead, sealed, []byte(kk.id+":"+context))
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, ciphertext, nil
+}
+
+func newAead(raw []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, plain []byte, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrInvalidFormat
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+	if err != nil {
+		return nil, errors.New("cannot decrypt secret, wrong key or context")
+	}
+	return plain, nil
+}
@@ -17,6 +17,8 @@
 
 package specs
 
+import "time"
+
 type AccountDetails struct {
 	AddressType string `json:"address_type"`
 	Name        string `json:"name"` // lastname + fistname
@@ -53,8 +55,17 @@ type TranslationTable struct {
 	InFavour          string `json:"in_favour"`
 }
 
+// Translation are the texts of the bill of an issuer in one language. Empty
+// texts fall back to the built-in ones.
+type Translation struct {
+	IssuerId     int    `json:"issuer_id"`
+	LanguageCode string `json:"language_code"`
+	TranslationTable
+}
+
 type MailConfig struct {
 	Enable       bool   `json:"enable"`
+	Id           int    `json:"id"`
 	IssuerId     int    `json:"issuer_id"`
 	Username     string `json:"username"`
 	SenderName   string `json:"sender_name"`
@@ -68,4 +79,164 @@ type MailConfig struct {
 	Pop3Port     int    `json:"pop3_port"`
 	Token        string `json:"token"`
 	UseWhitelist bool   `json:"use_whitelist"`
+	LanguageCode string `json:"language_code"` // of the replies, if the request has no Content-Language
+
+	Protocol        string `json:"protocol"` // POP3 or IMAP
+	ImapSecure      bool   `json:"imap_secure"`
+	ImapHost        string `json:"imap_host"`
+	ImapPort        int    `json:"imap_port"`
+	ImapFolder      string `json:"imap_folder"`      // watched folder, INBOX by default
+	ProcessedFolder string `json:"processed_folder"` // handled mails are moved here
+	FailedFolder    string `json:"failed_folder"`    // rejected mails are moved here
+	AuthServId      string `json:"auth_serv_id"`     // trusted Authentication-Results, empty to ignore spf
+}
+
+type Bill struct {
+	Id           int            `json:"id"`
+	IssuerId     int            `json:"issuer_id"`
+	CustomerId   int            `json:"customer_id"`
+	Channel      string         `json:"channel"`
+	LanguageCode string         `json:"language_code"` // of the pdf, DE, FR, IT or EN
+	Issuer       AccountDetails `json:"issuer"`
+	Customer     AccountDetails `json:"customer"`
+	Details      BillingDetails `json:"details"`
+	PayloadHash  string         `json:"payload_hash"` // sha256 of the swiss payment code
+	QrFile       string         `json:"-"`
+	PdfFile      string         `json:"-"`
+	PdfHash      string         `json:"pdf_hash"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+	PaidAt       *time.Time     `json:"paid_at,omitempty"`
+}
+
+// ReferenceFormat is the layout of the generated QRR references of an
+// issuer: the BESR-ID, the customer number zero padded to CustomerDigits
+// and the invoice number. Invoice numbers are taken from a sequence per
+// issuer, unless a request sets one.
+type ReferenceFormat struct {
+	IssuerId       int    `json:"issuer_id"`
+	BesrId         string `json:"besr_id"` // digits of the bank, empty if none
+	CustomerDigits int    `json:"customer_digits"`
+	LastNumber     int    `json:"last_number"` // last invoice number of the sequence
+}
+
+type BillFilter struct {
+	IssuerId  int
+	Customer  string // part of the customers name
+	Reference string
+	Channel   string
+	From      time.Time
+	To        time.Time
+	Limit     int
+	Offset    int
+}
+
+type ApiKey struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"-"` // sha256 of the token, the token itself isn't stored
+	Scopes     []string   `json:"scopes"`
+	Enable     bool       `json:"enable"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RateLimit  int        `json:"rate_limit,omitempty"` // requests per minute, 0 for the default
+}
+
+func (k *ApiKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the key is enabled, not revoked and not expired.
+func (k *ApiKey) Active(now time.Time) bool {
+	return k.Enable && k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// BatchRow is the outcome of one row of a batch. Rows are counted from 1.
+type BatchRow struct {
+	Row       int    `json:"row"`
+	BillId    int    `json:"bill_id,omitempty"`
+	Reference string `json:"reference,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type Job struct {
+	Id         int        `json:"id"`
+	ApiKeyId   int        `json:"-"`
+	State      string     `json:"state"`
+	Format     string     `json:"format"`
+	Total      int        `json:"total"`
+	Done       int        `json:"done"`
+	Failed     int        `json:"failed"`
+	Attempts   int        `json:"attempts"` // failed attempts, the job was retried after
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type Webhook struct {
+	Id        int       `json:"id"`
+	IssuerId  int       `json:"issuer_id"`
+	Url       string    `json:"url"`
+	Secret    string    `json:"-"` // key of the hmac signature
+	Events    []string  `json:"events"`
+	Enable    bool      `json:"enable"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	Id            int        `json:"id"`
+	WebhookId     int        `json:"webhook_id"`
+	Event         string     `json:"event"`
+	Payload       string     `json:"payload"`
+	State         string     `json:"state"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastStatus    int        `json:"last_status,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// BillDelivery is a bill sent by mail to the debtor.
+type BillDelivery struct {
+	Id            int        `json:"id"`
+	BillId        int        `json:"bill_id"`
+	MailId        int        `json:"mail_id"` // mail configuration of the issuer, which sends the bill
+	Recipient     string     `json:"recipient"`
+	LanguageCode  string     `json:"language_code,omitempty"`
+	MessageId     string     `json:"message_id"`
+	State         string     `json:"state"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+}
+
+// MailTemplate is a reply of the mail channel in one language. The bodies
+// are go templates, see mail.TemplateData.
+type MailTemplate struct {
+	IssuerId     int    `json:"issuer_id"`
+	LanguageCode string `json:"language_code"`
+	Kind         string `json:"kind"` // BILL, BILLS, ERROR or DELIVERY
+	Subject      string `json:"subject"`
+	TextBody     string `json:"text_body"`
+	HtmlBody     string `json:"html_body"` // optional
+	DueDays      int    `json:"due_days"`  // payment term, to show the due date
+}
+
+type IdempotencyKey struct {
+	ApiKeyId    int
+	Key         string
+	RequestHash string
+	BillId      int // 0 while the request is in progress
+	CreatedAt   time.Time
 }
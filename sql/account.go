@@ -0,0 +1,122 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+// accountColumns are the account details of the issuer and customer tables,
+// in the order of accountArgs and account.dest.
+const accountColumns = "address_type, fistname, lastname, address1, address2, zip, location, country"
+
+// account holds the scanned account details. They are NULL for the issuer
+// of a bill without issuer.
+type account struct {
+	addressType, firstname, lastname, address1, address2, zip, location, country sql.NullString
+}
+
+func (a *account) dest() []interface{} {
+	return []interface{}{&a.addressType, &a.firstname, &a.lastname, &a.address1, &a.address2, &a.zip,
+		&a.location, &a.country}
+}
+
+func (a *account) details() specs.AccountDetails {
+	return specs.AccountDetails{
+		AddressType: defaultString(a.addressType.String, qr.ADDRESS_TYPE_STRUCTURED),
+		Name:        joinName(a.firstname.String, a.lastname.String),
+		Address1:    a.address1.String,
+		Address2:    a.address2.String,
+		Zip:         a.zip.String,
+		Location:    a.location.String,
+		Country:     a.country.String,
+	}
+}
+
+// accountArgs returns the values of accountColumns.
+func accountArgs(details specs.AccountDetails) []interface{} {
+	firstname, lastname := splitName(details.Name)
+	return []interface{}{defaultString(details.AddressType, qr.ADDRESS_TYPE_STRUCTURED), firstname, lastname,
+		details.Address1, details.Address2, details.Zip, details.Location, details.Country}
+}
+
+// GetIssuer returns the iban and account details of an issuer.
+// sql.ErrNoRows is returned for unknown ids.
+func (db *Db) GetIssuer(id int) (string, specs.AccountDetails, error) {
+	var (
+		iban   string
+		issuer account
+	)
+
+	err := db.dbCon.QueryRow("SELECT iban, "+accountColumns+" FROM issuer WHERE id = ?", id).
+		Scan(append([]interface{}{&iban}, issuer.dest()...)...)
+	if err != nil {
+		return "", specs.AccountDetails{}, err
+	}
+	return iban, issuer.details(), nil
+}
+
+func (db *Db) InsertIssuer(iban string, details specs.AccountDetails) (*specs.AccountDetails, int, error) {
+	id, err := db.dbCon.insert("INSERT INTO issuer (iban, "+accountColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		append([]interface{}{iban}, accountArgs(details)...)...)
+	if err != nil {
+		return nil, id, err
+	}
+	return &details, id, nil
+}
+
+// InsertCustomer stores the account details of a debtor and returns its id.
+func (db *Db) InsertCustomer(customer specs.AccountDetails) (int, error) {
+	return insertCustomer(db.dbCon, customer)
+}
+
+func insertCustomer(ex execer, customer specs.AccountDetails) (int, error) {
+	return ex.insertReturning("cust_id", "INSERT INTO customer ("+accountColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		accountArgs(customer)...)
+}
+
+// GetCustomer returns the account details of a debtor. sql.ErrNoRows is
+// returned for unknown ids.
+func (db *Db) GetCustomer(id int) (specs.AccountDetails, error) {
+	var customer account
+
+	err := db.dbCon.QueryRow("SELECT "+accountColumns+" FROM customer WHERE cust_id = ?", id).
+		Scan(customer.dest()...)
+	if err != nil {
+		return specs.AccountDetails{}, err
+	}
+	return customer.details(), nil
+}
+
+// splitName splits a name in the form "lastname firstname" as used by
+// specs.AccountDetails. Single words are stored as firstname.
+func splitName(name string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(name), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[1], parts[0]
+}
+
+func joinName(firstname string, lastname string) string {
+	return strings.TrimSpace(lastname + " " + firstname)
+}
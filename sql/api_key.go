@@ -0,0 +1,105 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+const apiKeyColumns = "id, name, token_hash, scopes, enable, created_ts, expires_ts, revoked_ts, last_used_ts, rate_limit"
+
+// InsertApiKey stores a new api key. Only the hash of the token is stored.
+func (db *Db) InsertApiKey(key *specs.ApiKey) error {
+	id, err := db.dbCon.insert("INSERT INTO api_key (name, token_hash, scopes, enable, expires_ts, rate_limit) "+
+		"VALUES (?, ?, ?, ?, ?, ?)", key.Name, key.TokenHash, strings.Join(key.Scopes, ","), key.Enable,
+		nullTime(key.ExpiresAt), nullInt(key.RateLimit))
+	key.Id = id
+	return err
+}
+
+// GetApiKeyByHash returns the key matching the sha256 hash of a token.
+// sql.ErrNoRows is returned for unknown tokens.
+func (db *Db) GetApiKeyByHash(tokenHash string) (*specs.ApiKey, error) {
+	row := db.dbCon.QueryRow("SELECT "+apiKeyColumns+" FROM api_key WHERE token_hash = ?", tokenHash)
+	return scanApiKey(row)
+}
+
+func (db *Db) GetApiKeys() ([]*specs.ApiKey, error) {
+	rows, err := db.dbCon.Query("SELECT " + apiKeyColumns + " FROM api_key ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*specs.ApiKey{}
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeApiKey revokes a key permanently. sql.ErrNoRows is returned, if
+// there is no active key with this id.
+func (db *Db) RevokeApiKey(id int) error {
+	res, err := db.dbCon.Exec("UPDATE api_key SET revoked_ts = ? WHERE id = ? AND revoked_ts IS NULL",
+		time.Now(), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = sql.ErrNoRows
+	}
+	return err
+}
+
+func (db *Db) TouchApiKey(id int) error {
+	_, err := db.dbCon.Exec("UPDATE api_key SET last_used_ts = ? WHERE id = ?", time.Now(), id)
+	return err
+}
+
+func scanApiKey(row scanner) (*specs.ApiKey, error) {
+	var (
+		key                        specs.ApiKey
+		scopes                     string
+		expires, revoked, lastUsed sql.NullTime
+		rateLimit                  sql.NullInt64
+	)
+
+	err := row.Scan(&key.Id, &key.Name, &key.TokenHash, &scopes, &key.Enable, &key.CreatedAt,
+		&expires, &revoked, &lastUsed, &rateLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Scopes = splitList(scopes)
+	key.ExpiresAt = timePtr(expires)
+	key.RevokedAt = timePtr(revoked)
+	key.LastUsedAt = timePtr(lastUsed)
+	key.RateLimit = int(rateLimit.Int64)
+
+	return &key, nil
+}
@@ -0,0 +1,236 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/utils"
+)
+
+const (
+	DEFAULT_BILL_LIMIT = 50
+	MAX_BILL_LIMIT     = 500
+
+	billColumns = "b.id, b.issuer_id, b.cust_id, b.channel, b.language_code, b.ts, b.updated_ts, b.iban, b.ref_type, " +
+		"b.reference, b.add_msg, b.currency, b.amount, b.payload_hash, b.qr_file, b.pdf_file, b.pdf_hash, b.paid_ts, " +
+		"c.address_type, c.fistname, c.lastname, c.address1, c.address2, c.zip, c.location, c.country, " +
+		"i.address_type, i.fistname, i.lastname, i.address1, i.address2, i.zip, i.location, i.country"
+	billJoins = " FROM bill b LEFT JOIN customer c ON c.cust_id = b.cust_id LEFT JOIN issuer i ON i.id = b.issuer_id"
+)
+
+// ErrDuplicateReference is returned by InsertBill, if the issuer has a bill
+// with the reference already
+var ErrDuplicateReference = errors.New("issuer has a bill with the reference already")
+
+// InsertBill stores a generated bill together with its customer. Id and
+// CustomerId of the bill are set on success. The references of an issuer
+// are unique, the unique index of the bill table rejects concurrent
+// duplicates the check misses.
+func (db *Db) InsertBill(b *specs.Bill) error {
+	tx, err := db.dbCon.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id, custId, err := insertBill(tx, b)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	b.Id = id
+	b.CustomerId = custId
+	return nil
+}
+
+// insertBill stores a bill and its customer in a transaction and returns
+// their ids.
+func insertBill(tx *tx, b *specs.Bill) (int, int, error) {
+	reference := strings.ReplaceAll(b.Details.Referece, " ", "")
+	if reference != "" {
+		exists := 0
+		err := tx.QueryRow("SELECT COUNT(*) FROM bill WHERE issuer_id = ? AND reference = ?",
+			b.IssuerId, reference).Scan(&exists)
+		if err != nil {
+			return -1, -1, err
+		}
+		if exists > 0 {
+			return -1, -1, ErrDuplicateReference
+		}
+	}
+
+	custId, err := insertCustomer(tx, b.Customer)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	id, err := tx.insert("INSERT INTO bill (issuer_id, cust_id, channel, language_code, iban, ref_type, reference, "+
+		"add_msg, currency, amount, payload_hash, qr_file, pdf_file, pdf_hash) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		nullInt(b.IssuerId), custId, b.Channel, defaultString(b.LanguageCode, utils.LANGUAGE_DEFAULT), b.Details.IBAN,
+		b.Details.RefenreceType, nullString(reference), b.Details.AdditionalInfo,
+		b.Details.Currency, b.Details.Amount, b.PayloadHash, b.QrFile, b.PdfFile, b.PdfHash)
+	return id, custId, err
+}
+
+// GetBill returns a stored bill. sql.ErrNoRows is returned for unknown ids.
+func (db *Db) GetBill(id int) (*specs.Bill, error) {
+	row := db.dbCon.QueryRow("SELECT "+billColumns+billJoins+" WHERE b.id = ?", id)
+	return scanBill(row)
+}
+
+// GetBills returns the bills matching the filter, newest first, and the
+// total number of matching bills regardless of limit and offset.
+func (db *Db) GetBills(filter specs.BillFilter) ([]*specs.Bill, int, error) {
+	var (
+		where []string      = []string{}
+		args  []interface{} = []interface{}{}
+		total int           = 0
+	)
+
+	if filter.IssuerId > 0 {
+		where = append(where, "b.issuer_id = ?")
+		args = append(args, filter.IssuerId)
+	}
+	if filter.Customer != "" {
+		where = append(where, "CONCAT_WS(' ', c.lastname, c.fistname) "+db.dialect.like+" ?")
+		args = append(args, "%"+filter.Customer+"%")
+	}
+	if filter.Reference != "" {
+		where = append(where, "b.reference = ?")
+		args = append(args, strings.ReplaceAll(filter.Reference, " ", ""))
+	}
+	if filter.Channel != "" {
+		where = append(where, "b.channel = ?")
+		args = append(args, filter.Channel)
+	}
+	if !filter.From.IsZero() {
+		where = append(where, "b.ts >= ?")
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		where = append(where, "b.ts < ?")
+		args = append(args, filter.To)
+	}
+
+	cond := ""
+	if len(where) > 0 {
+		cond = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	err := db.dbCon.QueryRow("SELECT COUNT(*)"+billJoins+cond, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DEFAULT_BILL_LIMIT
+	} else if limit > MAX_BILL_LIMIT {
+		limit = MAX_BILL_LIMIT
+	}
+	offset := filter.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	rows, err := db.dbCon.Query("SELECT "+billColumns+billJoins+cond+" ORDER BY b.id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, total, err
+	}
+	defer rows.Close()
+
+	bills := []*specs.Bill{}
+	for rows.Next() {
+		b, err := scanBill(rows)
+		if err != nil {
+			return nil, total, err
+		}
+		bills = append(bills, b)
+	}
+
+	return bills, total, rows.Err()
+}
+
+// MarkBillPaid sets the payment time of a bill. sql.ErrNoRows is returned,
+// if there is no unpaid bill with this id.
+func (db *Db) MarkBillPaid(id int, paidAt time.Time) error {
+	res, err := db.dbCon.Exec("UPDATE bill SET paid_ts = ?, updated_ts = CURRENT_TIMESTAMP "+
+		"WHERE id = ? AND paid_ts IS NULL", paidAt, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = sql.ErrNoRows
+	}
+	return err
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	insertReturning(column string, query string, args ...interface{}) (int, error)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBill(row scanner) (*specs.Bill, error) {
+	var (
+		b                                           specs.Bill
+		issuerId, custId                            sql.NullInt64
+		paid                                        sql.NullTime
+		reference, addMsg, qrFile, pdfFile, pdfHash sql.NullString
+		customer, issuer                            account
+	)
+
+	dest := []interface{}{&b.Id, &issuerId, &custId, &b.Channel, &b.LanguageCode, &b.CreatedAt, &b.UpdatedAt, &b.Details.IBAN,
+		&b.Details.RefenreceType, &reference, &addMsg, &b.Details.Currency, &b.Details.Amount,
+		&b.PayloadHash, &qrFile, &pdfFile, &pdfHash, &paid}
+	dest = append(append(dest, customer.dest()...), issuer.dest()...)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	b.IssuerId = int(issuerId.Int64)
+	b.CustomerId = int(custId.Int64)
+	b.Details.Referece = reference.String
+	b.Details.AdditionalInfo = addMsg.String
+	b.QrFile = qrFile.String
+	b.PdfFile = pdfFile.String
+	b.PdfHash = pdfHash.String
+	b.PaidAt = timePtr(paid)
+	b.Customer = customer.details()
+	if issuerId.Valid {
+		b.Issuer = issuer.details()
+	}
+
+	return &b, nil
+}
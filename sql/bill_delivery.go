@@ -0,0 +1,118 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+const (
+	BILL_DELIVERY_PENDING = "PENDING"
+	BILL_DELIVERY_SENT    = "SENT"
+	BILL_DELIVERY_FAILED  = "FAILED"
+	BILL_DELIVERY_BOUNCED = "BOUNCED"
+
+	billDeliveryColumns = "id, bill_id, mail_id, recipient, language_code, message_id, state, attempts, " +
+		"next_attempt_ts, last_error, created_ts, sent_ts"
+)
+
+func (db *Db) InsertBillDelivery(delivery *specs.BillDelivery) error {
+	id, err := db.dbCon.insert("INSERT INTO bill_delivery (bill_id, mail_id, recipient, language_code, message_id, "+
+		"state, next_attempt_ts) VALUES (?, ?, ?, ?, ?, ?, ?)", delivery.BillId, delivery.MailId, delivery.Recipient,
+		sql.NullString{String: delivery.LanguageCode, Valid: delivery.LanguageCode != ""}, delivery.MessageId,
+		BILL_DELIVERY_PENDING, delivery.NextAttemptAt)
+	delivery.Id = id
+	delivery.State = BILL_DELIVERY_PENDING
+	return err
+}
+
+// GetBillDelivery returns a delivery. sql.ErrNoRows is returned for unknown
+// ids.
+func (db *Db) GetBillDelivery(id int) (*specs.BillDelivery, error) {
+	return scanBillDelivery(db.dbCon.QueryRow("SELECT "+billDeliveryColumns+" FROM bill_delivery WHERE id = ?", id))
+}
+
+// GetBillDeliveryByMessageId returns the delivery of a sent mail.
+// sql.ErrNoRows is returned for unknown message ids.
+func (db *Db) GetBillDeliveryByMessageId(messageId string) (*specs.BillDelivery, error) {
+	return scanBillDelivery(db.dbCon.QueryRow("SELECT "+billDeliveryColumns+" FROM bill_delivery "+
+		"WHERE message_id = ?", messageId))
+}
+
+// GetBillDeliveries returns the deliveries of a bill, newest first.
+func (db *Db) GetBillDeliveries(billId int) ([]*specs.BillDelivery, error) {
+	return db.queryBillDeliveries("SELECT "+billDeliveryColumns+" FROM bill_delivery WHERE bill_id = ? "+
+		"ORDER BY id DESC", billId)
+}
+
+// GetDueBillDeliveries returns up to limit pending deliveries, whose next
+// attempt is due.
+func (db *Db) GetDueBillDeliveries(now time.Time, limit int) ([]*specs.BillDelivery, error) {
+	return db.queryBillDeliveries("SELECT "+billDeliveryColumns+" FROM bill_delivery WHERE state = ? AND "+
+		"next_attempt_ts <= ? ORDER BY next_attempt_ts LIMIT ?", BILL_DELIVERY_PENDING, now, limit)
+}
+
+// UpdateBillDelivery stores the outcome of an attempt or a bounce.
+func (db *Db) UpdateBillDelivery(delivery *specs.BillDelivery) error {
+	_, err := db.dbCon.Exec("UPDATE bill_delivery SET state = ?, attempts = ?, next_attempt_ts = ?, "+
+		"last_error = ?, sent_ts = ? WHERE id = ?", delivery.State, delivery.Attempts, delivery.NextAttemptAt,
+		sql.NullString{String: delivery.LastError, Valid: delivery.LastError != ""},
+		nullTime(delivery.SentAt), delivery.Id)
+	return err
+}
+
+func (db *Db) queryBillDeliveries(query string, args ...interface{}) ([]*specs.BillDelivery, error) {
+	rows, err := db.dbCon.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*specs.BillDelivery{}
+	for rows.Next() {
+		delivery, err := scanBillDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func scanBillDelivery(row scanner) (*specs.BillDelivery, error) {
+	var (
+		delivery  specs.BillDelivery
+		language  sql.NullString
+		lastError sql.NullString
+		sent      sql.NullTime
+	)
+
+	err := row.Scan(&delivery.Id, &delivery.BillId, &delivery.MailId, &delivery.Recipient, &language,
+		&delivery.MessageId, &delivery.State, &delivery.Attempts, &delivery.NextAttemptAt, &lastError,
+		&delivery.CreatedAt, &sent)
+	if err != nil {
+		return nil, err
+	}
+	delivery.LanguageCode = language.String
+	delivery.LastError = lastError.String
+	delivery.SentAt = timePtr(sent)
+	return &delivery, nil
+}
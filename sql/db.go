@@ -18,161 +18,287 @@
 package sql
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
 	"strings"
+	"time"
 
-	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/secret"
 	"github.com/ChrIgiSta/swiss-qr-bill/specs"
 
-	_ "github.com/go-sql-driver/mysql"
-)
-
-const (
-	DRIVER = "mysql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
 )
 
 type Db struct {
 	ConnectionString string
-	dbCon            *sql.DB
+	dialect          *dialect
+	sqlDb            *sql.DB
+	dbCon            conn
+	keyring          *secret.Keyring
+	log              *slog.Logger
 }
 
-func NewMariaDb(connectionString string) *Db {
-	return &Db{
-		ConnectionString: connectionString,
+// ConnectionStringFromEnv builds the connection string of the database
+// selected by SQL_DRIVER from the SQL_* environment variables. For sqlite
+// SQL_DATABASE is the path of the file.
+func ConnectionStringFromEnv() string {
+	switch os.Getenv("SQL_DRIVER") {
+	case DIALECT_POSTGRES:
+		cs := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(os.Getenv("SQL_USER"), os.Getenv("SQL_PASSWORD")),
+			Host:   net.JoinHostPort(os.Getenv("SQL_HOST"), os.Getenv("SQL_PORT")),
+			Path:   "/" + os.Getenv("SQL_DATABASE"),
+		}
+		if os.Getenv("SQL_SSLMODE") != "" {
+			cs.RawQuery = url.Values{"sslmode": {os.Getenv("SQL_SSLMODE")}}.Encode()
+		}
+		return cs.String()
+	case DIALECT_SQLITE:
+		return os.Getenv("SQL_DATABASE")
 	}
+	return os.Getenv("SQL_USER") + ":" + os.Getenv("SQL_PASSWORD") + "@" +
+		"tcp(" + os.Getenv("SQL_HOST") + ":" + os.Getenv("SQL_PORT") + ")/" + os.Getenv("SQL_DATABASE") +
+		"?parseTime=true"
 }
 
-func (db *Db) Connect() error {
-	var err error
-
-	db.dbCon, err = sql.Open(DRIVER, db.ConnectionString)
-	return err
+// NewFromEnv returns the database selected by SQL_DRIVER (mariadb, postgres
+// or sqlite), mariadb by default.
+func NewFromEnv() (*Db, error) {
+	driver := os.Getenv("SQL_DRIVER")
+	if driver == "" {
+		driver = DIALECT_MARIADB
+	}
+	return New(driver, ConnectionStringFromEnv())
 }
 
-func (db *Db) RegisterVersion(version string) error {
-	var err error
+// New returns the database of a dialect, see DIALECT_*.
+func New(dialectName string, connectionString string) (*Db, error) {
+	d, err := getDialect(dialectName)
+	if err != nil {
+		return nil, err
+	}
+	return &Db{
+		ConnectionString: connectionString,
+		dialect:          d,
+		log:              slog.Default(),
+	}, nil
+}
 
-	_, err = db.dbCon.Exec("INSERT INTO versioning (version) VALUES (?)", version)
-	return err
+func NewMariaDb(connectionString string) *Db {
+	db, _ := New(DIALECT_MARIADB, connectionString)
+	return db
 }
 
-func (db *Db) CheckVersion() (string, error) {
-	var (
-		version string = ""
-	)
+// NewPostgres uses a postgres url or keyword/value connection string.
+func NewPostgres(connectionString string) *Db {
+	db, _ := New(DIALECT_POSTGRES, connectionString)
+	return db
+}
 
-	rows, err := db.dbCon.Query("SELECT version FROM version")
-	if err != nil {
-		return "", err
-	}
+// NewSqlite uses the database file at path, ":memory:" for a database which
+// is dropped on Close.
+func NewSqlite(path string) *Db {
+	db, _ := New(DIALECT_SQLITE, path)
+	return db
+}
 
-	defer rows.Close()
+// SetLogger replaces the default logger.
+func (db *Db) SetLogger(logger *slog.Logger) {
+	db.log = logger
+}
 
-	rows.Next()
-	rows.Scan(&version)
+// SetKeyring encrypts the secrets, e.g. mail passwords, with the keyring.
+// Without a keyring secrets are stored in plaintext.
+func (db *Db) SetKeyring(keyring *secret.Keyring) {
+	db.keyring = keyring
+}
 
-	return version, err
+// Dialect returns the kind of database, see DIALECT_*.
+func (db *Db) Dialect() string {
+	return db.dialect.name
 }
 
-func (db *Db) GetIssuer(id int) (string, specs.AccountDetails, error) {
-	var (
-		iban                string               = ""
-		firstname, lastname string               = "", ""
-		issuer              specs.AccountDetails = specs.AccountDetails{}
-	)
+func (db *Db) Connect() error {
+	var err error
 
-	rows, err := db.dbCon.Query("SELECT iban, fistname, lastname, address1, "+
-		"address2, zip, location, country FROM issuer WHERE id = ?", id)
+	dsn := db.ConnectionString
+	// never log the connection string, it contains the password
+	switch db.dialect.name {
+	case DIALECT_MARIADB:
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return err
+		}
+		db.log.Info("connect to database", "addr", cfg.Addr, "database", cfg.DBName, "user", cfg.User,
+			"dialect", db.dialect.name)
+	case DIALECT_POSTGRES:
+		cfg, err := pgx.ParseConfig(dsn)
+		if err != nil {
+			return err
+		}
+		db.log.Info("connect to database", "addr", net.JoinHostPort(cfg.Host, fmt.Sprint(cfg.Port)),
+			"database", cfg.Database, "user", cfg.User, "dialect", db.dialect.name)
+	case DIALECT_SQLITE:
+		db.log.Info("open database", "path", dsn, "dialect", db.dialect.name)
+		// times as text in utc, see dialect.utc
+		dsn += "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+	}
+
+	db.sqlDb, err = sql.Open(db.dialect.driver, dsn)
 	if err != nil {
-		return "", issuer, err
+		return err
 	}
-	defer rows.Close()
+	if db.dialect.name == DIALECT_SQLITE {
+		// sqlite has a single writer, an in-memory database lives in its
+		// connection
+		db.sqlDb.SetMaxOpenConns(1)
+	}
+	db.dbCon = conn{q: db.sqlDb, dialect: db.dialect}
+	return nil
+}
 
-	rows.Next()
-	err = rows.Scan(&iban, &firstname, &lastname, &issuer.Address1,
-		&issuer.Address2, &issuer.Zip, &issuer.Location, &issuer.Country)
-	issuer.AddressType = qr.ADDRESS_TYPE_STRUCTURED
-	issuer.Name = lastname + " " + firstname
+// Ping checks that the database is reachable.
+func (db *Db) Ping(ctx context.Context) error {
+	return db.sqlDb.PingContext(ctx)
+}
 
-	return iban, issuer, err
+func (db *Db) Close() error {
+	db.log.Info("close database")
+	return db.sqlDb.Close()
 }
 
-func (db *Db) InsertIssuer(iban string, details specs.AccountDetails) (*specs.AccountDetails, int, error) {
-	id := -1
-	nameSplit := strings.Split(details.Name, " ")
-	row, err := db.dbCon.Query("INSERT INTO issuer (iban, fistname, lastname, address1, "+
-		"address2, zip, location, country) VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id",
-		iban, nameSplit[1], nameSplit[0], details.Address1, details.Address2,
-		details.Zip, details.Location, details.Country)
+const mailColumns = "id, enable, issuer_id, username, email, sender_name, password, " +
+	"smtp_secure, smtp_host, smtp_port, pop3_secure, pop3_host, pop3_port, token, use_whitelist, " +
+	"protocol, imap_secure, imap_host, imap_port, imap_folder, processed_folder, failed_folder, auth_serv_id, language_code"
 
+func (db *Db) InsertMailConfig(cnf *specs.MailConfig) error {
+	protocol := cnf.Protocol
+	if protocol == "" {
+		protocol = "POP3"
+	}
+	password, err := db.keyring.Encrypt(cnf.Password, SECRET_MAIL_PASSWORD)
 	if err != nil {
-		return nil, id, err
+		return err
 	}
-
-	row.Next()
-	row.Scan(&id)
-	return &details, id, err
-}
-
-func (db *Db) InsertMailConfig(cnf *specs.MailConfig) error {
-	_, err := db.dbCon.Exec("INSERT INTO mail "+
-		"(token, enable, issuer_id, username, email, sender_name, password, smtp_secure, smtp_host, smtp_port, pop3_secure, pop3_host, pop3_port, use_whitelist) "+
-		"VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)",
-		cnf.Token, cnf.Enable, cnf.IssuerId, cnf.Username, cnf.Email, cnf.SenderName, cnf.Password, cnf.SmtpSecure, cnf.SmtpHost, cnf.SmtpPort, cnf.Pop3Secure,
-		cnf.Pop3Host, cnf.Pop3Port, cnf.UseWhitelist)
+	id, err := db.dbCon.insert("INSERT INTO mail "+
+		"(token, enable, issuer_id, username, email, sender_name, password, smtp_secure, smtp_host, smtp_port, pop3_secure, pop3_host, pop3_port, use_whitelist, "+
+		"protocol, imap_secure, imap_host, imap_port, imap_folder, processed_folder, failed_folder, auth_serv_id, language_code) "+
+		"VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		cnf.Token, cnf.Enable, nullInt(cnf.IssuerId), cnf.Username, cnf.Email, cnf.SenderName, password, cnf.SmtpSecure, cnf.SmtpHost, cnf.SmtpPort, cnf.Pop3Secure,
+		cnf.Pop3Host, cnf.Pop3Port, cnf.UseWhitelist,
+		protocol, cnf.ImapSecure, cnf.ImapHost, cnf.ImapPort, defaultString(cnf.ImapFolder, "INBOX"),
+		defaultString(cnf.ProcessedFolder, "Processed"), defaultString(cnf.FailedFolder, "Failed"),
+		sql.NullString{String: cnf.AuthServId, Valid: cnf.AuthServId != ""}, defaultString(cnf.LanguageCode, "EN"))
+	cnf.Id = id
 	return err
 }
 
-func (db *Db) GetTranslationTable(languageCode string) (specs.TranslationTable, error) {
-	tr := specs.TranslationTable{}
+func (db *Db) GetMailConfigurations() ([]*specs.MailConfig, error) {
+	mCnfs := []*specs.MailConfig{}
 
-	row, err := db.dbCon.Query("SELECT paymentPart, account, reference, additionalInfos, "+
-		"furtherInfos, currency, amount, receipt, acceptancePoint, sepBeforePay, payableBy, "+
-		"payableByNameAddr, inFavour FROM translation WHERE languageCode = ?", languageCode)
+	row, err := db.dbCon.Query("SELECT " + mailColumns + " FROM mail WHERE enable = true")
 
 	if err != nil {
-		return tr, err
+		return nil, err
 	}
 
 	defer row.Close()
-	row.Next()
-	err = row.Scan(&tr.PaymentPart, &tr.Account, &tr.Reference, &tr.AdditionalInfos,
-		&tr.FurtherInfos, &tr.Currency, &tr.Amount, &tr.Receipt, &tr.AcceptancePoint,
-		&tr.SepBeforePay, &tr.PayableBy, &tr.PayableByNameAddr, &tr.InFavour)
+	for row.Next() {
+		mCnf, err := db.scanMailConfig(row)
+		if err != nil {
+			return nil, err
+		}
+		mCnfs = append(mCnfs, mCnf)
+	}
 
-	return tr, err
+	return mCnfs, row.Err()
 }
 
-func (db *Db) GetApiToken() (string, error) {
-	var token string = ""
-	row := db.dbCon.QueryRow("SELECT token FROM api")
-	err := row.Scan(&token)
-
-	return token, err
+// GetMailConfig returns a mail configuration. sql.ErrNoRows is returned
+// for unknown ids.
+func (db *Db) GetMailConfig(id int) (*specs.MailConfig, error) {
+	return db.scanMailConfig(db.dbCon.QueryRow("SELECT "+mailColumns+" FROM mail WHERE id = ?", id))
 }
 
-func (db *Db) GetMailConfigurations() ([]*specs.MailConfig, error) {
-	mCnfs := []*specs.MailConfig{}
-
-	row, err := db.dbCon.Query("SELECT enable, issuer_id, username,	email, password " +
-		",smtp_secure ,smtp_host ,smtp_port ,pop3_secure ,pop3_host ,pop3_port ,token ,use_whitelist " +
-		"FROM mail WHERE enable = true")
+// GetMailConfigByIssuer returns the first enabled mail configuration of an
+// issuer. sql.ErrNoRows is returned, if there is none.
+func (db *Db) GetMailConfigByIssuer(issuerId int) (*specs.MailConfig, error) {
+	return db.scanMailConfig(db.dbCon.QueryRow("SELECT "+mailColumns+" FROM mail WHERE issuer_id = ? AND "+
+		"enable = true ORDER BY id LIMIT 1", issuerId))
+}
 
+// scanMailConfig scans a row of mailColumns and decrypts the password.
+func (db *Db) scanMailConfig(row scanner) (*specs.MailConfig, error) {
+	mCnf := specs.MailConfig{}
+	issuerId := sql.NullInt64{}
+	senderName, imapHost, authServId := sql.NullString{}, sql.NullString{}, sql.NullString{}
+
+	err := row.Scan(&mCnf.Id, &mCnf.Enable, &issuerId, &mCnf.Username, &mCnf.Email, &senderName, &mCnf.Password,
+		&mCnf.SmtpSecure, &mCnf.SmtpHost, &mCnf.SmtpPort, &mCnf.Pop3Secure, &mCnf.Pop3Host, &mCnf.Pop3Port,
+		&mCnf.Token, &mCnf.UseWhitelist,
+		&mCnf.Protocol, &mCnf.ImapSecure, &imapHost, &mCnf.ImapPort, &mCnf.ImapFolder, &mCnf.ProcessedFolder,
+		&mCnf.FailedFolder, &authServId, &mCnf.LanguageCode)
 	if err != nil {
 		return nil, err
 	}
+	mCnf.IssuerId = int(issuerId.Int64)
+	mCnf.SenderName = senderName.String
+	mCnf.ImapHost = imapHost.String
+	mCnf.AuthServId = authServId.String
+	mCnf.Password, err = db.keyring.Decrypt(mCnf.Password, SECRET_MAIL_PASSWORD)
+	if err != nil {
+		return nil, fmt.Errorf("mail %d: %w", mCnf.Id, err)
+	}
+	return &mCnf, nil
+}
 
-	defer row.Close()
-	for row.Next() {
-		mCnf := specs.MailConfig{}
-		err = row.Scan(&mCnf.Enable, &mCnf.IssuerId, &mCnf.Username, &mCnf.Email, &mCnf.Password,
-			&mCnf.SmtpSecure, &mCnf.SmtpHost, &mCnf.SmtpPort, &mCnf.Pop3Secure, &mCnf.Pop3Host, &mCnf.Pop3Port,
-			&mCnf.Token, &mCnf.UseWhitelist)
-		if err != nil {
-			return nil, err
-		}
-		mCnfs = append(mCnfs, &mCnf)
+func defaultString(value string, def string) string {
+	if value == "" {
+		return def
 	}
+	return value
+}
 
-	return mCnfs, err
+// nullString maps "" to NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullInt maps ids and limits <= 0 to NULL
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i > 0}
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// splitList splits a comma separated column.
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -0,0 +1,255 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DIALECT_MARIADB  = "mariadb"
+	DIALECT_POSTGRES = "postgres"
+	DIALECT_SQLITE   = "sqlite"
+
+	migrationLockId = 0x71722d62696c6c // "qr-bill", key of the postgres advisory lock
+)
+
+// dialect holds the differences of the databases. Queries are written for
+// mariadb with ? placeholders and translated by conn.
+type dialect struct {
+	name        string
+	driver      string // of database/sql
+	numbered    bool   // $1 placeholders instead of ?
+	returningId bool   // the driver has no LastInsertId, RETURNING id is used
+	utc         bool   // times are stored as text, they must be in the same zone to compare
+	like        string // case insensitive LIKE
+	forUpdate   string // row lock of a select, empty if the database locks as a whole
+	tableExists string // query counting the tables with a name
+	lock        string // query taking the migration lock, empty if not needed
+	unlock      string
+}
+
+var dialects = map[string]*dialect{
+	DIALECT_MARIADB: {
+		name:   DIALECT_MARIADB,
+		driver: "mysql",
+		like:   "LIKE",
+
+		forUpdate: " FOR UPDATE",
+		tableExists: "SELECT COUNT(*) FROM information_schema.tables " +
+			"WHERE table_schema = DATABASE() AND table_name = ?",
+		lock:   "SELECT GET_LOCK('swiss-qr-bill.migrate', 60) = 1",
+		unlock: "SELECT RELEASE_LOCK('swiss-qr-bill.migrate')",
+	},
+	DIALECT_POSTGRES: {
+		name:        DIALECT_POSTGRES,
+		driver:      "pgx",
+		numbered:    true,
+		returningId: true,
+		like:        "ILIKE",
+
+		forUpdate: " FOR UPDATE",
+		tableExists: "SELECT COUNT(*) FROM information_schema.tables " +
+			"WHERE table_schema = current_schema() AND table_name = ?",
+		lock:   "SELECT pg_advisory_lock(" + strconv.Itoa(migrationLockId) + ") IS NOT NULL",
+		unlock: "SELECT pg_advisory_unlock(" + strconv.Itoa(migrationLockId) + ")",
+	},
+	DIALECT_SQLITE: {
+		name:   DIALECT_SQLITE,
+		driver: "sqlite",
+		utc:    true,
+		like:   "LIKE",
+
+		tableExists: "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
+	},
+}
+
+func getDialect(name string) (*dialect, error) {
+	d, ok := dialects[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown database %q, use %s, %s or %s", name,
+			DIALECT_MARIADB, DIALECT_POSTGRES, DIALECT_SQLITE)
+	}
+	return d, nil
+}
+
+// rebind replaces the ? placeholders outside of quotes by $1, $2, ...
+func (d *dialect) rebind(query string) string {
+	if !d.numbered || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var (
+		out   strings.Builder
+		quote byte
+		n     int
+	)
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			out.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		out.WriteByte(c)
+	}
+	return out.String()
+}
+
+func (d *dialect) args(args []interface{}) []interface{} {
+	if !d.utc {
+		return args
+	}
+
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch t := arg.(type) {
+		case time.Time:
+			arg = t.UTC()
+		case sql.NullTime:
+			t.Time = t.Time.UTC()
+			arg = t
+		}
+		converted[i] = arg
+	}
+	return converted
+}
+
+// insertIgnore returns an insert, which skips rows violating a unique key.
+// into is the part after INSERT INTO.
+func (d *dialect) insertIgnore(into string) string {
+	if d.name == DIALECT_MARIADB {
+		return "INSERT IGNORE INTO " + into
+	}
+	return "INSERT INTO " + into + " ON CONFLICT DO NOTHING"
+}
+
+// onConflict starts the update of an insert hitting the unique key of the
+// columns keys, see excluded.
+func (d *dialect) onConflict(keys string) string {
+	if d.name == DIALECT_MARIADB {
+		return " ON DUPLICATE KEY UPDATE "
+	}
+	return " ON CONFLICT (" + keys + ") DO UPDATE SET "
+}
+
+// excluded refers to the value of column, which was to be inserted.
+func (d *dialect) excluded(column string) string {
+	if d.name == DIALECT_MARIADB {
+		return "VALUES(" + column + ")"
+	}
+	return "excluded." + column
+}
+
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// conn runs the queries on a database, transaction or connection in the
+// dialect of the database.
+type conn struct {
+	q       querier
+	dialect *dialect
+}
+
+func (c conn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.ExecContext(context.Background(), query, args...)
+}
+
+func (c conn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.QueryContext(context.Background(), query, args...)
+}
+
+func (c conn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.QueryRowContext(context.Background(), query, args...)
+}
+
+func (c conn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return c.q.ExecContext(ctx, c.dialect.rebind(query), c.dialect.args(args)...)
+}
+
+func (c conn) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.QueryContext(ctx, c.dialect.rebind(query), c.dialect.args(args)...)
+}
+
+func (c conn) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return c.q.QueryRowContext(ctx, c.dialect.rebind(query), c.dialect.args(args)...)
+}
+
+// insert runs an insert into a table with an id column and returns the
+// generated id.
+func (c conn) insert(query string, args ...interface{}) (int, error) {
+	return c.insertReturning("id", query, args...)
+}
+
+// insertReturning runs an insert and returns the generated value of the
+// auto increment column.
+func (c conn) insertReturning(column string, query string, args ...interface{}) (int, error) {
+	if c.dialect.returningId {
+		id := -1
+		err := c.QueryRow(query+" RETURNING "+column, args...).Scan(&id)
+		return id, err
+	}
+
+	res, err := c.Exec(query, args...)
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// Begin starts a transaction, its queries are run by the returned tx.
+func (c conn) Begin() (*tx, error) {
+	db, ok := c.q.(*sql.DB)
+	if !ok {
+		return nil, fmt.Errorf("cannot begin a transaction on %T", c.q)
+	}
+	t, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &tx{conn: conn{q: t, dialect: c.dialect}, t: t}, nil
+}
+
+type tx struct {
+	conn
+	t *sql.Tx
+}
+
+func (t *tx) Commit() error {
+	return t.t.Commit()
+}
+
+func (t *tx) Rollback() error {
+	return t.t.Rollback()
+}
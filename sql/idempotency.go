@@ -0,0 +1,70 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+// ReserveIdempotencyKey stores a new key without a bill. If the key is
+// already known, false is returned along with the stored key.
+func (db *Db) ReserveIdempotencyKey(key *specs.IdempotencyKey) (bool, *specs.IdempotencyKey, error) {
+	res, err := db.dbCon.Exec(db.dialect.insertIgnore("idempotency_key "+
+		"(api_key_id, idem_key, request_hash, created_ts) VALUES (?, ?, ?, ?)"), key.ApiKeyId, key.Key, key.RequestHash, key.CreatedAt)
+	if err != nil {
+		return false, nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, nil, err
+	}
+	if n == 1 {
+		return true, key, nil
+	}
+
+	var (
+		stored specs.IdempotencyKey
+		billId sql.NullInt64
+	)
+	err = db.dbCon.QueryRow("SELECT api_key_id, idem_key, request_hash, bill_id, created_ts FROM idempotency_key "+
+		"WHERE api_key_id = ? AND idem_key = ?", key.ApiKeyId, key.Key).Scan(&stored.ApiKeyId, &stored.Key,
+		&stored.RequestHash, &billId, &stored.CreatedAt)
+	stored.BillId = int(billId.Int64)
+	return false, &stored, err
+}
+
+// CompleteIdempotencyKey links the generated bill to a reserved key.
+func (db *Db) CompleteIdempotencyKey(apiKeyId int, key string, billId int) error {
+	_, err := db.dbCon.Exec("UPDATE idempotency_key SET bill_id = ? WHERE api_key_id = ? AND idem_key = ?",
+		billId, apiKeyId, key)
+	return err
+}
+
+func (db *Db) DeleteIdempotencyKey(apiKeyId int, key string) error {
+	_, err := db.dbCon.Exec("DELETE FROM idempotency_key WHERE api_key_id = ? AND idem_key = ?", apiKeyId, key)
+	return err
+}
+
+// DeleteIdempotencyKeysBefore removes all keys created before t.
+func (db *Db) DeleteIdempotencyKeysBefore(t time.Time) error {
+	_, err := db.dbCon.Exec("DELETE FROM idempotency_key WHERE created_ts < ?", t)
+	return err
+}
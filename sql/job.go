@@ -0,0 +1,223 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+const (
+	JOB_STATE_QUEUED  = "QUEUED"
+	JOB_STATE_RUNNING = "RUNNING"
+	JOB_STATE_DONE    = "DONE"
+	JOB_STATE_FAILED  = "FAILED"
+
+	jobColumns = "id, api_key_id, state, format, total, done, failed, attempts, error, created_ts, updated_ts, " +
+		"finished_ts"
+)
+
+// InsertJob queues a job with its request, the json encoded bill
+// informations.
+func (db *Db) InsertJob(job *specs.Job, request string) error {
+	id, err := db.dbCon.insert("INSERT INTO job (api_key_id, state, format, request, total) VALUES (?, ?, ?, ?, ?)",
+		nullInt(job.ApiKeyId), JOB_STATE_QUEUED, job.Format, request, job.Total)
+	job.Id = id
+	job.State = JOB_STATE_QUEUED
+	return err
+}
+
+// GetJob returns a job. sql.ErrNoRows is returned for unknown ids.
+func (db *Db) GetJob(id int) (*specs.Job, error) {
+	row := db.dbCon.QueryRow("SELECT "+jobColumns+" FROM job WHERE id = ?", id)
+	return scanJob(row)
+}
+
+func (db *Db) GetJobRequest(id int) (string, error) {
+	request := ""
+	err := db.dbCon.QueryRow("SELECT request FROM job WHERE id = ?", id).Scan(&request)
+	return request, err
+}
+
+// ClaimNextJob marks the oldest queued job as running and returns it.
+// sql.ErrNoRows is returned, if no job is queued.
+func (db *Db) ClaimNextJob() (*specs.Job, error) {
+	tx, err := db.dbCon.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	job, err := scanJob(tx.QueryRow("SELECT "+jobColumns+" FROM job WHERE state = ? ORDER BY id LIMIT 1"+
+		db.dialect.forUpdate, JOB_STATE_QUEUED))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE job SET state = ?, updated_ts = CURRENT_TIMESTAMP WHERE id = ?", JOB_STATE_RUNNING, job.Id)
+	if err != nil {
+		return nil, err
+	}
+	job.State = JOB_STATE_RUNNING
+
+	return job, tx.Commit()
+}
+
+// RequeueRunningJobs queues jobs again, which were interrupted by a stop
+// of the app.
+func (db *Db) RequeueRunningJobs() (int, error) {
+	res, err := db.dbCon.Exec("UPDATE job SET state = ?, updated_ts = CURRENT_TIMESTAMP WHERE state = ?",
+		JOB_STATE_QUEUED, JOB_STATE_RUNNING)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// FinishJob sets the final state of a job, errMsg is shown to the client.
+func (db *Db) FinishJob(id int, state string, errMsg string) error {
+	_, err := db.dbCon.Exec("UPDATE job SET state = ?, error = ?, finished_ts = ?, updated_ts = CURRENT_TIMESTAMP "+
+		"WHERE id = ?", state, sql.NullString{String: errMsg, Valid: errMsg != ""}, time.Now(), id)
+	return err
+}
+
+// RequeueJob queues a job again, which can't be run now. Its processed
+// rows are kept.
+func (db *Db) RequeueJob(id int) error {
+	_, err := db.dbCon.Exec("UPDATE job SET state = ?, updated_ts = CURRENT_TIMESTAMP WHERE id = ?",
+		JOB_STATE_QUEUED, id)
+	return err
+}
+
+// RetryJob queues a job again after a failed attempt and counts the
+// attempt, errMsg is kept as the error of the job.
+func (db *Db) RetryJob(id int, errMsg string) error {
+	_, err := db.dbCon.Exec("UPDATE job SET state = ?, attempts = attempts + 1, error = ?, "+
+		"updated_ts = CURRENT_TIMESTAMP WHERE id = ?", JOB_STATE_QUEUED, errMsg, id)
+	return err
+}
+
+// InsertJobRow stores the outcome of a row and updates the progress of the
+// job.
+func (db *Db) InsertJobRow(jobId int, row specs.BatchRow) error {
+	tx, err := db.dbCon.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertJobRow(tx, jobId, row)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// InsertJobBill stores the bill of a row together with the outcome of the
+// row, so a resumed job never stores a bill twice. Id and CustomerId of the
+// bill are set on success.
+func (db *Db) InsertJobBill(jobId int, rowNum int, b *specs.Bill) error {
+	tx, err := db.dbCon.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id, custId, err := insertBill(tx, b)
+	if err != nil {
+		return err
+	}
+	err = insertJobRow(tx, jobId, specs.BatchRow{Row: rowNum, BillId: id, Reference: b.Details.Referece})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	b.Id = id
+	b.CustomerId = custId
+	return nil
+}
+
+func insertJobRow(tx *tx, jobId int, row specs.BatchRow) error {
+	_, err := tx.Exec("INSERT INTO job_row (job_id, row_num, bill_id, reference, error) VALUES (?, ?, ?, ?, ?)",
+		jobId, row.Row, nullInt(row.BillId), row.Reference, sql.NullString{String: row.Error, Valid: row.Error != ""})
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	if row.Error != "" {
+		failed = 1
+	}
+	_, err = tx.Exec("UPDATE job SET done = done + 1, failed = failed + ?, updated_ts = CURRENT_TIMESTAMP "+
+		"WHERE id = ?", failed, jobId)
+	return err
+}
+
+// GetJobRows returns the outcomes of the processed rows of a job.
+func (db *Db) GetJobRows(jobId int) ([]specs.BatchRow, error) {
+	rows, err := db.dbCon.Query("SELECT row_num, bill_id, reference, error FROM job_row WHERE job_id = ? "+
+		"ORDER BY row_num", jobId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobRows := []specs.BatchRow{}
+	for rows.Next() {
+		var (
+			row               specs.BatchRow
+			billId            sql.NullInt64
+			reference, errMsg sql.NullString
+		)
+		err = rows.Scan(&row.Row, &billId, &reference, &errMsg)
+		if err != nil {
+			return nil, err
+		}
+		row.BillId = int(billId.Int64)
+		row.Reference = reference.String
+		row.Error = errMsg.String
+		jobRows = append(jobRows, row)
+	}
+	return jobRows, rows.Err()
+}
+
+func scanJob(row scanner) (*specs.Job, error) {
+	var (
+		job      specs.Job
+		apiKeyId sql.NullInt64
+		errMsg   sql.NullString
+		finished sql.NullTime
+	)
+
+	err := row.Scan(&job.Id, &apiKeyId, &job.State, &job.Format, &job.Total, &job.Done, &job.Failed,
+		&job.Attempts, &errMsg, &job.CreatedAt, &job.UpdatedAt, &finished)
+	if err != nil {
+		return nil, err
+	}
+	job.ApiKeyId = int(apiKeyId.Int64)
+	job.Error = errMsg.String
+	job.FinishedAt = timePtr(finished)
+
+	return &job, nil
+}
@@ -0,0 +1,58 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+// GetMailTemplate returns the reply template of an issuer, sql.ErrNoRows
+// if there is none.
+func (db *Db) GetMailTemplate(issuerId int, languageCode string, kind string) (*specs.MailTemplate, error) {
+	t := specs.MailTemplate{}
+	htmlBody := sql.NullString{}
+
+	err := db.dbCon.QueryRow("SELECT issuer_id, language_code, kind, subject, text_body, html_body, due_days "+
+		"FROM mail_template WHERE issuer_id = ? AND language_code = ? AND kind = ?", issuerId, languageCode, kind).
+		Scan(&t.IssuerId, &t.LanguageCode, &t.Kind, &t.Subject, &t.TextBody, &htmlBody, &t.DueDays)
+	if err != nil {
+		return nil, err
+	}
+	t.HtmlBody = htmlBody.String
+	return &t, nil
+}
+
+// SetMailTemplate inserts or replaces a reply template of an issuer.
+func (db *Db) SetMailTemplate(t *specs.MailTemplate) error {
+	_, err := db.dbCon.Exec("INSERT INTO mail_template "+
+		"(issuer_id, language_code, kind, subject, text_body, html_body, due_days) VALUES (?, ?, ?, ?, ?, ?, ?)"+
+		db.dialect.onConflict("issuer_id, language_code, kind")+
+		"subject = "+db.dialect.excluded("subject")+", text_body = "+db.dialect.excluded("text_body")+", "+
+		"html_body = "+db.dialect.excluded("html_body")+", due_days = "+db.dialect.excluded("due_days"),
+		t.IssuerId, t.LanguageCode, t.Kind, t.Subject, t.TextBody,
+		sql.NullString{String: t.HtmlBody, Valid: t.HtmlBody != ""}, t.DueDays)
+	return err
+}
+
+func (db *Db) DeleteMailTemplate(issuerId int, languageCode string, kind string) error {
+	_, err := db.dbCon.Exec("DELETE FROM mail_template WHERE issuer_id = ? AND language_code = ? AND kind = ?",
+		issuerId, languageCode, kind)
+	return err
+}
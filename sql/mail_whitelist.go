@@ -0,0 +1,52 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+// GetMailWhitelist returns the allowed senders of a mail configuration.
+func (db *Db) GetMailWhitelist(mailId int) ([]string, error) {
+	whitelist := []string{}
+
+	rows, err := db.dbCon.Query("SELECT email FROM mail_whitelist WHERE mail_id = ?", mailId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var email string
+		err = rows.Scan(&email)
+		if err != nil {
+			return nil, err
+		}
+		whitelist = append(whitelist, email)
+	}
+	return whitelist, rows.Err()
+}
+
+// InsertMailWhitelist allows a sender address or a domain wildcard (*@domain,
+// *@*.domain) for a mail configuration.
+func (db *Db) InsertMailWhitelist(mailId int, email string) error {
+	_, err := db.dbCon.Exec(db.dialect.insertIgnore("mail_whitelist (mail_id, email) VALUES (?, ?)"),
+		mailId, email)
+	return err
+}
+
+func (db *Db) DeleteMailWhitelist(mailId int, email string) error {
+	_, err := db.dbCon.Exec("DELETE FROM mail_whitelist WHERE mail_id = ? AND email = ?", mailId, email)
+	return err
+}
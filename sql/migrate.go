@@ -0,0 +1,343 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("checksum of applied migration changed")
+	ErrUnknownMigration = errors.New("database has an unknown migration, the app is too old")
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is a forward only schema change, read from
+// migrations/<dialect>/<version>_<name>.sql. Applied migrations must never be
+// edited, add a new one instead. The versions of all dialects are kept in
+// step.
+type Migration struct {
+	Version   int
+	Name      string
+	Checksum  string // sha256 of the file
+	Sql       string
+	AppliedAt *time.Time // nil while pending
+}
+
+// Migrations returns the embedded migrations of a dialect ordered by
+// version.
+func Migrations(dialectName string) ([]Migration, error) {
+	if _, err := getDialect(dialectName); err != nil {
+		return nil, err
+	}
+	files, err := fs.Glob(migrationFiles, "migrations/"+dialectName+"/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []Migration{}
+	for _, file := range files {
+		base := strings.TrimSuffix(path.Base(file), ".sql")
+		version, name, ok := strings.Cut(base, "_")
+		v, err := strconv.Atoi(version)
+		if !ok || err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %s", file)
+		}
+		content, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		migrations = append(migrations, Migration{
+			Version:  v,
+			Name:     name,
+			Checksum: hex.EncodeToString(sum[:]),
+			Sql:      string(content),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Statements splits the migration into single statements, the driver doesn't
+// run multiple statements at once. Comments are dropped, semicolons in
+// quotes are kept.
+func (m *Migration) Statements() []string {
+	var (
+		statements = []string{}
+		current    strings.Builder
+		quote      byte
+	)
+	flush := func() {
+		if s := strings.TrimSpace(current.String()); s != "" {
+			statements = append(statements, s)
+		}
+		current.Reset()
+	}
+
+	src := m.Sql
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if quote != 0 {
+			current.WriteByte(c)
+			if c == '\\' && quote != '`' && i+1 < len(src) {
+				i++
+				current.WriteByte(src[i])
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			current.WriteByte(c)
+		case c == '#' || lineComment(src[i:]):
+			end := strings.IndexByte(src[i:], '\n')
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end - 1
+			}
+		case c == '/' && strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end + 3
+			}
+			current.WriteByte(' ')
+		case c == ';':
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
+
+// MigrationStatus returns all known migrations with the time they were
+// applied. Checksums of applied migrations are verified.
+func (db *Db) MigrationStatus(ctx context.Context) ([]Migration, error) {
+	conn, err := db.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	migrations, err := Migrations(db.dialect.name)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.createMigrationTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.applied(ctx, migrations)
+	return migrations, err
+}
+
+// Migrate applies the pending migrations and returns how many were applied.
+// Concurrent instances wait on a database lock. A database created from the
+// init.sql of v1.0.0, which is the mariadb migration 1, is recorded at
+// version 1 without running it.
+func (db *Db) Migrate(ctx context.Context) (int, error) {
+	conn, err := db.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.close()
+
+	if db.dialect.lock != "" {
+		locked := false
+		err = conn.QueryRowContext(ctx, db.dialect.lock).Scan(&locked)
+		if err != nil {
+			return 0, err
+		}
+		if !locked {
+			return 0, errors.New("timeout waiting for the migration lock")
+		}
+		defer conn.ExecContext(context.Background(), db.dialect.unlock)
+	}
+
+	migrations, err := Migrations(db.dialect.name)
+	if err != nil {
+		return 0, err
+	}
+
+	exists, err := conn.tableExists(ctx, "schema_migrations")
+	if err != nil {
+		return 0, err
+	}
+	err = conn.createMigrationTable(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !exists && len(migrations) > 0 {
+		baseline, err := conn.tableExists(ctx, "issuer")
+		if err != nil {
+			return 0, err
+		}
+		if baseline {
+			db.log.Info("record existing schema as migration", "version", migrations[0].Version)
+			err = conn.recordMigration(ctx, migrations[0])
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	err = conn.applied(ctx, migrations)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if m.AppliedAt != nil {
+			continue
+		}
+		db.log.Info("apply migration", "version", m.Version, "name", m.Name)
+		// mariadb commits ddl implicitly, a failed migration must be
+		// cleaned up by hand
+		for _, statement := range m.Statements() {
+			_, err = conn.ExecContext(ctx, statement)
+			if err != nil {
+				return count, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+		}
+		err = conn.recordMigration(ctx, m)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 for an
+// empty database.
+func (db *Db) SchemaVersion(ctx context.Context) (int, error) {
+	version := sql.NullInt64{}
+	err := db.dbCon.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	return int(version.Int64), err
+}
+
+// migrationConn is a single connection, the lock of mariadb and postgres
+// belongs to it.
+type migrationConn struct {
+	conn
+	c *sql.Conn
+}
+
+func (db *Db) conn(ctx context.Context) (*migrationConn, error) {
+	c, err := db.sqlDb.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &migrationConn{conn: conn{q: c, dialect: db.dialect}, c: c}, nil
+}
+
+func (c *migrationConn) close() error {
+	return c.c.Close()
+}
+
+// lineComment reports whether src starts with "--" followed by whitespace,
+// mariadb reads "--1" as two minus signs.
+func lineComment(src string) bool {
+	return strings.HasPrefix(src, "--") && (len(src) == 2 || strings.ContainsRune(" \t\r\n", rune(src[2])))
+}
+
+func (c *migrationConn) createMigrationTable(ctx context.Context) error {
+	_, err := c.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations ("+
+		"version INT NOT NULL PRIMARY KEY, "+
+		"name VARCHAR(255) NOT NULL, "+
+		"checksum CHAR(64) NOT NULL, "+
+		"applied_ts TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)")
+	return err
+}
+
+func (c *migrationConn) tableExists(ctx context.Context, table string) (bool, error) {
+	count := 0
+	err := c.QueryRowContext(ctx, c.dialect.tableExists, table).Scan(&count)
+	return count > 0, err
+}
+
+func (c *migrationConn) recordMigration(ctx context.Context, m Migration) error {
+	_, err := c.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES (?, ?, ?)",
+		m.Version, m.Name, m.Checksum)
+	return err
+}
+
+// applied sets AppliedAt of the migrations recorded in the database.
+func (c *migrationConn) applied(ctx context.Context, migrations []Migration) error {
+	rows, err := c.QueryContext(ctx, "SELECT version, checksum, applied_ts FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	index := map[int]*Migration{}
+	for i := range migrations {
+		index[migrations[i].Version] = &migrations[i]
+	}
+	for rows.Next() {
+		var (
+			version   int
+			checksum  string
+			appliedAt time.Time
+		)
+		err = rows.Scan(&version, &checksum, &appliedAt)
+		if err != nil {
+			return err
+		}
+		m, ok := index[version]
+		if !ok {
+			return fmt.Errorf("%w: %d", ErrUnknownMigration, version)
+		}
+		if m.Checksum != checksum {
+			return fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, m.Version, m.Name)
+		}
+		m.AppliedAt = &appliedAt
+	}
+	return rows.Err()
+}
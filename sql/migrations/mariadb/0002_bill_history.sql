@@ -0,0 +1,34 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+-- generated bills are stored with their issuer, channel, files and the sha256
+-- of the swiss payment code, see sql.Db.InsertBill. Bills of v1.0.0 are taken
+-- as CLI bills.
+ALTER TABLE bill
+    ADD COLUMN issuer_id BIGINT REFERENCES issuer(id) AFTER id,
+    ADD COLUMN channel ENUM ('API', 'MAIL', 'CLI') NOT NULL DEFAULT 'CLI' AFTER cust_id,
+    MODIFY ts TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN updated_ts TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP AFTER ts,
+    ADD COLUMN iban VARCHAR(26) NOT NULL DEFAULT '' AFTER updated_ts,
+    MODIFY reference VARCHAR(35),
+    ADD COLUMN payload_hash CHAR(64) NOT NULL DEFAULT '' AFTER amount,
+    ADD COLUMN qr_file TEXT AFTER payload_hash,
+    ADD COLUMN pdf_file TEXT AFTER qr_file,
+    ADD COLUMN pdf_hash CHAR(64) AFTER pdf_file;
+ALTER TABLE bill
+    ALTER COLUMN channel DROP DEFAULT,
+    ALTER COLUMN iban DROP DEFAULT,
+    ALTER COLUMN payload_hash DROP DEFAULT;
+CREATE INDEX bill_issuer_ts ON bill (issuer_id, ts);
+CREATE INDEX bill_reference ON bill (reference);
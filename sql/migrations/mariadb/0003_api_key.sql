@@ -0,0 +1,32 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+-- hashed api keys with scopes replace the token of the api table
+CREATE TABLE IF NOT EXISTS api_key
+(
+    id           BIGINT PRIMARY KEY NOT NULL UNIQUE AUTO_INCREMENT,
+    name         VARCHAR(64) NOT NULL UNIQUE,
+    token_hash   CHAR(64) NOT NULL UNIQUE, -- sha256 of the token
+    scopes       TEXT NOT NULL,            -- comma separated, eg. bills:create,bills:read
+    enable       BOOLEAN NOT NULL DEFAULT true,
+    created_ts   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_ts   TIMESTAMP NULL,
+    revoked_ts   TIMESTAMP NULL,
+    last_used_ts TIMESTAMP NULL
+);
+
+-- the former token keeps all rights
+INSERT IGNORE INTO api_key (name, token_hash, scopes, enable)
+    SELECT 'legacy', SHA2(token, 256), '*', COALESCE(enable, true) FROM api WHERE token IS NOT NULL AND token <> '';
+DROP TABLE IF EXISTS api;
@@ -0,0 +1,27 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+-- bills per day of an issuer and requests per minute of an api key, if NULL
+-- the default limits apply
+ALTER TABLE issuer ADD COLUMN daily_quota INT NULL;
+ALTER TABLE api_key ADD COLUMN rate_limit INT NULL;
+
+CREATE TABLE IF NOT EXISTS rate_counter
+(
+    scope        VARCHAR(16) NOT NULL,  -- key, ip or issuer
+    subject      VARCHAR(128) NOT NULL,
+    window_start TIMESTAMP NOT NULL,
+    count        INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (scope, subject, window_start)
+);
@@ -0,0 +1,40 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+CREATE TABLE IF NOT EXISTS job
+(
+    id          BIGINT PRIMARY KEY NOT NULL UNIQUE AUTO_INCREMENT,
+    api_key_id  BIGINT REFERENCES api_key(id),
+    state       ENUM ('QUEUED', 'RUNNING', 'DONE', 'FAILED') NOT NULL DEFAULT 'QUEUED',
+    format      ENUM ('zip', 'pdf') NOT NULL DEFAULT 'zip',
+    request     LONGTEXT NOT NULL, -- json array of the bill informations
+    total       INT NOT NULL,
+    done        INT NOT NULL DEFAULT 0,
+    failed      INT NOT NULL DEFAULT 0,
+    error       TEXT,
+    created_ts  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_ts  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    finished_ts TIMESTAMP NULL,
+    INDEX (state, id)
+);
+
+CREATE TABLE IF NOT EXISTS job_row
+(
+    job_id    BIGINT NOT NULL REFERENCES job(id),
+    row_num   INT NOT NULL,
+    bill_id   BIGINT REFERENCES bill(id),
+    reference VARCHAR(35),
+    error     TEXT,
+    PRIMARY KEY (job_id, row_num)
+);
@@ -0,0 +1,42 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+ALTER TABLE bill ADD COLUMN paid_ts TIMESTAMP NULL AFTER pdf_hash;
+
+CREATE TABLE IF NOT EXISTS webhook
+(
+    id         BIGINT PRIMARY KEY NOT NULL UNIQUE AUTO_INCREMENT,
+    issuer_id  BIGINT NOT NULL REFERENCES issuer(id),
+    url        TEXT NOT NULL,
+    secret     TEXT NOT NULL, -- key of the HMAC-SHA256 signature
+    events     TEXT NOT NULL, -- comma separated, eg. bill.generated,bill.paid
+    enable     BOOLEAN NOT NULL DEFAULT true,
+    created_ts TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS webhook_delivery
+(
+    id              BIGINT PRIMARY KEY NOT NULL UNIQUE AUTO_INCREMENT,
+    webhook_id      BIGINT NOT NULL REFERENCES webhook(id),
+    event           VARCHAR(32) NOT NULL,
+    payload         MEDIUMTEXT NOT NULL,
+    state           ENUM ('PENDING', 'DELIVERED', 'FAILED') NOT NULL DEFAULT 'PENDING',
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_ts TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_status     INT NULL,
+    last_error      TEXT,
+    created_ts      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_ts    TIMESTAMP NULL,
+    INDEX (state, next_attempt_ts)
+);
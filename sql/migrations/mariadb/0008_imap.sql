@@ -0,0 +1,22 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+ALTER TABLE mail
+    ADD COLUMN protocol ENUM ('POP3', 'IMAP') NOT NULL DEFAULT 'POP3',
+    ADD COLUMN imap_secure BOOLEAN NOT NULL DEFAULT true,
+    ADD COLUMN imap_host TEXT,
+    ADD COLUMN imap_port INT NOT NULL DEFAULT 993,
+    ADD COLUMN imap_folder VARCHAR(255) NOT NULL DEFAULT 'INBOX',
+    ADD COLUMN processed_folder VARCHAR(255) NOT NULL DEFAULT 'Processed',
+    ADD COLUMN failed_folder VARCHAR(255) NOT NULL DEFAULT 'Failed';
@@ -0,0 +1,32 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+-- spf results are only trusted from the server auth_serv_id
+ALTER TABLE mail
+    ADD COLUMN id BIGINT PRIMARY KEY NOT NULL UNIQUE AUTO_INCREMENT FIRST,
+    ADD COLUMN auth_serv_id VARCHAR(255);
+
+-- allowed senders, an address, all addresses of a domain (*@domain) or of
+-- its subdomains (*@*.domain). The entries of v1.0.0 applied to all mail
+-- configurations.
+RENAME TABLE mail_whitelist TO mail_whitelist_v1;
+CREATE TABLE IF NOT EXISTS mail_whitelist
+(
+    mail_id BIGINT NOT NULL REFERENCES mail(id),
+    email   VARCHAR(255) NOT NULL CHECK ( email regexp '^(\\*|[a-zA-Z0-9_.+-]+)@(\\*\\.)?(([a-zA-Z0-9-])+.)+([a-zA-Z0-9]{2,})+\$' ),
+    PRIMARY KEY (mail_id, email)
+);
+INSERT IGNORE INTO mail_whitelist (mail_id, email)
+    SELECT mail.id, mail_whitelist_v1.email FROM mail, mail_whitelist_v1;
+DROP TABLE mail_whitelist_v1;
@@ -0,0 +1,30 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+-- the language of the replies
+ALTER TABLE mail ADD COLUMN language_code ENUM ('DE', 'FR', 'IT', 'EN') NOT NULL DEFAULT 'EN' AFTER enable;
+
+-- reply templates of the mail channel, the built-in ones are used for
+-- missing templates
+CREATE TABLE IF NOT EXISTS mail_template
+(
+    issuer_id     BIGINT NOT NULL REFERENCES issuer(id),
+    language_code ENUM ('DE', 'FR', 'IT', 'EN') NOT NULL,
+    kind          ENUM ('BILL', 'BILLS', 'ERROR') NOT NULL,
+    subject       TEXT NOT NULL,
+    text_body     TEXT NOT NULL,
+    html_body     TEXT,
+    due_days      INT NOT NULL DEFAULT 30,
+    PRIMARY KEY (issuer_id, language_code, kind)
+);
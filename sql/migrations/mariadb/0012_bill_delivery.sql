@@ -0,0 +1,34 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+-- bills sent by mail to the debtor, queued until sent
+CREATE TABLE IF NOT EXISTS bill_delivery
+(
+    id              BIGINT PRIMARY KEY NOT NULL UNIQUE AUTO_INCREMENT,
+    bill_id         BIGINT NOT NULL REFERENCES bill(id),
+    mail_id         BIGINT NOT NULL REFERENCES mail(id),
+    recipient       VARCHAR(255) NOT NULL,
+    language_code   ENUM ('DE', 'FR', 'IT', 'EN'),
+    message_id      VARCHAR(255) NOT NULL UNIQUE, -- to match bounces
+    state           ENUM ('PENDING', 'SENT', 'FAILED', 'BOUNCED') NOT NULL DEFAULT 'PENDING',
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_ts TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error      TEXT,
+    created_ts      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent_ts         TIMESTAMP NULL,
+    INDEX (state, next_attempt_ts),
+    INDEX (bill_id)
+);
+
+ALTER TABLE mail_template MODIFY kind ENUM ('BILL', 'BILLS', 'ERROR', 'DELIVERY') NOT NULL;
@@ -0,0 +1,25 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+-- the version table is replaced by schema_migrations
+DROP TABLE IF EXISTS version;
+
+-- Liechtenstein is LI in ISO 3166 and in the swiss payment code, not FL
+ALTER TABLE issuer MODIFY country ENUM ('CH', 'FL', 'LI');
+UPDATE issuer SET country = 'LI' WHERE country = 'FL';
+ALTER TABLE issuer MODIFY country ENUM ('CH', 'LI');
+
+-- debtors may live in any country, ISO 3166-1 alpha-2
+ALTER TABLE customer MODIFY country CHAR(2);
+UPDATE customer SET country = 'LI' WHERE country = 'FL';
@@ -0,0 +1,249 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+-- the schema of the mariadb migrations up to 0013, see migrations/mariadb
+
+CREATE TABLE IF NOT EXISTS issuer
+(
+    id          BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    fistname    TEXT NOT NULL,
+    lastname    TEXT,
+    address1    TEXT NOT NULL,
+    address2    TEXT,
+    zip         TEXT NOT NULL,
+    location    TEXT NOT NULL,
+    country     VARCHAR(2) CHECK ( country IN ('CH', 'LI') ),
+    iban        VARCHAR(26) NOT NULL, -- (21 + 5) with spaces
+    daily_quota INT NULL -- bills per day, if NULL the default quota applies
+);
+
+CREATE TABLE IF NOT EXISTS customer
+(
+    cust_id  BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    fistname TEXT NOT NULL,
+    lastname TEXT,
+    address1 TEXT NOT NULL,
+    address2 TEXT,
+    zip      TEXT NOT NULL,
+    location TEXT NOT NULL,
+    country  CHAR(2)
+);
+
+CREATE TABLE IF NOT EXISTS bill
+(
+    id           BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    issuer_id    BIGINT REFERENCES issuer(id),
+    cust_id      BIGINT REFERENCES customer(cust_id),
+    channel      VARCHAR(4) NOT NULL CHECK ( channel IN ('API', 'MAIL', 'CLI') ),
+    ts           TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_ts   TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    iban         VARCHAR(26) NOT NULL,
+    ref_type     VARCHAR(4) CHECK ( ref_type IN ('NON', 'QRR', 'SCOR') ),
+    reference    VARCHAR(35),
+    add_msg      TEXT,
+    currency     VARCHAR(3) CHECK ( currency IN ('CHF', 'EUR') ),
+    amount       DOUBLE PRECISION,
+    payload_hash CHAR(64) NOT NULL, -- sha256 of the swiss payment code
+    qr_file      TEXT,
+    pdf_file     TEXT,
+    pdf_hash     CHAR(64),
+    paid_ts      TIMESTAMPTZ NULL
+);
+CREATE INDEX IF NOT EXISTS bill_issuer_ts ON bill (issuer_id, ts);
+CREATE INDEX IF NOT EXISTS bill_reference ON bill (reference);
+
+CREATE TABLE IF NOT EXISTS api_key
+(
+    id           BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    name         VARCHAR(64) NOT NULL UNIQUE,
+    token_hash   CHAR(64) NOT NULL UNIQUE, -- sha256 of the token
+    scopes       TEXT NOT NULL,            -- comma separated, eg. bills:create,bills:read
+    enable       BOOLEAN NOT NULL DEFAULT true,
+    created_ts   TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_ts   TIMESTAMPTZ NULL,
+    revoked_ts   TIMESTAMPTZ NULL,
+    last_used_ts TIMESTAMPTZ NULL,
+    rate_limit   INT NULL                  -- requests per minute, if NULL the default limit applies
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_key
+(
+    api_key_id   BIGINT NOT NULL REFERENCES api_key(id),
+    idem_key     VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,       -- sha256 of the normalized request
+    bill_id      BIGINT REFERENCES bill(id), -- NULL while the request is in progress
+    created_ts   TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (api_key_id, idem_key)
+);
+
+CREATE TABLE IF NOT EXISTS rate_counter
+(
+    scope        VARCHAR(16) NOT NULL,  -- key, ip or issuer
+    subject      VARCHAR(128) NOT NULL,
+    window_start TIMESTAMPTZ NOT NULL,
+    count        INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (scope, subject, window_start)
+);
+
+CREATE TABLE IF NOT EXISTS job
+(
+    id          BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    api_key_id  BIGINT REFERENCES api_key(id),
+    state       VARCHAR(8) NOT NULL DEFAULT 'QUEUED' CHECK ( state IN ('QUEUED', 'RUNNING', 'DONE', 'FAILED') ),
+    format      VARCHAR(3) NOT NULL DEFAULT 'zip' CHECK ( format IN ('zip', 'pdf') ),
+    request     TEXT NOT NULL, -- json array of the bill informations
+    total       INT NOT NULL,
+    done        INT NOT NULL DEFAULT 0,
+    failed      INT NOT NULL DEFAULT 0,
+    error       TEXT,
+    created_ts  TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_ts  TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_ts TIMESTAMPTZ NULL
+);
+CREATE INDEX IF NOT EXISTS job_state ON job (state, id);
+
+CREATE TABLE IF NOT EXISTS job_row
+(
+    job_id    BIGINT NOT NULL REFERENCES job(id),
+    row_num   INT NOT NULL,
+    bill_id   BIGINT REFERENCES bill(id),
+    reference VARCHAR(35),
+    error     TEXT,
+    PRIMARY KEY (job_id, row_num)
+);
+
+CREATE TABLE IF NOT EXISTS webhook
+(
+    id         BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    issuer_id  BIGINT NOT NULL REFERENCES issuer(id),
+    url        TEXT NOT NULL,
+    secret     TEXT NOT NULL, -- key of the HMAC-SHA256 signature
+    events     TEXT NOT NULL, -- comma separated, eg. bill.generated,bill.paid
+    enable     BOOLEAN NOT NULL DEFAULT true,
+    created_ts TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS webhook_delivery
+(
+    id              BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    webhook_id      BIGINT NOT NULL REFERENCES webhook(id),
+    event           VARCHAR(32) NOT NULL,
+    payload         TEXT NOT NULL,
+    state           VARCHAR(9) NOT NULL DEFAULT 'PENDING' CHECK ( state IN ('PENDING', 'DELIVERED', 'FAILED') ),
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_ts TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_status     INT NULL,
+    last_error      TEXT,
+    created_ts      TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_ts    TIMESTAMPTZ NULL
+);
+CREATE INDEX IF NOT EXISTS webhook_delivery_due ON webhook_delivery (state, next_attempt_ts);
+
+CREATE TABLE IF NOT EXISTS mail
+(
+    id            BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    token         TEXT,
+    enable        BOOLEAN NOT NULL DEFAULT false,
+    language_code VARCHAR(2) NOT NULL DEFAULT 'EN' CHECK ( language_code IN ('DE', 'FR', 'IT', 'EN') ), -- of the replies
+    issuer_id     BIGINT REFERENCES issuer(id),
+    username      TEXT NOT NULL,
+    sender_name   TEXT,
+    email         TEXT NOT NULL CHECK ( email ~ '^([a-zA-Z0-9_.-])+@(([a-zA-Z0-9-])+.)+([a-zA-Z0-9]{2,4})+$' ),
+    password      TEXT,
+    smtp_secure   BOOLEAN NOT NULL DEFAULT true,
+    smtp_host     TEXT,
+    smtp_port     INT NOT NULL DEFAULT 587,
+    pop3_secure   BOOLEAN NOT NULL DEFAULT true,
+    pop3_host     TEXT,
+    pop3_port     INT NOT NULL DEFAULT 995,
+    use_whitelist BOOLEAN NOT NULL DEFAULT false,
+    protocol      VARCHAR(4) NOT NULL DEFAULT 'POP3' CHECK ( protocol IN ('POP3', 'IMAP') ),
+    imap_secure   BOOLEAN NOT NULL DEFAULT true,
+    imap_host     TEXT,
+    imap_port     INT NOT NULL DEFAULT 993,
+    imap_folder      VARCHAR(255) NOT NULL DEFAULT 'INBOX',
+    processed_folder VARCHAR(255) NOT NULL DEFAULT 'Processed',
+    failed_folder    VARCHAR(255) NOT NULL DEFAULT 'Failed',
+    auth_serv_id     VARCHAR(255) -- spf results are only trusted from this server
+);
+
+-- allowed senders, an address, all addresses of a domain (*@domain) or of
+-- its subdomains (*@*.domain)
+CREATE TABLE IF NOT EXISTS mail_whitelist
+(
+    mail_id BIGINT NOT NULL REFERENCES mail(id),
+    email   VARCHAR(255) NOT NULL CHECK ( email ~ '^(\*|[a-zA-Z0-9_.+-]+)@(\*\.)?(([a-zA-Z0-9-])+.)+([a-zA-Z0-9]{2,})+$' ),
+    PRIMARY KEY (mail_id, email)
+);
+
+CREATE TABLE IF NOT EXISTS translation
+(
+    language_code        VARCHAR(2) NOT NULL UNIQUE CHECK ( language_code IN ('DE', 'FR', 'IT', 'EN') ),
+    payment_part         TEXT NOT NULL,
+    account              TEXT NOT NULL,
+    reference            TEXT NOT NULL,
+    additional_infos     TEXT NOT NULL,
+    further_infos        TEXT NOT NULL,
+    currency             TEXT NOT NULL,
+    amount               TEXT NOT NULL,
+    receipt              TEXT NOT NULL,
+    acceptance_point     TEXT NOT NULL,
+    sep_before_pay       TEXT NOT NULL,
+    payable_by           TEXT NOT NULL,
+    payable_by_name_addr TEXT NOT NULL,
+    in_favour            TEXT NOT NULL
+);
+
+-- bills sent by mail to the debtor, queued until sent
+CREATE TABLE IF NOT EXISTS bill_delivery
+(
+    id              BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    bill_id         BIGINT NOT NULL REFERENCES bill(id),
+    mail_id         BIGINT NOT NULL REFERENCES mail(id),
+    recipient       VARCHAR(255) NOT NULL,
+    language_code   VARCHAR(2) CHECK ( language_code IN ('DE', 'FR', 'IT', 'EN') ),
+    message_id      VARCHAR(255) NOT NULL UNIQUE, -- to match bounces
+    state           VARCHAR(7) NOT NULL DEFAULT 'PENDING' CHECK ( state IN ('PENDING', 'SENT', 'FAILED', 'BOUNCED') ),
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_ts TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error      TEXT,
+    created_ts      TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent_ts         TIMESTAMPTZ NULL
+);
+CREATE INDEX IF NOT EXISTS bill_delivery_due ON bill_delivery (state, next_attempt_ts);
+CREATE INDEX IF NOT EXISTS bill_delivery_bill ON bill_delivery (bill_id);
+
+-- reply templates of the mail channel, the built-in ones are used for
+-- missing templates
+CREATE TABLE IF NOT EXISTS mail_template
+(
+    issuer_id     BIGINT NOT NULL REFERENCES issuer(id),
+    language_code VARCHAR(2) NOT NULL CHECK ( language_code IN ('DE', 'FR', 'IT', 'EN') ),
+    kind          VARCHAR(8) NOT NULL CHECK ( kind IN ('BILL', 'BILLS', 'ERROR', 'DELIVERY') ),
+    subject       TEXT NOT NULL,
+    text_body     TEXT NOT NULL,
+    html_body     TEXT,
+    due_days      INT NOT NULL DEFAULT 30,
+    PRIMARY KEY (issuer_id, language_code, kind)
+);
+
+--
+-- data
+--
+INSERT INTO translation (language_code, payment_part, account, reference, additional_infos, further_infos, currency, amount, receipt, acceptance_point, sep_before_pay, payable_by, payable_by_name_addr, in_favour)
+VALUES 
+    ('EN', 'Payment part',      'Account / Payable to', 'Reference',   'Additional information',      'Further information',          'Currency', 'Amount',  'Receipt',        'Acceptance point',      'Separate before paying in',        'Payable by',    'Payable by (name/address)',    'In favour of'),
+    ('DE', 'Zahlteil',          'Konto / Zahlbar an',   'Referenz',    'Zusätzliche Informationen',   'Weitere Informationen',        'Währung',  'Betrag',  'Empfangsschein', 'Annahmestelle',         'Vor der Einzahlung abzutrennen',   'Zahlbar durch', 'Zahlbar durch (Name/Adresse)', 'Zugunsten'),
+    ('FR', 'Section paiement',  'Compte / Payable à',   'Référence',   'Informations additionnelles', 'Informations supplémentaires', 'Monnaie',  'Montant', 'Récépissé',      'Point de dépôt',        'A détacher avant le versement',    'Payable par',   'Payable par (nom/adresse)',    'En faveur de'),
+    ('IT', 'Sezione pagamento', 'Conto / Pagabile a',   'Riferimento', 'Informazioni aggiuntive',     'Informazioni supplementari',   'Valuta',   'Importo', 'Ricevuta',       'Punto di accettazione', 'Da staccare prima del versamento', 'Pagabile da',   'Pagabile da (nome/indirizzo)', 'A favore di');
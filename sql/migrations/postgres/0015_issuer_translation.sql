@@ -0,0 +1,37 @@
+-- Copyright © 2022, Staufi Tech - Switzerland
+-- All rights reserved.
+--  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+--  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+--  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+--  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+--  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+--  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+--  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+--  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+--  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+--  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+--  POSSIBILITY OF SUCH DAMAGE.
+
+-- the language of the pdf
+ALTER TABLE bill ADD COLUMN language_code VARCHAR(2) NOT NULL DEFAULT 'EN' CHECK ( language_code IN ('DE', 'FR', 'IT', 'EN') );
+
+-- texts of the bill per issuer, empty texts fall back to the built-in ones
+CREATE TABLE IF NOT EXISTS issuer_translation
+(
+    issuer_id            BIGINT NOT NULL REFERENCES issuer(id),
+    language_code        VARCHAR(2) NOT NULL CHECK ( language_code IN ('DE', 'FR', 'IT', 'EN') ),
+    payment_part         TEXT NOT NULL DEFAULT '',
+    account              TEXT NOT NULL DEFAULT '',
+    reference            TEXT NOT NULL DEFAULT '',
+    additional_infos     TEXT NOT NULL DEFAULT '',
+    further_infos        TEXT NOT NULL DEFAULT '',
+    currency             TEXT NOT NULL DEFAULT '',
+    amount               TEXT NOT NULL DEFAULT '',
+    receipt              TEXT NOT NULL DEFAULT '',
+    acceptance_point     TEXT NOT NULL DEFAULT '',
+    sep_before_pay       TEXT NOT NULL DEFAULT '',
+    payable_by           TEXT NOT NULL DEFAULT '',
+    payable_by_name_addr TEXT NOT NULL DEFAULT '',
+    in_favour            TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (issuer_id, language_code)
+);
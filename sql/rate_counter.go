@@ -0,0 +1,63 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+	"time"
+)
+
+// IncrementCounter adds n to the rate counter of a subject in the window
+// starting at windowStart and returns the new count.
+func (db *Db) IncrementCounter(scope string, subject string, windowStart time.Time, n int) (int, error) {
+	count := 0
+
+	tx, err := db.dbCon.Begin()
+	if err != nil {
+		return count, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO rate_counter (scope, subject, window_start, count) VALUES (?, ?, ?, ?)"+
+		db.dialect.onConflict("scope, subject, window_start")+"count = rate_counter.count + "+db.dialect.excluded("count"),
+		scope, subject, windowStart, n)
+	if err != nil {
+		return count, err
+	}
+	err = tx.QueryRow("SELECT count FROM rate_counter WHERE scope = ? AND subject = ? AND window_start = ?",
+		scope, subject, windowStart).Scan(&count)
+	if err != nil {
+		return count, err
+	}
+
+	return count, tx.Commit()
+}
+
+// DeleteCountersBefore removes all counters of windows started before t.
+func (db *Db) DeleteCountersBefore(t time.Time) error {
+	_, err := db.dbCon.Exec("DELETE FROM rate_counter WHERE window_start < ?", t)
+	return err
+}
+
+// GetIssuerDailyQuota returns the bills per day an issuer may generate, 0
+// if the default quota applies.
+func (db *Db) GetIssuerDailyQuota(issuerId int) (int, error) {
+	var quota sql.NullInt64
+	err := db.dbCon.QueryRow("SELECT daily_quota FROM issuer WHERE id = ?", issuerId).Scan(&quota)
+	return int(quota.Int64), err
+}
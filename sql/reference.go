@@ -0,0 +1,116 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+// GetReferenceFormat returns the reference format of an issuer.
+// sql.ErrNoRows is returned, if the issuer has none.
+func (db *Db) GetReferenceFormat(issuerId int) (*specs.ReferenceFormat, error) {
+	f := specs.ReferenceFormat{IssuerId: issuerId}
+
+	err := db.dbCon.QueryRow("SELECT besr_id, customer_digits, last_number FROM reference_sequence "+
+		"WHERE issuer_id = ?", issuerId).Scan(&f.BesrId, &f.CustomerDigits, &f.LastNumber)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// SetReferenceFormat creates or replaces the reference format of an
+// issuer. The sequence of the invoice numbers is kept.
+func (db *Db) SetReferenceFormat(f *specs.ReferenceFormat) error {
+	_, err := db.dbCon.Exec("INSERT INTO reference_sequence (issuer_id, besr_id, customer_digits) VALUES (?, ?, ?)"+
+		db.dialect.onConflict("issuer_id")+
+		"besr_id = "+db.dialect.excluded("besr_id")+", customer_digits = "+db.dialect.excluded("customer_digits"),
+		f.IssuerId, f.BesrId, f.CustomerDigits)
+	return err
+}
+
+// NextInvoiceNumber increments the sequence of an issuer and returns the
+// new invoice number, starting at 1. The update locks the row until the
+// commit, so concurrent callers, also of other processes, get unique
+// numbers. sql.ErrNoRows is returned for unknown issuers.
+func (db *Db) NextInvoiceNumber(issuerId int) (int, error) {
+	tx, err := db.dbCon.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(db.dialect.insertIgnore("reference_sequence (issuer_id) SELECT id FROM issuer WHERE id = ?"),
+		issuerId)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("UPDATE reference_sequence SET last_number = last_number + 1 WHERE issuer_id = ?", issuerId)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	number := 0
+	err = tx.QueryRow("SELECT last_number FROM reference_sequence WHERE issuer_id = ?", issuerId).Scan(&number)
+	if err != nil {
+		return 0, err
+	}
+	return number, tx.Commit()
+}
+
+// ReserveInvoiceNumber advances the sequence of an issuer to an invoice
+// number chosen by the caller, so NextInvoiceNumber never hands it out.
+// False is returned, if the sequence reached the number already.
+// sql.ErrNoRows is returned for unknown issuers.
+func (db *Db) ReserveInvoiceNumber(issuerId int, number int) (bool, error) {
+	tx, err := db.dbCon.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(db.dialect.insertIgnore("reference_sequence (issuer_id) SELECT id FROM issuer WHERE id = ?"),
+		issuerId)
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec("UPDATE reference_sequence SET last_number = ? WHERE issuer_id = ? AND last_number < ?",
+		number, issuerId, number)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		last := 0
+		err = tx.QueryRow("SELECT last_number FROM reference_sequence WHERE issuer_id = ?", issuerId).Scan(&last)
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,154 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"context"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+// Repository is the storage of the app. Db implements it for mariadb,
+// postgres and sqlite, see sqltest.Run for the behaviour all of them share.
+// Lookups of unknown ids return sql.ErrNoRows.
+type Repository interface {
+	IssuerRepository
+	CustomerRepository
+	BillRepository
+	ApiKeyRepository
+	MailRepository
+	TranslationRepository
+	JobRepository
+	WebhookRepository
+	RateRepository
+	ReferenceRepository
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+type IssuerRepository interface {
+	GetIssuer(id int) (string, specs.AccountDetails, error)
+	InsertIssuer(iban string, details specs.AccountDetails) (*specs.AccountDetails, int, error)
+	GetIssuerDailyQuota(issuerId int) (int, error)
+}
+
+type CustomerRepository interface {
+	InsertCustomer(customer specs.AccountDetails) (int, error)
+	GetCustomer(id int) (specs.AccountDetails, error)
+}
+
+type BillRepository interface {
+	InsertBill(b *specs.Bill) error
+	GetBill(id int) (*specs.Bill, error)
+	GetBills(filter specs.BillFilter) ([]*specs.Bill, int, error)
+	MarkBillPaid(id int, paidAt time.Time) error
+
+	InsertBillDelivery(delivery *specs.BillDelivery) error
+	GetBillDelivery(id int) (*specs.BillDelivery, error)
+	GetBillDeliveryByMessageId(messageId string) (*specs.BillDelivery, error)
+	GetBillDeliveries(billId int) ([]*specs.BillDelivery, error)
+	GetDueBillDeliveries(now time.Time, limit int) ([]*specs.BillDelivery, error)
+	UpdateBillDelivery(delivery *specs.BillDelivery) error
+}
+
+// ApiKeyRepository stores the api tokens and the idempotency keys of their
+// requests.
+type ApiKeyRepository interface {
+	InsertApiKey(key *specs.ApiKey) error
+	GetApiKeyByHash(tokenHash string) (*specs.ApiKey, error)
+	GetApiKeys() ([]*specs.ApiKey, error)
+	RevokeApiKey(id int) error
+	TouchApiKey(id int) error
+
+	ReserveIdempotencyKey(key *specs.IdempotencyKey) (bool, *specs.IdempotencyKey, error)
+	CompleteIdempotencyKey(apiKeyId int, key string, billId int) error
+	DeleteIdempotencyKey(apiKeyId int, key string) error
+	DeleteIdempotencyKeysBefore(t time.Time) error
+}
+
+// MailRepository stores the mail configurations with their whitelists and
+// reply templates.
+type MailRepository interface {
+	InsertMailConfig(cnf *specs.MailConfig) error
+	GetMailConfigurations() ([]*specs.MailConfig, error)
+	GetMailConfig(id int) (*specs.MailConfig, error)
+	GetMailConfigByIssuer(issuerId int) (*specs.MailConfig, error)
+
+	GetMailWhitelist(mailId int) ([]string, error)
+	InsertMailWhitelist(mailId int, email string) error
+	DeleteMailWhitelist(mailId int, email string) error
+
+	GetMailTemplate(issuerId int, languageCode string, kind string) (*specs.MailTemplate, error)
+	SetMailTemplate(t *specs.MailTemplate) error
+	DeleteMailTemplate(issuerId int, languageCode string, kind string) error
+}
+
+type TranslationRepository interface {
+	GetTranslationTable(languageCode string) (specs.TranslationTable, error)
+	GetIssuerTranslation(issuerId int, languageCode string) (*specs.Translation, error)
+	GetIssuerTranslations(issuerId int) ([]*specs.Translation, error)
+	SetIssuerTranslation(tr *specs.Translation) error
+	DeleteIssuerTranslation(issuerId int, languageCode string) error
+}
+
+type JobRepository interface {
+	InsertJob(job *specs.Job, request string) error
+	GetJob(id int) (*specs.Job, error)
+	GetJobRequest(id int) (string, error)
+	ClaimNextJob() (*specs.Job, error)
+	RequeueRunningJobs() (int, error)
+	FinishJob(id int, state string, errMsg string) error
+	RequeueJob(id int) error
+	RetryJob(id int, errMsg string) error
+	InsertJobRow(jobId int, row specs.BatchRow) error
+	InsertJobBill(jobId int, rowNum int, b *specs.Bill) error
+	GetJobRows(jobId int) ([]specs.BatchRow, error)
+}
+
+type WebhookRepository interface {
+	InsertWebhook(hook *specs.Webhook) error
+	GetWebhook(id int) (*specs.Webhook, error)
+	GetWebhooks(issuerId int) ([]*specs.Webhook, error)
+	DeleteWebhook(id int) error
+
+	InsertWebhookDelivery(delivery *specs.WebhookDelivery) error
+	GetDueWebhookDeliveries(now time.Time, limit int) ([]*specs.WebhookDelivery, error)
+	GetWebhookDeliveries(webhookId int, limit int, offset int) ([]*specs.WebhookDelivery, error)
+	GetWebhookDelivery(id int) (*specs.WebhookDelivery, error)
+	UpdateWebhookDelivery(delivery *specs.WebhookDelivery) error
+	ReplayWebhookDelivery(id int) error
+}
+
+// RateRepository counts the requests of the rate limits and quotas.
+type RateRepository interface {
+	IncrementCounter(scope string, subject string, windowStart time.Time, n int) (int, error)
+	DeleteCountersBefore(t time.Time) error
+}
+
+// ReferenceRepository holds the reference formats and the sequences of the
+// invoice numbers per issuer.
+type ReferenceRepository interface {
+	GetReferenceFormat(issuerId int) (*specs.ReferenceFormat, error)
+	SetReferenceFormat(f *specs.ReferenceFormat) error
+	NextInvoiceNumber(issuerId int) (int, error)
+	ReserveInvoiceNumber(issuerId int, number int) (bool, error)
+}
+
+var _ Repository = (*Db)(nil)
@@ -0,0 +1,101 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// contexts of the encrypted columns, see secret.Keyring.Encrypt
+const (
+	SECRET_MAIL_PASSWORD  = "mail.password"
+	SECRET_WEBHOOK_SECRET = "webhook.secret"
+)
+
+// the encrypted columns, their tables have an id column
+var secretColumns = []struct {
+	table, column, context string
+}{
+	{"mail", "password", SECRET_MAIL_PASSWORD},
+	{"webhook", "secret", SECRET_WEBHOOK_SECRET},
+}
+
+// RotateSecrets encrypts the plaintext secrets and reseals the secrets of
+// old keys with the primary key of the keyring. It returns the number of
+// updated secrets. All secrets are updated or none.
+func (db *Db) RotateSecrets(ctx context.Context) (int, error) {
+	if db.keyring == nil {
+		return 0, errors.New("no secret key set")
+	}
+
+	tx, err := db.dbCon.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count := 0
+	for _, col := range secretColumns {
+		n, err := db.rotateColumn(ctx, tx, col.table, col.column, col.context)
+		if err != nil {
+			return 0, fmt.Errorf("%s.%s: %w", col.table, col.column, err)
+		}
+		count += n
+	}
+	return count, tx.Commit()
+}
+
+func (db *Db) rotateColumn(ctx context.Context, tx *tx, table, column, context string) (int, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, "+column+" FROM "+table+" WHERE "+column+" <> ''")
+	if err != nil {
+		return 0, err
+	}
+	values := map[int]string{}
+	for rows.Next() {
+		var (
+			rowId int
+			value string
+		)
+		err = rows.Scan(&rowId, &value)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if db.keyring.NeedsRotation(value) {
+			values[rowId] = value
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for rowId, value := range values {
+		value, err = db.keyring.Rotate(value, context)
+		if err != nil {
+			return 0, fmt.Errorf("id %d: %w", rowId, err)
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE "+table+" SET "+column+" = ? WHERE id = ?", value, rowId)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(values), nil
+}
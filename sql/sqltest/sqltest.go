@@ -0,0 +1,845 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package sqltest holds the conformance tests, which every implementation of
+// sql.Repository must pass, and opens migrated test databases.
+package sqltest
+
+import (
+	"context"
+	dbSql "database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/qr"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/sql"
+)
+
+const (
+	IBAN         = "CH4431999123000889012"
+	PAYLOAD_HASH = "8d969eef6ecad3c29a3a629280e686cf0c3f5d5a86aff3ca12020c923adc6c92"
+)
+
+// Open connects to a database, applies the migrations and closes it at the
+// end of the test.
+func Open(t *testing.T, dialect string, connectionString string) *sql.Db {
+	t.Helper()
+
+	db, err := sql.New(dialect, connectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	err = db.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Migrate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Sqlite opens an empty sqlite database in a temporary directory.
+func Sqlite(t *testing.T) *sql.Db {
+	t.Helper()
+	return Open(t, sql.DIALECT_SQLITE, filepath.Join(t.TempDir(), "qr-bill.db"))
+}
+
+// Run tests a repository. It may hold data already, all records are created
+// with unique names.
+func Run(t *testing.T, db sql.Repository) {
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	issuerId := testIssuers(t, db)
+	t.Run("Bills", func(t *testing.T) { testBills(t, db, issuerId, suffix) })
+	t.Run("ApiKeys", func(t *testing.T) { testApiKeys(t, db, suffix) })
+	t.Run("Customers", func(t *testing.T) { testCustomers(t, db) })
+	t.Run("IdempotencyKeys", func(t *testing.T) { testIdempotencyKeys(t, db, issuerId, suffix) })
+	t.Run("MailConfigs", func(t *testing.T) { testMailConfigs(t, db, issuerId, suffix) })
+	t.Run("MailWhitelists", func(t *testing.T) { testMailWhitelists(t, db, suffix) })
+	t.Run("MailTemplates", func(t *testing.T) { testMailTemplates(t, db, issuerId) })
+	t.Run("Translations", func(t *testing.T) { testTranslations(t, db, issuerId) })
+	t.Run("References", func(t *testing.T) { testReferences(t, db, issuerId) })
+	t.Run("Jobs", func(t *testing.T) { testJobs(t, db, issuerId, suffix) })
+	t.Run("Webhooks", func(t *testing.T) { testWebhooks(t, db, issuerId) })
+	t.Run("RateCounters", func(t *testing.T) { testRateCounters(t, db, suffix) })
+}
+
+func testIssuers(t *testing.T, db sql.Repository) int {
+	t.Helper()
+
+	details := specs.AccountDetails{
+		AddressType: qr.ADDRESS_TYPE_STRUCTURED,
+		Name:        "Muster Hans",
+		Address1:    "Bahnhofstrasse 1",
+		Zip:         "9490",
+		Location:    "Vaduz",
+		Country:     qr.COUNTRY_LICHTENSTEIN,
+	}
+	_, id, err := db.InsertIssuer(IBAN, details)
+	if err != nil {
+		t.Fatal("insert issuer: ", err)
+	}
+
+	iban, stored, err := db.GetIssuer(id)
+	if err != nil {
+		t.Fatal("get issuer: ", err)
+	}
+	if iban != IBAN || stored != details {
+		t.Errorf("issuer: %s %+v", iban, stored)
+	}
+
+	// companies have a single name, lines only addresses are combined
+	combined := specs.AccountDetails{
+		AddressType: qr.ADDRESS_TYPE_COMBINED,
+		Name:        "Migros",
+		Address1:    "Limmatstrasse 152",
+		Address2:    "8005 Zürich",
+		Country:     qr.COUNTRY_SWITZERLAND,
+	}
+	_, combinedId, err := db.InsertIssuer(IBAN, combined)
+	if err != nil {
+		t.Fatal("insert combined issuer: ", err)
+	}
+	_, stored, err = db.GetIssuer(combinedId)
+	if err != nil || stored != combined {
+		t.Errorf("combined issuer: %+v %v", stored, err)
+	}
+	if _, _, err = db.GetIssuer(-1); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("unknown issuer: ", err)
+	}
+
+	quota, err := db.GetIssuerDailyQuota(id)
+	if err != nil || quota != 0 {
+		t.Error("daily quota: ", quota, err)
+	}
+	return id
+}
+
+func testBills(t *testing.T, db sql.Repository, issuerId int, suffix string) {
+	b := &specs.Bill{
+		IssuerId:     issuerId,
+		Channel:      "API",
+		LanguageCode: "IT",
+		Customer: specs.AccountDetails{Name: "Beispiel" + suffix + " Peter", Address1: "Seeweg 3", Zip: "6003",
+			Location: "Luzern", Country: qr.COUNTRY_SWITZERLAND},
+		Details: specs.BillingDetails{IBAN: IBAN, RefenreceType: "SCOR", Referece: "RF18 5390 0754 7034",
+			AdditionalInfo: "Rechnung " + suffix, Currency: "CHF", Amount: 1949.75},
+		PayloadHash: PAYLOAD_HASH,
+		PdfFile:     "out/bills/" + suffix + ".pdf",
+		PdfHash:     PAYLOAD_HASH,
+	}
+	err := db.InsertBill(b)
+	if err != nil || b.Id <= 0 || b.CustomerId <= 0 {
+		t.Fatal("insert bill: ", b.Id, err)
+	}
+
+	stored, err := db.GetBill(b.Id)
+	if err != nil {
+		t.Fatal("get bill: ", err)
+	}
+	duplicate := *b
+	if err = db.InsertBill(&duplicate); !errors.Is(err, sql.ErrDuplicateReference) {
+		t.Error("insert bill with duplicate reference: ", err)
+	}
+	if stored.IssuerId != issuerId || stored.CustomerId != b.CustomerId || stored.Channel != b.Channel ||
+		stored.LanguageCode != "IT" ||
+		stored.Details.Referece != "RF18539007547034" || stored.Details.Amount != b.Details.Amount ||
+		stored.Details.AdditionalInfo != b.Details.AdditionalInfo || stored.PdfFile != b.PdfFile ||
+		stored.PdfHash != b.PdfHash || stored.PayloadHash != b.PayloadHash || stored.PaidAt != nil {
+		t.Errorf("bill: %+v", stored)
+	}
+	// the address type is structured by default
+	b.Customer.AddressType = qr.ADDRESS_TYPE_STRUCTURED
+	if stored.Customer != b.Customer || stored.Issuer.Name != "Muster Hans" ||
+		stored.Issuer.AddressType != qr.ADDRESS_TYPE_STRUCTURED || stored.CreatedAt.IsZero() {
+		t.Errorf("bill parties: %+v %+v %s", stored.Customer, stored.Issuer, stored.CreatedAt)
+	}
+
+	// the customer filter ignores the case
+	bills, total, err := db.GetBills(specs.BillFilter{IssuerId: issuerId, Customer: "BEISPIEL" + suffix})
+	if err != nil || total != 1 || len(bills) != 1 || bills[0].Id != b.Id {
+		t.Error("filter by customer: ", total, len(bills), err)
+	}
+	bills, total, err = db.GetBills(specs.BillFilter{Reference: "RF18 5390 0754 7034", Limit: 1,
+		From: stored.CreatedAt.Add(-time.Minute), To: time.Now().Add(time.Minute)})
+	if err != nil || total < 1 || len(bills) != 1 {
+		t.Error("filter by reference: ", total, len(bills), err)
+	}
+
+	err = db.MarkBillPaid(b.Id, time.Now())
+	if err != nil {
+		t.Error("mark paid: ", err)
+	}
+	if err = db.MarkBillPaid(b.Id, time.Now()); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("paid twice: ", err)
+	}
+	if _, err = db.GetBill(-1); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("unknown bill: ", err)
+	}
+}
+
+func testApiKeys(t *testing.T, db sql.Repository, suffix string) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	key := &specs.ApiKey{
+		Name:      "erp-" + suffix,
+		TokenHash: (suffix + PAYLOAD_HASH)[:64],
+		Scopes:    []string{"bills:create", "bills:read"},
+		Enable:    true,
+		ExpiresAt: &expires,
+		RateLimit: 60,
+	}
+	err := db.InsertApiKey(key)
+	if err != nil || key.Id <= 0 {
+		t.Fatal("insert key: ", err)
+	}
+
+	stored, err := db.GetApiKeyByHash(key.TokenHash)
+	if err != nil {
+		t.Fatal("get key: ", err)
+	}
+	if stored.Id != key.Id || stored.Name != key.Name || len(stored.Scopes) != 2 || !stored.Enable ||
+		stored.RateLimit != 60 || stored.ExpiresAt == nil || !sameTime(*stored.ExpiresAt, expires) ||
+		!stored.Active(time.Now()) {
+		t.Errorf("key: %+v", stored)
+	}
+
+	err = db.TouchApiKey(key.Id)
+	if err != nil {
+		t.Error("touch: ", err)
+	}
+	err = db.RevokeApiKey(key.Id)
+	if err != nil {
+		t.Error("revoke: ", err)
+	}
+	if err = db.RevokeApiKey(key.Id); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("revoked twice: ", err)
+	}
+	keys, err := db.GetApiKeys()
+	if err != nil {
+		t.Fatal("get keys: ", err)
+	}
+	found := false
+	for _, k := range keys {
+		if k.Id == key.Id {
+			found = k.RevokedAt != nil && k.LastUsedAt != nil
+		}
+	}
+	if !found {
+		t.Error("revoked key not listed")
+	}
+}
+
+func testCustomers(t *testing.T, db sql.Repository) {
+	customers := []specs.AccountDetails{
+		{AddressType: qr.ADDRESS_TYPE_STRUCTURED, Name: "Muster Hans", Address1: "Bahnhofstrasse",
+			Address2: "12a", Zip: "8001", Location: "Zürich", Country: qr.COUNTRY_SWITZERLAND},
+		{AddressType: qr.ADDRESS_TYPE_COMBINED, Name: "Meier Anna Lena", Address1: "Dorfstrasse 2",
+			Address2: "80331 München", Country: "DE"},
+		// optional fields stay empty
+		{AddressType: qr.ADDRESS_TYPE_STRUCTURED, Name: "Keller AG", Zip: "3000", Location: "Bern",
+			Country: qr.COUNTRY_SWITZERLAND},
+	}
+	for _, customer := range customers {
+		id, err := db.InsertCustomer(customer)
+		if err != nil || id <= 0 {
+			t.Fatal("insert customer: ", id, err)
+		}
+		stored, err := db.GetCustomer(id)
+		if err != nil || stored != customer {
+			t.Errorf("customer:\n%+v\n%+v %v", stored, customer, err)
+		}
+	}
+	if _, err := db.GetCustomer(-1); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("unknown customer: ", err)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, db sql.Repository, issuerId int, suffix string) {
+	apiKey := &specs.ApiKey{Name: "idem-" + suffix, TokenHash: (PAYLOAD_HASH + suffix)[len(suffix):],
+		Scopes: []string{"bills:create"}, Enable: true}
+	err := db.InsertApiKey(apiKey)
+	if err != nil {
+		t.Fatal("insert key: ", err)
+	}
+	b := &specs.Bill{IssuerId: issuerId, Channel: "API", LanguageCode: "DE",
+		Customer: specs.AccountDetails{Name: "Idem " + suffix, Zip: "8000", Location: "Zürich",
+			Country: qr.COUNTRY_SWITZERLAND},
+		Details:     specs.BillingDetails{IBAN: IBAN, RefenreceType: "NON", Currency: "CHF", Amount: 10},
+		PayloadHash: PAYLOAD_HASH, PdfFile: "out/bills/idem-" + suffix + ".pdf", PdfHash: PAYLOAD_HASH}
+	err = db.InsertBill(b)
+	if err != nil {
+		t.Fatal("insert bill: ", err)
+	}
+
+	created := time.Now().Add(-time.Minute).Truncate(time.Second)
+	key := &specs.IdempotencyKey{ApiKeyId: apiKey.Id, Key: "req-" + suffix, RequestHash: PAYLOAD_HASH,
+		CreatedAt: created}
+	reserved, _, err := db.ReserveIdempotencyKey(key)
+	if err != nil || !reserved {
+		t.Fatal("reserve idempotency key: ", reserved, err)
+	}
+	// in progress until it is completed
+	reserved, stored, err := db.ReserveIdempotencyKey(&specs.IdempotencyKey{ApiKeyId: apiKey.Id, Key: key.Key,
+		RequestHash: "other", CreatedAt: time.Now()})
+	if err != nil || reserved || stored.ApiKeyId != apiKey.Id || stored.Key != key.Key ||
+		stored.RequestHash != PAYLOAD_HASH || stored.BillId != 0 || !sameTime(stored.CreatedAt, created) {
+		t.Errorf("reserve twice: %v %+v %v", reserved, stored, err)
+	}
+
+	err = db.CompleteIdempotencyKey(apiKey.Id, key.Key, b.Id)
+	if err != nil {
+		t.Fatal("complete idempotency key: ", err)
+	}
+	reserved, stored, err = db.ReserveIdempotencyKey(key)
+	if err != nil || reserved || stored.BillId != b.Id || stored.RequestHash != PAYLOAD_HASH {
+		t.Errorf("completed key: %v %+v %v", reserved, stored, err)
+	}
+
+	// keys are scoped to their api key
+	other := &specs.IdempotencyKey{ApiKeyId: apiKey.Id, Key: "other-" + suffix, RequestHash: PAYLOAD_HASH,
+		CreatedAt: time.Now()}
+	reserved, _, err = db.ReserveIdempotencyKey(other)
+	if err != nil || !reserved {
+		t.Error("reserve other key: ", reserved, err)
+	}
+	err = db.DeleteIdempotencyKey(apiKey.Id, other.Key)
+	if err != nil {
+		t.Error("delete idempotency key: ", err)
+	}
+	reserved, _, err = db.ReserveIdempotencyKey(other)
+	if err != nil || !reserved {
+		t.Error("reserve deleted key: ", reserved, err)
+	}
+
+	// only the keys older than the limit expire
+	err = db.DeleteIdempotencyKeysBefore(created.Add(time.Second))
+	if err != nil {
+		t.Error("expire idempotency keys: ", err)
+	}
+	reserved, _, err = db.ReserveIdempotencyKey(other)
+	if err != nil || reserved {
+		t.Error("recent key expired: ", reserved, err)
+	}
+	reserved, _, err = db.ReserveIdempotencyKey(key)
+	if err != nil || !reserved {
+		t.Error("expired key: ", reserved, err)
+	}
+}
+
+func testMailWhitelists(t *testing.T, db sql.Repository, suffix string) {
+	cnf := &specs.MailConfig{Username: "whitelist-" + suffix, Email: "whitelist@example.org"}
+	err := db.InsertMailConfig(cnf)
+	if err != nil {
+		t.Fatal("insert mail config: ", err)
+	}
+	whitelist, err := db.GetMailWhitelist(cnf.Id)
+	if err != nil || len(whitelist) != 0 {
+		t.Error("empty whitelist: ", whitelist, err)
+	}
+
+	entries := []string{"*@example.org", "hans.muster@example.ch"}
+	for i := 0; i < 2; i++ {
+		for _, email := range entries {
+			err = db.InsertMailWhitelist(cnf.Id, email)
+			if err != nil {
+				t.Error("insert whitelist: ", err)
+			}
+		}
+	}
+	whitelist, err = db.GetMailWhitelist(cnf.Id)
+	sort.Strings(whitelist)
+	if err != nil || !slices.Equal(whitelist, entries) {
+		t.Error("whitelist: ", whitelist, err)
+	}
+
+	err = db.DeleteMailWhitelist(cnf.Id, "*@example.org")
+	if err != nil {
+		t.Error("delete whitelist: ", err)
+	}
+	whitelist, err = db.GetMailWhitelist(cnf.Id)
+	if err != nil || len(whitelist) != 1 || whitelist[0] != "hans.muster@example.ch" {
+		t.Error("whitelist after delete: ", whitelist, err)
+	}
+}
+
+func testMailTemplates(t *testing.T, db sql.Repository, issuerId int) {
+	templates := []*specs.MailTemplate{
+		{IssuerId: issuerId, LanguageCode: "FR", Kind: "BILL", Subject: "Facture", TextBody: "Bonjour",
+			DueDays: 30},
+		{IssuerId: issuerId, LanguageCode: "FR", Kind: "ERROR", Subject: "Erreur", TextBody: "Désolé",
+			HtmlBody: "<p>Désolé</p>"},
+		{IssuerId: issuerId, LanguageCode: "IT", Kind: "BILL", Subject: "Fattura", TextBody: "Buongiorno",
+			DueDays: 20},
+	}
+	for _, template := range templates {
+		err := db.SetMailTemplate(template)
+		if err != nil {
+			t.Fatal("set template: ", err)
+		}
+	}
+	templates[0].Subject, templates[0].HtmlBody, templates[0].DueDays = "Votre facture", "<p>Bonjour</p>", 10
+	err := db.SetMailTemplate(templates[0])
+	if err != nil {
+		t.Fatal("replace template: ", err)
+	}
+	for _, template := range templates {
+		stored, err := db.GetMailTemplate(issuerId, template.LanguageCode, template.Kind)
+		if err != nil || *stored != *template {
+			t.Errorf("template:\n%+v\n%+v %v", stored, template, err)
+		}
+	}
+
+	err = db.DeleteMailTemplate(issuerId, "FR", "BILL")
+	if err != nil {
+		t.Error("delete template: ", err)
+	}
+	if _, err = db.GetMailTemplate(issuerId, "FR", "BILL"); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("deleted template: ", err)
+	}
+	if _, err = db.GetMailTemplate(issuerId, "FR", "ERROR"); err != nil {
+		t.Error("template of other kind deleted: ", err)
+	}
+	if _, err = db.GetMailTemplate(issuerId, "DE", "DELIVERY"); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("unknown template: ", err)
+	}
+}
+
+func testMailConfigs(t *testing.T, db sql.Repository, issuerId int, suffix string) {
+	cnf := &specs.MailConfig{
+		Enable:          true,
+		IssuerId:        issuerId,
+		Username:        "qr-" + suffix,
+		SenderName:      "Muster AG",
+		Email:           "qr@example.org",
+		Password:        "secret",
+		SmtpSecure:      true,
+		SmtpHost:        "smtp.example.org",
+		SmtpPort:        465,
+		Pop3Host:        "pop3.example.org",
+		Pop3Port:        995,
+		Token:           "make a bill",
+		UseWhitelist:    true,
+		LanguageCode:    "DE",
+		Protocol:        "IMAP",
+		ImapSecure:      true,
+		ImapHost:        "imap.example.org",
+		ImapPort:        993,
+		ImapFolder:      "INBOX",
+		ProcessedFolder: "Done",
+		FailedFolder:    "Failed",
+		AuthServId:      "mx.example.org",
+	}
+	err := db.InsertMailConfig(cnf)
+	if err != nil || cnf.Id <= 0 {
+		t.Fatal("insert mail config: ", err)
+	}
+
+	stored, err := db.GetMailConfig(cnf.Id)
+	if err != nil {
+		t.Fatal("get mail config: ", err)
+	}
+	if *stored != *cnf {
+		t.Errorf("mail config:\n%+v\n%+v", stored, cnf)
+	}
+	byIssuer, err := db.GetMailConfigByIssuer(issuerId)
+	if err != nil || byIssuer.IssuerId != issuerId {
+		t.Error("mail config of issuer: ", err)
+	}
+
+	// configurations without issuer and with the defaults
+	plain := &specs.MailConfig{Username: "plain-" + suffix, Email: "plain@example.org"}
+	err = db.InsertMailConfig(plain)
+	if err != nil {
+		t.Fatal("insert plain mail config: ", err)
+	}
+	stored, err = db.GetMailConfig(plain.Id)
+	if err != nil || stored.IssuerId != 0 || stored.Protocol != "POP3" || stored.ImapFolder != "INBOX" ||
+		stored.LanguageCode != "EN" {
+		t.Errorf("plain mail config: %+v %v", stored, err)
+	}
+
+	cnfs, err := db.GetMailConfigurations()
+	if err != nil {
+		t.Fatal("get mail configs: ", err)
+	}
+	enabled := map[int]bool{}
+	for _, c := range cnfs {
+		enabled[c.Id] = true
+		if c.Id == cnf.Id && *c != *cnf {
+			t.Errorf("enabled mail config:\n%+v\n%+v", c, cnf)
+		}
+	}
+	if !enabled[cnf.Id] || enabled[plain.Id] {
+		t.Error("enabled mail configs: ", enabled)
+	}
+
+	testBillDeliveries(t, db, issuerId, cnf.Id, suffix)
+}
+
+func testBillDeliveries(t *testing.T, db sql.Repository, issuerId int, mailId int, suffix string) {
+	b := &specs.Bill{IssuerId: issuerId, Channel: "MAIL", Customer: specs.AccountDetails{Name: "Meier Anna",
+		Address1: "Dorfstrasse 2", Zip: "8000", Location: "Zürich", Country: "CH"},
+		Details: specs.BillingDetails{IBAN: IBAN, RefenreceType: "NON", Currency: "EUR"}, PayloadHash: PAYLOAD_HASH}
+	err := db.InsertBill(b)
+	if err != nil {
+		t.Fatal("insert bill: ", err)
+	}
+
+	delivery := &specs.BillDelivery{BillId: b.Id, MailId: mailId, Recipient: "anna@example.org",
+		LanguageCode: "DE", MessageId: suffix + "@example.org", NextAttemptAt: time.Now().Add(-time.Second)}
+	err = db.InsertBillDelivery(delivery)
+	if err != nil || delivery.Id <= 0 || delivery.State != sql.BILL_DELIVERY_PENDING {
+		t.Fatal("insert delivery: ", err)
+	}
+
+	due, err := db.GetDueBillDeliveries(time.Now(), 1000)
+	if err != nil || !containsDelivery(due, delivery.Id) {
+		t.Error("due deliveries: ", len(due), err)
+	}
+
+	sent := time.Now()
+	delivery.State, delivery.Attempts, delivery.SentAt = sql.BILL_DELIVERY_SENT, 1, &sent
+	err = db.UpdateBillDelivery(delivery)
+	if err != nil {
+		t.Error("update delivery: ", err)
+	}
+	stored, err := db.GetBillDeliveryByMessageId(delivery.MessageId)
+	if err != nil || stored.Id != delivery.Id || stored.State != sql.BILL_DELIVERY_SENT || stored.SentAt == nil ||
+		stored.LanguageCode != "DE" || stored.Recipient != delivery.Recipient {
+		t.Errorf("delivery: %+v %v", stored, err)
+	}
+	due, err = db.GetDueBillDeliveries(time.Now(), 1000)
+	if err != nil || containsDelivery(due, delivery.Id) {
+		t.Error("sent delivery is due: ", err)
+	}
+	deliveries, err := db.GetBillDeliveries(b.Id)
+	if err != nil || len(deliveries) != 1 {
+		t.Error("deliveries of bill: ", len(deliveries), err)
+	}
+	if _, err = db.GetBillDelivery(-1); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("unknown delivery: ", err)
+	}
+}
+
+func testTranslations(t *testing.T, db sql.Repository, issuerId int) {
+	tr, err := db.GetTranslationTable("DE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.PaymentPart != "Zahlteil" || tr.Currency != "Währung" || tr.InFavour != "Zugunsten" {
+		t.Errorf("translation: %+v", tr)
+	}
+	for _, lang := range []string{"FR", "IT", "EN"} {
+		tr, err = db.GetTranslationTable(lang)
+		if err != nil || tr.PaymentPart == "" || tr.PayableByNameAddr == "" {
+			t.Errorf("translation %s: %+v %v", lang, tr, err)
+		}
+	}
+	if _, err = db.GetTranslationTable("XX"); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("unknown language: ", err)
+	}
+
+	override := &specs.Translation{IssuerId: issuerId, LanguageCode: "FR",
+		TranslationTable: specs.TranslationTable{PaymentPart: "Paiement"}}
+	err = db.SetIssuerTranslation(override)
+	if err != nil {
+		t.Fatal("set issuer translation: ", err)
+	}
+	override.PaymentPart, override.InFavour = "Section de paiement", "Au profit de"
+	err = db.SetIssuerTranslation(override)
+	if err != nil {
+		t.Fatal("replace issuer translation: ", err)
+	}
+	stored, err := db.GetIssuerTranslation(issuerId, "FR")
+	if err != nil || *stored != *override {
+		t.Errorf("issuer translation: %+v %v", stored, err)
+	}
+	all, err := db.GetIssuerTranslations(issuerId)
+	if err != nil || len(all) != 1 || *all[0] != *override {
+		t.Error("issuer translations: ", len(all), err)
+	}
+	if _, err = db.GetIssuerTranslation(issuerId, "IT"); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("unset issuer translation: ", err)
+	}
+	err = db.DeleteIssuerTranslation(issuerId, "FR")
+	if err != nil {
+		t.Error("delete issuer translation: ", err)
+	}
+	if err = db.DeleteIssuerTranslation(issuerId, "FR"); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("deleted issuer translation twice: ", err)
+	}
+}
+
+func testReferences(t *testing.T, db sql.Repository, issuerId int) {
+	// the issuer may be left from an earlier run against the same database
+	first, err := db.NextInvoiceNumber(issuerId)
+	if err != nil || first < 1 {
+		t.Fatal("first invoice number: ", first, err)
+	}
+	next, err := db.NextInvoiceNumber(issuerId)
+	if err != nil || next != first+1 {
+		t.Error("next invoice number: ", next, err)
+	}
+	if _, err = db.NextInvoiceNumber(-1); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("invoice number of unknown issuer: ", err)
+	}
+
+	// invoice numbers of requests are skipped by the sequence
+	reserved, err := db.ReserveInvoiceNumber(issuerId, next+5)
+	if err != nil || !reserved {
+		t.Error("reserve invoice number: ", reserved, err)
+	}
+	if reserved, err = db.ReserveInvoiceNumber(issuerId, next+3); err != nil || reserved {
+		t.Error("reserve issued invoice number: ", reserved, err)
+	}
+	next, err = db.NextInvoiceNumber(issuerId)
+	if err != nil || next != first+7 {
+		t.Error("invoice number after reservation: ", next, err)
+	}
+	if _, err = db.ReserveInvoiceNumber(-1, 1); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("reserve invoice number of unknown issuer: ", err)
+	}
+
+	f := &specs.ReferenceFormat{IssuerId: issuerId, BesrId: "210000", CustomerDigits: 6}
+	err = db.SetReferenceFormat(f)
+	if err != nil {
+		t.Fatal("set reference format: ", err)
+	}
+	f.BesrId = "123456"
+	err = db.SetReferenceFormat(f)
+	if err != nil {
+		t.Fatal("replace reference format: ", err)
+	}
+	f.LastNumber = next
+	stored, err := db.GetReferenceFormat(issuerId)
+	if err != nil || *stored != *f {
+		t.Errorf("reference format: %+v %v", stored, err)
+	}
+	if _, err = db.GetReferenceFormat(-1); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("reference format of unknown issuer: ", err)
+	}
+}
+
+func testJobs(t *testing.T, db sql.Repository, issuerId int, suffix string) {
+	job := &specs.Job{Format: "zip", Total: 2}
+	err := db.InsertJob(job, `[{"amount": 1}, {"amount": 2}]`)
+	if err != nil || job.Id <= 0 || job.State != sql.JOB_STATE_QUEUED {
+		t.Fatal("insert job: ", err)
+	}
+	request, err := db.GetJobRequest(job.Id)
+	if err != nil || request != `[{"amount": 1}, {"amount": 2}]` {
+		t.Error("job request: ", request, err)
+	}
+
+	// queued jobs of former runs are claimed first
+	claimed := false
+	for !claimed {
+		next, err := db.ClaimNextJob()
+		if err != nil {
+			t.Fatal("claim job: ", err)
+		}
+		claimed = next.Id == job.Id && next.State == sql.JOB_STATE_RUNNING
+	}
+	if _, err = db.ClaimNextJob(); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("claimed job twice: ", err)
+	}
+
+	err = db.InsertJobRow(job.Id, specs.BatchRow{Row: 1, Reference: "RF18539007547034"})
+	if err == nil {
+		err = db.InsertJobRow(job.Id, specs.BatchRow{Row: 2, Error: "invalid iban"})
+	}
+	if err != nil {
+		t.Fatal("insert job rows: ", err)
+	}
+
+	// the bill of a row is stored together with the row
+	b := &specs.Bill{IssuerId: issuerId, Channel: "API", Customer: specs.AccountDetails{Name: "Meier Anna",
+		Address1: "Dorfstrasse 2", Zip: "8000", Location: "Zürich", Country: "CH"},
+		Details: specs.BillingDetails{IBAN: IBAN, RefenreceType: "SCOR", Referece: "RF00" + strings.ToUpper(suffix),
+			Currency: "CHF"}, PayloadHash: PAYLOAD_HASH}
+	err = db.InsertJobBill(job.Id, 3, b)
+	if err != nil || b.Id <= 0 || b.CustomerId <= 0 {
+		t.Fatal("insert job bill: ", err)
+	}
+	duplicate := *b
+	if err = db.InsertJobBill(job.Id, 4, &duplicate); !errors.Is(err, sql.ErrDuplicateReference) {
+		t.Error("insert job bill with duplicate reference: ", err)
+	}
+
+	rows, err := db.GetJobRows(job.Id)
+	if err != nil || len(rows) != 3 || rows[0].Reference != "RF18539007547034" || rows[1].Error != "invalid iban" ||
+		rows[2].BillId != b.Id || rows[2].Reference != b.Details.Referece {
+		t.Errorf("job rows: %+v %v", rows, err)
+	}
+
+	n, err := db.RequeueRunningJobs()
+	if err != nil || n < 1 {
+		t.Error("requeue running jobs: ", n, err)
+	}
+	err = db.FinishJob(job.Id, sql.JOB_STATE_DONE, "")
+	if err != nil {
+		t.Error("finish job: ", err)
+	}
+	stored, err := db.GetJob(job.Id)
+	if err != nil || stored.State != sql.JOB_STATE_DONE || stored.Done != 3 || stored.Failed != 1 ||
+		stored.FinishedAt == nil || stored.Error != "" {
+		t.Errorf("job: %+v %v", stored, err)
+	}
+	err = db.RequeueJob(job.Id)
+	if err != nil {
+		t.Error("requeue job: ", err)
+	}
+	for i := 0; i < 2 && err == nil; i++ {
+		err = db.RetryJob(job.Id, "cannot store row")
+	}
+	stored, err = db.GetJob(job.Id)
+	if err != nil || stored.State != sql.JOB_STATE_QUEUED || stored.Attempts != 2 || stored.Error != "cannot store row" {
+		t.Errorf("retried job: %+v %v", stored, err)
+	}
+	err = db.FinishJob(job.Id, sql.JOB_STATE_FAILED, "stopped")
+	if err != nil {
+		t.Error("fail job: ", err)
+	}
+	if _, err = db.GetJob(-1); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("unknown job: ", err)
+	}
+}
+
+func testWebhooks(t *testing.T, db sql.Repository, issuerId int) {
+	hook := &specs.Webhook{IssuerId: issuerId, Url: "https://example.org/hook", Secret: "secret",
+		Events: []string{"bill.generated", "bill.paid"}, Enable: true}
+	err := db.InsertWebhook(hook)
+	if err != nil || hook.Id <= 0 {
+		t.Fatal("insert webhook: ", err)
+	}
+	stored, err := db.GetWebhook(hook.Id)
+	if err != nil || stored.Url != hook.Url || stored.Secret != hook.Secret || stored.IssuerId != issuerId ||
+		strings.Join(stored.Events, ",") != "bill.generated,bill.paid" || !stored.Enable || stored.CreatedAt.IsZero() {
+		t.Errorf("webhook: %+v %v", stored, err)
+	}
+	hooks, err := db.GetWebhooks(issuerId)
+	if err != nil || len(hooks) != 1 {
+		t.Error("webhooks of issuer: ", len(hooks), err)
+	}
+	hooks, err = db.GetWebhooks(0)
+	if err != nil || len(hooks) < 1 {
+		t.Error("all webhooks: ", len(hooks), err)
+	}
+
+	delivery := &specs.WebhookDelivery{WebhookId: hook.Id, Event: "bill.paid", Payload: `{"event":"bill.paid"}`,
+		NextAttemptAt: time.Now().Add(-time.Second)}
+	err = db.InsertWebhookDelivery(delivery)
+	if err != nil || delivery.Id <= 0 {
+		t.Fatal("insert webhook delivery: ", err)
+	}
+	due, err := db.GetDueWebhookDeliveries(time.Now(), 1000)
+	if err != nil || !containsWebhookDelivery(due, delivery.Id) {
+		t.Error("due webhook deliveries: ", len(due), err)
+	}
+
+	delivered := time.Now()
+	delivery.State, delivery.Attempts, delivery.LastStatus, delivery.DeliveredAt =
+		sql.DELIVERY_STATE_DELIVERED, 1, 204, &delivered
+	err = db.UpdateWebhookDelivery(delivery)
+	if err != nil {
+		t.Error("update webhook delivery: ", err)
+	}
+	due, err = db.GetDueWebhookDeliveries(time.Now(), 1000)
+	if err != nil || containsWebhookDelivery(due, delivery.Id) {
+		t.Error("delivered webhook is due: ", err)
+	}
+
+	err = db.ReplayWebhookDelivery(delivery.Id)
+	if err != nil {
+		t.Error("replay: ", err)
+	}
+	storedDelivery, err := db.GetWebhookDelivery(delivery.Id)
+	if err != nil || storedDelivery.State != sql.DELIVERY_STATE_PENDING || storedDelivery.Attempts != 0 ||
+		storedDelivery.LastStatus != 204 || storedDelivery.DeliveredAt == nil {
+		t.Errorf("replayed delivery: %+v %v", storedDelivery, err)
+	}
+	deliveries, err := db.GetWebhookDeliveries(hook.Id, 10, 0)
+	if err != nil || len(deliveries) != 1 {
+		t.Error("delivery log: ", len(deliveries), err)
+	}
+
+	err = db.DeleteWebhook(hook.Id)
+	if err != nil {
+		t.Error("delete webhook: ", err)
+	}
+	if err = db.DeleteWebhook(hook.Id); !errors.Is(err, dbSql.ErrNoRows) {
+		t.Error("deleted twice: ", err)
+	}
+}
+
+func testRateCounters(t *testing.T, db sql.Repository, suffix string) {
+	window := time.Now().Truncate(time.Minute)
+	count, err := db.IncrementCounter("key", suffix, window, 1)
+	if err != nil || count != 1 {
+		t.Fatal("increment: ", count, err)
+	}
+	count, err = db.IncrementCounter("key", suffix, window, 2)
+	if err != nil || count != 3 {
+		t.Error("increment existing: ", count, err)
+	}
+
+	err = db.DeleteCountersBefore(window.Add(time.Minute))
+	if err != nil {
+		t.Error("delete counters: ", err)
+	}
+	count, err = db.IncrementCounter("key", suffix, window, 1)
+	if err != nil || count != 1 {
+		t.Error("increment deleted: ", count, err)
+	}
+}
+
+// sameTime compares times with the precision of a TIMESTAMP column.
+func sameTime(a time.Time, b time.Time) bool {
+	return a.Sub(b).Abs() < time.Second
+}
+
+func containsDelivery(deliveries []*specs.BillDelivery, id int) bool {
+	for _, d := range deliveries {
+		if d.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsWebhookDelivery(deliveries []*specs.WebhookDelivery, id int) bool {
+	for _, d := range deliveries {
+		if d.Id == id {
+			return true
+		}
+	}
+	return false
+}
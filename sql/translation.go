@@ -0,0 +1,112 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+const translationColumns = "payment_part, account, reference, additional_infos, further_infos, currency, amount, " +
+	"receipt, acceptance_point, sep_before_pay, payable_by, payable_by_name_addr, in_favour"
+
+// GetTranslationTable returns the texts of the bill in a language.
+// sql.ErrNoRows is returned for unknown languages.
+func (db *Db) GetTranslationTable(languageCode string) (specs.TranslationTable, error) {
+	tr := specs.TranslationTable{}
+
+	err := db.dbCon.QueryRow("SELECT "+translationColumns+" FROM translation WHERE language_code = ?",
+		languageCode).Scan(translationDest(&tr)...)
+	return tr, err
+}
+
+// GetIssuerTranslation returns the texts of an issuer in a language.
+// sql.ErrNoRows is returned, if the issuer has none.
+func (db *Db) GetIssuerTranslation(issuerId int, languageCode string) (*specs.Translation, error) {
+	tr := specs.Translation{IssuerId: issuerId, LanguageCode: languageCode}
+
+	err := db.dbCon.QueryRow("SELECT "+translationColumns+" FROM issuer_translation "+
+		"WHERE issuer_id = ? AND language_code = ?", issuerId, languageCode).Scan(translationDest(&tr.TranslationTable)...)
+	if err != nil {
+		return nil, err
+	}
+	return &tr, nil
+}
+
+// GetIssuerTranslations returns the texts of an issuer in all languages it
+// has set.
+func (db *Db) GetIssuerTranslations(issuerId int) ([]*specs.Translation, error) {
+	rows, err := db.dbCon.Query("SELECT language_code, "+translationColumns+" FROM issuer_translation "+
+		"WHERE issuer_id = ? ORDER BY language_code", issuerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := []*specs.Translation{}
+	for rows.Next() {
+		tr := specs.Translation{IssuerId: issuerId}
+		err = rows.Scan(append([]interface{}{&tr.LanguageCode}, translationDest(&tr.TranslationTable)...)...)
+		if err != nil {
+			return nil, err
+		}
+		translations = append(translations, &tr)
+	}
+	return translations, rows.Err()
+}
+
+// SetIssuerTranslation creates or replaces the texts of an issuer in a
+// language.
+func (db *Db) SetIssuerTranslation(tr *specs.Translation) error {
+	updates := []string{}
+	for _, col := range strings.Split(translationColumns, ", ") {
+		updates = append(updates, col+" = "+db.dialect.excluded(col))
+	}
+	t := &tr.TranslationTable
+	_, err := db.dbCon.Exec("INSERT INTO issuer_translation (issuer_id, language_code, "+translationColumns+") "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"+
+		db.dialect.onConflict("issuer_id, language_code")+strings.Join(updates, ", "),
+		tr.IssuerId, tr.LanguageCode, t.PaymentPart, t.Account, t.Reference, t.AdditionalInfos, t.FurtherInfos,
+		t.Currency, t.Amount, t.Receipt, t.AcceptancePoint, t.SepBeforePay, t.PayableBy, t.PayableByNameAddr,
+		t.InFavour)
+	return err
+}
+
+// DeleteIssuerTranslation removes the texts of an issuer in a language.
+// sql.ErrNoRows is returned, if the issuer has none.
+func (db *Db) DeleteIssuerTranslation(issuerId int, languageCode string) error {
+	res, err := db.dbCon.Exec("DELETE FROM issuer_translation WHERE issuer_id = ? AND language_code = ?",
+		issuerId, languageCode)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = sql.ErrNoRows
+	}
+	return err
+}
+
+// translationDest returns the scan destinations of translationColumns.
+func translationDest(tr *specs.TranslationTable) []interface{} {
+	return []interface{}{&tr.PaymentPart, &tr.Account, &tr.Reference, &tr.AdditionalInfos, &tr.FurtherInfos,
+		&tr.Currency, &tr.Amount, &tr.Receipt, &tr.AcceptancePoint, &tr.SepBeforePay, &tr.PayableBy,
+		&tr.PayableByNameAddr, &tr.InFavour}
+}
@@ -0,0 +1,198 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+const (
+	DELIVERY_STATE_PENDING   = "PENDING"
+	DELIVERY_STATE_DELIVERED = "DELIVERED"
+	DELIVERY_STATE_FAILED    = "FAILED"
+
+	webhookColumns  = "id, issuer_id, url, secret, events, enable, created_ts"
+	deliveryColumns = "id, webhook_id, event, payload, state, attempts, next_attempt_ts, last_status, " +
+		"last_error, created_ts, delivered_ts"
+)
+
+func (db *Db) InsertWebhook(hook *specs.Webhook) error {
+	secret, err := db.keyring.Encrypt(hook.Secret, SECRET_WEBHOOK_SECRET)
+	if err != nil {
+		return err
+	}
+	id, err := db.dbCon.insert("INSERT INTO webhook (issuer_id, url, secret, events, enable) VALUES (?, ?, ?, ?, ?)",
+		hook.IssuerId, hook.Url, secret, strings.Join(hook.Events, ","), hook.Enable)
+	hook.Id = id
+	return err
+}
+
+// GetWebhook returns a subscription. sql.ErrNoRows is returned for unknown
+// ids.
+func (db *Db) GetWebhook(id int) (*specs.Webhook, error) {
+	return db.scanWebhook(db.dbCon.QueryRow("SELECT "+webhookColumns+" FROM webhook WHERE id = ?", id))
+}
+
+// GetWebhooks returns the subscriptions of an issuer, all if issuerId is 0.
+func (db *Db) GetWebhooks(issuerId int) ([]*specs.Webhook, error) {
+	rows, err := db.dbCon.Query("SELECT "+webhookColumns+" FROM webhook WHERE ? = 0 OR issuer_id = ? ORDER BY id",
+		issuerId, issuerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []*specs.Webhook{}
+	for rows.Next() {
+		hook, err := db.scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// DeleteWebhook disables a subscription, its delivery log is kept.
+// sql.ErrNoRows is returned for unknown ids.
+func (db *Db) DeleteWebhook(id int) error {
+	res, err := db.dbCon.Exec("UPDATE webhook SET enable = false WHERE id = ? AND enable = true", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = sql.ErrNoRows
+	}
+	return err
+}
+
+func (db *Db) InsertWebhookDelivery(delivery *specs.WebhookDelivery) error {
+	id, err := db.dbCon.insert("INSERT INTO webhook_delivery (webhook_id, event, payload, state, next_attempt_ts) "+
+		"VALUES (?, ?, ?, ?, ?)", delivery.WebhookId, delivery.Event, delivery.Payload, DELIVERY_STATE_PENDING,
+		delivery.NextAttemptAt)
+	delivery.Id = id
+	delivery.State = DELIVERY_STATE_PENDING
+	return err
+}
+
+// GetDueWebhookDeliveries returns up to limit pending deliveries, whose
+// next attempt is due.
+func (db *Db) GetDueWebhookDeliveries(now time.Time, limit int) ([]*specs.WebhookDelivery, error) {
+	return db.queryDeliveries("SELECT "+deliveryColumns+" FROM webhook_delivery WHERE state = ? AND "+
+		"next_attempt_ts <= ? ORDER BY next_attempt_ts LIMIT ?", DELIVERY_STATE_PENDING, now, limit)
+}
+
+// GetWebhookDeliveries returns the delivery log of a subscription, newest
+// first.
+func (db *Db) GetWebhookDeliveries(webhookId int, limit int, offset int) ([]*specs.WebhookDelivery, error) {
+	return db.queryDeliveries("SELECT "+deliveryColumns+" FROM webhook_delivery WHERE webhook_id = ? "+
+		"ORDER BY id DESC LIMIT ? OFFSET ?", webhookId, limit, offset)
+}
+
+// GetWebhookDelivery returns a delivery. sql.ErrNoRows is returned for
+// unknown ids.
+func (db *Db) GetWebhookDelivery(id int) (*specs.WebhookDelivery, error) {
+	return scanDelivery(db.dbCon.QueryRow("SELECT "+deliveryColumns+" FROM webhook_delivery WHERE id = ?", id))
+}
+
+// UpdateWebhookDelivery stores the outcome of an attempt.
+func (db *Db) UpdateWebhookDelivery(delivery *specs.WebhookDelivery) error {
+	_, err := db.dbCon.Exec("UPDATE webhook_delivery SET state = ?, attempts = ?, next_attempt_ts = ?, "+
+		"last_status = ?, last_error = ?, delivered_ts = ? WHERE id = ?", delivery.State, delivery.Attempts,
+		delivery.NextAttemptAt, nullInt(delivery.LastStatus),
+		sql.NullString{String: delivery.LastError, Valid: delivery.LastError != ""},
+		nullTime(delivery.DeliveredAt), delivery.Id)
+	return err
+}
+
+// ReplayWebhookDelivery queues a delivery again for an immediate attempt.
+// sql.ErrNoRows is returned for unknown ids.
+func (db *Db) ReplayWebhookDelivery(id int) error {
+	res, err := db.dbCon.Exec("UPDATE webhook_delivery SET state = ?, attempts = 0, next_attempt_ts = ? "+
+		"WHERE id = ?", DELIVERY_STATE_PENDING, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = sql.ErrNoRows
+	}
+	return err
+}
+
+func (db *Db) queryDeliveries(query string, args ...interface{}) ([]*specs.WebhookDelivery, error) {
+	rows, err := db.dbCon.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*specs.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// scanWebhook scans a row of webhookColumns and decrypts the secret.
+func (db *Db) scanWebhook(row scanner) (*specs.Webhook, error) {
+	var (
+		hook   specs.Webhook
+		events string
+	)
+
+	err := row.Scan(&hook.Id, &hook.IssuerId, &hook.Url, &hook.Secret, &events, &hook.Enable, &hook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	hook.Events = splitList(events)
+	hook.Secret, err = db.keyring.Decrypt(hook.Secret, SECRET_WEBHOOK_SECRET)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %d: %w", hook.Id, err)
+	}
+	return &hook, nil
+}
+
+func scanDelivery(row scanner) (*specs.WebhookDelivery, error) {
+	var (
+		delivery   specs.WebhookDelivery
+		lastStatus sql.NullInt64
+		lastError  sql.NullString
+		delivered  sql.NullTime
+	)
+
+	err := row.Scan(&delivery.Id, &delivery.WebhookId, &delivery.Event, &delivery.Payload, &delivery.State,
+		&delivery.Attempts, &delivery.NextAttemptAt, &lastStatus, &lastError, &delivery.CreatedAt, &delivered)
+	if err != nil {
+		return nil, err
+	}
+	delivery.LastStatus = int(lastStatus.Int64)
+	delivery.LastError = lastError.String
+	delivery.DeliveredAt = timePtr(delivered)
+	return &delivery, nil
+}
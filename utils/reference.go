@@ -71,7 +71,17 @@ func ValidateReference(referenceType string, reference string) error {
 
 	case qr.REFERENCE_TYPE_CREDITOR:
 		// ISO-11649, mod 97-10
-		return errors.New("ref credo not implemented")
+		reference = strings.ToUpper(reference)
+		if len(reference) < 5 || len(reference) > 25 || !strings.HasPrefix(reference, "RF") {
+			return errors.New("creditor ref should start with RF and be 5 to 25 characters long")
+		}
+		mod, err := mod97(reference[4:] + reference[:4])
+		if err != nil {
+			return err
+		}
+		if mod != 1 {
+			return errors.New("checksum of creditor ref isn't valid")
+		}
 
 	default:
 		return errors.New("unknown ref type")
@@ -84,7 +94,6 @@ func GetQrReferenceCheckNum(qrReference string) (string, error) {
 	z := 0
 
 	if len(qrReference) != 26 {
-		fmt.Println(len(qrReference))
 		return "", errors.New("QR ref should be a 26 dig long string (without checknum)")
 	}
 	for i := 0; i < 26; i++ {
@@ -99,3 +108,64 @@ func GetQrReferenceCheckNum(qrReference string) (string, error) {
 
 	return strconv.Itoa(int(chkNum)), nil
 }
+
+// CreateQrReference builds a QRR reference of the BESR-ID, the customer
+// number zero padded to customerDigits and the invoice number, zero padded
+// to the remaining of the 26 digits, followed by the check digit. The
+// BESR-ID and the customer number may be empty.
+func CreateQrReference(besrId string, customerNumber string, customerDigits int, invoiceNumber string) (string, error) {
+	for _, part := range []string{besrId, customerNumber, invoiceNumber} {
+		if strings.Trim(part, "0123456789") != "" {
+			return "", fmt.Errorf("QR ref part %s contains characters", part)
+		}
+	}
+	if len(customerNumber) > customerDigits {
+		return "", fmt.Errorf("customer number %s exceeds %d digits", customerNumber, customerDigits)
+	}
+	invoiceDigits := 26 - len(besrId) - customerDigits
+	if len(invoiceNumber) > invoiceDigits {
+		return "", fmt.Errorf("invoice number %s exceeds %d digits", invoiceNumber, invoiceDigits)
+	}
+
+	reference := besrId + zeroPad(customerNumber, customerDigits) + zeroPad(invoiceNumber, invoiceDigits)
+	chkNum, err := GetQrReferenceCheckNum(reference)
+	if err != nil {
+		return "", err
+	}
+	return reference + chkNum, nil
+}
+
+// CreateCreditorReference builds a SCOR reference (ISO-11649) of an invoice
+// number of up to 21 letters and digits.
+func CreateCreditorReference(invoiceNumber string) (string, error) {
+	invoiceNumber = strings.ToUpper(strings.ReplaceAll(invoiceNumber, " ", ""))
+	if invoiceNumber == "" || len(invoiceNumber) > 21 {
+		return "", errors.New("invoice number of a creditor ref should be 1 to 21 characters long")
+	}
+	mod, err := mod97(invoiceNumber + "RF00")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("RF%02d%s", 98-mod, invoiceNumber), nil
+}
+
+// mod97 calculates the remainder of the ISO-7064 mod 97-10 checksum, the
+// letters are replaced by 10 (A) to 35 (Z).
+func mod97(reference string) (int, error) {
+	mod := 0
+	for _, c := range reference {
+		switch {
+		case c >= '0' && c <= '9':
+			mod = (mod*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z':
+			mod = (mod*100 + int(c-'A') + 10) % 97
+		default:
+			return 0, errors.New("creditor ref contains invalid characters")
+		}
+	}
+	return mod, nil
+}
+
+func zeroPad(number string, digits int) string {
+	return strings.Repeat("0", digits-len(number)) + number
+}
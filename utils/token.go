@@ -18,10 +18,11 @@
 package utils
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
-	"math/rand"
-	"time"
+	"math/big"
 )
 
 const CharSet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
@@ -35,12 +36,15 @@ type Token struct {
 }
 
 func CreateNewToken(length int) Token {
-	rand.Seed(time.Now().UnixNano())
-
 	t := make([]byte, length)
+	max := big.NewInt(int64(len(CharSet)))
 
 	for i := range t {
-		t[i] = CharSet[rand.Intn(len(CharSet))]
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic("crypto random not available: " + err.Error())
+		}
+		t[i] = CharSet[n.Int64()]
 	}
 
 	token := Token{
@@ -56,3 +60,9 @@ func GetSha256(plain []byte) string {
 	hasher.Write(plain)
 	return hex.EncodeToString(hasher.Sum(nil))
 }
+
+// ValidateToken compares the hash of a plain token with a stored sha256
+// hash in constant time.
+func ValidateToken(plain string, sha256Hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(GetSha256([]byte(plain))), []byte(sha256Hash)) == 1
+}
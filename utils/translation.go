@@ -17,10 +17,22 @@
 
 package utils
 
-import "github.com/ChrIgiSta/swiss-qr-bill/specs"
+import (
+	"strings"
 
-func GetEnglishTranslationTable() *specs.TranslationTable {
-	return &specs.TranslationTable{
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+)
+
+// LANGUAGE_DEFAULT is used for bills without a supported language.
+const LANGUAGE_DEFAULT = "EN"
+
+// LANGUAGES are the languages of the bill, the official languages of the
+// swiss qr bill.
+var LANGUAGES = []string{"DE", "FR", "IT", "EN"}
+
+// TRANSLATIONS are the built-in texts of the bill per language.
+var TRANSLATIONS = map[string]specs.TranslationTable{
+	"EN": {
 		PaymentPart:       "Payment part",
 		Account:           "Account / Payable to",
 		Reference:         "Reference",
@@ -34,5 +46,102 @@ func GetEnglishTranslationTable() *specs.TranslationTable {
 		PayableBy:         "Payable by",
 		PayableByNameAddr: "Payable by (name/address)",
 		InFavour:          "In favour of",
+	},
+	"DE": {
+		PaymentPart:       "Zahlteil",
+		Account:           "Konto / Zahlbar an",
+		Reference:         "Referenz",
+		AdditionalInfos:   "Zusätzliche Informationen",
+		FurtherInfos:      "Weitere Informationen",
+		Currency:          "Währung",
+		Amount:            "Betrag",
+		Receipt:           "Empfangsschein",
+		AcceptancePoint:   "Annahmestelle",
+		SepBeforePay:      "Vor der Einzahlung abzutrennen",
+		PayableBy:         "Zahlbar durch",
+		PayableByNameAddr: "Zahlbar durch (Name/Adresse)",
+		InFavour:          "Zugunsten",
+	},
+	"FR": {
+		PaymentPart:       "Section paiement",
+		Account:           "Compte / Payable à",
+		Reference:         "Référence",
+		AdditionalInfos:   "Informations additionnelles",
+		FurtherInfos:      "Informations supplémentaires",
+		Currency:          "Monnaie",
+		Amount:            "Montant",
+		Receipt:           "Récépissé",
+		AcceptancePoint:   "Point de dépôt",
+		SepBeforePay:      "A détacher avant le versement",
+		PayableBy:         "Payable par",
+		PayableByNameAddr: "Payable par (nom/adresse)",
+		InFavour:          "En faveur de",
+	},
+	"IT": {
+		PaymentPart:       "Sezione pagamento",
+		Account:           "Conto / Pagabile a",
+		Reference:         "Riferimento",
+		AdditionalInfos:   "Informazioni aggiuntive",
+		FurtherInfos:      "Informazioni supplementari",
+		Currency:          "Valuta",
+		Amount:            "Importo",
+		Receipt:           "Ricevuta",
+		AcceptancePoint:   "Punto di accettazione",
+		SepBeforePay:      "Da staccare prima del versamento",
+		PayableBy:         "Pagabile da",
+		PayableByNameAddr: "Pagabile da (nome/indirizzo)",
+		InFavour:          "A favore di",
+	},
+}
+
+func GetEnglishTranslationTable() *specs.TranslationTable {
+	return GetTranslationTable(LANGUAGE_DEFAULT)
+}
+
+// GetTranslationTable returns the built-in texts of a language, english
+// for unsupported languages.
+func GetTranslationTable(languageCode string) *specs.TranslationTable {
+	tr, ok := TRANSLATIONS[ParseLanguage(languageCode)]
+	if !ok {
+		tr = TRANSLATIONS[LANGUAGE_DEFAULT]
+	}
+	return &tr
+}
+
+// ParseLanguage returns the supported language of a language code or tag,
+// e.g. DE for de-CH. It returns an empty string for unsupported languages.
+func ParseLanguage(language string) string {
+	language = strings.ToUpper(strings.TrimSpace(language))
+	if len(language) > 2 && (language[2] == '-' || language[2] == '_') {
+		language = language[:2]
+	}
+	if _, ok := TRANSLATIONS[language]; !ok {
+		return ""
+	}
+	return language
+}
+
+// MergeTranslationTable replaces the texts of tr by the texts set in
+// override. Empty texts of the override are kept.
+func MergeTranslationTable(tr *specs.TranslationTable, override *specs.TranslationTable) {
+	fields := []struct{ dst, src *string }{
+		{&tr.PaymentPart, &override.PaymentPart},
+		{&tr.Account, &override.Account},
+		{&tr.Reference, &override.Reference},
+		{&tr.AdditionalInfos, &override.AdditionalInfos},
+		{&tr.FurtherInfos, &override.FurtherInfos},
+		{&tr.Currency, &override.Currency},
+		{&tr.Amount, &override.Amount},
+		{&tr.Receipt, &override.Receipt},
+		{&tr.AcceptancePoint, &override.AcceptancePoint},
+		{&tr.SepBeforePay, &override.SepBeforePay},
+		{&tr.PayableBy, &override.PayableBy},
+		{&tr.PayableByNameAddr, &override.PayableByNameAddr},
+		{&tr.InFavour, &override.InFavour},
+	}
+	for _, f := range fields {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
 	}
 }
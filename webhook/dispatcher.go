@@ -0,0 +1,254 @@
+/**
+ * Copyright © 2022, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	dbSql "database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ChrIgiSta/swiss-qr-bill/logging"
+	"github.com/ChrIgiSta/swiss-qr-bill/specs"
+	"github.com/ChrIgiSta/swiss-qr-bill/sql"
+)
+
+const (
+	EVENT_BILL_GENERATED = "bill.generated"
+	EVENT_BILL_PAID      = "bill.paid"
+
+	HEADER_EVENT     = "X-Webhook-Event"
+	HEADER_DELIVERY  = "X-Webhook-Delivery"
+	HEADER_TIMESTAMP = "X-Webhook-Timestamp"
+	HEADER_SIGNATURE = "X-Webhook-Signature"
+
+	MAX_ATTEMPTS    = 12
+	BACKOFF_BASE    = 30 * time.Second
+	BACKOFF_MAX     = 6 * time.Hour
+	POLL_INTERVAL   = 5 * time.Second
+	REQUEST_TIMEOUT = 10 * time.Second
+	BATCH_SIZE      = 50
+)
+
+var EVENTS = []string{EVENT_BILL_GENERATED, EVENT_BILL_PAID}
+
+type Payload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Bill      *specs.Bill `json:"bill"`
+}
+
+type Dispatcher struct {
+	db     sql.Repository
+	client *http.Client
+	log    *slog.Logger
+}
+
+func NewDispatcher(db sql.Repository) *Dispatcher {
+	return &Dispatcher{
+		db:     db,
+		client: &http.Client{Timeout: REQUEST_TIMEOUT},
+		log:    slog.Default(),
+	}
+}
+
+// SetLogger replaces the default logger.
+func (d *Dispatcher) SetLogger(logger *slog.Logger) {
+	d.log = logger
+}
+
+// Emit queues a delivery of the event for each subscription of the bills
+// issuer. The deliveries are sent by a running Dispatcher.
+func Emit(db sql.Repository, event string, b *specs.Bill) error {
+	if b.IssuerId <= 0 {
+		return nil
+	}
+	hooks, err := db.GetWebhooks(b.IssuerId)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(Payload{Event: event, CreatedAt: now, Bill: b})
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		if !hook.Enable || !subscribed(hook, event) {
+			continue
+		}
+		err = db.InsertWebhookDelivery(&specs.WebhookDelivery{
+			WebhookId:     hook.Id,
+			Event:         event,
+			Payload:       string(payload),
+			NextAttemptAt: now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<payload>".
+func Sign(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Run sends due deliveries until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	d.log.Info("webhook dispatcher started")
+	for ctx.Err() == nil {
+		deliveries, err := d.db.GetDueWebhookDeliveries(time.Now(), BATCH_SIZE)
+		if err != nil {
+			d.log.ErrorContext(ctx, "cannot get due webhook deliveries", logging.Err(err))
+		}
+		for _, delivery := range deliveries {
+			if ctx.Err() != nil {
+				break
+			}
+			d.deliver(ctx, delivery)
+		}
+
+		if len(deliveries) < BATCH_SIZE {
+			select {
+			case <-ctx.Done():
+			case <-time.After(POLL_INTERVAL):
+			}
+		}
+	}
+	d.log.Info("webhook dispatcher stopped")
+}
+
+// deliver sends a delivery and records the outcome. Deliveries, whose
+// webhook can't be read, e.g. as its secret doesn't decrypt anymore, are
+// retried like failed ones, those of a missing webhook fail at once.
+func (d *Dispatcher) deliver(ctx context.Context, delivery *specs.WebhookDelivery) {
+	var (
+		status int
+		final  bool
+	)
+
+	delivery.Attempts++
+	hook, err := d.db.GetWebhook(delivery.WebhookId)
+	if err != nil {
+		d.log.ErrorContext(ctx, "cannot get webhook of delivery", "delivery_id", delivery.Id, logging.Err(err))
+		final = errors.Is(err, dbSql.ErrNoRows)
+	} else {
+		status, err = d.send(ctx, hook, delivery)
+		final = !hook.Enable
+	}
+	delivery.LastStatus = status
+	delivery.LastError = ""
+
+	if err == nil {
+		now := time.Now()
+		delivery.State = sql.DELIVERY_STATE_DELIVERED
+		delivery.DeliveredAt = &now
+	} else {
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= MAX_ATTEMPTS || final {
+			d.log.WarnContext(ctx, "webhook delivery failed finally", "delivery_id", delivery.Id, logging.Err(err))
+			delivery.State = sql.DELIVERY_STATE_FAILED
+		} else {
+			delivery.NextAttemptAt = time.Now().Add(Backoff(delivery.Attempts))
+		}
+	}
+
+	err = d.db.UpdateWebhookDelivery(delivery)
+	if err != nil {
+		d.log.ErrorContext(ctx, "cannot update webhook delivery", "delivery_id", delivery.Id, logging.Err(err))
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, hook *specs.Webhook, delivery *specs.WebhookDelivery) (int, error) {
+	if !hook.Enable {
+		return 0, fmt.Errorf("webhook disabled")
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Url, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HEADER_EVENT, delivery.Event)
+	req.Header.Set(HEADER_DELIVERY, strconv.Itoa(delivery.Id))
+	req.Header.Set(HEADER_TIMESTAMP, timestamp)
+	req.Header.Set(HEADER_SIGNATURE, "sha256="+Sign(hook.Secret, timestamp, []byte(delivery.Payload)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Backoff returns the delay after the given number of failed attempts,
+// doubling from BACKOFF_BASE up to BACKOFF_MAX.
+func Backoff(attempts int) time.Duration {
+	delay := BACKOFF_BASE
+	for i := 1; i < attempts && delay < BACKOFF_MAX; i++ {
+		delay *= 2
+	}
+	if delay > BACKOFF_MAX {
+		delay = BACKOFF_MAX
+	}
+	return delay
+}
+
+func ValidEvent(event string) bool {
+	for _, e := range EVENTS {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func subscribed(hook *specs.Webhook, event string) bool {
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}